@@ -1,55 +1,29 @@
 package main
 
 import (
-	"crypto/sha256"
-	"fmt"
+	"context"
 	"log"
-	"net/http"
 	"os"
 	"os/signal"
 	"strconv"
 	"strings"
 	"syscall"
+	"time"
 
-	"http-scratch/internal/headers"
+	"http-scratch/internal/http2"
+	"http-scratch/internal/problem"
+	"http-scratch/internal/proxy"
 	"http-scratch/internal/request"
 	"http-scratch/internal/response"
 	"http-scratch/internal/server"
 )
 
-func toStr(bytes []byte) string {
-	out := ""
-	for _, b := range bytes {
-		out += fmt.Sprintf("%02x", b)
-	}
-	return out
-}
+const (
+	port        = 42069
+	maxBodySize = 10 << 20
 
-const port = 42069
-
-func resp400() []byte {
-	return []byte(`<html>
-  <head>
-    <title>400 Bad Request</title>
-  </head>
-  <body>
-    <h1>Bad Request</h1>
-    <p>Your request honestly kinda sucked.</p>
-  </body>
-</html>`)
-}
-
-func resp500() []byte {
-	return []byte(`<html>
-  <head>
-    <title>500 Internal Server Error</title>
-  </head>
-  <body>
-    <h1>Internal Server Error</h1>
-    <p>Okay, you know what? This one is on me.</p>
-  </body>
-</html>`)
-}
+	shutdownTimeout = 5 * time.Second
+)
 
 func resp200() []byte {
 	return []byte(`<html>
@@ -63,77 +37,64 @@ func resp200() []byte {
 </html>`)
 }
 
-func main() {
-	s, err := server.Serve(port, func(w *response.Writer, req *request.Request) {
-		h := response.GetDefaultHeaders(0)
-		body := resp200()
-		status := response.StatusOK
+var httpbin *proxy.ReverseProxy
 
-		if req.RequestLine.RequestTarget == "/yourproblem" {
-			body = resp400()
-			status = response.StatusBadRequest
-		} else if req.RequestLine.RequestTarget == "/myproblem" {
-			body = resp500()
-			status = response.StatusInternalServerError
-		} else if req.RequestLine.RequestTarget == "/video" {
-			f, _ := os.ReadFile("assets/vim.mp4")
-			h.Replace("content-type", "video/mp4")
-			h.Replace("content-length", strconv.Itoa(len(f)))
-			w.WriteStatusLine(response.StatusOK)
-			w.WriteHeaders(h)
-			w.WriteBody(f)
-		} else if strings.HasPrefix(req.RequestLine.RequestTarget, "/httpbin/") {
-			target := req.RequestLine.RequestTarget
-			res, err := http.Get("https://httpbin.org/" + target[len("/httpbin/"):])
-			if err != nil {
-				body = resp500()
-				status = response.StatusInternalServerError
-			} else {
-				w.WriteStatusLine(response.StatusOK)
-				h.Delete("content-length")
-				h.Set("transfer-encoding", "chunked")
-				h.Replace("content-type", "text/plain")
-				h.Set("trailer", "X-Content-SHA256")
-				h.Set("trailer", "X-Content-Length")
-				w.WriteHeaders(h)
-				var fullBody []byte
+func handler(w *response.Writer, req *request.Request) {
+	h := response.GetDefaultHeaders(0)
+	body := resp200()
+	status := response.StatusOK
 
-				for {
-					data := make([]byte, 32)
-					n, err := res.Body.Read(data)
-					if err != nil {
-						break
-					}
+	if req.RequestLine.RequestTarget == "/yourproblem" {
+		problem.Write(w, req, problem.New(response.StatusBadRequest, "Your request honestly kinda sucked."), nil)
+		return
+	} else if req.RequestLine.RequestTarget == "/myproblem" {
+		problem.Write(w, req, problem.New(response.StatusInternalServerError, "Okay, you know what? This one is on me."), nil)
+		return
+	} else if req.RequestLine.RequestTarget == "/video" {
+		f, _ := os.ReadFile("assets/vim.mp4")
+		h.Replace("content-type", "video/mp4")
+		h.Replace("content-length", strconv.Itoa(len(f)))
+		w.WriteStatusLine(response.StatusOK)
+		w.WriteHeaders(h)
+		w.WriteBody(f)
+	} else if strings.HasPrefix(req.RequestLine.RequestTarget, "/httpbin/") {
+		httpbin.Handle(w, req)
+		return
+	}
 
-					fullBody = append(fullBody, data[:n]...)
-					w.WriteBody(fmt.Appendf(nil, "%x\r\n", n))
-					w.WriteBody(data[:n])
-					w.WriteBody([]byte("\r\n"))
-				}
-				w.WriteBody([]byte("0\r\n"))
-				trailer := headers.NewHeaders()
-				out := sha256.Sum256(fullBody)
-				trailer.Set("X-Content-SHA256", toStr(out[:]))
-				trailer.Set("X-Content-Length", fmt.Sprintf("%d", len(fullBody)))
-				w.WriteHeaders(trailer)
-				return
-			}
-		}
+	h.Replace("content-length", strconv.Itoa(len(body)))
+	h.Replace("content-type", "text/html")
+	w.WriteStatusLine(status)
+	w.WriteHeaders(h)
+	w.WriteBody(body)
+}
 
-		h.Replace("content-length", strconv.Itoa(len(body)))
-		h.Replace("content-type", "text/html")
-		w.WriteStatusLine(status)
-		w.WriteHeaders(h)
-		w.WriteBody(body)
-	})
+func main() {
+	var err error
+	httpbin, err = proxy.New("https://httpbin.org")
+	if err != nil {
+		log.Fatalf("Error creating httpbin proxy: %v", err)
+	}
+	httpbin.StripPrefix = "/httpbin"
+	httpbin.ChecksumTrailers = true
+
+	h := server.DecodeBody(maxBodySize, handler)
+	s, err := server.Serve(port, h)
 	if err != nil {
 		log.Fatalf("Error starting server: %v", err)
 	}
-	defer s.Close()
+	h2 := &http2.Server{Handler: h}
+	h2.EnableH2C(s)
 	log.Println("Server started on port", port)
 
 	sigChan := make(chan os.Signal, 1)
 	signal.Notify(sigChan, syscall.SIGINT, syscall.SIGTERM)
 	<-sigChan
+
+	ctx, cancel := context.WithTimeout(context.Background(), shutdownTimeout)
+	defer cancel()
+	if err := s.Shutdown(ctx); err != nil {
+		log.Printf("Error shutting down: %v", err)
+	}
 	log.Println("Server gracefully stopped")
 }
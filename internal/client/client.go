@@ -0,0 +1,384 @@
+package client
+
+import (
+	"bufio"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"http-scratch/internal/headers"
+	"http-scratch/internal/request"
+	"http-scratch/internal/response"
+)
+
+var (
+	ErrInvalidURL             = errors.New("invalid request url")
+	ErrUnsupportedScheme      = errors.New("unsupported url scheme")
+	ErrContentLengthShort     = errors.New("content-length body ended early")
+	ErrMalformedContentLength = errors.New("malformed content-length")
+)
+
+// Client is safe for concurrent use; its idle connections are shared
+// between goroutines.
+type Client struct {
+	// Dial opens the transport connection. Defaults to net.Dialer.Dial.
+	Dial      func(network, addr string) (net.Conn, error)
+	TLSConfig *tls.Config
+	// Timeout bounds a whole exchange, including reading the body.
+	Timeout time.Duration
+
+	DisableKeepAlives bool
+	// MaxIdleConns caps idle connections across all hosts, zero means no
+	// limit. MaxIdleConnsPerHost defaults to 2.
+	MaxIdleConns        int
+	MaxIdleConnsPerHost int
+	// MaxConnsPerHost caps open connections per host; Do blocks once it is
+	// reached. Zero means no limit.
+	MaxConnsPerHost int
+	// IdleConnTimeout defaults to 90 seconds.
+	IdleConnTimeout time.Duration
+
+	// CheckRedirect is asked before every redirect is followed, with the
+	// request about to be sent and the ones already sent, oldest first.
+	// Returning ErrUseLastResponse hands back the redirect response itself.
+	// When nil, up to 10 redirects are followed.
+	CheckRedirect func(req *request.Request, via []*request.Request) error
+	// Jar, when set, receives Set-Cookie fields from every response and
+	// supplies the Cookie field of every request, redirects included.
+	Jar CookieJar
+
+	pool pool
+}
+
+var DefaultClient = &Client{}
+
+// NewRequest builds a request whose target is the absolute URL. Do dials
+// the URL's host and puts the origin-form target on the wire.
+func NewRequest(method, rawURL string, body string) (*request.Request, error) {
+	u, err := parseURL(rawURL)
+	if err != nil {
+		return nil, err
+	}
+
+	req := &request.Request{
+		RequestLine: request.RequestLine{
+			HTTPVersion:   "1.1",
+			RequestTarget: u.String(),
+			Method:        method,
+		},
+		Headers: headers.NewHeaders(),
+		Body:    body,
+	}
+	req.Headers.Set("Host", u.Host)
+	return req, nil
+}
+
+func Get(rawURL string) (*Response, error) {
+	return DefaultClient.Get(rawURL)
+}
+
+func (c *Client) Get(rawURL string) (*Response, error) {
+	req, err := NewRequest("GET", rawURL, "")
+	if err != nil {
+		return nil, err
+	}
+	return c.Do(req)
+}
+
+// send performs a single exchange, without redirects or cookies.
+func (c *Client) send(req *request.Request) (*Response, error) {
+	u, err := parseURL(req.RequestLine.RequestTarget)
+	if err != nil {
+		return nil, err
+	}
+
+	if c.DisableKeepAlives {
+		req.Headers.Replace("Connection", "close")
+	}
+
+	res, pc, err := c.roundTrip(u, req)
+	// A reused connection can be closed by the server between our liveness
+	// check and the write; idempotent requests get one more go on a fresh
+	// connection.
+	if err != nil && pc != nil && pc.reused && isIdempotent(req.RequestLine.Method) {
+		res, _, err = c.roundTrip(u, req)
+	}
+	return res, err
+}
+
+func (c *Client) roundTrip(u *url.URL, req *request.Request) (*Response, *persistConn, error) {
+	pc, err := c.getConn(u)
+	if err != nil {
+		return nil, nil, err
+	}
+	if c.Timeout > 0 {
+		pc.conn.SetDeadline(time.Now().Add(c.Timeout))
+	}
+
+	if err := writeRequest(pc.conn, u, req); err != nil {
+		pc.close()
+		return nil, pc, err
+	}
+
+	res, err := readResponse(pc.br, req.RequestLine.Method)
+	if err != nil {
+		pc.close()
+		return nil, pc, err
+	}
+
+	reusable := !c.DisableKeepAlives && keepAlive(req, res)
+	b := &body{Reader: res.Body, pc: pc, client: c, reusable: reusable}
+	res.Body = b
+	if res.ContentLength == 0 {
+		b.finish(true)
+	}
+	return res, pc, nil
+}
+
+// CloseIdleConnections closes every connection sitting idle in the pool.
+// Connections carrying a request are left alone.
+func (c *Client) CloseIdleConnections() {
+	c.pool.closeIdle()
+}
+
+func (c *Client) Stats() PoolStats {
+	return c.pool.stats()
+}
+
+func (c *Client) getConn(u *url.URL) (*persistConn, error) {
+	key := u.Scheme + "://" + hostPort(u)
+	for {
+		pc := c.pool.take(key, c.MaxConnsPerHost)
+		if pc == nil {
+			break
+		}
+		if c.pool.usable(pc, c.idleConnTimeout()) {
+			c.pool.hits.Add(1)
+			return pc, nil
+		}
+	}
+
+	conn, err := c.dial(u)
+	if err != nil {
+		c.pool.closed(key)
+		return nil, err
+	}
+	c.pool.misses.Add(1)
+	return &persistConn{
+		conn:    conn,
+		br:      bufio.NewReader(conn),
+		key:     key,
+		onClose: func() { c.pool.closed(key) },
+	}, nil
+}
+
+func (c *Client) putConn(pc *persistConn) {
+	pc.conn.SetDeadline(time.Time{})
+	maxPerHost := c.MaxIdleConnsPerHost
+	if maxPerHost == 0 {
+		maxPerHost = defaultMaxIdleConnsPerHost
+	}
+	if !c.pool.put(pc, c.MaxIdleConns, maxPerHost, c.idleConnTimeout()) {
+		pc.close()
+	}
+}
+
+func (c *Client) idleConnTimeout() time.Duration {
+	if c.IdleConnTimeout == 0 {
+		return defaultIdleConnTimeout
+	}
+	return c.IdleConnTimeout
+}
+
+func (c *Client) dial(u *url.URL) (net.Conn, error) {
+	dial := c.Dial
+	if dial == nil {
+		dial = (&net.Dialer{Timeout: c.Timeout}).Dial
+	}
+
+	conn, err := dial("tcp", hostPort(u))
+	if err != nil {
+		return nil, err
+	}
+	if u.Scheme != "https" {
+		return conn, nil
+	}
+
+	cfg := &tls.Config{}
+	if c.TLSConfig != nil {
+		cfg = c.TLSConfig.Clone()
+	}
+	if cfg.ServerName == "" {
+		cfg.ServerName = u.Hostname()
+	}
+	tlsConn := tls.Client(conn, cfg)
+	if err := tlsConn.Handshake(); err != nil {
+		conn.Close()
+		return nil, err
+	}
+	return tlsConn, nil
+}
+
+func writeRequest(w io.Writer, u *url.URL, req *request.Request) error {
+	target := u.RequestURI()
+	if req.RequestLine.Method == "OPTIONS" && u.Path == "" && u.RawQuery == "" {
+		target = "*"
+	}
+
+	h := req.Headers
+	if _, ok := h.Get("host"); !ok {
+		h.Set("Host", u.Host)
+	}
+	h.Delete("transfer-encoding")
+	if len(req.Body) > 0 || methodExpectsBody(req.RequestLine.Method) {
+		h.Replace("Content-Length", strconv.Itoa(len(req.Body)))
+	} else {
+		h.Delete("content-length")
+	}
+
+	b := fmt.Appendf(nil, "%s %s HTTP/1.1\r\n", req.RequestLine.Method, target)
+	h.ForEach(func(n, v string) {
+		b = fmt.Appendf(b, "%s: %s\r\n", n, v)
+	})
+	b = append(b, Separator...)
+	b = append(b, req.Body...)
+	_, err := w.Write(b)
+	return err
+}
+
+// readResponse leaves the body framing to res.Body, which reads straight
+// from br.
+func readResponse(br *bufio.Reader, method string) (*Response, error) {
+	var sl StatusLine
+	var h headers.Headers
+	var err error
+
+	// Interim 1xx responses are dropped; 101 is final, the connection is
+	// no longer HTTP after it.
+	for {
+		sl, h, err = ReadHead(br)
+		if err != nil {
+			return nil, err
+		}
+		if sl.StatusCode >= 200 || sl.StatusCode == response.StatusSwitchingProtocols {
+			break
+		}
+	}
+
+	res := &Response{
+		StatusLine:    sl,
+		Headers:       h,
+		ContentLength: -1,
+	}
+
+	switch {
+	case !bodyAllowed(method, sl.StatusCode):
+		res.ContentLength = 0
+		res.Body = io.NopCloser(strings.NewReader(""))
+	case isChunked(h):
+		res.Body = io.NopCloser(&chunkedReader{br: br, res: res})
+	default:
+		if cl, ok := h.Get("content-length"); ok {
+			n, err := strconv.ParseInt(strings.TrimSpace(cl), 10, 64)
+			if err != nil || n < 0 {
+				return nil, ErrMalformedContentLength
+			}
+			res.ContentLength = n
+			res.Body = io.NopCloser(&lengthReader{r: br, left: n})
+		} else {
+			res.Body = io.NopCloser(br)
+		}
+	}
+	return res, nil
+}
+
+// keepAlive reports whether the connection can carry another request
+// once this response's body is done.
+func keepAlive(req *request.Request, res *Response) bool {
+	if hasToken(req.Headers, "connection", "close") || hasToken(res.Headers, "connection", "close") {
+		return false
+	}
+	if res.StatusLine.StatusCode == response.StatusSwitchingProtocols {
+		return false
+	}
+	// Close-delimited bodies end with the connection
+	if res.ContentLength == -1 && !isChunked(res.Headers) {
+		return false
+	}
+	if res.StatusLine.HTTPVersion == "1.0" {
+		return hasToken(res.Headers, "connection", "keep-alive")
+	}
+	return true
+}
+
+func hasToken(h headers.Headers, name, token string) bool {
+	v, ok := h.Get(name)
+	if !ok {
+		return false
+	}
+	for _, t := range strings.Split(v, ",") {
+		if strings.EqualFold(strings.TrimSpace(t), token) {
+			return true
+		}
+	}
+	return false
+}
+
+func isIdempotent(method string) bool {
+	switch method {
+	case "GET", "HEAD", "OPTIONS", "TRACE", "PUT", "DELETE":
+		return true
+	}
+	return false
+}
+
+type lengthReader struct {
+	r    io.Reader
+	left int64
+}
+
+func (lr *lengthReader) Read(p []byte) (int, error) {
+	if lr.left <= 0 {
+		return 0, io.EOF
+	}
+	if int64(len(p)) > lr.left {
+		p = p[:lr.left]
+	}
+	n, err := lr.r.Read(p)
+	lr.left -= int64(n)
+	if errors.Is(err, io.EOF) && lr.left > 0 {
+		return n, ErrContentLengthShort
+	}
+	return n, err
+}
+
+func methodExpectsBody(method string) bool {
+	return method == "POST" || method == "PUT" || method == "PATCH"
+}
+
+func parseURL(rawURL string) (*url.URL, error) {
+	u, err := url.Parse(rawURL)
+	if err != nil || u.Host == "" {
+		return nil, ErrInvalidURL
+	}
+	if u.Scheme != "http" && u.Scheme != "https" {
+		return nil, ErrUnsupportedScheme
+	}
+	return u, nil
+}
+
+func hostPort(u *url.URL) string {
+	if u.Port() != "" {
+		return u.Host
+	}
+	if u.Scheme == "https" {
+		return net.JoinHostPort(u.Hostname(), "443")
+	}
+	return net.JoinHostPort(u.Hostname(), "80")
+}
@@ -0,0 +1,168 @@
+package client
+
+import (
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"http-scratch/internal/response"
+)
+
+func TestParseStatusLine(t *testing.T) {
+	// Test: Good status line
+	sl, n, err := parseStatusLine([]byte("HTTP/1.1 404 Not Found\r\nServer: x\r\n"))
+	require.NoError(t, err)
+	assert.Equal(t, 24, n)
+	assert.Equal(t, "1.1", sl.HTTPVersion)
+	assert.Equal(t, response.StatusNotFound, sl.StatusCode)
+	assert.Equal(t, "Not Found", sl.ReasonPhrase)
+
+	// Test: Empty reason phrase
+	sl, _, err = parseStatusLine([]byte("HTTP/1.0 299 \r\n"))
+	require.NoError(t, err)
+	assert.Equal(t, "1.0", sl.HTTPVersion)
+	assert.Equal(t, response.StatusCode(299), sl.StatusCode)
+	assert.Equal(t, "", sl.ReasonPhrase)
+
+	// Test: Not enough data
+	_, n, err = parseStatusLine([]byte("HTTP/1.1 200 O"))
+	require.NoError(t, err)
+	assert.Equal(t, 0, n)
+
+	// Test: Malformed status lines
+	_, _, err = parseStatusLine([]byte("HTTP/1.1 20 OK\r\n"))
+	require.ErrorIs(t, err, ErrMalformedStatusLine)
+	_, _, err = parseStatusLine([]byte("HTTP/1.1\r\n"))
+	require.ErrorIs(t, err, ErrMalformedStatusLine)
+	_, _, err = parseStatusLine([]byte("HTTP/2 200 OK\r\n"))
+	require.ErrorIs(t, err, ErrUnsupportedHTTPVersion)
+}
+
+func TestClientDo(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		b, _ := io.ReadAll(r.Body)
+		switch r.URL.Path {
+		case "/echo":
+			w.Header().Set("X-Method", r.Method)
+			w.Header().Set("X-Query", r.URL.RawQuery)
+			w.Write(b)
+		case "/chunked":
+			w.Header().Set("Trailer", "X-Checksum")
+			w.Write([]byte("hello "))
+			w.(http.Flusher).Flush()
+			w.Write([]byte("world"))
+			w.Header().Set("X-Checksum", "abc123")
+		}
+	}))
+	defer srv.Close()
+
+	// Test: Content-Length body with request body and query
+	req, err := NewRequest("POST", srv.URL+"/echo?a=1", "ping")
+	require.NoError(t, err)
+	res, err := DefaultClient.Do(req)
+	require.NoError(t, err)
+	assert.Equal(t, response.StatusOK, res.StatusLine.StatusCode)
+	method, _ := res.Headers.Get("x-method")
+	assert.Equal(t, "POST", method)
+	query, _ := res.Headers.Get("x-query")
+	assert.Equal(t, "a=1", query)
+	assert.EqualValues(t, 4, res.ContentLength)
+	b, err := io.ReadAll(res.Body)
+	require.NoError(t, err)
+	assert.Equal(t, "ping", string(b))
+	require.NoError(t, res.Body.Close())
+
+	// Test: Chunked body with trailers
+	res, err = Get(srv.URL + "/chunked")
+	require.NoError(t, err)
+	assert.EqualValues(t, -1, res.ContentLength)
+	b, err = io.ReadAll(res.Body)
+	require.NoError(t, err)
+	assert.Equal(t, "hello world", string(b))
+	checksum, ok := res.Trailers.Get("x-checksum")
+	assert.True(t, ok)
+	assert.Equal(t, "abc123", checksum)
+	res.Body.Close()
+
+	// Test: HEAD has no body even with Content-Length
+	req, _ = NewRequest("HEAD", srv.URL+"/echo", "")
+	res, err = DefaultClient.Do(req)
+	require.NoError(t, err)
+	b, _ = io.ReadAll(res.Body)
+	assert.Empty(t, b)
+	res.Body.Close()
+
+	// Test: Bad URLs
+	_, err = Get("ftp://example.com/")
+	require.ErrorIs(t, err, ErrUnsupportedScheme)
+	_, err = Get("/relative")
+	require.ErrorIs(t, err, ErrInvalidURL)
+}
+
+// rawServer answers every connection with the canned response and closes.
+func rawServer(t *testing.T, raw string) string {
+	t.Helper()
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	t.Cleanup(func() { ln.Close() })
+
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			buf := make([]byte, 4096)
+			conn.Read(buf)
+			conn.Write([]byte(raw))
+			conn.Close()
+		}
+	}()
+	return "http://" + ln.Addr().String()
+}
+
+func TestClientRawResponses(t *testing.T) {
+	// Test: Close-delimited body after an interim 100 Continue
+	url := rawServer(t, "HTTP/1.1 100 Continue\r\n\r\nHTTP/1.0 200 OK\r\nContent-Type: text/plain\r\n\r\nuntil the end")
+	res, err := Get(url)
+	require.NoError(t, err)
+	assert.Equal(t, response.StatusOK, res.StatusLine.StatusCode)
+	b, err := io.ReadAll(res.Body)
+	require.NoError(t, err)
+	assert.Equal(t, "until the end", string(b))
+
+	// Test: Chunk extensions and multiple trailers
+	url = rawServer(t, "HTTP/1.1 200 OK\r\nTransfer-Encoding: chunked\r\n\r\n"+
+		"5;name=value\r\nhello\r\n1\r\n!\r\n0\r\nX-A: 1\r\nX-B: 2\r\n\r\n")
+	res, err = Get(url)
+	require.NoError(t, err)
+	b, err = io.ReadAll(res.Body)
+	require.NoError(t, err)
+	assert.Equal(t, "hello!", string(b))
+	assert.Len(t, res.Trailers, 2)
+
+	// Test: Truncated Content-Length body
+	url = rawServer(t, "HTTP/1.1 200 OK\r\nContent-Length: 10\r\n\r\nshort")
+	res, err = Get(url)
+	require.NoError(t, err)
+	_, err = io.ReadAll(res.Body)
+	require.ErrorIs(t, err, ErrContentLengthShort)
+
+	// Test: Malformed chunk size
+	url = rawServer(t, "HTTP/1.1 200 OK\r\nTransfer-Encoding: chunked\r\n\r\nzz\r\nhello\r\n0\r\n\r\n")
+	res, err = Get(url)
+	require.NoError(t, err)
+	_, err = io.ReadAll(res.Body)
+	require.ErrorIs(t, err, ErrMalformedChunk)
+
+	// Test: Garbage status line
+	url = rawServer(t, strings.Repeat("nope", 4)+"\r\n\r\n")
+	_, err = Get(url)
+	require.ErrorIs(t, err, ErrMalformedStatusLine)
+}
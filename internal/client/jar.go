@@ -0,0 +1,194 @@
+package client
+
+import (
+	"net"
+	"net/url"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"http-scratch/internal/cookie"
+)
+
+// CookieJar stores cookies received from servers and hands back the ones
+// that apply to a given URL.
+type CookieJar interface {
+	SetCookies(u *url.URL, cookies []*cookie.Cookie)
+	Cookies(u *url.URL) []*cookie.Cookie
+}
+
+// Jar is an in-memory CookieJar implementing the storage model of RFC 6265
+// section 5.3. It has no public suffix list, so it only refuses Domain
+// attributes that name a single label such as "com".
+type Jar struct {
+	mu      sync.Mutex
+	entries map[string]*jarEntry
+	// now is overridden in tests
+	now func() time.Time
+}
+
+type jarEntry struct {
+	name       string
+	value      string
+	domain     string
+	path       string
+	hostOnly   bool
+	secure     bool
+	persistent bool
+	expires    time.Time
+	created    time.Time
+}
+
+func NewJar() *Jar {
+	return &Jar{entries: map[string]*jarEntry{}, now: time.Now}
+}
+
+func (j *Jar) SetCookies(u *url.URL, cookies []*cookie.Cookie) {
+	host := canonicalHost(u)
+	now := j.now()
+
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	for _, c := range cookies {
+		e, ok := newEntry(c, u, host, now)
+		if !ok {
+			continue
+		}
+
+		key := e.domain + ";" + e.path + ";" + e.name
+		if old, ok := j.entries[key]; ok {
+			e.created = old.created
+		}
+		if e.persistent && !e.expires.After(now) {
+			delete(j.entries, key)
+			continue
+		}
+		j.entries[key] = e
+	}
+}
+
+func newEntry(c *cookie.Cookie, u *url.URL, host string, now time.Time) (*jarEntry, bool) {
+	e := &jarEntry{
+		name:    c.Name,
+		value:   c.Value,
+		path:    c.Path,
+		secure:  c.Secure,
+		created: now,
+	}
+
+	// Max-Age wins over Expires
+	switch {
+	case c.MaxAge < 0:
+		e.persistent, e.expires = true, time.Time{}
+	case c.MaxAge > 0:
+		e.persistent, e.expires = true, now.Add(time.Duration(c.MaxAge)*time.Second)
+	case !c.Expires.IsZero():
+		e.persistent, e.expires = true, c.Expires
+	}
+
+	if c.Domain == "" {
+		e.domain, e.hostOnly = host, true
+	} else {
+		if !strings.Contains(c.Domain, ".") && c.Domain != host {
+			return nil, false
+		}
+		if !domainMatch(host, c.Domain) {
+			return nil, false
+		}
+		e.domain = c.Domain
+	}
+
+	if e.path == "" {
+		e.path = defaultPath(u.Path)
+	}
+	if e.secure && u.Scheme != "https" {
+		return nil, false
+	}
+	return e, true
+}
+
+func (j *Jar) Cookies(u *url.URL) []*cookie.Cookie {
+	host := canonicalHost(u)
+	path := u.Path
+	if path == "" {
+		path = "/"
+	}
+	now := j.now()
+
+	j.mu.Lock()
+	var matched []*jarEntry
+	for key, e := range j.entries {
+		if e.persistent && !e.expires.After(now) {
+			delete(j.entries, key)
+			continue
+		}
+		if e.hostOnly && host != e.domain {
+			continue
+		}
+		if !e.hostOnly && !domainMatch(host, e.domain) {
+			continue
+		}
+		if !pathMatch(path, e.path) {
+			continue
+		}
+		if e.secure && u.Scheme != "https" {
+			continue
+		}
+		matched = append(matched, e)
+	}
+	j.mu.Unlock()
+
+	// Longer paths first, then oldest first (RFC 6265 section 5.4)
+	sort.Slice(matched, func(a, b int) bool {
+		if len(matched[a].path) != len(matched[b].path) {
+			return len(matched[a].path) > len(matched[b].path)
+		}
+		return matched[a].created.Before(matched[b].created)
+	})
+
+	cookies := make([]*cookie.Cookie, 0, len(matched))
+	for _, e := range matched {
+		cookies = append(cookies, &cookie.Cookie{Name: e.name, Value: e.value})
+	}
+	return cookies
+}
+
+func canonicalHost(u *url.URL) string {
+	return strings.ToLower(u.Hostname())
+}
+
+// domainMatch implements RFC 6265 section 5.1.3. IP addresses only ever
+// match themselves.
+func domainMatch(host, domain string) bool {
+	if host == domain {
+		return true
+	}
+	if net.ParseIP(host) != nil {
+		return false
+	}
+	return strings.HasSuffix(host, "."+domain)
+}
+
+// pathMatch implements RFC 6265 section 5.1.4.
+func pathMatch(reqPath, cookiePath string) bool {
+	if reqPath == cookiePath {
+		return true
+	}
+	if !strings.HasPrefix(reqPath, cookiePath) {
+		return false
+	}
+	return strings.HasSuffix(cookiePath, "/") || reqPath[len(cookiePath)] == '/'
+}
+
+// defaultPath implements RFC 6265 section 5.1.4.
+func defaultPath(p string) string {
+	if p == "" || p[0] != '/' {
+		return "/"
+	}
+	i := strings.LastIndex(p, "/")
+	if i == 0 {
+		return "/"
+	}
+	return p[:i]
+}
@@ -0,0 +1,85 @@
+package client
+
+import (
+	"net/url"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"http-scratch/internal/cookie"
+)
+
+func mustURL(t *testing.T, s string) *url.URL {
+	t.Helper()
+	u, err := url.Parse(s)
+	require.NoError(t, err)
+	return u
+}
+
+func set(t *testing.T, j *Jar, rawURL string, setCookies ...string) {
+	t.Helper()
+	var cookies []*cookie.Cookie
+	for _, sc := range setCookies {
+		c, err := cookie.ParseSetCookie(sc)
+		require.NoError(t, err)
+		cookies = append(cookies, c)
+	}
+	j.SetCookies(mustURL(t, rawURL), cookies)
+}
+
+func names(cookies []*cookie.Cookie) []string {
+	out := []string{}
+	for _, c := range cookies {
+		out = append(out, c.Name+"="+c.Value)
+	}
+	return out
+}
+
+func TestJar(t *testing.T) {
+	now := time.Date(2026, 1, 1, 0, 0, 0, 0, time.UTC)
+	j := NewJar()
+	j.now = func() time.Time { return now }
+
+	set(t, j, "http://www.example.com/app/login",
+		"host=1",
+		"dom=2; Domain=example.com",
+		"root=3; Path=/",
+		"deep=4; Path=/app/admin",
+		"sec=5; Secure",
+		"short=6; Max-Age=60",
+	)
+	// Rejected: foreign domain, single label domain, secure over http
+	set(t, j, "http://www.example.com/", "evil=1; Domain=other.com", "tld=1; Domain=com")
+
+	// Test: host-only vs domain cookies
+	assert.ElementsMatch(t, []string{"host=1", "dom=2", "root=3", "short=6"}, names(j.Cookies(mustURL(t, "http://www.example.com/app/page"))))
+	assert.ElementsMatch(t, []string{"dom=2"}, names(j.Cookies(mustURL(t, "http://api.example.com/app/x"))))
+	assert.Empty(t, j.Cookies(mustURL(t, "http://example.org/")))
+
+	// Test: path matching and longest path first
+	got := names(j.Cookies(mustURL(t, "http://www.example.com/app/admin/users")))
+	require.NotEmpty(t, got)
+	assert.Equal(t, "deep=4", got[0])
+	assert.NotContains(t, names(j.Cookies(mustURL(t, "http://www.example.com/application"))), "host=1")
+
+	// Test: secure cookies only over https
+	set(t, j, "https://www.example.com/", "sec=5; Secure")
+	assert.Contains(t, names(j.Cookies(mustURL(t, "https://www.example.com/"))), "sec=5")
+	assert.NotContains(t, names(j.Cookies(mustURL(t, "http://www.example.com/"))), "sec=5")
+
+	// Test: expiry
+	now = now.Add(2 * time.Minute)
+	assert.NotContains(t, names(j.Cookies(mustURL(t, "http://www.example.com/app/x"))), "short=6")
+
+	// Test: overwrite and delete
+	set(t, j, "http://www.example.com/", "root=new; Path=/")
+	assert.Contains(t, names(j.Cookies(mustURL(t, "http://www.example.com/"))), "root=new")
+	set(t, j, "http://www.example.com/", "root=; Path=/; Max-Age=0")
+	assert.NotContains(t, names(j.Cookies(mustURL(t, "http://www.example.com/"))), "root=new")
+
+	// Test: IP hosts only match themselves
+	set(t, j, "http://127.0.0.1/", "ip=1")
+	assert.Equal(t, []string{"ip=1"}, names(j.Cookies(mustURL(t, "http://127.0.0.1/"))))
+}
@@ -0,0 +1,226 @@
+package client
+
+import (
+	"bufio"
+	"errors"
+	"net"
+	"os"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	defaultMaxIdleConnsPerHost = 2
+	defaultIdleConnTimeout     = 90 * time.Second
+)
+
+type PoolStats struct {
+	// Hits counts requests sent on a reused connection, Misses those that
+	// had to dial.
+	Hits   uint64
+	Misses uint64
+	// Stale counts idle connections found closed by the server on reuse,
+	// Expired those dropped after IdleConnTimeout.
+	Stale   uint64
+	Expired uint64
+	Idle    int
+}
+
+type persistConn struct {
+	conn   net.Conn
+	br     *bufio.Reader
+	key    string
+	idleAt time.Time
+	reused bool
+
+	closeOnce sync.Once
+	onClose   func()
+}
+
+func (pc *persistConn) close() {
+	pc.closeOnce.Do(func() {
+		pc.conn.Close()
+		if pc.onClose != nil {
+			pc.onClose()
+		}
+	})
+}
+
+// alive peeks at an idle connection with a tiny deadline. A live one has
+// nothing to say and times out; one the server closed (or that has
+// unsolicited bytes on it) is not safe to send a request on.
+func (pc *persistConn) alive() bool {
+	if pc.br.Buffered() > 0 {
+		return false
+	}
+	pc.conn.SetReadDeadline(time.Now().Add(time.Millisecond))
+	_, err := pc.br.Peek(1)
+	pc.conn.SetReadDeadline(time.Time{})
+	return errors.Is(err, os.ErrDeadlineExceeded)
+}
+
+// pool tracks idle connections and, per host, how many connections are
+// open in total so that MaxConnsPerHost can make callers wait. Waiters
+// are woken whenever a connection goes idle or is closed.
+type pool struct {
+	mu      sync.Mutex
+	cond    *sync.Cond
+	idle    map[string][]*persistConn
+	idleLen int
+	open    map[string]int
+
+	hits    atomic.Uint64
+	misses  atomic.Uint64
+	stale   atomic.Uint64
+	expired atomic.Uint64
+}
+
+func (p *pool) initLocked() {
+	if p.cond == nil {
+		p.cond = sync.NewCond(&p.mu)
+		p.idle = map[string][]*persistConn{}
+		p.open = map[string]int{}
+	}
+}
+
+// take returns the most recently used idle connection for key, or nil
+// once it has reserved a slot for a new one. It blocks while maxConns
+// connections to key are open and none of them is idle.
+func (p *pool) take(key string, maxConns int) *persistConn {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.initLocked()
+
+	for {
+		if conns := p.idle[key]; len(conns) > 0 {
+			pc := conns[len(conns)-1]
+			p.idle[key] = conns[:len(conns)-1]
+			p.idleLen--
+			return pc
+		}
+		if maxConns <= 0 || p.open[key] < maxConns {
+			p.open[key]++
+			return nil
+		}
+		p.cond.Wait()
+	}
+}
+
+// usable vets a connection handed out by take, closing it if it expired
+// or the server hung up on it.
+func (p *pool) usable(pc *persistConn, idleTimeout time.Duration) bool {
+	if idleTimeout > 0 && time.Since(pc.idleAt) > idleTimeout {
+		p.expired.Add(1)
+		pc.close()
+		return false
+	}
+	if !pc.alive() {
+		p.stale.Add(1)
+		pc.close()
+		return false
+	}
+	pc.reused = true
+	return true
+}
+
+// closed gives back the slot of a connection that went away.
+func (p *pool) closed(key string) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.initLocked()
+	p.open[key]--
+	p.cond.Broadcast()
+}
+
+// put parks pc as idle. It reports false, and the caller closes pc, when
+// the limits leave no room for it.
+func (p *pool) put(pc *persistConn, maxIdle, maxIdlePerHost int, idleTimeout time.Duration) bool {
+	p.mu.Lock()
+	p.initLocked()
+	drop := p.pruneLocked(idleTimeout)
+
+	ok := len(p.idle[pc.key]) < maxIdlePerHost
+	if ok {
+		if maxIdle > 0 && p.idleLen >= maxIdle {
+			if oldest := p.evictOldestLocked(); oldest != nil {
+				drop = append(drop, oldest)
+			}
+		}
+		pc.idleAt = time.Now()
+		p.idle[pc.key] = append(p.idle[pc.key], pc)
+		p.idleLen++
+		p.cond.Broadcast()
+	}
+	p.mu.Unlock()
+
+	for _, pc := range drop {
+		pc.close()
+	}
+	return ok
+}
+
+func (p *pool) pruneLocked(idleTimeout time.Duration) []*persistConn {
+	if idleTimeout <= 0 {
+		return nil
+	}
+	var drop []*persistConn
+	for key, conns := range p.idle {
+		kept := conns[:0]
+		for _, pc := range conns {
+			if time.Since(pc.idleAt) > idleTimeout {
+				p.expired.Add(1)
+				p.idleLen--
+				drop = append(drop, pc)
+				continue
+			}
+			kept = append(kept, pc)
+		}
+		p.idle[key] = kept
+	}
+	return drop
+}
+
+func (p *pool) evictOldestLocked() *persistConn {
+	var oldestKey string
+	var oldest *persistConn
+	for key, conns := range p.idle {
+		if len(conns) > 0 && (oldest == nil || conns[0].idleAt.Before(oldest.idleAt)) {
+			oldestKey, oldest = key, conns[0]
+		}
+	}
+	if oldest == nil {
+		return nil
+	}
+	p.idle[oldestKey] = p.idle[oldestKey][1:]
+	p.idleLen--
+	return oldest
+}
+
+func (p *pool) closeIdle() {
+	p.mu.Lock()
+	var drop []*persistConn
+	for key, conns := range p.idle {
+		drop = append(drop, conns...)
+		delete(p.idle, key)
+	}
+	p.idleLen = 0
+	p.mu.Unlock()
+
+	for _, pc := range drop {
+		pc.close()
+	}
+}
+
+func (p *pool) stats() PoolStats {
+	p.mu.Lock()
+	idle := p.idleLen
+	p.mu.Unlock()
+	return PoolStats{
+		Hits:    p.hits.Load(),
+		Misses:  p.misses.Load(),
+		Stale:   p.stale.Load(),
+		Expired: p.expired.Load(),
+		Idle:    idle,
+	}
+}
@@ -0,0 +1,131 @@
+package client
+
+import (
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func fetch(t *testing.T, c *Client, url string) string {
+	t.Helper()
+	res, err := c.Get(url)
+	require.NoError(t, err)
+	b, err := io.ReadAll(res.Body)
+	require.NoError(t, err)
+	res.Body.Close()
+	return string(b)
+}
+
+func TestPoolReuse(t *testing.T) {
+	var conns atomic.Int32
+	srv := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("ok"))
+	}))
+	srv.Config.ConnState = func(_ net.Conn, state http.ConnState) {
+		if state == http.StateNew {
+			conns.Add(1)
+		}
+	}
+	srv.Start()
+	defer srv.Close()
+
+	c := &Client{}
+
+	// Test: sequential requests share one connection
+	for range 5 {
+		assert.Equal(t, "ok", fetch(t, c, srv.URL))
+	}
+	stats := c.Stats()
+	assert.EqualValues(t, 1, stats.Misses)
+	assert.EqualValues(t, 4, stats.Hits)
+	assert.Equal(t, 1, stats.Idle)
+	assert.EqualValues(t, 1, conns.Load())
+
+	// Test: a connection closed by the server is detected before reuse
+	srv.CloseClientConnections()
+	require.Eventually(t, func() bool {
+		return fetch(t, c, srv.URL) == "ok" && c.Stats().Stale == 1
+	}, time.Second, 10*time.Millisecond)
+	assert.EqualValues(t, 2, c.Stats().Misses)
+
+	// Test: CloseIdleConnections empties the pool
+	c.CloseIdleConnections()
+	assert.Equal(t, 0, c.Stats().Idle)
+
+	// Test: a body closed before EOF does not go back to the pool
+	res, err := c.Get(srv.URL)
+	require.NoError(t, err)
+	res.Body.Close()
+	assert.Equal(t, 0, c.Stats().Idle)
+}
+
+func TestPoolLimits(t *testing.T) {
+	release := make(chan struct{})
+	var inFlight, peak atomic.Int32
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		n := inFlight.Add(1)
+		for {
+			p := peak.Load()
+			if n <= p || peak.CompareAndSwap(p, n) {
+				break
+			}
+		}
+		if r.URL.Path == "/slow" {
+			<-release
+		}
+		inFlight.Add(-1)
+		w.Write([]byte("ok"))
+	}))
+	defer srv.Close()
+
+	// Test: MaxConnsPerHost bounds concurrent connections
+	c := &Client{MaxConnsPerHost: 2, MaxIdleConnsPerHost: 2}
+	var wg sync.WaitGroup
+	for range 6 {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			fetch(t, c, srv.URL+"/slow")
+		}()
+	}
+	time.Sleep(50 * time.Millisecond)
+	assert.EqualValues(t, 2, inFlight.Load())
+	close(release)
+	wg.Wait()
+	assert.EqualValues(t, 2, peak.Load())
+	assert.EqualValues(t, 2, c.Stats().Misses)
+	assert.Equal(t, 2, c.Stats().Idle)
+
+	// Test: MaxIdleConnsPerHost keeps the rest from idling
+	c = &Client{MaxIdleConnsPerHost: 1}
+	res1, err := c.Get(srv.URL)
+	require.NoError(t, err)
+	res2, err := c.Get(srv.URL)
+	require.NoError(t, err)
+	io.ReadAll(res1.Body)
+	io.ReadAll(res2.Body)
+	assert.Equal(t, 1, c.Stats().Idle)
+
+	// Test: idle connections expire
+	c = &Client{IdleConnTimeout: 20 * time.Millisecond}
+	fetch(t, c, srv.URL)
+	time.Sleep(40 * time.Millisecond)
+	fetch(t, c, srv.URL)
+	assert.EqualValues(t, 1, c.Stats().Expired)
+	assert.EqualValues(t, 2, c.Stats().Misses)
+
+	// Test: DisableKeepAlives never pools
+	c = &Client{DisableKeepAlives: true}
+	fetch(t, c, srv.URL)
+	fetch(t, c, srv.URL)
+	assert.Equal(t, 0, c.Stats().Idle)
+	assert.EqualValues(t, 2, c.Stats().Misses)
+}
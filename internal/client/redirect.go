@@ -0,0 +1,198 @@
+package client
+
+import (
+	"errors"
+	"io"
+	"net/url"
+	"strings"
+
+	"http-scratch/internal/cookie"
+	"http-scratch/internal/request"
+	"http-scratch/internal/response"
+)
+
+var (
+	ErrUseLastResponse  = errors.New("use last response")
+	ErrTooManyRedirects = errors.New("stopped after 10 redirects")
+)
+
+const (
+	defaultMaxRedirects = 10
+	// Redirect bodies up to this size are drained so the connection can go
+	// back to the pool; anything bigger is cheaper to just close.
+	maxDrainBytes = 4 << 10
+)
+
+// Fields that carry credentials for one origin and must not follow a
+// redirect to another host.
+var sensitiveHeaders = []string{
+	"authorization",
+	"proxy-authorization",
+	"www-authenticate",
+	"cookie",
+}
+
+// Do sends req, follows redirects according to CheckRedirect and keeps
+// Jar up to date. On a CheckRedirect error other than ErrUseLastResponse
+// the error is returned and the last response is closed.
+func (c *Client) Do(req *request.Request) (*Response, error) {
+	var via []*request.Request
+	userCookies, _ := req.Headers.Get("cookie")
+
+	for {
+		u, err := parseURL(req.RequestLine.RequestTarget)
+		if err != nil {
+			return nil, err
+		}
+		c.addCookies(req, u, userCookies)
+
+		res, err := c.send(req)
+		if err != nil {
+			return nil, err
+		}
+		c.storeCookies(u, res)
+
+		next, ok := redirectRequest(req, u, res)
+		if !ok {
+			return res, nil
+		}
+		// Credentials and hand-set cookies stay with the original host
+		if nextURL, err := parseURL(next.RequestLine.RequestTarget); err != nil || canonicalHost(u) != canonicalHost(nextURL) {
+			userCookies = ""
+		}
+
+		via = append(via, req)
+		if err := c.checkRedirect(next, via); err != nil {
+			if errors.Is(err, ErrUseLastResponse) {
+				return res, nil
+			}
+			res.Body.Close()
+			return nil, err
+		}
+
+		drain(res)
+		req = next
+	}
+}
+
+func (c *Client) checkRedirect(req *request.Request, via []*request.Request) error {
+	if c.CheckRedirect != nil {
+		return c.CheckRedirect(req, via)
+	}
+	if len(via) >= defaultMaxRedirects {
+		return ErrTooManyRedirects
+	}
+	return nil
+}
+
+// redirectRequest builds the follow-up request for a 3xx response, or
+// reports false when res is not something to follow.
+func redirectRequest(req *request.Request, u *url.URL, res *Response) (*request.Request, bool) {
+	method := req.RequestLine.Method
+	body := req.Body
+	keepBody := true
+
+	switch res.StatusLine.StatusCode {
+	case response.StatusMovedPermanently, response.StatusFound:
+		// Historically user agents turn POST into GET here
+		if method == "POST" {
+			method, body, keepBody = "GET", "", false
+		}
+	case response.StatusSeeOther:
+		if method != "HEAD" {
+			method, body, keepBody = "GET", "", false
+		}
+	case response.StatusTemporaryRedirect, response.StatusPermanentRedirect:
+		// Method and body are replayed untouched
+	default:
+		return nil, false
+	}
+
+	loc, ok := res.Headers.Get("location")
+	if !ok || loc == "" {
+		return nil, false
+	}
+	target, err := u.Parse(loc)
+	if err != nil {
+		return nil, false
+	}
+	// Fragments are kept from the original request when the target has none
+	if target.Fragment == "" {
+		target.Fragment = u.Fragment
+	}
+
+	next, err := NewRequest(method, target.String(), body)
+	if err != nil {
+		return nil, false
+	}
+
+	sameHost := canonicalHost(u) == canonicalHost(target)
+	req.Headers.ForEach(func(n, v string) {
+		switch n {
+		case "host", "content-length", "connection":
+			return
+		case "content-type", "content-encoding", "content-language":
+			if !keepBody {
+				return
+			}
+		}
+		if !sameHost && isSensitive(n) {
+			return
+		}
+		next.Headers.Replace(n, v)
+	})
+	// Don't leak an https URL to a plain http origin
+	if u.Scheme == "https" && target.Scheme == "http" {
+		next.Headers.Delete("referer")
+	}
+	return next, true
+}
+
+func (c *Client) addCookies(req *request.Request, u *url.URL, userCookies string) {
+	if c.Jar == nil {
+		return
+	}
+
+	var pairs []string
+	if userCookies != "" {
+		pairs = append(pairs, userCookies)
+	}
+	for _, ck := range c.Jar.Cookies(u) {
+		pairs = append(pairs, ck.Name+"="+ck.Value)
+	}
+	if len(pairs) == 0 {
+		req.Headers.Delete("cookie")
+		return
+	}
+	req.Headers.Replace("cookie", strings.Join(pairs, "; "))
+}
+
+func (c *Client) storeCookies(u *url.URL, res *Response) {
+	if c.Jar == nil {
+		return
+	}
+
+	var cookies []*cookie.Cookie
+	for _, v := range res.Headers.Values("set-cookie") {
+		if ck, err := cookie.ParseSetCookie(v); err == nil {
+			cookies = append(cookies, ck)
+		}
+	}
+	if len(cookies) > 0 {
+		c.Jar.SetCookies(u, cookies)
+	}
+}
+
+func isSensitive(name string) bool {
+	for _, s := range sensitiveHeaders {
+		if name == s {
+			return true
+		}
+	}
+	return false
+}
+
+func drain(res *Response) {
+	io.CopyN(io.Discard, res.Body, maxDrainBytes)
+	res.Body.Close()
+}
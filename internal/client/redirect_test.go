@@ -0,0 +1,119 @@
+package client
+
+import (
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"http-scratch/internal/request"
+	"http-scratch/internal/response"
+)
+
+func TestRedirects(t *testing.T) {
+	var srv *httptest.Server
+	srv = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		b, _ := io.ReadAll(r.Body)
+		switch r.URL.Path {
+		case "/301", "/302", "/303", "/307", "/308":
+			code := map[string]int{"/301": 301, "/302": 302, "/303": 303, "/307": 307, "/308": 308}[r.URL.Path]
+			http.Redirect(w, r, "/echo", code)
+		case "/loop":
+			http.Redirect(w, r, "/loop", http.StatusFound)
+		case "/away":
+			// Same server, but a different host name
+			http.Redirect(w, r, strings.Replace(srv.URL, "127.0.0.1", "localhost", 1)+"/echo", http.StatusFound)
+		case "/login":
+			http.SetCookie(w, &http.Cookie{Name: "session", Value: "s3cr3t", Path: "/"})
+			http.Redirect(w, r, "/echo", http.StatusSeeOther)
+		case "/echo":
+			w.Header().Set("X-Method", r.Method)
+			w.Header().Set("X-Auth", r.Header.Get("Authorization"))
+			w.Header().Set("X-Cookie", r.Header.Get("Cookie"))
+			w.Write(b)
+		}
+	}))
+	defer srv.Close()
+
+	c := &Client{}
+	do := func(method, path, body string) *Response {
+		t.Helper()
+		req, err := NewRequest(method, srv.URL+path, body)
+		require.NoError(t, err)
+		req.Headers.Set("Authorization", "Bearer token")
+		res, err := c.Do(req)
+		require.NoError(t, err)
+		return res
+	}
+	header := func(res *Response, name string) string {
+		v, _ := res.Headers.Get(name)
+		return v
+	}
+
+	// Test: 301/302 turn POST into GET and drop the body
+	for _, path := range []string{"/301", "/302"} {
+		res := do("POST", path, "payload")
+		assert.Equal(t, "GET", header(res, "x-method"))
+		assert.Empty(t, readAll(t, res))
+	}
+
+	// Test: 303 turns everything but HEAD into GET
+	res := do("PUT", "/303", "payload")
+	assert.Equal(t, "GET", header(res, "x-method"))
+	res = do("HEAD", "/303", "")
+	assert.Equal(t, "HEAD", header(res, "x-method"))
+
+	// Test: 307/308 replay method and body
+	for _, path := range []string{"/307", "/308"} {
+		res := do("POST", path, "payload")
+		assert.Equal(t, "POST", header(res, "x-method"))
+		assert.Equal(t, "payload", readAll(t, res))
+		assert.Equal(t, "Bearer token", header(res, "x-auth"))
+	}
+
+	// Test: credentials are dropped on a cross-host redirect
+	res = do("GET", "/away", "")
+	assert.Equal(t, response.StatusOK, res.StatusLine.StatusCode)
+	assert.Empty(t, header(res, "x-auth"))
+
+	// Test: max hops
+	req, _ := NewRequest("GET", srv.URL+"/loop", "")
+	_, err := c.Do(req)
+	require.ErrorIs(t, err, ErrTooManyRedirects)
+
+	// Test: policy hook
+	var seen []string
+	c.CheckRedirect = func(req *request.Request, via []*request.Request) error {
+		seen = append(seen, req.RequestLine.RequestTarget)
+		return ErrUseLastResponse
+	}
+	res = do("GET", "/302", "")
+	assert.Equal(t, response.StatusFound, res.StatusLine.StatusCode)
+	assert.Equal(t, []string{srv.URL + "/echo"}, seen)
+
+	errStop := errors.New("stop")
+	c.CheckRedirect = func(*request.Request, []*request.Request) error { return errStop }
+	req, _ = NewRequest("GET", srv.URL+"/302", "")
+	_, err = c.Do(req)
+	require.ErrorIs(t, err, errStop)
+
+	// Test: cookie jar keeps the session across the redirect and calls
+	c = &Client{Jar: NewJar()}
+	res = do("POST", "/login", "user=me")
+	assert.Equal(t, "session=s3cr3t", header(res, "x-cookie"))
+	res = do("GET", "/echo", "")
+	assert.Equal(t, "session=s3cr3t", header(res, "x-cookie"))
+}
+
+func readAll(t *testing.T, res *Response) string {
+	t.Helper()
+	b, err := io.ReadAll(res.Body)
+	require.NoError(t, err)
+	res.Body.Close()
+	return string(b)
+}
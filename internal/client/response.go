@@ -0,0 +1,286 @@
+package client
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"io"
+	"strconv"
+	"strings"
+	"sync"
+
+	"http-scratch/internal/headers"
+	"http-scratch/internal/response"
+)
+
+var (
+	ErrMalformedStatusLine    = errors.New("malformed status line")
+	ErrUnsupportedHTTPVersion = errors.New("unsupported HTTP version")
+	ErrMalformedChunk         = errors.New("malformed chunk")
+	ErrHeaderTooLarge         = errors.New("header section too large")
+	Separator                 = []byte("\r\n")
+)
+
+const maxHeaderBytes = 64 * 1024
+
+type StatusLine struct {
+	HTTPVersion  string
+	StatusCode   response.StatusCode
+	ReasonPhrase string
+}
+
+type Response struct {
+	StatusLine StatusLine
+	Headers    headers.Headers
+	// Body is never nil. Closing it before EOF tears down the connection.
+	Body io.ReadCloser
+	// ContentLength is -1 when the body is chunked or close-delimited.
+	ContentLength int64
+	// Trailers is filled in once a chunked Body has been read to EOF.
+	Trailers headers.Headers
+}
+
+func parseStatusLine(b []byte) (StatusLine, int, error) {
+	idx := bytes.Index(b, Separator)
+
+	// Return, not enough data
+	if idx == -1 {
+		return StatusLine{}, 0, nil
+	}
+
+	statusLine := b[:idx]
+	read := idx + len(Separator)
+
+	// Reason phrase may contain spaces or be empty
+	parts := bytes.SplitN(statusLine, []byte(" "), 3)
+	if len(parts) < 2 {
+		return StatusLine{}, 0, ErrMalformedStatusLine
+	}
+
+	httpParts := bytes.Split(parts[0], []byte("/"))
+	if len(httpParts) != 2 || string(httpParts[0]) != "HTTP" {
+		return StatusLine{}, 0, ErrMalformedStatusLine
+	}
+	version := string(httpParts[1])
+	if version != "1.1" && version != "1.0" {
+		return StatusLine{}, 0, ErrUnsupportedHTTPVersion
+	}
+
+	if len(parts[1]) != 3 {
+		return StatusLine{}, 0, ErrMalformedStatusLine
+	}
+	code, err := strconv.Atoi(string(parts[1]))
+	if err != nil || code < 100 {
+		return StatusLine{}, 0, ErrMalformedStatusLine
+	}
+
+	sl := StatusLine{
+		HTTPVersion: version,
+		StatusCode:  response.StatusCode(code),
+	}
+	if len(parts) == 3 {
+		sl.ReasonPhrase = string(parts[2])
+	}
+	return sl, read, nil
+}
+
+// ReadHead reads one status line and its header section, leaving br at
+// the start of the body. It is for callers that take the connection over
+// after the response head, like a WebSocket dialer.
+func ReadHead(br *bufio.Reader) (StatusLine, headers.Headers, error) {
+	line, err := readLine(br)
+	if err != nil {
+		return StatusLine{}, nil, err
+	}
+	sl, _, err := parseStatusLine(line)
+	if err != nil {
+		return StatusLine{}, nil, err
+	}
+
+	h, err := readHeaders(br)
+	if err != nil {
+		return StatusLine{}, nil, err
+	}
+	return sl, h, nil
+}
+
+// readHeaders collects lines up to and including the empty line and hands
+// the block to headers.Parse in one go.
+func readHeaders(br *bufio.Reader) (headers.Headers, error) {
+	var block []byte
+	for {
+		line, err := readLine(br)
+		if err != nil {
+			return nil, err
+		}
+		block = append(block, line...)
+		if len(block) > maxHeaderBytes {
+			return nil, ErrHeaderTooLarge
+		}
+		if len(line) == len(Separator) {
+			break
+		}
+	}
+
+	h := headers.NewHeaders()
+	_, done, err := h.Parse(block)
+	if err != nil {
+		return nil, err
+	}
+	if !done {
+		return nil, io.ErrUnexpectedEOF
+	}
+	return h, nil
+}
+
+// readLine returns a line including its CRLF. Bare LF endings are
+// normalised so that the parsers only ever see CRLF.
+func readLine(br *bufio.Reader) ([]byte, error) {
+	line, err := br.ReadSlice('\n')
+	if errors.Is(err, bufio.ErrBufferFull) {
+		return nil, ErrHeaderTooLarge
+	}
+	if err != nil {
+		if errors.Is(err, io.EOF) && len(line) > 0 {
+			return nil, io.ErrUnexpectedEOF
+		}
+		return nil, err
+	}
+	line = bytes.TrimSuffix(line[:len(line)-1], []byte("\r"))
+	return append(append([]byte{}, line...), Separator...), nil
+}
+
+func bodyAllowed(method string, status response.StatusCode) bool {
+	if method == "HEAD" {
+		return false
+	}
+	return status >= 200 && status != response.StatusNoContent && status != response.StatusNotModified
+}
+
+func isChunked(h headers.Headers) bool {
+	te, ok := h.Get("transfer-encoding")
+	if !ok {
+		return false
+	}
+	codings := strings.Split(te, ",")
+	return strings.EqualFold(strings.TrimSpace(codings[len(codings)-1]), "chunked")
+}
+
+type chunkedReader struct {
+	br       *bufio.Reader
+	res      *Response
+	left     int64
+	finished bool
+	err      error
+}
+
+func (cr *chunkedReader) Read(p []byte) (int, error) {
+	if cr.err != nil {
+		return 0, cr.err
+	}
+	if cr.finished {
+		return 0, io.EOF
+	}
+
+	if cr.left == 0 {
+		size, err := cr.readChunkSize()
+		if err != nil {
+			cr.err = err
+			return 0, err
+		}
+		if size == 0 {
+			trailers, err := readHeaders(cr.br)
+			if err != nil {
+				cr.err = err
+				return 0, err
+			}
+			cr.res.Trailers = trailers
+			cr.finished = true
+			return 0, io.EOF
+		}
+		cr.left = size
+	}
+
+	if int64(len(p)) > cr.left {
+		p = p[:cr.left]
+	}
+	n, err := cr.br.Read(p)
+	cr.left -= int64(n)
+	if err != nil {
+		if errors.Is(err, io.EOF) {
+			err = io.ErrUnexpectedEOF
+		}
+		cr.err = err
+		return n, err
+	}
+
+	if cr.left == 0 {
+		crlf, err := readLine(cr.br)
+		if err != nil || len(crlf) != len(Separator) {
+			cr.err = ErrMalformedChunk
+			return n, nil
+		}
+	}
+	return n, nil
+}
+
+func (cr *chunkedReader) readChunkSize() (int64, error) {
+	line, err := readLine(cr.br)
+	if err != nil {
+		if errors.Is(err, io.EOF) {
+			return 0, io.ErrUnexpectedEOF
+		}
+		return 0, err
+	}
+	line = line[:len(line)-len(Separator)]
+
+	// Chunk extensions are allowed and ignored
+	if idx := bytes.IndexByte(line, ';'); idx != -1 {
+		line = line[:idx]
+	}
+	size, err := strconv.ParseInt(string(bytes.TrimSpace(line)), 16, 64)
+	if err != nil || size < 0 {
+		return 0, ErrMalformedChunk
+	}
+	return size, nil
+}
+
+// body hands its connection back to the pool once it has been read to
+// EOF. Closing it early closes the connection instead.
+type body struct {
+	io.Reader
+	pc       *persistConn
+	client   *Client
+	reusable bool
+
+	mu   sync.Mutex
+	done bool
+}
+
+func (b *body) Read(p []byte) (int, error) {
+	n, err := b.Reader.Read(p)
+	if err != nil {
+		b.finish(errors.Is(err, io.EOF))
+	}
+	return n, err
+}
+
+func (b *body) Close() error {
+	b.finish(false)
+	return nil
+}
+
+func (b *body) finish(clean bool) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.done {
+		return
+	}
+	b.done = true
+
+	if clean && b.reusable {
+		b.client.putConn(b.pc)
+	} else {
+		b.pc.close()
+	}
+}
@@ -0,0 +1,261 @@
+package cookie
+
+import (
+	"errors"
+	"strconv"
+	"strings"
+	"time"
+)
+
+var (
+	ErrMalformedCookie = errors.New("malformed cookie")
+	ErrInvalidName     = errors.New("invalid cookie name")
+	ErrInvalidValue    = errors.New("invalid cookie value")
+	ErrInvalidPath     = errors.New("invalid cookie path")
+	ErrInvalidDomain   = errors.New("invalid cookie domain")
+	ErrInsecure        = errors.New("cookie attributes require Secure")
+)
+
+type SameSite int
+
+const (
+	// SameSiteDefault leaves the attribute out and the choice to the browser.
+	SameSiteDefault SameSite = iota
+	SameSiteLax
+	SameSiteStrict
+	SameSiteNone
+)
+
+func (s SameSite) String() string {
+	switch s {
+	case SameSiteLax:
+		return "Lax"
+	case SameSiteStrict:
+		return "Strict"
+	case SameSiteNone:
+		return "None"
+	}
+	return ""
+}
+
+type Cookie struct {
+	Name  string
+	Value string
+
+	Domain string
+	Path   string
+	// Expires is the zero time when the attribute is missing.
+	Expires time.Time
+	// MaxAge is zero when the attribute is missing and negative when the
+	// cookie must be dropped right away ("Max-Age=0" included).
+	MaxAge   int
+	Secure   bool
+	HttpOnly bool
+	SameSite SameSite
+	// Partitioned opts into partitioned storage (CHIPS); it needs Secure.
+	Partitioned bool
+}
+
+const httpDate = "Mon, 02 Jan 2006 15:04:05 GMT"
+
+// Date formats seen in the wild for Expires, preferred one first.
+var dateFormats = []string{
+	time.RFC1123,
+	"Mon, 02-Jan-2006 15:04:05 MST",
+	time.RFC850,
+	time.ANSIC,
+}
+
+// ParseSetCookie parses one Set-Cookie field value following the
+// user-agent algorithm of RFC 6265 section 5.2: the name-value pair is
+// mandatory, unknown or malformed attributes are ignored.
+func ParseSetCookie(value string) (*Cookie, error) {
+	parts := strings.Split(value, ";")
+
+	name, val, ok := strings.Cut(parts[0], "=")
+	name = strings.TrimSpace(name)
+	if !ok || name == "" || !isToken(name) {
+		return nil, ErrMalformedCookie
+	}
+
+	c := &Cookie{Name: name, Value: trimValue(val)}
+	for _, attr := range parts[1:] {
+		key, val, _ := strings.Cut(attr, "=")
+		key = strings.TrimSpace(key)
+		val = strings.TrimSpace(val)
+
+		switch strings.ToLower(key) {
+		case "expires":
+			if t, ok := parseDate(val); ok {
+				c.Expires = t
+			}
+		case "max-age":
+			n, err := strconv.Atoi(val)
+			if err != nil || (val[0] != '-' && (val[0] < '0' || val[0] > '9')) {
+				continue
+			}
+			if n <= 0 {
+				n = -1
+			}
+			c.MaxAge = n
+		case "domain":
+			c.Domain = strings.ToLower(strings.TrimPrefix(val, "."))
+		case "path":
+			if strings.HasPrefix(val, "/") {
+				c.Path = val
+			}
+		case "secure":
+			c.Secure = true
+		case "httponly":
+			c.HttpOnly = true
+		case "samesite":
+			switch strings.ToLower(val) {
+			case "lax":
+				c.SameSite = SameSiteLax
+			case "strict":
+				c.SameSite = SameSiteStrict
+			case "none":
+				c.SameSite = SameSiteNone
+			}
+		case "partitioned":
+			c.Partitioned = true
+		}
+	}
+	return c, nil
+}
+
+// ParseCookies parses the value of a request's Cookie field. Pairs that
+// don't parse are skipped rather than failing the whole field.
+func ParseCookies(value string) []*Cookie {
+	var cookies []*Cookie
+	for _, pair := range strings.Split(value, ";") {
+		name, val, ok := strings.Cut(pair, "=")
+		name = strings.TrimSpace(name)
+		if !ok || name == "" || !isToken(name) {
+			continue
+		}
+		cookies = append(cookies, &Cookie{Name: name, Value: trimValue(val)})
+	}
+	return cookies
+}
+
+// Valid reports whether c can be sent in a Set-Cookie field as is.
+func (c *Cookie) Valid() error {
+	if c.Name == "" || !isToken(c.Name) {
+		return ErrInvalidName
+	}
+	for _, b := range []byte(c.Value) {
+		if !isCookieValueByte(b) {
+			return ErrInvalidValue
+		}
+	}
+	// Both go into the field as is, where a ";" would start another
+	// attribute and a CTL another field
+	for _, b := range []byte(c.Path) {
+		if b < 0x20 || b == 0x7f || b == ';' {
+			return ErrInvalidPath
+		}
+	}
+	if c.Domain != "" && !isDomainName(c.Domain) {
+		return ErrInvalidDomain
+	}
+	if (c.Partitioned || c.SameSite == SameSiteNone) && !c.Secure {
+		return ErrInsecure
+	}
+	return nil
+}
+
+// String serializes c as a Set-Cookie field value. Call Valid first, String
+// does not check anything.
+func (c *Cookie) String() string {
+	var b strings.Builder
+	b.WriteString(c.Name)
+	b.WriteByte('=')
+	if strings.ContainsAny(c.Value, " ,") {
+		b.WriteString(`"` + c.Value + `"`)
+	} else {
+		b.WriteString(c.Value)
+	}
+
+	if c.Path != "" {
+		b.WriteString("; Path=" + c.Path)
+	}
+	if c.Domain != "" {
+		b.WriteString("; Domain=" + c.Domain)
+	}
+	if !c.Expires.IsZero() {
+		b.WriteString("; Expires=" + c.Expires.UTC().Format(httpDate))
+	}
+	if c.MaxAge > 0 {
+		b.WriteString("; Max-Age=" + strconv.Itoa(c.MaxAge))
+	} else if c.MaxAge < 0 {
+		b.WriteString("; Max-Age=0")
+	}
+	if c.Secure {
+		b.WriteString("; Secure")
+	}
+	if c.HttpOnly {
+		b.WriteString("; HttpOnly")
+	}
+	if c.SameSite != SameSiteDefault {
+		b.WriteString("; SameSite=" + c.SameSite.String())
+	}
+	if c.Partitioned {
+		b.WriteString("; Partitioned")
+	}
+	return b.String()
+}
+
+func parseDate(s string) (time.Time, bool) {
+	for _, layout := range dateFormats {
+		if t, err := time.Parse(layout, s); err == nil {
+			return t.UTC(), true
+		}
+	}
+	return time.Time{}, false
+}
+
+// trimValue drops surrounding whitespace and one pair of double quotes.
+func trimValue(v string) string {
+	v = strings.TrimSpace(v)
+	if len(v) >= 2 && v[0] == '"' && v[len(v)-1] == '"' {
+		v = v[1 : len(v)-1]
+	}
+	return v
+}
+
+// cookie-octet from RFC 6265 section 4.1.1, plus space and comma which
+// String copes with by quoting.
+func isCookieValueByte(b byte) bool {
+	return b >= 0x20 && b < 0x7f && b != '"' && b != ';' && b != '\\'
+}
+
+// isDomainName checks the preferred name syntax of RFC 1034 section 3.5,
+// which Domain takes (RFC 6265 section 4.1.1). A leading dot is tolerated
+// the way browsers tolerate it.
+func isDomainName(s string) bool {
+	s = strings.TrimPrefix(s, ".")
+	if s == "" || len(s) > 253 {
+		return false
+	}
+	for _, label := range strings.Split(s, ".") {
+		if label == "" || len(label) > 63 || label[0] == '-' || label[len(label)-1] == '-' {
+			return false
+		}
+		for _, b := range []byte(label) {
+			if !(b >= 'a' && b <= 'z' || b >= 'A' && b <= 'Z' || b >= '0' && b <= '9' || b == '-') {
+				return false
+			}
+		}
+	}
+	return true
+}
+
+func isToken(s string) bool {
+	for _, c := range []byte(s) {
+		if c <= ' ' || c >= 0x7f || strings.IndexByte(`()<>@,;:\"/[]?={}`, c) != -1 {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,112 @@
+package cookie
+
+import (
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestParseSetCookie(t *testing.T) {
+	// Test: Name and value only
+	c, err := ParseSetCookie("session=abc123")
+	require.NoError(t, err)
+	assert.Equal(t, "session", c.Name)
+	assert.Equal(t, "abc123", c.Value)
+
+	// Test: All attributes
+	c, err = ParseSetCookie(`id="a3fWa"; Expires=Wed, 21 Oct 2015 07:28:00 GMT; Max-Age=3600; Domain=.Example.com; Path=/docs; Secure; HttpOnly`)
+	require.NoError(t, err)
+	assert.Equal(t, "a3fWa", c.Value)
+	assert.Equal(t, time.Date(2015, 10, 21, 7, 28, 0, 0, time.UTC), c.Expires)
+	assert.Equal(t, 3600, c.MaxAge)
+	assert.Equal(t, "example.com", c.Domain)
+	assert.Equal(t, "/docs", c.Path)
+	assert.True(t, c.Secure)
+	assert.True(t, c.HttpOnly)
+
+	// Test: Legacy date format and deletion
+	c, err = ParseSetCookie("gone=; expires=Thu, 01-Jan-1970 00:00:00 GMT; max-age=0")
+	require.NoError(t, err)
+	assert.Equal(t, "", c.Value)
+	assert.Equal(t, 1970, c.Expires.Year())
+	assert.Equal(t, -1, c.MaxAge)
+
+	// Test: Malformed attributes are ignored
+	c, err = ParseSetCookie("a=b; Max-Age=soon; Path=relative; Expires=tomorrow")
+	require.NoError(t, err)
+	assert.Equal(t, 0, c.MaxAge)
+	assert.Equal(t, "", c.Path)
+	assert.True(t, c.Expires.IsZero())
+
+	// Test: Missing name
+	_, err = ParseSetCookie("=value")
+	require.ErrorIs(t, err, ErrMalformedCookie)
+	_, err = ParseSetCookie("novalue")
+	require.ErrorIs(t, err, ErrMalformedCookie)
+}
+
+func TestParseCookies(t *testing.T) {
+	// Test: Several pairs, quoted value, junk in between
+	cookies := ParseCookies(`a=1; b="two"; ; junk; c=`)
+	require.Len(t, cookies, 3)
+	assert.Equal(t, "a", cookies[0].Name)
+	assert.Equal(t, "1", cookies[0].Value)
+	assert.Equal(t, "two", cookies[1].Value)
+	assert.Equal(t, "c", cookies[2].Name)
+	assert.Equal(t, "", cookies[2].Value)
+
+	// Test: Empty field
+	assert.Empty(t, ParseCookies(""))
+}
+
+func TestCookieString(t *testing.T) {
+	// Test: Every attribute
+	c := &Cookie{
+		Name:        "id",
+		Value:       "a3fWa",
+		Path:        "/",
+		Domain:      "example.com",
+		Expires:     time.Date(2015, 10, 21, 7, 28, 0, 0, time.UTC),
+		MaxAge:      3600,
+		Secure:      true,
+		HttpOnly:    true,
+		SameSite:    SameSiteNone,
+		Partitioned: true,
+	}
+	require.NoError(t, c.Valid())
+	assert.Equal(t, "id=a3fWa; Path=/; Domain=example.com; Expires=Wed, 21 Oct 2015 07:28:00 GMT; Max-Age=3600; Secure; HttpOnly; SameSite=None; Partitioned", c.String())
+
+	// Test: Round trip through the parser
+	parsed, err := ParseSetCookie(c.String())
+	require.NoError(t, err)
+	assert.Equal(t, c, parsed)
+
+	// Test: Deletion and quoting
+	c = &Cookie{Name: "gone", Value: "a b", MaxAge: -1, SameSite: SameSiteLax}
+	assert.Equal(t, `gone="a b"; Max-Age=0; SameSite=Lax`, c.String())
+
+	// Test: Invalid cookies
+	assert.ErrorIs(t, (&Cookie{Name: "bad name", Value: "x"}).Valid(), ErrInvalidName)
+	assert.ErrorIs(t, (&Cookie{Name: "x", Value: "semi;colon"}).Valid(), ErrInvalidValue)
+	assert.ErrorIs(t, (&Cookie{Name: "x", Partitioned: true}).Valid(), ErrInsecure)
+	assert.ErrorIs(t, (&Cookie{Name: "x", SameSite: SameSiteNone}).Valid(), ErrInsecure)
+
+	// Test: Path and Domain can't smuggle attributes or fields
+	assert.ErrorIs(t, (&Cookie{Name: "x", Path: "/; Domain=evil.test"}).Valid(), ErrInvalidPath)
+	assert.ErrorIs(t, (&Cookie{Name: "x", Path: "/\nSet-Cookie: admin=1"}).Valid(), ErrInvalidPath)
+	assert.ErrorIs(t, (&Cookie{Name: "x", Path: "/\r\n\r\n<html>"}).Valid(), ErrInvalidPath)
+	assert.ErrorIs(t, (&Cookie{Name: "x", Domain: "example.com; Secure"}).Valid(), ErrInvalidDomain)
+	assert.ErrorIs(t, (&Cookie{Name: "x", Domain: "example.com\r\nX-Evil: 1"}).Valid(), ErrInvalidDomain)
+
+	// Test: Domain name syntax
+	for _, domain := range []string{"example.com", ".example.com", "a-b.c0.example", "localhost"} {
+		assert.NoError(t, (&Cookie{Name: "x", Domain: domain}).Valid(), domain)
+	}
+	for _, domain := range []string{".", "example..com", "-a.com", "a-.com", "exa mple.com", "ex_ample.com", strings.Repeat("a", 64) + ".com"} {
+		assert.ErrorIs(t, (&Cookie{Name: "x", Domain: domain}).Valid(), ErrInvalidDomain, domain)
+	}
+	assert.NoError(t, (&Cookie{Name: "x", Path: "/a b/c"}).Valid())
+}
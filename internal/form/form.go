@@ -0,0 +1,212 @@
+package form
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"net/url"
+	"os"
+	"strings"
+
+	"http-scratch/internal/headers"
+	"http-scratch/internal/request"
+)
+
+var (
+	ErrNotForm         = errors.New("content type is not a form")
+	ErrMalformedForm   = errors.New("malformed form")
+	ErrMissingBoundary = errors.New("multipart boundary missing or invalid")
+	ErrMalformedPart   = errors.New("malformed multipart part")
+	ErrPartTooLarge    = errors.New("multipart part too large")
+	ErrFormTooLarge    = errors.New("form too large")
+	ErrTooManyParts    = errors.New("too many multipart parts")
+)
+
+// Limits bound what a form may cost to parse. Zero fields take the
+// defaults below.
+type Limits struct {
+	// MaxMemory is how many bytes of uploaded files a Form keeps in
+	// memory, summed over the whole form; files past it are written to
+	// temporary files instead. It bounds what the Form holds on to, not
+	// the request: Parse and MultipartReader work on req.Body, which is
+	// read whole first.
+	MaxMemory int64
+	// MaxPartSize bounds the body of a single part, file or not.
+	MaxPartSize int64
+	// MaxTotalSize bounds the whole form: every part's body, or the raw
+	// url-encoded body.
+	MaxTotalSize int64
+	MaxParts     int
+}
+
+const (
+	defaultMaxMemory    = 1 << 20
+	defaultMaxPartSize  = 10 << 20
+	defaultMaxTotalSize = 32 << 20
+	defaultMaxParts     = 1000
+)
+
+func (l Limits) withDefaults() Limits {
+	if l.MaxMemory <= 0 {
+		l.MaxMemory = defaultMaxMemory
+	}
+	if l.MaxPartSize <= 0 {
+		l.MaxPartSize = defaultMaxPartSize
+	}
+	if l.MaxTotalSize <= 0 {
+		l.MaxTotalSize = defaultMaxTotalSize
+	}
+	if l.MaxParts <= 0 {
+		l.MaxParts = defaultMaxParts
+	}
+	return l
+}
+
+// Values maps a field name to every value it was sent with, in order.
+type Values map[string][]string
+
+// Get returns the first value of key, "" if there is none.
+func (v Values) Get(key string) string {
+	if vs := v[key]; len(vs) > 0 {
+		return vs[0]
+	}
+	return ""
+}
+
+func (v Values) Add(key, value string) {
+	v[key] = append(v[key], value)
+}
+
+func (v Values) Set(key, value string) {
+	v[key] = []string{value}
+}
+
+// ParseURLEncoded parses an application/x-www-form-urlencoded body. Pairs
+// are separated by '&' only, '+' stands for a space and a key without '='
+// gets an empty value.
+func ParseURLEncoded(body string) (Values, error) {
+	values := Values{}
+	for _, pair := range strings.Split(body, "&") {
+		if pair == "" {
+			continue
+		}
+		key, value, _ := strings.Cut(pair, "=")
+		key, err := url.QueryUnescape(key)
+		if err != nil {
+			return nil, ErrMalformedForm
+		}
+		value, err = url.QueryUnescape(value)
+		if err != nil {
+			return nil, ErrMalformedForm
+		}
+		values.Add(key, value)
+	}
+	return values, nil
+}
+
+// Form is a parsed form body. Uploaded files are only found in multipart
+// forms; every other field ends up in Values.
+type Form struct {
+	Values Values
+	Files  map[string][]*FileHeader
+}
+
+// RemoveAll deletes the temporary files behind the form's uploads. Call it
+// once the handler is done with them.
+func (f *Form) RemoveAll() error {
+	var errs []error
+	for _, fhs := range f.Files {
+		for _, fh := range fhs {
+			if fh.tmpfile == "" {
+				continue
+			}
+			if err := os.Remove(fh.tmpfile); err != nil && !errors.Is(err, os.ErrNotExist) {
+				errs = append(errs, err)
+			}
+		}
+	}
+	return errors.Join(errs...)
+}
+
+// FileHeader describes an uploaded file, held either in memory or in a
+// temporary file.
+type FileHeader struct {
+	Filename string
+	Headers  headers.Headers
+	Size     int64
+
+	content []byte
+	tmpfile string
+}
+
+func (fh *FileHeader) Open() (io.ReadCloser, error) {
+	if fh.tmpfile != "" {
+		return os.Open(fh.tmpfile)
+	}
+	return io.NopCloser(bytes.NewReader(fh.content)), nil
+}
+
+// Parse parses req's body as either kind of form, according to its
+// Content-Type. Anything else gives ErrNotForm.
+func Parse(req *request.Request, limits Limits) (*Form, error) {
+	limits = limits.withDefaults()
+	mediaType, params, err := contentType(req)
+	if err != nil {
+		return nil, err
+	}
+
+	if mediaType != "application/x-www-form-urlencoded" && mediaType != "multipart/form-data" {
+		return nil, ErrNotForm
+	}
+	// A body the client holds back is turned down before it is sent
+	if req.BodyHeld() && int64(req.ContentLength()) > limits.MaxTotalSize {
+		return nil, ErrFormTooLarge
+	}
+	if err := req.LoadBody(); err != nil {
+		return nil, err
+	}
+
+	switch mediaType {
+	case "application/x-www-form-urlencoded":
+		if int64(len(req.Body)) > limits.MaxTotalSize {
+			return nil, ErrFormTooLarge
+		}
+		values, err := ParseURLEncoded(req.Body)
+		if err != nil {
+			return nil, err
+		}
+		return &Form{Values: values, Files: map[string][]*FileHeader{}}, nil
+	case "multipart/form-data":
+		r, err := NewReader(strings.NewReader(req.Body), params["boundary"], limits)
+		if err != nil {
+			return nil, err
+		}
+		return r.ReadForm()
+	}
+	return nil, ErrNotForm
+}
+
+// MultipartReader gives part by part access to a multipart/form-data
+// request, for handlers that would rather not copy every file into a
+// Form. The body itself is read whole into req.Body first.
+func MultipartReader(req *request.Request, limits Limits) (*Reader, error) {
+	mediaType, params, err := contentType(req)
+	if err != nil {
+		return nil, err
+	}
+	if mediaType != "multipart/form-data" {
+		return nil, ErrNotForm
+	}
+	if err := req.LoadBody(); err != nil {
+		return nil, err
+	}
+	return NewReader(strings.NewReader(req.Body), params["boundary"], limits)
+}
+
+func contentType(req *request.Request) (string, map[string]string, error) {
+	mediaType, params, err := req.Headers.MediaType("content-type")
+	if err != nil {
+		return "", nil, ErrNotForm
+	}
+	return mediaType, params, nil
+}
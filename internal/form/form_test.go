@@ -0,0 +1,148 @@
+package form
+
+import (
+	"io"
+	"os"
+	"strconv"
+	"strings"
+	"testing"
+	"testing/iotest"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"http-scratch/internal/request"
+)
+
+func formRequest(t *testing.T, contentType, body string) *request.Request {
+	t.Helper()
+	raw := "POST /upload HTTP/1.1\r\nHost: localhost\r\nContent-Type: " + contentType +
+		"\r\nContent-Length: " + strconv.Itoa(len(body)) + "\r\n\r\n" + body
+	req, err := request.RequestFromReader(strings.NewReader(raw))
+	require.NoError(t, err)
+	return req
+}
+
+const multipartBody = "preamble to ignore\r\n" +
+	"--XyZ\r\n" +
+	"Content-Disposition: form-data; name=\"title\"\r\n" +
+	"\r\n" +
+	"Hello, world\r\n" +
+	"--XyZ\r\n" +
+	"Content-Disposition: form-data; name=\"tag\"\r\n" +
+	"\r\n" +
+	"a\r\n" +
+	"--XyZ\r\n" +
+	"Content-Disposition: form-data; name=\"tag\"\r\n" +
+	"\r\n" +
+	"b\r\n" +
+	"--XyZ\r\n" +
+	"Content-Disposition: form-data; name=\"file\"; filename=\"../../etc/notes.txt\"\r\n" +
+	"Content-Type: text/plain\r\n" +
+	"\r\n" +
+	"line one\r\n--XyNot a boundary\r\n" +
+	"--XyZ--\r\n" +
+	"epilogue"
+
+func TestParseURLEncoded(t *testing.T) {
+	// Test: Multi-valued fields, escapes and '+'
+	values, err := ParseURLEncoded("name=J%C3%BCrgen+Smith&tag=a&tag=b&empty=&flag")
+	require.NoError(t, err)
+	assert.Equal(t, "Jürgen Smith", values.Get("name"))
+	assert.Equal(t, []string{"a", "b"}, values["tag"])
+	assert.Equal(t, []string{""}, values["empty"])
+	assert.Equal(t, []string{""}, values["flag"])
+	assert.Equal(t, "", values.Get("missing"))
+
+	// Test: Bad escape
+	_, err = ParseURLEncoded("a=%zz")
+	require.ErrorIs(t, err, ErrMalformedForm)
+
+	// Test: Through the request
+	f, err := Parse(formRequest(t, "application/x-www-form-urlencoded", "q=go&page=2"), Limits{})
+	require.NoError(t, err)
+	assert.Equal(t, "2", f.Values.Get("page"))
+
+	_, err = Parse(formRequest(t, "application/x-www-form-urlencoded", "q=go&page=2"), Limits{MaxTotalSize: 5})
+	require.ErrorIs(t, err, ErrFormTooLarge)
+
+	_, err = Parse(formRequest(t, "application/json", "{}"), Limits{})
+	require.ErrorIs(t, err, ErrNotForm)
+}
+
+func TestMultipartForm(t *testing.T) {
+	// Test: Fields and files
+	f, err := Parse(formRequest(t, `multipart/form-data; boundary="XyZ"`, multipartBody), Limits{})
+	require.NoError(t, err)
+	defer f.RemoveAll()
+	assert.Equal(t, "Hello, world", f.Values.Get("title"))
+	assert.Equal(t, []string{"a", "b"}, f.Values["tag"])
+
+	require.Len(t, f.Files["file"], 1)
+	fh := f.Files["file"][0]
+	assert.Equal(t, "notes.txt", fh.Filename)
+	ct, _ := fh.Headers.Get("content-type")
+	assert.Equal(t, "text/plain", ct)
+	assert.Equal(t, int64(len("line one\r\n--XyNot a boundary")), fh.Size)
+	assert.Empty(t, fh.tmpfile)
+
+	rc, err := fh.Open()
+	require.NoError(t, err)
+	b, _ := io.ReadAll(rc)
+	assert.Equal(t, "line one\r\n--XyNot a boundary", string(b))
+
+	// Test: Files past MaxMemory are spilled to disk and removed afterwards
+	f, err = Parse(formRequest(t, "multipart/form-data; boundary=XyZ", multipartBody), Limits{MaxMemory: 4})
+	require.NoError(t, err)
+	fh = f.Files["file"][0]
+	require.NotEmpty(t, fh.tmpfile)
+	rc, err = fh.Open()
+	require.NoError(t, err)
+	b, _ = io.ReadAll(rc)
+	rc.Close()
+	assert.Equal(t, "line one\r\n--XyNot a boundary", string(b))
+	require.NoError(t, f.RemoveAll())
+	_, err = os.Stat(fh.tmpfile)
+	assert.ErrorIs(t, err, os.ErrNotExist)
+
+	// Test: Limits
+	_, err = Parse(formRequest(t, "multipart/form-data; boundary=XyZ", multipartBody), Limits{MaxPartSize: 20})
+	require.ErrorIs(t, err, ErrPartTooLarge)
+	_, err = Parse(formRequest(t, "multipart/form-data; boundary=XyZ", multipartBody), Limits{MaxTotalSize: 16})
+	require.ErrorIs(t, err, ErrFormTooLarge)
+	_, err = Parse(formRequest(t, "multipart/form-data; boundary=XyZ", multipartBody), Limits{MaxParts: 3})
+	require.ErrorIs(t, err, ErrTooManyParts)
+
+	// Test: Missing boundary and missing closing delimiter
+	_, err = Parse(formRequest(t, "multipart/form-data", multipartBody), Limits{})
+	require.ErrorIs(t, err, ErrMissingBoundary)
+	truncated := multipartBody[:strings.Index(multipartBody, "--XyZ--")]
+	_, err = Parse(formRequest(t, "multipart/form-data; boundary=XyZ", truncated), Limits{})
+	require.ErrorIs(t, err, ErrMalformedPart)
+}
+
+func TestMultipartReader(t *testing.T) {
+	// Test: Streaming parts one byte at a time
+	r, err := NewReader(iotest.OneByteReader(strings.NewReader(multipartBody)), "XyZ", Limits{})
+	require.NoError(t, err)
+
+	var names []string
+	for {
+		p, err := r.NextPart()
+		if err == io.EOF {
+			break
+		}
+		require.NoError(t, err)
+		names = append(names, p.Name)
+		if p.Name == "title" {
+			b, err := io.ReadAll(iotest.HalfReader(p))
+			require.NoError(t, err)
+			assert.Equal(t, "Hello, world", string(b))
+		}
+	}
+	assert.Equal(t, []string{"title", "tag", "tag", "file"}, names)
+
+	// Test: Reading past the end
+	_, err = r.NextPart()
+	assert.ErrorIs(t, err, io.EOF)
+}
@@ -0,0 +1,286 @@
+package form
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"io"
+	"mime"
+	"os"
+	"path/filepath"
+
+	"http-scratch/internal/headers"
+)
+
+const (
+	bufferSize = 32 << 10
+	// maxPartHeaderSize bounds the header block of a single part.
+	maxPartHeaderSize = 16 << 10
+)
+
+// Reader reads the parts of a multipart/form-data body (RFC 7578) one at a
+// time, buffering no more than one read buffer of r itself.
+type Reader struct {
+	br     *bufio.Reader
+	limits Limits
+	// delim ends a part's body; dashBoundary starts a part.
+	delim        []byte
+	dashBoundary []byte
+
+	current *Part
+	parts   int
+	total   int64
+	started bool
+	done    bool
+}
+
+// NewReader reads parts separated by boundary from r. Zero Limits fields
+// take their defaults.
+func NewReader(r io.Reader, boundary string, limits Limits) (*Reader, error) {
+	if !validBoundary(boundary) {
+		return nil, ErrMissingBoundary
+	}
+	return &Reader{
+		br:           bufio.NewReaderSize(r, bufferSize),
+		limits:       limits.withDefaults(),
+		delim:        []byte("\r\n--" + boundary),
+		dashBoundary: []byte("--" + boundary),
+	}, nil
+}
+
+// Part is one part of a multipart body. Reading it yields the part's body;
+// it is only valid until the next call to NextPart.
+type Part struct {
+	Headers headers.Headers
+	// Name and FileName come from the Content-Disposition field; FileName
+	// is stripped of any directory and empty for plain fields.
+	Name     string
+	FileName string
+
+	r   *Reader
+	n   int64
+	eof bool
+	err error
+}
+
+// NextPart skips whatever is left of the current part and returns the
+// next one, or io.EOF after the closing boundary.
+func (r *Reader) NextPart() (*Part, error) {
+	if r.done {
+		return nil, io.EOF
+	}
+	if r.current != nil {
+		if _, err := io.Copy(io.Discard, r.current); err != nil {
+			return nil, err
+		}
+		r.current = nil
+		// The CRLF in front of the boundary belongs to the delimiter
+		if _, err := r.br.Discard(2); err != nil {
+			return nil, ErrMalformedPart
+		}
+	}
+
+	closing := append(append([]byte{}, r.dashBoundary...), "--"...)
+	for {
+		line, err := r.br.ReadSlice('\n')
+		if errors.Is(err, bufio.ErrBufferFull) && !r.started {
+			// An overlong preamble line, which can't be a boundary
+			continue
+		}
+		if err != nil && !errors.Is(err, io.EOF) {
+			return nil, err
+		}
+
+		trimmed := bytes.TrimRight(line, " \t\r\n")
+		if bytes.Equal(trimmed, r.dashBoundary) {
+			r.started = true
+			break
+		}
+		if bytes.Equal(trimmed, closing) {
+			r.done = true
+			return nil, io.EOF
+		}
+		// Anything before the first boundary is preamble and ignored
+		if r.started || err != nil {
+			return nil, ErrMalformedPart
+		}
+	}
+
+	r.parts++
+	if r.parts > r.limits.MaxParts {
+		return nil, ErrTooManyParts
+	}
+
+	h, err := r.readHeaders()
+	if err != nil {
+		return nil, err
+	}
+	p := &Part{Headers: h, r: r}
+	if value, ok := h.Get("content-disposition"); ok {
+		disposition, params, err := mime.ParseMediaType(value)
+		if err != nil || disposition != "form-data" {
+			return nil, ErrMalformedPart
+		}
+		p.Name = params["name"]
+		if name := params["filename"]; name != "" {
+			p.FileName = filepath.Base(filepath.ToSlash(name))
+		}
+	}
+	r.current = p
+	return p, nil
+}
+
+func (r *Reader) readHeaders() (headers.Headers, error) {
+	var block []byte
+	for {
+		line, err := r.br.ReadSlice('\n')
+		if err != nil {
+			return nil, ErrMalformedPart
+		}
+		if len(block)+len(line) > maxPartHeaderSize {
+			return nil, ErrMalformedPart
+		}
+		line = bytes.TrimRight(line, "\r\n")
+		block = append(block, line...)
+		block = append(block, headers.Separator...)
+		if len(line) == 0 {
+			break
+		}
+	}
+
+	h := headers.NewHeaders()
+	if _, _, err := h.Parse(block); err != nil {
+		return nil, ErrMalformedPart
+	}
+	return h, nil
+}
+
+// Read reads the part's body up to the next delimiter. Bytes that could
+// still turn out to be the start of the delimiter are held back until
+// enough of the body has been buffered to tell.
+func (p *Part) Read(b []byte) (int, error) {
+	if p.err != nil {
+		return 0, p.err
+	}
+	if p.eof {
+		return 0, io.EOF
+	}
+
+	br := p.r.br
+	peek, err := br.Peek(br.Size())
+	if err != nil && !errors.Is(err, io.EOF) {
+		return 0, err
+	}
+
+	var n int
+	if idx := bytes.Index(peek, p.r.delim); idx >= 0 {
+		n = copy(b, peek[:idx])
+		if n == idx {
+			p.eof = true
+		}
+	} else {
+		if err != nil {
+			p.err = ErrMalformedPart
+			return 0, p.err
+		}
+		n = copy(b, peek[:len(peek)-len(p.r.delim)+1])
+	}
+	br.Discard(n)
+
+	p.n += int64(n)
+	p.r.total += int64(n)
+	if p.n > p.r.limits.MaxPartSize {
+		p.err = ErrPartTooLarge
+	} else if p.r.total > p.r.limits.MaxTotalSize {
+		p.err = ErrFormTooLarge
+	}
+	if p.err != nil {
+		return n, p.err
+	}
+	if p.eof && n == 0 {
+		return 0, io.EOF
+	}
+	return n, nil
+}
+
+// ReadForm reads every remaining part. Plain fields go to Values; files
+// are kept in memory until MaxMemory bytes of them have been read, and
+// written to temporary files from then on. On error no temporary file is
+// left behind.
+func (r *Reader) ReadForm() (*Form, error) {
+	f := &Form{Values: Values{}, Files: map[string][]*FileHeader{}}
+	if err := r.readForm(f); err != nil {
+		f.RemoveAll()
+		return nil, err
+	}
+	return f, nil
+}
+
+func (r *Reader) readForm(f *Form) error {
+	memory := r.limits.MaxMemory
+	for {
+		p, err := r.NextPart()
+		if errors.Is(err, io.EOF) {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		if p.Name == "" {
+			continue
+		}
+
+		if p.FileName == "" {
+			b, err := io.ReadAll(p)
+			if err != nil {
+				return err
+			}
+			f.Values.Add(p.Name, string(b))
+			continue
+		}
+
+		fh := &FileHeader{Filename: p.FileName, Headers: p.Headers}
+		f.Files[p.Name] = append(f.Files[p.Name], fh)
+
+		var buf bytes.Buffer
+		n, err := io.CopyN(&buf, p, memory+1)
+		if err != nil && !errors.Is(err, io.EOF) {
+			return err
+		}
+		if n <= memory {
+			fh.content = buf.Bytes()
+			fh.Size = n
+			memory -= n
+			continue
+		}
+
+		tmp, err := os.CreateTemp("", "form-upload-*")
+		if err != nil {
+			return err
+		}
+		fh.tmpfile = tmp.Name()
+		fh.Size, err = io.Copy(tmp, io.MultiReader(&buf, p))
+		if closeErr := tmp.Close(); err == nil {
+			err = closeErr
+		}
+		if err != nil {
+			return err
+		}
+	}
+}
+
+// validBoundary follows the bchars rule of RFC 2046 section 5.1.1.
+func validBoundary(boundary string) bool {
+	if len(boundary) == 0 || len(boundary) > 70 || boundary[len(boundary)-1] == ' ' {
+		return false
+	}
+	for _, c := range []byte(boundary) {
+		switch {
+		case c >= 'a' && c <= 'z', c >= 'A' && c <= 'Z', c >= '0' && c <= '9':
+		case bytes.IndexByte([]byte("'()+_,-./:=? "), c) != -1:
+		default:
+			return false
+		}
+	}
+	return true
+}
@@ -14,6 +14,17 @@ var (
 	Separator              = []byte("\r\n")
 )
 
+// Set-Cookie values can't be folded into one comma-separated line (RFC
+// 9110 section 5.3), so repeated Set-Cookie fields are kept apart with a
+// byte that can never appear in a field value. Repeated Cookie fields are
+// joined the way RFC 6265 wants a single one to look.
+const (
+	setCookie         = "set-cookie"
+	setCookieSplitter = "\n"
+	cookie            = "cookie"
+	cookieSplitter    = "; "
+)
+
 type Headers map[string]string
 
 func (h Headers) Get(name string) (string, bool) {
@@ -21,10 +32,30 @@ func (h Headers) Get(name string) (string, bool) {
 	return str, ok
 }
 
+// Values returns every value of a field. Only Set-Cookie can have more
+// than one; other repeated fields were already combined by Set.
+func (h Headers) Values(name string) []string {
+	name = strings.ToLower(name)
+	v, ok := h[name]
+	if !ok {
+		return nil
+	}
+	if name == setCookie {
+		return strings.Split(v, setCookieSplitter)
+	}
+	return []string{v}
+}
+
 func (h Headers) Set(name, value string) {
 	name = strings.ToLower(name)
 	if v, ok := h[name]; ok {
-		h[name] = fmt.Sprintf("%s,%s", v, value)
+		if name == setCookie {
+			h[name] = v + setCookieSplitter + value
+		} else if name == cookie {
+			h[name] = v + cookieSplitter + value
+		} else {
+			h[name] = fmt.Sprintf("%s,%s", v, value)
+		}
 	} else {
 		h[name] = value
 	}
@@ -40,9 +71,13 @@ func (h Headers) Delete(name string) {
 	delete(h, name)
 }
 
+// ForEach calls fn once per field line, so each Set-Cookie value gets a
+// call of its own.
 func (h Headers) ForEach(fn func(n, v string)) {
-	for n, v := range h {
-		fn(n, v)
+	for n := range h {
+		for _, v := range h.Values(n) {
+			fn(n, v)
+		}
 	}
 }
 
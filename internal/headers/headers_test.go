@@ -2,6 +2,7 @@ package headers
 
 import (
 	"testing"
+	"time"
 
 	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/require"
@@ -72,4 +73,64 @@ func TestHeaders(t *testing.T) {
 	assert.Equal(t, "localhost:42069,localhost:676767", host)
 	assert.Equal(t, 49, n)
 	assert.True(t, done)
+
+	// Test: Set-Cookie is never folded
+	headers = NewHeaders()
+	data = []byte("Set-Cookie: a=1; Expires=Wed, 21 Oct 2015 07:28:00 GMT\r\nSet-Cookie: b=2\r\n\r\n")
+	_, done, err = headers.Parse(data)
+	require.NoError(t, err)
+	assert.True(t, done)
+	assert.Equal(t, []string{"a=1; Expires=Wed, 21 Oct 2015 07:28:00 GMT", "b=2"}, headers.Values("set-cookie"))
+
+	var lines []string
+	headers.ForEach(func(n, v string) {
+		lines = append(lines, n+": "+v)
+	})
+	assert.Equal(t, []string{"set-cookie: a=1; Expires=Wed, 21 Oct 2015 07:28:00 GMT", "set-cookie: b=2"}, lines)
+}
+
+func TestTypedAccessors(t *testing.T) {
+	h := NewHeaders()
+	h.Set("Content-Length", "42")
+	h.Set("Max-Forwards", "-1")
+	h.Set("Date", "Sun, 06 Nov 1994 08:49:37 GMT")
+	h.Set("If-Modified-Since", "Sunday, 06-Nov-94 08:49:37 GMT")
+	h.Set("Last-Modified", "Sun Nov  6 08:49:37 1994")
+	h.Set("If-None-Match", `"xyzzy", W/"r2,d2", , "c3po"`)
+	h.Set("Content-Type", `Text/HTML; Charset="utf-8" ; note="a \"quoted\"; value"`)
+
+	// Test: Integers
+	n, err := h.Int("content-length")
+	require.NoError(t, err)
+	assert.Equal(t, int64(42), n)
+	_, err = h.Int("max-forwards")
+	require.ErrorIs(t, err, ErrInvalidValue)
+	_, err = h.Int("age")
+	require.ErrorIs(t, err, ErrMissingField)
+
+	// Test: All three HTTP-date formats
+	want := time.Date(1994, 11, 6, 8, 49, 37, 0, time.UTC)
+	for _, name := range []string{"date", "if-modified-since", "last-modified"} {
+		got, err := h.Time(name)
+		require.NoError(t, err, name)
+		assert.Equal(t, want, got, name)
+	}
+	h.SetTime("Expires", want.In(time.FixedZone("CET", 3600)))
+	expires, _ := h.Get("expires")
+	assert.Equal(t, "Sun, 06 Nov 1994 08:49:37 GMT", expires)
+
+	// Test: Lists keep quoted commas
+	assert.Equal(t, []string{`"xyzzy"`, `W/"r2,d2"`, `"c3po"`}, h.List("if-none-match"))
+	assert.Nil(t, h.List("accept"))
+
+	// Test: Media types
+	mediaType, params, err := h.MediaType("content-type")
+	require.NoError(t, err)
+	assert.Equal(t, "text/html", mediaType)
+	assert.Equal(t, map[string]string{"charset": "utf-8", "note": `a "quoted"; value`}, params)
+
+	for _, bad := range []string{"text", "text/html; charset", `text/html; a="open`, "text/html; a=b c"} {
+		_, _, err = ParseMediaType(bad)
+		assert.ErrorIs(t, err, ErrInvalidValue, bad)
+	}
 }
@@ -0,0 +1,613 @@
+package headers
+
+import (
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"math"
+	"strconv"
+	"strings"
+)
+
+var (
+	ErrMalformedStructured = errors.New("malformed structured field")
+	ErrInvalidStructured   = errors.New("value can't be serialized as a structured field")
+)
+
+// Structured field values, RFC 8941. A bare item is one of int64,
+// float64 (a Decimal), string, Token, []byte (a Byte Sequence) or bool.
+// Serialization also takes int for convenience.
+
+// Token is a bare item that serializes without quotes, like text/html or
+// gzip.
+type Token string
+
+// Param is one parameter; Params keeps them in field order.
+type Param struct {
+	Key   string
+	Value any
+}
+
+type Params []Param
+
+// Get returns the value of the parameter key, if present.
+func (ps Params) Get(key string) (any, bool) {
+	for _, p := range ps {
+		if p.Key == key {
+			return p.Value, true
+		}
+	}
+	return nil, false
+}
+
+// set overwrites an existing parameter in place, as the RFC asks for
+// repeated keys.
+func (ps Params) set(key string, value any) Params {
+	for i := range ps {
+		if ps[i].Key == key {
+			ps[i].Value = value
+			return ps
+		}
+	}
+	return append(ps, Param{Key: key, Value: value})
+}
+
+// Member is an Item or an InnerList, the things Lists and Dictionaries
+// hold.
+type Member interface {
+	member()
+}
+
+type Item struct {
+	Value  any
+	Params Params
+}
+
+type InnerList struct {
+	Items  []Item
+	Params Params
+}
+
+func (Item) member()      {}
+func (InnerList) member() {}
+
+type List []Member
+
+// DictMember is one key of a Dictionary. A key with no value holds the
+// Item true.
+type DictMember struct {
+	Key   string
+	Value Member
+}
+
+// Dictionary keeps its members in field order.
+type Dictionary []DictMember
+
+// Get returns the member for key, if present.
+func (d Dictionary) Get(key string) (Member, bool) {
+	for _, m := range d {
+		if m.Key == key {
+			return m.Value, true
+		}
+	}
+	return nil, false
+}
+
+// ParseItem parses a structured field value that is a single Item.
+func ParseItem(value string) (Item, error) {
+	p := &sfParser{s: strings.TrimLeft(value, " ")}
+	item, err := p.item()
+	if err != nil {
+		return Item{}, err
+	}
+	return item, p.end()
+}
+
+// ParseList parses a List; an empty value is an empty List.
+func ParseList(value string) (List, error) {
+	p := &sfParser{s: strings.TrimLeft(value, " ")}
+	var list List
+	for !p.eof() {
+		m, err := p.itemOrInnerList()
+		if err != nil {
+			return nil, err
+		}
+		list = append(list, m)
+		if err := p.nextMember(); err != nil {
+			return nil, err
+		}
+	}
+	return list, p.end()
+}
+
+// ParseDictionary parses a Dictionary; an empty value is an empty
+// Dictionary.
+func ParseDictionary(value string) (Dictionary, error) {
+	p := &sfParser{s: strings.TrimLeft(value, " ")}
+	var dict Dictionary
+	for !p.eof() {
+		key, err := p.key()
+		if err != nil {
+			return nil, err
+		}
+
+		var m Member
+		if p.peek() == '=' {
+			p.i++
+			if m, err = p.itemOrInnerList(); err != nil {
+				return nil, err
+			}
+		} else {
+			params, err := p.params()
+			if err != nil {
+				return nil, err
+			}
+			m = Item{Value: true, Params: params}
+		}
+		dict = dict.set(key, m)
+
+		if err := p.nextMember(); err != nil {
+			return nil, err
+		}
+	}
+	return dict, p.end()
+}
+
+func (d Dictionary) set(key string, m Member) Dictionary {
+	for i := range d {
+		if d[i].Key == key {
+			d[i].Value = m
+			return d
+		}
+	}
+	return append(d, DictMember{Key: key, Value: m})
+}
+
+type sfParser struct {
+	s string
+	i int
+}
+
+func (p *sfParser) eof() bool {
+	return p.i >= len(p.s)
+}
+
+func (p *sfParser) peek() byte {
+	if p.eof() {
+		return 0
+	}
+	return p.s[p.i]
+}
+
+func (p *sfParser) skipOWS() {
+	for !p.eof() && (p.s[p.i] == ' ' || p.s[p.i] == '\t') {
+		p.i++
+	}
+}
+
+func (p *sfParser) skipSP() {
+	for !p.eof() && p.s[p.i] == ' ' {
+		p.i++
+	}
+}
+
+// nextMember consumes the comma between list or dictionary members. A
+// trailing comma is an error.
+func (p *sfParser) nextMember() error {
+	p.skipOWS()
+	if p.eof() {
+		return nil
+	}
+	if p.s[p.i] != ',' {
+		return ErrMalformedStructured
+	}
+	p.i++
+	p.skipOWS()
+	if p.eof() {
+		return ErrMalformedStructured
+	}
+	return nil
+}
+
+func (p *sfParser) end() error {
+	p.skipSP()
+	if !p.eof() {
+		return ErrMalformedStructured
+	}
+	return nil
+}
+
+func (p *sfParser) itemOrInnerList() (Member, error) {
+	if p.peek() == '(' {
+		return p.innerList()
+	}
+	return p.item()
+}
+
+func (p *sfParser) innerList() (InnerList, error) {
+	p.i++ // (
+	var list InnerList
+	for {
+		p.skipSP()
+		if p.eof() {
+			return InnerList{}, ErrMalformedStructured
+		}
+		if p.s[p.i] == ')' {
+			p.i++
+			params, err := p.params()
+			if err != nil {
+				return InnerList{}, err
+			}
+			list.Params = params
+			return list, nil
+		}
+
+		item, err := p.item()
+		if err != nil {
+			return InnerList{}, err
+		}
+		list.Items = append(list.Items, item)
+		if c := p.peek(); c != ' ' && c != ')' {
+			return InnerList{}, ErrMalformedStructured
+		}
+	}
+}
+
+func (p *sfParser) item() (Item, error) {
+	v, err := p.bareItem()
+	if err != nil {
+		return Item{}, err
+	}
+	params, err := p.params()
+	if err != nil {
+		return Item{}, err
+	}
+	return Item{Value: v, Params: params}, nil
+}
+
+func (p *sfParser) params() (Params, error) {
+	var params Params
+	for p.peek() == ';' {
+		p.i++
+		p.skipSP()
+		key, err := p.key()
+		if err != nil {
+			return nil, err
+		}
+		var v any = true
+		if p.peek() == '=' {
+			p.i++
+			if v, err = p.bareItem(); err != nil {
+				return nil, err
+			}
+		}
+		params = params.set(key, v)
+	}
+	return params, nil
+}
+
+func (p *sfParser) key() (string, error) {
+	start := p.i
+	if c := p.peek(); !isLCAlpha(c) && c != '*' {
+		return "", ErrMalformedStructured
+	}
+	for !p.eof() && isKeyChar(p.s[p.i]) {
+		p.i++
+	}
+	return p.s[start:p.i], nil
+}
+
+func (p *sfParser) bareItem() (any, error) {
+	c := p.peek()
+	switch {
+	case c == '-' || isDigit(c):
+		return p.number()
+	case c == '"':
+		return p.string()
+	case c == '*' || isAlpha(c):
+		return p.token(), nil
+	case c == ':':
+		return p.byteSequence()
+	case c == '?':
+		return p.boolean()
+	}
+	return nil, ErrMalformedStructured
+}
+
+func (p *sfParser) number() (any, error) {
+	start := p.i
+	if p.peek() == '-' {
+		p.i++
+	}
+	if !isDigit(p.peek()) {
+		return nil, ErrMalformedStructured
+	}
+
+	digitsStart, dot := p.i, -1
+	for !p.eof() {
+		c := p.s[p.i]
+		if c == '.' && dot == -1 {
+			if p.i-digitsStart > 12 {
+				return nil, ErrMalformedStructured
+			}
+			dot = p.i
+		} else if !isDigit(c) {
+			break
+		}
+		p.i++
+		if dot == -1 && p.i-digitsStart > 15 {
+			return nil, ErrMalformedStructured
+		}
+		if dot != -1 && p.i-digitsStart > 16 {
+			return nil, ErrMalformedStructured
+		}
+	}
+
+	num := p.s[start:p.i]
+	if dot == -1 {
+		return strconv.ParseInt(num, 10, 64)
+	}
+	if frac := p.i - dot - 1; frac < 1 || frac > 3 {
+		return nil, ErrMalformedStructured
+	}
+	return strconv.ParseFloat(num, 64)
+}
+
+func (p *sfParser) string() (string, error) {
+	p.i++ // "
+	var b strings.Builder
+	for !p.eof() {
+		c := p.s[p.i]
+		p.i++
+		switch {
+		case c == '\\':
+			if p.eof() || (p.s[p.i] != '"' && p.s[p.i] != '\\') {
+				return "", ErrMalformedStructured
+			}
+			b.WriteByte(p.s[p.i])
+			p.i++
+		case c == '"':
+			return b.String(), nil
+		case c < 0x20 || c > 0x7e:
+			return "", ErrMalformedStructured
+		default:
+			b.WriteByte(c)
+		}
+	}
+	return "", ErrMalformedStructured
+}
+
+func (p *sfParser) token() Token {
+	start := p.i
+	p.i++
+	for !p.eof() && (isTchar(p.s[p.i]) || p.s[p.i] == ':' || p.s[p.i] == '/') {
+		p.i++
+	}
+	return Token(p.s[start:p.i])
+}
+
+func (p *sfParser) byteSequence() ([]byte, error) {
+	p.i++ // :
+	end := strings.IndexByte(p.s[p.i:], ':')
+	if end == -1 {
+		return nil, ErrMalformedStructured
+	}
+	encoded := p.s[p.i : p.i+end]
+	p.i += end + 1
+	for _, c := range []byte(encoded) {
+		if !isAlpha(c) && !isDigit(c) && c != '+' && c != '/' && c != '=' {
+			return nil, ErrMalformedStructured
+		}
+	}
+	b, err := base64.StdEncoding.DecodeString(encoded)
+	if err != nil {
+		// Padding is optional for parsers
+		if b, err = base64.RawStdEncoding.DecodeString(encoded); err != nil {
+			return nil, ErrMalformedStructured
+		}
+	}
+	return b, nil
+}
+
+func (p *sfParser) boolean() (bool, error) {
+	p.i++ // ?
+	switch p.peek() {
+	case '1':
+		p.i++
+		return true, nil
+	case '0':
+		p.i++
+		return false, nil
+	}
+	return false, ErrMalformedStructured
+}
+
+// Serialize renders the Item as a field value.
+func (it Item) Serialize() (string, error) {
+	var b strings.Builder
+	if err := it.serialize(&b); err != nil {
+		return "", err
+	}
+	return b.String(), nil
+}
+
+func (it Item) serialize(b *strings.Builder) error {
+	if err := serializeBareItem(b, it.Value); err != nil {
+		return err
+	}
+	return it.Params.serialize(b)
+}
+
+func (l InnerList) serialize(b *strings.Builder) error {
+	b.WriteByte('(')
+	for i, it := range l.Items {
+		if i > 0 {
+			b.WriteByte(' ')
+		}
+		if err := it.serialize(b); err != nil {
+			return err
+		}
+	}
+	b.WriteByte(')')
+	return l.Params.serialize(b)
+}
+
+func (ps Params) serialize(b *strings.Builder) error {
+	for _, p := range ps {
+		if !validKey(p.Key) {
+			return ErrInvalidStructured
+		}
+		b.WriteByte(';')
+		b.WriteString(p.Key)
+		if v, ok := p.Value.(bool); ok && v {
+			continue
+		}
+		b.WriteByte('=')
+		if err := serializeBareItem(b, p.Value); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func serializeMember(b *strings.Builder, m Member) error {
+	switch m := m.(type) {
+	case Item:
+		return m.serialize(b)
+	case InnerList:
+		return m.serialize(b)
+	}
+	return ErrInvalidStructured
+}
+
+// Serialize renders the List as a field value.
+func (l List) Serialize() (string, error) {
+	var b strings.Builder
+	for i, m := range l {
+		if i > 0 {
+			b.WriteString(", ")
+		}
+		if err := serializeMember(&b, m); err != nil {
+			return "", err
+		}
+	}
+	return b.String(), nil
+}
+
+// Serialize renders the Dictionary as a field value; members whose value
+// is the Item true are written as a bare key.
+func (d Dictionary) Serialize() (string, error) {
+	var b strings.Builder
+	for i, m := range d {
+		if !validKey(m.Key) {
+			return "", ErrInvalidStructured
+		}
+		if i > 0 {
+			b.WriteString(", ")
+		}
+		b.WriteString(m.Key)
+		if it, ok := m.Value.(Item); ok {
+			if v, ok := it.Value.(bool); ok && v {
+				if err := it.Params.serialize(&b); err != nil {
+					return "", err
+				}
+				continue
+			}
+		}
+		b.WriteByte('=')
+		if err := serializeMember(&b, m.Value); err != nil {
+			return "", err
+		}
+	}
+	return b.String(), nil
+}
+
+const maxSFInteger = 999_999_999_999_999
+
+func serializeBareItem(b *strings.Builder, v any) error {
+	switch v := v.(type) {
+	case int:
+		return serializeBareItem(b, int64(v))
+	case int64:
+		if v > maxSFInteger || v < -maxSFInteger {
+			return ErrInvalidStructured
+		}
+		b.WriteString(strconv.FormatInt(v, 10))
+	case float64:
+		v = math.RoundToEven(v*1000) / 1000
+		if math.IsNaN(v) || math.Abs(v) >= 1e12 {
+			return ErrInvalidStructured
+		}
+		s := strconv.FormatFloat(v, 'f', -1, 64)
+		if !strings.Contains(s, ".") {
+			s += ".0"
+		}
+		b.WriteString(s)
+	case string:
+		b.WriteByte('"')
+		for _, c := range []byte(v) {
+			if c < 0x20 || c > 0x7e {
+				return ErrInvalidStructured
+			}
+			if c == '"' || c == '\\' {
+				b.WriteByte('\\')
+			}
+			b.WriteByte(c)
+		}
+		b.WriteByte('"')
+	case Token:
+		if !validToken(string(v)) {
+			return ErrInvalidStructured
+		}
+		b.WriteString(string(v))
+	case []byte:
+		b.WriteByte(':')
+		b.WriteString(base64.StdEncoding.EncodeToString(v))
+		b.WriteByte(':')
+	case bool:
+		if v {
+			b.WriteString("?1")
+		} else {
+			b.WriteString("?0")
+		}
+	default:
+		return fmt.Errorf("%w: unsupported type %T", ErrInvalidStructured, v)
+	}
+	return nil
+}
+
+func validKey(k string) bool {
+	if k == "" || (!isLCAlpha(k[0]) && k[0] != '*') {
+		return false
+	}
+	for _, c := range []byte(k) {
+		if !isKeyChar(c) {
+			return false
+		}
+	}
+	return true
+}
+
+func validToken(t string) bool {
+	if t == "" || (!isAlpha(t[0]) && t[0] != '*') {
+		return false
+	}
+	for _, c := range []byte(t) {
+		if !isTchar(c) && c != ':' && c != '/' {
+			return false
+		}
+	}
+	return true
+}
+
+func isDigit(c byte) bool   { return c >= '0' && c <= '9' }
+func isLCAlpha(c byte) bool { return c >= 'a' && c <= 'z' }
+func isAlpha(c byte) bool   { return isLCAlpha(c) || (c >= 'A' && c <= 'Z') }
+
+func isKeyChar(c byte) bool {
+	return isLCAlpha(c) || isDigit(c) || c == '_' || c == '-' || c == '.' || c == '*'
+}
+
+func isTchar(c byte) bool {
+	return isToken([]byte{c})
+}
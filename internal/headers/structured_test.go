@@ -0,0 +1,132 @@
+package headers
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestParseStructured(t *testing.T) {
+	// Test: Bare item types
+	items := map[string]any{
+		"42":            int64(42),
+		"-17":           int64(-17),
+		"4.5":           4.5,
+		"-0.25":         -0.25,
+		`"hello \"w\""`: `hello "w"`,
+		"foo123/456":    Token("foo123/456"),
+		"*":             Token("*"),
+		":cHJldGVuZCB0aGlzIGlzIGJpbmFyeSBjb250ZW50Lg==:": []byte("pretend this is binary content."),
+		"?1": true,
+		"?0": false,
+	}
+	for in, want := range items {
+		item, err := ParseItem(in)
+		require.NoError(t, err, in)
+		assert.Equal(t, want, item.Value, in)
+	}
+
+	// Test: Parameters
+	item, err := ParseItem(`text/html;charset=utf-8;q=0.5;secure;a=1;a=2`)
+	require.NoError(t, err)
+	assert.Equal(t, Token("text/html"), item.Value)
+	assert.Equal(t, Params{{"charset", Token("utf-8")}, {"q", 0.5}, {"secure", true}, {"a", int64(2)}}, item.Params)
+
+	// Test: Lists with inner lists
+	list, err := ParseList(`sugar, tea, ("milk" "honey");sweet, ()`)
+	require.NoError(t, err)
+	require.Len(t, list, 4)
+	assert.Equal(t, Item{Value: Token("tea")}, list[1])
+	assert.Equal(t, InnerList{
+		Items:  []Item{{Value: "milk"}, {Value: "honey"}},
+		Params: Params{{"sweet", true}},
+	}, list[2])
+	assert.Equal(t, InnerList{}, list[3])
+
+	list, err = ParseList("")
+	require.NoError(t, err)
+	assert.Empty(t, list)
+
+	// Test: Dictionaries keep order, later duplicates win in place
+	dict, err := ParseDictionary(`a=1, b;x=?0, c=(1 2), a=3`)
+	require.NoError(t, err)
+	require.Len(t, dict, 3)
+	assert.Equal(t, "a", dict[0].Key)
+	assert.Equal(t, Item{Value: int64(3)}, dict[0].Value)
+	b, ok := dict.Get("b")
+	assert.True(t, ok)
+	assert.Equal(t, Item{Value: true, Params: Params{{"x", false}}}, b)
+
+	// Test: Malformed values
+	for _, bad := range []string{
+		"", "1234567890123456", "1.2345", "1234567890123.0", "1.", `"unterminated`, `"bad \n escape"`,
+		":not base64!:", "?2", "a b", "1,", "(1 2", "(1,2)",
+	} {
+		_, err := ParseItem(bad)
+		assert.ErrorIs(t, err, ErrMalformedStructured, bad)
+	}
+	for _, bad := range []string{"a,", "a,,b", "a b"} {
+		_, err := ParseList(bad)
+		assert.ErrorIs(t, err, ErrMalformedStructured, bad)
+	}
+	_, err = ParseDictionary("A=1")
+	assert.ErrorIs(t, err, ErrMalformedStructured)
+}
+
+func TestSerializeStructured(t *testing.T) {
+	// Test: Round trips
+	for _, in := range []string{
+		`sugar, tea, ("milk" "honey");sweet, ()`,
+		`text/html;charset=utf-8;q=0.5, ?0;valid, :AQID:`,
+		`-7, 1.5, "a \"b\" \\ c"`,
+	} {
+		list, err := ParseList(in)
+		require.NoError(t, err, in)
+		out, err := list.Serialize()
+		require.NoError(t, err, in)
+		assert.Equal(t, in, out)
+	}
+
+	dict, err := ParseDictionary(`u=2, i, a=(1 2);x`)
+	require.NoError(t, err)
+	out, err := dict.Serialize()
+	require.NoError(t, err)
+	assert.Equal(t, `u=2, i, a=(1 2);x`, out)
+
+	// Test: Decimals are rounded to three digits
+	out, err = Item{Value: 1.23456}.Serialize()
+	require.NoError(t, err)
+	assert.Equal(t, "1.235", out)
+	out, err = Item{Value: 2.0}.Serialize()
+	require.NoError(t, err)
+	assert.Equal(t, "2.0", out)
+
+	// Test: Values that can't be serialized
+	for _, bad := range []Item{
+		{Value: int64(1_000_000_000_000_000)},
+		{Value: 1e12},
+		{Value: "café"},
+		{Value: Token("1abc")},
+		{Value: struct{}{}},
+		{Value: 1, Params: Params{{"Upper", true}}},
+	} {
+		_, err := bad.Serialize()
+		assert.ErrorIs(t, err, ErrInvalidStructured, bad)
+	}
+
+	// Test: Through Headers
+	h := NewHeaders()
+	require.NoError(t, h.SetStructured("Priority", Dictionary{{"u", Item{Value: 3}}, {"i", Item{Value: true}}}))
+	prio, err := h.StructuredDictionary("priority")
+	require.NoError(t, err)
+	u, _ := prio.Get("u")
+	assert.Equal(t, Item{Value: int64(3)}, u)
+
+	require.Error(t, h.SetStructured("Bad", Item{Value: Token("")}))
+	_, ok := h.Get("bad")
+	assert.False(t, ok)
+
+	_, err = h.StructuredItem("missing")
+	assert.ErrorIs(t, err, ErrMissingField)
+}
@@ -0,0 +1,231 @@
+package headers
+
+import (
+	"errors"
+	"strconv"
+	"strings"
+	"time"
+)
+
+var (
+	ErrMissingField = errors.New("field not present")
+	ErrInvalidValue = errors.New("invalid field value")
+)
+
+// TimeFormat is the preferred HTTP-date format, IMF-fixdate.
+const TimeFormat = "Mon, 02 Jan 2006 15:04:05 GMT"
+
+// Obsolete HTTP-date formats recipients must still accept (RFC 9110
+// section 5.6.7).
+var timeFormats = []string{
+	TimeFormat,
+	"Monday, 02-Jan-06 15:04:05 GMT",
+	"Mon Jan _2 15:04:05 2006",
+}
+
+// Int parses a field holding a non-negative decimal integer, like
+// Content-Length or Max-Forwards.
+func (h Headers) Int(name string) (int64, error) {
+	v, ok := h.Get(name)
+	if !ok {
+		return 0, ErrMissingField
+	}
+	v = strings.TrimSpace(v)
+	if v == "" {
+		return 0, ErrInvalidValue
+	}
+	for _, c := range []byte(v) {
+		if !isDigit(c) {
+			return 0, ErrInvalidValue
+		}
+	}
+	n, err := strconv.ParseInt(v, 10, 64)
+	if err != nil {
+		return 0, ErrInvalidValue
+	}
+	return n, nil
+}
+
+// Time parses a field holding an HTTP-date, like Date or If-Modified-Since.
+func (h Headers) Time(name string) (time.Time, error) {
+	v, ok := h.Get(name)
+	if !ok {
+		return time.Time{}, ErrMissingField
+	}
+	v = strings.TrimSpace(v)
+	for _, layout := range timeFormats {
+		if t, err := time.Parse(layout, v); err == nil {
+			return t.UTC(), nil
+		}
+	}
+	return time.Time{}, ErrInvalidValue
+}
+
+// SetTime replaces the field with t as an IMF-fixdate.
+func (h Headers) SetTime(name string, t time.Time) {
+	h.Replace(name, t.UTC().Format(TimeFormat))
+}
+
+// List splits a comma-separated field into its elements. Commas inside
+// quoted-strings don't split, empty elements are dropped and elements are
+// returned as sent, quotes included, since for things like ETags they are
+// part of the value. A missing field is an empty list.
+func (h Headers) List(name string) []string {
+	v, ok := h.Get(name)
+	if !ok {
+		return nil
+	}
+	return splitList(v)
+}
+
+func splitList(v string) []string {
+	var elems []string
+	start, quoted := 0, false
+	for i := 0; i < len(v); i++ {
+		switch c := v[i]; {
+		case quoted && c == '\\':
+			i++
+		case c == '"':
+			quoted = !quoted
+		case !quoted && c == ',':
+			if e := strings.Trim(v[start:i], " \t"); e != "" {
+				elems = append(elems, e)
+			}
+			start = i + 1
+		}
+	}
+	if e := strings.Trim(v[start:], " \t"); e != "" {
+		elems = append(elems, e)
+	}
+	return elems
+}
+
+// MediaType parses a field like Content-Type into its lowercased media
+// type and parameters. Parameter names are lowercased, values unquoted.
+func (h Headers) MediaType(name string) (string, map[string]string, error) {
+	v, ok := h.Get(name)
+	if !ok {
+		return "", nil, ErrMissingField
+	}
+	return ParseMediaType(v)
+}
+
+// ParseMediaType parses "type/subtype *( OWS ; OWS parameter )".
+func ParseMediaType(v string) (string, map[string]string, error) {
+	mediaType, rest, _ := strings.Cut(v, ";")
+	mediaType = strings.ToLower(strings.TrimSpace(mediaType))
+	typ, subtype, ok := strings.Cut(mediaType, "/")
+	if !ok || typ == "" || subtype == "" || !isToken([]byte(typ)) || !isToken([]byte(subtype)) {
+		return "", nil, ErrInvalidValue
+	}
+
+	params := map[string]string{}
+	for {
+		rest = strings.TrimLeft(rest, " \t")
+		if rest == "" {
+			break
+		}
+		eq := strings.IndexByte(rest, '=')
+		if eq <= 0 || !isToken([]byte(strings.TrimSpace(rest[:eq]))) {
+			return "", nil, ErrInvalidValue
+		}
+		key := strings.ToLower(strings.TrimSpace(rest[:eq]))
+		rest = rest[eq+1:]
+
+		var value string
+		if strings.HasPrefix(rest, `"`) {
+			var err error
+			value, rest, err = unquote(rest)
+			if err != nil {
+				return "", nil, err
+			}
+		} else {
+			end := strings.IndexByte(rest, ';')
+			if end == -1 {
+				end = len(rest)
+			}
+			value = strings.TrimRight(rest[:end], " \t")
+			rest = rest[end:]
+			if value == "" || !isToken([]byte(value)) {
+				return "", nil, ErrInvalidValue
+			}
+		}
+		params[key] = value
+
+		rest = strings.TrimLeft(rest, " \t")
+		if rest == "" {
+			break
+		}
+		if rest[0] != ';' {
+			return "", nil, ErrInvalidValue
+		}
+		rest = rest[1:]
+	}
+	return mediaType, params, nil
+}
+
+// unquote reads the quoted-string at the start of s and returns its
+// content and what follows it.
+func unquote(s string) (string, string, error) {
+	var b strings.Builder
+	for i := 1; i < len(s); i++ {
+		switch s[i] {
+		case '\\':
+			i++
+			if i == len(s) {
+				return "", "", ErrInvalidValue
+			}
+			b.WriteByte(s[i])
+		case '"':
+			return b.String(), s[i+1:], nil
+		default:
+			b.WriteByte(s[i])
+		}
+	}
+	return "", "", ErrInvalidValue
+}
+
+// StructuredItem parses a field defined as an RFC 8941 Item.
+func (h Headers) StructuredItem(name string) (Item, error) {
+	v, ok := h.Get(name)
+	if !ok {
+		return Item{}, ErrMissingField
+	}
+	return ParseItem(v)
+}
+
+// StructuredList parses a field defined as an RFC 8941 List. A missing
+// field is an empty List.
+func (h Headers) StructuredList(name string) (List, error) {
+	v, ok := h.Get(name)
+	if !ok {
+		return nil, nil
+	}
+	return ParseList(v)
+}
+
+// StructuredDictionary parses a field defined as an RFC 8941 Dictionary. A
+// missing field is an empty Dictionary.
+func (h Headers) StructuredDictionary(name string) (Dictionary, error) {
+	v, ok := h.Get(name)
+	if !ok {
+		return nil, nil
+	}
+	return ParseDictionary(v)
+}
+
+// Structured is what SetStructured accepts: an Item, List or Dictionary.
+type Structured interface {
+	Serialize() (string, error)
+}
+
+// SetStructured replaces the field with the serialization of v. Nothing is
+// set if v can't be serialized.
+func (h Headers) SetStructured(name string, v Structured) error {
+	s, err := v.Serialize()
+	if err != nil {
+		return err
+	}
+	h.Replace(name, s)
+	return nil
+}
@@ -0,0 +1,146 @@
+package hpack
+
+import (
+	"fmt"
+
+	"http-scratch/internal/headers"
+)
+
+// Decoder decodes the header blocks of one connection, in the order they
+// were sent.
+type Decoder struct {
+	table dynamicTable
+	// allowedSize is the table size we advertised; updates may not exceed
+	// it.
+	allowedSize uint32
+	// maxStringLen bounds every decoded name and value.
+	maxStringLen int
+}
+
+// NewDecoder returns a Decoder whose table holds tableSize bytes, the
+// size advertised to the encoder. Names and values longer than
+// maxStringLen are refused when it is positive.
+func NewDecoder(tableSize uint32, maxStringLen int) *Decoder {
+	return &Decoder{
+		table:        dynamicTable{maxSize: tableSize},
+		allowedSize:  tableSize,
+		maxStringLen: maxStringLen,
+	}
+}
+
+// SetAllowedMaxTableSize changes the most the encoder may size the table
+// to, after advertising it. The encoder says when it takes the new size
+// up.
+func (d *Decoder) SetAllowedMaxTableSize(n uint32) {
+	d.allowedSize = n
+}
+
+// TableSize is the current size of the dynamic table's entries.
+func (d *Decoder) TableSize() uint32 {
+	return d.table.size
+}
+
+// Decode decodes a complete header block.
+func (d *Decoder) Decode(block []byte) ([]HeaderField, error) {
+	var fields []HeaderField
+	for len(block) > 0 {
+		b := block[0]
+		var f HeaderField
+		var err error
+		switch {
+		case b&0x80 != 0:
+			// Indexed field
+			var i uint64
+			if i, block, err = readInt(block, 7); err != nil {
+				return nil, err
+			}
+			var ok bool
+			if f, ok = d.table.field(i); !ok {
+				return nil, fmt.Errorf("%w: index %d out of range", ErrMalformed, i)
+			}
+		case b&0xc0 == 0x40:
+			// Literal with incremental indexing
+			if f, block, err = d.readLiteral(block, 6); err != nil {
+				return nil, err
+			}
+			d.table.add(f)
+		case b&0xe0 == 0x20:
+			// Dynamic table size update, only allowed before any field
+			if len(fields) > 0 {
+				return nil, fmt.Errorf("%w: table size update after a field", ErrMalformed)
+			}
+			var n uint64
+			if n, block, err = readInt(block, 5); err != nil {
+				return nil, err
+			}
+			if n > uint64(d.allowedSize) {
+				return nil, fmt.Errorf("%w: table size %d over the limit", ErrMalformed, n)
+			}
+			d.table.setMaxSize(uint32(n))
+			continue
+		default:
+			// Literal without indexing, 0000, or never indexed, 0001
+			if f, block, err = d.readLiteral(block, 4); err != nil {
+				return nil, err
+			}
+			f.Sensitive = b&0x10 != 0
+		}
+		fields = append(fields, f)
+	}
+	return fields, nil
+}
+
+// DecodeHeaders is Decode into a headers.Headers.
+func (d *Decoder) DecodeHeaders(block []byte) (headers.Headers, error) {
+	fields, err := d.Decode(block)
+	if err != nil {
+		return nil, err
+	}
+	return Headers(fields), nil
+}
+
+func (d *Decoder) readLiteral(block []byte, prefix uint8) (HeaderField, []byte, error) {
+	var f HeaderField
+	i, block, err := readInt(block, prefix)
+	if err != nil {
+		return f, nil, err
+	}
+	if i == 0 {
+		if f.Name, block, err = d.readString(block); err != nil {
+			return f, nil, err
+		}
+	} else {
+		named, ok := d.table.field(i)
+		if !ok {
+			return f, nil, fmt.Errorf("%w: index %d out of range", ErrMalformed, i)
+		}
+		f.Name = named.Name
+	}
+	if f.Value, block, err = d.readString(block); err != nil {
+		return f, nil, err
+	}
+	return f, block, nil
+}
+
+func (d *Decoder) readString(block []byte) (string, []byte, error) {
+	if len(block) == 0 {
+		return "", nil, fmt.Errorf("%w: truncated string", ErrMalformed)
+	}
+	huffman := block[0]&0x80 != 0
+	n, block, err := readInt(block, 7)
+	if err != nil {
+		return "", nil, err
+	}
+	if n > uint64(len(block)) {
+		return "", nil, fmt.Errorf("%w: truncated string", ErrMalformed)
+	}
+	raw, block := block[:n], block[n:]
+	if !huffman {
+		if d.maxStringLen > 0 && len(raw) > d.maxStringLen {
+			return "", nil, fmt.Errorf("%w: string too long", ErrMalformed)
+		}
+		return string(raw), block, nil
+	}
+	s, err := HuffmanDecode(raw, d.maxStringLen)
+	return s, block, err
+}
@@ -0,0 +1,94 @@
+package hpack
+
+import "http-scratch/internal/headers"
+
+// Encoder encodes the header blocks of one connection. Each block may
+// change the table the next one is decoded against, so blocks have to be
+// sent in the order they were encoded.
+type Encoder struct {
+	// DisableHuffman sends every string as is, for comparing sizes or
+	// peers that decode faster without it.
+	DisableHuffman bool
+
+	table dynamicTable
+	// minSize is the smallest the table was sized to since the last block,
+	// which the decoder has to hear about before the final size.
+	minSize     uint32
+	sizeChanged bool
+}
+
+// NewEncoder returns an Encoder for a decoder whose table holds tableSize
+// bytes, 4096 unless HTTP/2 settings said otherwise.
+func NewEncoder(tableSize uint32) *Encoder {
+	return &Encoder{table: dynamicTable{maxSize: tableSize}}
+}
+
+// SetMaxTableSize resizes the table, as when the decoder's side changes
+// SETTINGS_HEADER_TABLE_SIZE. The next block starts by saying so.
+func (e *Encoder) SetMaxTableSize(n uint32) {
+	if !e.sizeChanged || n < e.minSize {
+		e.minSize = n
+	}
+	e.sizeChanged = true
+	e.table.setMaxSize(n)
+}
+
+// TableSize is the current size of the dynamic table's entries.
+func (e *Encoder) TableSize() uint32 {
+	return e.table.size
+}
+
+// Encode encodes fields as one header block. Fields already in a table
+// are sent as indexes; others are added to the dynamic table unless they
+// are sensitive or wouldn't fit.
+func (e *Encoder) Encode(fields []HeaderField) []byte {
+	var block []byte
+	if e.sizeChanged {
+		if e.minSize < e.table.maxSize {
+			block = appendInt(block, 0x20, 5, uint64(e.minSize))
+		}
+		block = appendInt(block, 0x20, 5, uint64(e.table.maxSize))
+		e.sizeChanged = false
+	}
+	for _, f := range fields {
+		block = e.appendField(block, f)
+	}
+	return block
+}
+
+// EncodeHeaders encodes h in the order Fields puts it.
+func (e *Encoder) EncodeHeaders(h headers.Headers) []byte {
+	return e.Encode(Fields(h))
+}
+
+func (e *Encoder) appendField(dst []byte, f HeaderField) []byte {
+	i, exact := e.table.search(f)
+	// A sensitive field already in a table was sent by someone who didn't
+	// care, but we do: it goes as a never-indexed literal regardless
+	if exact && !f.Sensitive {
+		return appendInt(dst, 0x80, 7, i)
+	}
+
+	var first byte
+	var prefix uint8
+	index := false
+	switch {
+	case f.Sensitive:
+		first, prefix = 0x10, 4
+	case f.Size() <= e.table.maxSize:
+		first, prefix, index = 0x40, 6, true
+	default:
+		first, prefix = 0x00, 4
+	}
+	if i > 0 {
+		dst = appendInt(dst, first, prefix, i)
+	} else {
+		dst = append(dst, first)
+		dst = appendString(dst, f.Name, !e.DisableHuffman)
+	}
+	dst = appendString(dst, f.Value, !e.DisableHuffman)
+	if index {
+		e.table.add(HeaderField{Name: f.Name, Value: f.Value})
+	}
+	return dst
+}
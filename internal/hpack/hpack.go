@@ -0,0 +1,115 @@
+// Package hpack implements HPACK, the header compression of HTTP/2 (RFC
+// 7541).
+package hpack
+
+import (
+	"errors"
+	"fmt"
+	"sort"
+
+	"http-scratch/internal/headers"
+)
+
+var ErrMalformed = errors.New("hpack: malformed header block")
+
+// HeaderField is one field of a header block. Sensitive fields are sent,
+// and were received, as never-indexed literals: no encoder along the way
+// may add them to a table.
+type HeaderField struct {
+	Name      string
+	Value     string
+	Sensitive bool
+}
+
+// Size is what a field counts against the table size (RFC 7541 section
+// 4.1).
+func (f HeaderField) Size() uint32 {
+	return uint32(len(f.Name) + len(f.Value) + 32)
+}
+
+// sensitiveFields carry credentials, which a table shared with other
+// requests could leak through compression side channels.
+var sensitiveFields = map[string]bool{
+	"authorization":       true,
+	"proxy-authorization": true,
+	"cookie":              true,
+	"set-cookie":          true,
+}
+
+// Fields lists the fields of h, sorted by name so the same headers always
+// encode the same way. Credentials are marked sensitive.
+func Fields(h headers.Headers) []HeaderField {
+	var fields []HeaderField
+	h.ForEach(func(n, v string) {
+		fields = append(fields, HeaderField{Name: n, Value: v, Sensitive: sensitiveFields[n]})
+	})
+	sort.SliceStable(fields, func(i, j int) bool {
+		return fields[i].Name < fields[j].Name
+	})
+	return fields
+}
+
+// Headers collects fields into a headers.Headers, repeated names joined
+// the way Set joins them.
+func Headers(fields []HeaderField) headers.Headers {
+	h := headers.NewHeaders()
+	for _, f := range fields {
+		h.Set(f.Name, f.Value)
+	}
+	return h
+}
+
+// readInt reads an integer with an n-bit prefix (RFC 7541 section 5.1).
+func readInt(b []byte, n uint8) (uint64, []byte, error) {
+	if len(b) == 0 {
+		return 0, nil, fmt.Errorf("%w: truncated integer", ErrMalformed)
+	}
+	max := uint64(1)<<n - 1
+	i := uint64(b[0]) & max
+	b = b[1:]
+	if i < max {
+		return i, b, nil
+	}
+	for shift := uint(0); len(b) > 0; shift += 7 {
+		// Anything past 32 bits is an attack, not a header
+		if shift > 28 {
+			return 0, nil, fmt.Errorf("%w: integer overflow", ErrMalformed)
+		}
+		c := b[0]
+		b = b[1:]
+		i += uint64(c&0x7f) << shift
+		if c&0x80 == 0 {
+			return i, b, nil
+		}
+	}
+	return 0, nil, fmt.Errorf("%w: truncated integer", ErrMalformed)
+}
+
+// appendInt appends i with an n-bit prefix, the bits above it taken from
+// first.
+func appendInt(dst []byte, first byte, n uint8, i uint64) []byte {
+	max := uint64(1)<<n - 1
+	if i < max {
+		return append(dst, first|byte(i))
+	}
+	dst = append(dst, first|byte(max))
+	i -= max
+	for i >= 0x80 {
+		dst = append(dst, byte(i&0x7f)|0x80)
+		i >>= 7
+	}
+	return append(dst, byte(i))
+}
+
+// appendString appends a string literal, Huffman coded when huffman is
+// set and that is no longer; ties go to Huffman as in RFC 7541's examples.
+func appendString(dst []byte, s string, huffman bool) []byte {
+	if huffman {
+		if n := HuffmanEncodedLen(s); n <= len(s) {
+			dst = appendInt(dst, 0x80, 7, uint64(n))
+			return AppendHuffman(dst, s)
+		}
+	}
+	dst = appendInt(dst, 0, 7, uint64(len(s)))
+	return append(dst, s...)
+}
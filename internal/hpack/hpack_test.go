@@ -0,0 +1,250 @@
+package hpack
+
+import (
+	"encoding/hex"
+	"strings"
+	"testing"
+
+	"http-scratch/internal/headers"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func unhex(t *testing.T, s string) []byte {
+	b, err := hex.DecodeString(strings.ReplaceAll(s, " ", ""))
+	require.NoError(t, err)
+	return b
+}
+
+func pairs(kv ...string) []HeaderField {
+	var fields []HeaderField
+	for i := 0; i < len(kv); i += 2 {
+		fields = append(fields, HeaderField{Name: kv[i], Value: kv[i+1]})
+	}
+	return fields
+}
+
+// example is one header block of an RFC 7541 Appendix C sequence, with
+// the table size after it.
+type example struct {
+	block  string
+	fields []HeaderField
+	size   uint32
+}
+
+// checkSequence decodes and encodes a sequence of blocks sharing a
+// connection's tables.
+func checkSequence(t *testing.T, tableSize uint32, huffman bool, examples []example) {
+	d := NewDecoder(tableSize, 0)
+	e := NewEncoder(tableSize)
+	e.DisableHuffman = !huffman
+	for i, ex := range examples {
+		fields, err := d.Decode(unhex(t, ex.block))
+		require.NoError(t, err, "block %d", i)
+		assert.Equal(t, ex.fields, fields, "block %d", i)
+		assert.Equal(t, ex.size, d.TableSize(), "block %d", i)
+
+		assert.Equal(t, ex.block, hex.EncodeToString(e.Encode(ex.fields)), "block %d", i)
+		assert.Equal(t, ex.size, e.TableSize(), "block %d", i)
+	}
+}
+
+func TestIntegers(t *testing.T) {
+	// Test: RFC 7541 C.1
+	assert.Equal(t, []byte{0x0a}, appendInt(nil, 0, 5, 10))
+	assert.Equal(t, []byte{0x1f, 0x9a, 0x0a}, appendInt(nil, 0, 5, 1337))
+	assert.Equal(t, []byte{0x2a}, appendInt(nil, 0, 8, 42))
+
+	i, rest, err := readInt([]byte{0xff, 0x9a, 0x0a, 0x01}, 5)
+	require.NoError(t, err)
+	assert.Equal(t, uint64(1337), i)
+	assert.Equal(t, []byte{0x01}, rest)
+
+	// Test: Truncated and overlong integers
+	_, _, err = readInt([]byte{0x1f, 0x9a}, 5)
+	assert.ErrorIs(t, err, ErrMalformed)
+	_, _, err = readInt([]byte{0x1f, 0xff, 0xff, 0xff, 0xff, 0xff, 0x01}, 5)
+	assert.ErrorIs(t, err, ErrMalformed)
+}
+
+func TestLiterals(t *testing.T) {
+	// Test: RFC 7541 C.2.1, literal with indexing
+	d := NewDecoder(4096, 0)
+	fields, err := d.Decode(unhex(t, "400a 6375 7374 6f6d 2d6b 6579 0d63 7573 746f 6d2d 6865 6164 6572"))
+	require.NoError(t, err)
+	assert.Equal(t, pairs("custom-key", "custom-header"), fields)
+	assert.Equal(t, uint32(55), d.TableSize())
+
+	// Test: RFC 7541 C.2.2, literal without indexing
+	d = NewDecoder(4096, 0)
+	fields, err = d.Decode(unhex(t, "040c 2f73 616d 706c 652f 7061 7468"))
+	require.NoError(t, err)
+	assert.Equal(t, pairs(":path", "/sample/path"), fields)
+	assert.Equal(t, uint32(0), d.TableSize())
+
+	// Test: RFC 7541 C.2.3, never indexed
+	block := "100870617373776f726406736563726574"
+	fields, err = d.Decode(unhex(t, block))
+	require.NoError(t, err)
+	assert.Equal(t, []HeaderField{{Name: "password", Value: "secret", Sensitive: true}}, fields)
+	assert.Equal(t, uint32(0), d.TableSize())
+	e := NewEncoder(4096)
+	e.DisableHuffman = true
+	assert.Equal(t, block, hex.EncodeToString(e.Encode(fields)))
+	assert.Equal(t, uint32(0), e.TableSize())
+
+	// Test: RFC 7541 C.2.4, indexed
+	fields, err = d.Decode([]byte{0x82})
+	require.NoError(t, err)
+	assert.Equal(t, pairs(":method", "GET"), fields)
+
+	// Test: Indexes past the tables
+	_, err = d.Decode([]byte{0xbe})
+	assert.ErrorIs(t, err, ErrMalformed)
+	_, err = d.Decode([]byte{0x80})
+	assert.ErrorIs(t, err, ErrMalformed)
+
+	// Test: Strings over the limit
+	d = NewDecoder(4096, 8)
+	_, err = d.Decode(unhex(t, "400a 6375 7374 6f6d 2d6b 6579 0d63 7573 746f 6d2d 6865 6164 6572"))
+	assert.ErrorIs(t, err, ErrMalformed)
+}
+
+var requestFields = [][]HeaderField{
+	pairs(":method", "GET", ":scheme", "http", ":path", "/", ":authority", "www.example.com"),
+	pairs(":method", "GET", ":scheme", "http", ":path", "/", ":authority", "www.example.com", "cache-control", "no-cache"),
+	pairs(":method", "GET", ":scheme", "https", ":path", "/index.html", ":authority", "www.example.com", "custom-key", "custom-value"),
+}
+
+var responseFields = [][]HeaderField{
+	pairs(":status", "302", "cache-control", "private", "date", "Mon, 21 Oct 2013 20:13:21 GMT", "location", "https://www.example.com"),
+	pairs(":status", "307", "cache-control", "private", "date", "Mon, 21 Oct 2013 20:13:21 GMT", "location", "https://www.example.com"),
+	pairs(":status", "200", "cache-control", "private", "date", "Mon, 21 Oct 2013 20:13:22 GMT", "location", "https://www.example.com",
+		"content-encoding", "gzip", "set-cookie", "foo=ASDJKHQKBZXOQWEOPIUAXQWEOIU; max-age=3600; version=1"),
+}
+
+func TestRequests(t *testing.T) {
+	// Test: RFC 7541 C.3, requests without Huffman coding
+	checkSequence(t, 4096, false, []example{
+		{"828684410f7777772e6578616d706c652e636f6d", requestFields[0], 57},
+		{"828684be58086e6f2d6361636865", requestFields[1], 110},
+		{"828785bf400a637573746f6d2d6b65790c637573746f6d2d76616c7565", requestFields[2], 164},
+	})
+
+	// Test: RFC 7541 C.4, requests with Huffman coding
+	checkSequence(t, 4096, true, []example{
+		{"828684418cf1e3c2e5f23a6ba0ab90f4ff", requestFields[0], 57},
+		{"828684be5886a8eb10649cbf", requestFields[1], 110},
+		{"828785bf408825a849e95ba97d7f8925a849e95bb8e8b4bf", requestFields[2], 164},
+	})
+}
+
+func TestResponses(t *testing.T) {
+	// Test: RFC 7541 C.5, responses without Huffman coding, evicting from a
+	// 256 byte table
+	checkSequence(t, 256, false, []example{
+		{"4803333032580770726976617465611d4d6f6e2c203231204f637420323031332032303a31333a323120474d546e1768747470733a2f2f7777772e6578616d706c652e636f6d", responseFields[0], 222},
+		{"4803333037c1c0bf", responseFields[1], 222},
+		{"88c1611d4d6f6e2c203231204f637420323031332032303a31333a323220474d54c05a04677a69707738666f6f3d4153444a4b48514b425a584f5157454f50495541585157454f49553b206d61782d6167653d333630303b2076657273696f6e3d31", responseFields[2], 215},
+	})
+
+	// Test: RFC 7541 C.6, responses with Huffman coding
+	checkSequence(t, 256, true, []example{
+		{"488264025885aec3771a4b6196d07abe941054d444a8200595040b8166e082a62d1bff6e919d29ad171863c78f0b97c8e9ae82ae43d3", responseFields[0], 222},
+		{"4883640effc1c0bf", responseFields[1], 222},
+		{"88c16196d07abe941054d444a8200595040b8166e084a62d1bffc05a839bd9ab77ad94e7821dd7f2e6c7b335dfdfcd5b3960d5af27087f3672c1ab270fb5291f9587316065c003ed4ee5b1063d5007", responseFields[2], 215},
+	})
+}
+
+func TestHuffman(t *testing.T) {
+	// Test: Every byte round trips
+	var all strings.Builder
+	for i := 0; i < 256; i++ {
+		all.WriteByte(byte(i))
+	}
+	for _, s := range []string{"", "a", "www.example.com", all.String()} {
+		b := AppendHuffman(nil, s)
+		assert.Len(t, b, HuffmanEncodedLen(s))
+		got, err := HuffmanDecode(b, 0)
+		require.NoError(t, err)
+		assert.Equal(t, s, got)
+	}
+
+	// Test: Padding has to be a short run of ones
+	_, err := HuffmanDecode([]byte{0x1f, 0xff}, 0)
+	assert.ErrorIs(t, err, ErrMalformed)
+	_, err = HuffmanDecode([]byte{0x00}, 0)
+	assert.ErrorIs(t, err, ErrMalformed)
+
+	// Test: EOS in a string is an error
+	_, err = HuffmanDecode([]byte{0xff, 0xff, 0xff, 0xff}, 0)
+	assert.ErrorIs(t, err, ErrMalformed)
+
+	// Test: Output over the limit
+	_, err = HuffmanDecode(AppendHuffman(nil, "www.example.com"), 4)
+	assert.ErrorIs(t, err, ErrMalformed)
+}
+
+func TestTableSizeUpdate(t *testing.T) {
+	e := NewEncoder(4096)
+	d := NewDecoder(4096, 0)
+	decode := func(block []byte) []HeaderField {
+		fields, err := d.Decode(block)
+		require.NoError(t, err)
+		return fields
+	}
+	decode(e.Encode(pairs("x-a", "1", "x-b", "2")))
+	assert.Equal(t, uint32(2*36), d.TableSize())
+
+	// Test: Shrinking and growing again signals both sizes, evicting
+	e.SetMaxTableSize(0)
+	e.SetMaxTableSize(100)
+	d.SetAllowedMaxTableSize(100)
+	block := e.Encode(pairs("x-c", "3"))
+	assert.Equal(t, []byte{0x20, 0x3f, 0x45}, block[:3])
+	assert.Equal(t, pairs("x-c", "3"), decode(block))
+	assert.Equal(t, uint32(36), d.TableSize())
+	assert.Equal(t, e.TableSize(), d.TableSize())
+
+	// Test: Fields larger than the table aren't indexed
+	big := strings.Repeat("v", 100)
+	assert.Equal(t, pairs("x-big", big), decode(e.Encode(pairs("x-big", big))))
+	assert.Equal(t, uint32(36), d.TableSize())
+
+	// Test: Updates past the advertised size and after fields are refused
+	_, err := d.Decode([]byte{0x3f, 0xe1, 0x1f})
+	assert.ErrorIs(t, err, ErrMalformed)
+	_, err = d.Decode([]byte{0x82, 0x20})
+	assert.ErrorIs(t, err, ErrMalformed)
+}
+
+func TestHeaders(t *testing.T) {
+	h := headers.NewHeaders()
+	h.Set("Content-Type", "text/plain")
+	h.Set("Authorization", "Bearer abc")
+	h.Set("Set-Cookie", "a=1")
+	h.Set("Set-Cookie", "b=2")
+
+	// Test: Fields are sorted and credentials kept out of the table
+	fields := Fields(h)
+	assert.Equal(t, []HeaderField{
+		{Name: "authorization", Value: "Bearer abc", Sensitive: true},
+		{Name: "content-type", Value: "text/plain"},
+		{Name: "set-cookie", Value: "a=1", Sensitive: true},
+		{Name: "set-cookie", Value: "b=2", Sensitive: true},
+	}, fields)
+
+	e := NewEncoder(4096)
+	block := e.EncodeHeaders(h)
+	assert.Equal(t, uint32(len("content-type")+len("text/plain")+32), e.TableSize())
+
+	// Test: Round trip through headers.Headers
+	got, err := NewDecoder(4096, 0).DecodeHeaders(block)
+	require.NoError(t, err)
+	assert.Equal(t, h, got)
+
+	// Test: Repeating headers costs a few bytes once indexed
+	again := e.EncodeHeaders(h)
+	assert.Less(t, len(again), len(block))
+}
@@ -0,0 +1,103 @@
+package hpack
+
+import (
+	"fmt"
+	"strings"
+)
+
+// huffmanNode is a node of the decoding tree; leaves have sym >= 0.
+type huffmanNode struct {
+	next [2]int32
+	sym  int16
+}
+
+var huffmanTree = buildHuffmanTree()
+
+func buildHuffmanTree() []huffmanNode {
+	tree := []huffmanNode{{sym: -1}}
+	insert := func(code uint32, length uint8, sym int16) {
+		n := 0
+		for i := int(length) - 1; i >= 0; i-- {
+			bit := (code >> i) & 1
+			if tree[n].next[bit] == 0 {
+				tree = append(tree, huffmanNode{sym: -1})
+				tree[n].next[bit] = int32(len(tree) - 1)
+			}
+			n = int(tree[n].next[bit])
+		}
+		tree[n].sym = sym
+	}
+	for sym, code := range huffmanCodes {
+		insert(code, huffmanCodeLen[sym], int16(sym))
+	}
+	insert(huffmanEOS, huffmanEOSLen, 256)
+	return tree
+}
+
+// HuffmanDecode decodes a Huffman coded string, refusing to produce more
+// than maxLen bytes when maxLen is positive.
+func HuffmanDecode(b []byte, maxLen int) (string, error) {
+	var s strings.Builder
+	n := 0
+	// Bits since the last symbol, and whether they were all ones: padding
+	// must be a prefix of EOS shorter than a byte (RFC 7541 section 5.2)
+	pending, ones := 0, true
+	for _, c := range b {
+		for i := 7; i >= 0; i-- {
+			bit := (c >> i) & 1
+			n = int(huffmanTree[n].next[bit])
+			if n == 0 {
+				return "", fmt.Errorf("%w: invalid Huffman code", ErrMalformed)
+			}
+			pending++
+			ones = ones && bit == 1
+			sym := huffmanTree[n].sym
+			if sym < 0 {
+				continue
+			}
+			if sym == 256 {
+				return "", fmt.Errorf("%w: EOS in Huffman string", ErrMalformed)
+			}
+			if maxLen > 0 && s.Len() >= maxLen {
+				return "", fmt.Errorf("%w: string too long", ErrMalformed)
+			}
+			s.WriteByte(byte(sym))
+			n, pending, ones = 0, 0, true
+		}
+	}
+	if pending > 7 || !ones {
+		return "", fmt.Errorf("%w: invalid Huffman padding", ErrMalformed)
+	}
+	return s.String(), nil
+}
+
+// HuffmanEncodedLen is the length of s once Huffman coded.
+func HuffmanEncodedLen(s string) int {
+	bits := 0
+	for i := 0; i < len(s); i++ {
+		bits += int(huffmanCodeLen[s[i]])
+	}
+	return (bits + 7) / 8
+}
+
+// AppendHuffman appends the Huffman code of s, padded with the start of
+// EOS.
+func AppendHuffman(dst []byte, s string) []byte {
+	// Codes are at most 30 bits, so 64 bits of room always fit one more
+	var acc uint64
+	n := 0
+	for i := 0; i < len(s); i++ {
+		length := int(huffmanCodeLen[s[i]])
+		acc = acc<<length | uint64(huffmanCodes[s[i]])
+		n += length
+		for n >= 8 {
+			n -= 8
+			dst = append(dst, byte(acc>>n))
+		}
+	}
+	if n > 0 {
+		acc = acc<<(8-n) | uint64(0xff>>n)
+		dst = append(dst, byte(acc))
+	}
+	return dst
+}
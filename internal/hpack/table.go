@@ -0,0 +1,92 @@
+package hpack
+
+// dynamicTable holds the fields added by earlier header blocks, oldest
+// first.
+type dynamicTable struct {
+	ents    []HeaderField
+	size    uint32
+	maxSize uint32
+}
+
+func (t *dynamicTable) add(f HeaderField) {
+	// A field larger than the table empties it and isn't added (RFC 7541
+	// section 4.4)
+	if f.Size() > t.maxSize {
+		t.ents = t.ents[:0]
+		t.size = 0
+		return
+	}
+	t.ents = append(t.ents, f)
+	t.size += f.Size()
+	t.evict()
+}
+
+func (t *dynamicTable) setMaxSize(n uint32) {
+	t.maxSize = n
+	t.evict()
+}
+
+func (t *dynamicTable) evict() {
+	n := 0
+	for t.size > t.maxSize && n < len(t.ents) {
+		t.size -= t.ents[n].Size()
+		n++
+	}
+	t.ents = append(t.ents[:0], t.ents[n:]...)
+}
+
+// field returns the entry at a combined static and dynamic index.
+func (t *dynamicTable) field(i uint64) (HeaderField, bool) {
+	if i == 0 {
+		return HeaderField{}, false
+	}
+	if i <= uint64(len(staticTable)) {
+		return staticTable[i-1], true
+	}
+	i -= uint64(len(staticTable))
+	if i > uint64(len(t.ents)) {
+		return HeaderField{}, false
+	}
+	return t.ents[len(t.ents)-int(i)], true
+}
+
+// search finds f in either table. i is the index of an entry with f's
+// name and value when exact, of one with just its name otherwise, and 0
+// when there's neither. Static entries win ties.
+func (t *dynamicTable) search(f HeaderField) (i uint64, exact bool) {
+	if i, ok := staticIndex[HeaderField{Name: f.Name, Value: f.Value}]; ok {
+		return i, true
+	}
+	nameIndex := staticNameIndex[f.Name]
+	// Newest first, as those have the lowest indexes
+	for j := len(t.ents) - 1; j >= 0; j-- {
+		e := t.ents[j]
+		if e.Name != f.Name {
+			continue
+		}
+		index := uint64(len(staticTable) + len(t.ents) - j)
+		if e.Value == f.Value {
+			return index, true
+		}
+		if nameIndex == 0 {
+			nameIndex = index
+		}
+	}
+	return nameIndex, false
+}
+
+var (
+	staticIndex     = map[HeaderField]uint64{}
+	staticNameIndex = map[string]uint64{}
+)
+
+func init() {
+	for i, f := range staticTable {
+		if _, ok := staticIndex[f]; !ok {
+			staticIndex[f] = uint64(i + 1)
+		}
+		if _, ok := staticNameIndex[f.Name]; !ok {
+			staticNameIndex[f.Name] = uint64(i + 1)
+		}
+	}
+}
@@ -0,0 +1,647 @@
+package http2
+
+import (
+	"bufio"
+	"context"
+	"crypto/tls"
+	"encoding/binary"
+	"errors"
+	"io"
+	"net"
+	"sync"
+	"time"
+
+	"http-scratch/internal/headers"
+	"http-scratch/internal/hpack"
+	"http-scratch/internal/request"
+	"http-scratch/internal/response"
+)
+
+// maxEncoderTableSize caps the memory a client's SETTINGS_HEADER_TABLE_SIZE
+// can make us spend on its table.
+const maxEncoderTableSize = 64 << 10
+
+// goAwayTimeout is how long a connection that sent its last response
+// waits for the client to hang up before closing on its own.
+const goAwayTimeout = time.Second
+
+// serverConn is one HTTP/2 connection. The read loop owns the HPACK
+// decoder and opens streams; handlers write their responses from their
+// own goroutines.
+type serverConn struct {
+	srv        *Server
+	conn       net.Conn
+	br         *bufio.Reader
+	remoteAddr string
+	tls        *tls.ConnectionState
+
+	// Owned by the read loop
+	dec         *hpack.Decoder
+	recvWindow  int64
+	block       []byte // header block waiting for CONTINUATION frames
+	blockStream uint32
+	blockEnd    bool  // the HEADERS frame carried END_STREAM
+	blockErr    error // reported once the block is decoded
+
+	// wmu keeps frames from different streams from interleaving, and
+	// guards enc.
+	wmu sync.Mutex
+	enc *hpack.Encoder
+
+	mu sync.Mutex
+	// cond is broadcast when send windows grow or streams go away.
+	cond          *sync.Cond
+	streams       map[uint32]*stream
+	maxStreamID   uint32 // highest stream the client opened
+	sendWindow    int64
+	initialWindow int64 // the client's SETTINGS_INITIAL_WINDOW_SIZE
+	maxFrameSize  int   // the client's SETTINGS_MAX_FRAME_SIZE
+	goingAway     bool
+	goAwayID      uint32 // streams past it are ignored once going away
+	closed        bool
+
+	// ctx ends with the connection, taking every stream with it.
+	ctx      context.Context
+	cancel   context.CancelFunc
+	handlers sync.WaitGroup
+}
+
+func newServerConn(srv *Server, conn net.Conn, br *bufio.Reader) *serverConn {
+	sc := &serverConn{
+		srv:           srv,
+		conn:          conn,
+		br:            br,
+		remoteAddr:    conn.RemoteAddr().String(),
+		dec:           hpack.NewDecoder(defaultTableSize, int(srv.maxHeaderListSize())),
+		enc:           hpack.NewEncoder(defaultTableSize),
+		recvWindow:    defaultWindowSize,
+		streams:       map[uint32]*stream{},
+		sendWindow:    defaultWindowSize,
+		initialWindow: defaultWindowSize,
+		maxFrameSize:  defaultMaxFrameSize,
+	}
+	if tlsConn, ok := conn.(*tls.Conn); ok {
+		state := tlsConn.ConnectionState()
+		sc.tls = &state
+	}
+	sc.cond = sync.NewCond(&sc.mu)
+	sc.ctx, sc.cancel = context.WithCancel(context.Background())
+	return sc
+}
+
+// serve runs the connection until either side ends it. After an h2c
+// upgrade, upgrade is the request to answer on stream 1 and settings the
+// client's HTTP2-Settings.
+func (sc *serverConn) serve(ctx context.Context, upgrade *request.Request, settings []setting) {
+	defer sc.close()
+	go func() {
+		select {
+		case <-ctx.Done():
+			sc.goAway(ErrCodeNo)
+		case <-sc.ctx.Done():
+		}
+	}()
+
+	// HTTP/2 over TLS needs 1.2 or later (RFC 9113 section 9.2)
+	if sc.tls != nil && sc.tls.Version < tls.VersionTLS12 {
+		sc.write(appendGoAway(nil, 0, ErrCodeInadequateSecurity, "TLS 1.2 required"))
+		return
+	}
+	if err := sc.writePreface(); err != nil {
+		return
+	}
+	if upgrade != nil {
+		if err := sc.applySettings(settings); err != nil {
+			sc.handleError(err)
+			return
+		}
+		sc.openUpgraded(upgrade)
+	}
+	if err := sc.readPreface(); err != nil {
+		sc.handleError(err)
+		return
+	}
+
+	for first := true; ; first = false {
+		f, err := readFrame(sc.br, defaultMaxFrameSize)
+		if err == nil {
+			if first && (f.typ != frameSettings || f.has(flagAck)) {
+				err = connError(ErrCodeProtocol, "connection must start with SETTINGS")
+			} else {
+				err = sc.processFrame(f)
+			}
+		}
+		if err != nil && !sc.handleError(err) {
+			return
+		}
+	}
+}
+
+// handleError resets the stream a StreamError is about and reports true,
+// the connection carrying on. Anything else ends the connection, with a
+// GOAWAY for a ConnError.
+func (sc *serverConn) handleError(err error) bool {
+	var se *StreamError
+	if errors.As(err, &se) {
+		sc.write(appendRSTStream(nil, se.StreamID, se.Code))
+		if st := sc.stream(se.StreamID); st != nil {
+			sc.closeStream(st)
+		}
+		return true
+	}
+	var ce *ConnError
+	if errors.As(err, &ce) {
+		sc.mu.Lock()
+		last := sc.maxStreamID
+		sc.mu.Unlock()
+		sc.write(appendGoAway(nil, last, ce.Code, ce.Reason))
+	}
+	return false
+}
+
+func (sc *serverConn) close() {
+	sc.mu.Lock()
+	sc.closed = true
+	sc.mu.Unlock()
+	sc.cancel()
+	sc.cond.Broadcast()
+	sc.conn.Close()
+	sc.handlers.Wait()
+}
+
+func (sc *serverConn) write(b []byte) error {
+	sc.wmu.Lock()
+	defer sc.wmu.Unlock()
+	_, err := sc.conn.Write(b)
+	return err
+}
+
+func (sc *serverConn) writePreface() error {
+	b := appendSettings(nil,
+		setting{settingMaxConcurrentStreams, sc.srv.maxConcurrentStreams()},
+		setting{settingMaxHeaderListSize, sc.srv.maxHeaderListSize()},
+		setting{settingInitialWindowSize, sc.srv.initialWindowSize()},
+	)
+	// The connection window can only grow by WINDOW_UPDATE
+	if w := int64(sc.srv.initialWindowSize()); w > sc.recvWindow {
+		b = appendWindowUpdate(b, 0, uint32(w-sc.recvWindow))
+		sc.recvWindow = w
+	}
+	return sc.write(b)
+}
+
+func (sc *serverConn) readPreface() error {
+	buf := make([]byte, len(ClientPreface))
+	if _, err := io.ReadFull(sc.br, buf); err != nil {
+		return err
+	}
+	if string(buf) != ClientPreface {
+		return connError(ErrCodeProtocol, "bad connection preface")
+	}
+	return nil
+}
+
+// goAway stops new streams and ends the connection once the open ones are
+// done.
+func (sc *serverConn) goAway(code ErrCode) {
+	sc.mu.Lock()
+	if sc.goingAway || sc.closed {
+		sc.mu.Unlock()
+		return
+	}
+	sc.goingAway = true
+	sc.goAwayID = sc.maxStreamID
+	idle := len(sc.streams) == 0
+	sc.mu.Unlock()
+
+	sc.write(appendGoAway(nil, sc.goAwayID, code, ""))
+	if idle {
+		sc.closeWrite()
+	}
+}
+
+// closeWrite ends our side of the connection. Closing outright could throw
+// away responses the client hasn't read yet, so the read loop keeps going
+// until the client hangs up too, or goAwayTimeout passes.
+func (sc *serverConn) closeWrite() {
+	if cw, ok := sc.conn.(interface{ CloseWrite() error }); ok {
+		sc.wmu.Lock()
+		defer sc.wmu.Unlock()
+		cw.CloseWrite()
+		sc.conn.SetReadDeadline(time.Now().Add(goAwayTimeout))
+		return
+	}
+	sc.conn.Close()
+}
+
+func (sc *serverConn) stream(id uint32) *stream {
+	sc.mu.Lock()
+	defer sc.mu.Unlock()
+	return sc.streams[id]
+}
+
+// closeStream forgets st and ends its context. Its handler may still be
+// running; its writes fail from now on.
+func (sc *serverConn) closeStream(st *stream) {
+	sc.mu.Lock()
+	st.closed = true
+	delete(sc.streams, st.id)
+	idle := sc.goingAway && len(sc.streams) == 0
+	sc.mu.Unlock()
+
+	st.cancel()
+	sc.cond.Broadcast()
+	if idle {
+		sc.closeWrite()
+	}
+}
+
+func (sc *serverConn) processFrame(f *frame) error {
+	if sc.blockStream != 0 && f.typ != frameContinuation {
+		return connError(ErrCodeProtocol, "%v frame inside a header block", f.typ)
+	}
+	switch f.typ {
+	case frameData:
+		return sc.processData(f)
+	case frameHeaders:
+		return sc.processHeaders(f)
+	case framePriority:
+		return sc.processPriority(f)
+	case frameRSTStream:
+		return sc.processRSTStream(f)
+	case frameSettings:
+		return sc.processSettings(f)
+	case framePushPromise:
+		return connError(ErrCodeProtocol, "clients can't push")
+	case framePing:
+		return sc.processPing(f)
+	case frameGoAway:
+		return sc.processGoAway(f)
+	case frameWindowUpdate:
+		return sc.processWindowUpdate(f)
+	case frameContinuation:
+		return sc.processContinuation(f)
+	}
+	// Unknown frame types are ignored (RFC 9113 section 4.1)
+	return nil
+}
+
+func (sc *serverConn) processHeaders(f *frame) error {
+	if f.streamID == 0 || f.streamID%2 == 0 {
+		return connError(ErrCodeProtocol, "HEADERS on stream %d", f.streamID)
+	}
+	p, err := f.unpad()
+	if err != nil {
+		return err
+	}
+	sc.blockErr = nil
+	if f.has(flagPriority) {
+		if len(p) < 5 {
+			return connError(ErrCodeFrameSize, "HEADERS too short for its priority")
+		}
+		if binary.BigEndian.Uint32(p)&maxWindowSize == f.streamID {
+			sc.blockErr = streamError(f.streamID, ErrCodeProtocol, "stream depends on itself")
+		}
+		p = p[5:]
+	}
+	sc.block = append(sc.block[:0], p...)
+	sc.blockStream = f.streamID
+	sc.blockEnd = f.has(flagEndStream)
+	return sc.continueHeaders(f)
+}
+
+func (sc *serverConn) processContinuation(f *frame) error {
+	if sc.blockStream == 0 || f.streamID != sc.blockStream {
+		return connError(ErrCodeProtocol, "unexpected CONTINUATION on stream %d", f.streamID)
+	}
+	sc.block = append(sc.block, f.payload...)
+	return sc.continueHeaders(f)
+}
+
+func (sc *serverConn) continueHeaders(f *frame) error {
+	// A header block can't be decoded until it's complete, so its encoded
+	// size is bounded instead
+	if len(sc.block) > 2*int(sc.srv.maxHeaderListSize()) {
+		return connError(ErrCodeEnhanceYourCalm, "header block too large")
+	}
+	if !f.has(flagEndHeaders) {
+		return nil
+	}
+	id, end := sc.blockStream, sc.blockEnd
+	sc.blockStream = 0
+	fields, err := sc.dec.Decode(sc.block)
+	if err != nil {
+		return connError(ErrCodeCompression, "%v", err)
+	}
+	if sc.blockErr != nil {
+		return sc.blockErr
+	}
+	return sc.endHeaders(id, fields, end)
+}
+
+func (sc *serverConn) endHeaders(id uint32, fields []hpack.HeaderField, end bool) error {
+	sc.mu.Lock()
+	st := sc.streams[id]
+	isNew := id > sc.maxStreamID
+	if isNew {
+		sc.maxStreamID = id
+	}
+	ignore := sc.goingAway && id > sc.goAwayID
+	open := len(sc.streams)
+	sc.mu.Unlock()
+
+	if !isNew {
+		// Trailers
+		if st == nil || st.remoteClosed() {
+			return streamError(id, ErrCodeStreamClosed, "HEADERS on a closed stream")
+		}
+		if !end {
+			return streamError(id, ErrCodeProtocol, "trailers without END_STREAM")
+		}
+		for _, f := range fields {
+			if isPseudo(f.Name) {
+				return streamError(id, ErrCodeProtocol, "pseudo-header in trailers")
+			}
+		}
+		return sc.endStream(st)
+	}
+	if ignore {
+		return nil
+	}
+	if uint32(open) >= sc.srv.maxConcurrentStreams() {
+		return streamError(id, ErrCodeRefusedStream, "too many concurrent streams")
+	}
+
+	st = sc.newStream(id)
+	var size uint32
+	for _, f := range fields {
+		size += f.Size()
+	}
+	if size > sc.srv.maxHeaderListSize() {
+		st.req = sc.bareRequest()
+		sc.openStream(st, end)
+		sc.dispatch(st, reject(431, "header fields too large"))
+		return nil
+	}
+	if err := sc.buildRequest(st, fields); err != nil {
+		return err
+	}
+	sc.openStream(st, end)
+	if end {
+		return sc.endStream(st)
+	}
+	// Bodies are only handled once complete, so a client holding one back
+	// is told to go on straight away, unless it is too large already
+	if st.req.ExpectsContinue() {
+		if st.contentLength > sc.srv.maxBodySize() {
+			sc.dispatch(st, reject(413, "request body too large"))
+			return nil
+		}
+		return sc.writeInformational(st, response.StatusContinue, headers.NewHeaders())
+	}
+	return nil
+}
+
+// endStream is the client's END_STREAM: the request is complete.
+func (sc *serverConn) endStream(st *stream) error {
+	sc.mu.Lock()
+	st.endStream = true
+	sc.mu.Unlock()
+	if st.dispatched {
+		return nil
+	}
+	if st.contentLength >= 0 && st.contentLength != len(st.body) {
+		return streamError(st.id, ErrCodeProtocol, "body of %d bytes, content-length %d", len(st.body), st.contentLength)
+	}
+	st.req.Body = string(st.body)
+	st.body = nil
+	sc.dispatch(st, sc.srv.Handler)
+	return nil
+}
+
+func (sc *serverConn) processData(f *frame) error {
+	if f.streamID == 0 {
+		return connError(ErrCodeProtocol, "DATA on stream 0")
+	}
+	// Padding counts against flow control too
+	n := int64(len(f.payload))
+	sc.recvWindow -= n
+	if sc.recvWindow < 0 {
+		return connError(ErrCodeFlowControl, "DATA past the connection window")
+	}
+
+	sc.mu.Lock()
+	st := sc.streams[f.streamID]
+	idle := f.streamID > sc.maxStreamID
+	sc.mu.Unlock()
+	if st == nil {
+		if idle {
+			return connError(ErrCodeProtocol, "DATA on idle stream %d", f.streamID)
+		}
+		// Streams we reset may have data in flight
+		return sc.replenish(f.streamID, n, false)
+	}
+	if st.remoteClosed() {
+		if err := sc.replenish(f.streamID, n, false); err != nil {
+			return err
+		}
+		return streamError(f.streamID, ErrCodeStreamClosed, "DATA after END_STREAM")
+	}
+	st.recvWindow -= n
+	if st.recvWindow < 0 {
+		return streamError(f.streamID, ErrCodeFlowControl, "DATA past the stream window")
+	}
+
+	data, err := f.unpad()
+	if err != nil {
+		return err
+	}
+	if !st.dispatched {
+		if len(st.body)+len(data) > sc.srv.maxBodySize() {
+			st.body = nil
+			sc.dispatch(st, reject(413, "request body too large"))
+		} else {
+			st.body = append(st.body, data...)
+		}
+	}
+	end := f.has(flagEndStream)
+	if err := sc.replenish(f.streamID, n, !end); err != nil {
+		return err
+	}
+	if end {
+		return sc.endStream(st)
+	}
+	return nil
+}
+
+// replenish hands n consumed bytes back to the client's windows: the
+// connection's always, the stream's while it stays open. Bodies are
+// buffered whole, so waiting for the handler to read them gains nothing.
+func (sc *serverConn) replenish(id uint32, n int64, stream bool) error {
+	if n == 0 {
+		return nil
+	}
+	sc.recvWindow += n
+	b := appendWindowUpdate(nil, 0, uint32(n))
+	if stream {
+		if st := sc.stream(id); st != nil {
+			st.recvWindow += n
+			b = appendWindowUpdate(b, id, uint32(n))
+		}
+	}
+	return sc.write(b)
+}
+
+func (sc *serverConn) processPriority(f *frame) error {
+	if f.streamID == 0 {
+		return connError(ErrCodeProtocol, "PRIORITY on stream 0")
+	}
+	if len(f.payload) != 5 {
+		return streamError(f.streamID, ErrCodeFrameSize, "PRIORITY of %d bytes", len(f.payload))
+	}
+	if binary.BigEndian.Uint32(f.payload)&maxWindowSize == f.streamID {
+		return streamError(f.streamID, ErrCodeProtocol, "stream depends on itself")
+	}
+	// Priorities are advisory; every stream is served as it comes
+	return nil
+}
+
+func (sc *serverConn) processRSTStream(f *frame) error {
+	if f.streamID == 0 {
+		return connError(ErrCodeProtocol, "RST_STREAM on stream 0")
+	}
+	if len(f.payload) != 4 {
+		return connError(ErrCodeFrameSize, "RST_STREAM of %d bytes", len(f.payload))
+	}
+	sc.mu.Lock()
+	st := sc.streams[f.streamID]
+	idle := f.streamID > sc.maxStreamID
+	sc.mu.Unlock()
+	if idle {
+		return connError(ErrCodeProtocol, "RST_STREAM on idle stream %d", f.streamID)
+	}
+	if st != nil {
+		sc.closeStream(st)
+	}
+	return nil
+}
+
+func (sc *serverConn) processSettings(f *frame) error {
+	if f.streamID != 0 {
+		return connError(ErrCodeProtocol, "SETTINGS on stream %d", f.streamID)
+	}
+	if f.has(flagAck) {
+		if len(f.payload) != 0 {
+			return connError(ErrCodeFrameSize, "SETTINGS ACK with a payload")
+		}
+		return nil
+	}
+	settings, err := parseSettings(f.payload)
+	if err != nil {
+		return err
+	}
+	if err := sc.applySettings(settings); err != nil {
+		return err
+	}
+	return sc.write(appendFrame(nil, frameSettings, flagAck, 0, nil))
+}
+
+func (sc *serverConn) applySettings(settings []setting) error {
+	sc.mu.Lock()
+	defer sc.mu.Unlock()
+	for _, s := range settings {
+		switch s.id {
+		case settingHeaderTableSize:
+			sc.wmu.Lock()
+			sc.enc.SetMaxTableSize(min(s.value, maxEncoderTableSize))
+			sc.wmu.Unlock()
+		case settingEnablePush:
+			if s.value > 1 {
+				return connError(ErrCodeProtocol, "ENABLE_PUSH of %d", s.value)
+			}
+		case settingInitialWindowSize:
+			if s.value > maxWindowSize {
+				return connError(ErrCodeFlowControl, "INITIAL_WINDOW_SIZE of %d", s.value)
+			}
+			// The change applies to every open stream (RFC 9113 section
+			// 6.9.2)
+			delta := int64(s.value) - sc.initialWindow
+			sc.initialWindow = int64(s.value)
+			for _, st := range sc.streams {
+				st.sendWindow += delta
+				if st.sendWindow > maxWindowSize {
+					return connError(ErrCodeFlowControl, "stream %d window overflow", st.id)
+				}
+			}
+			sc.cond.Broadcast()
+		case settingMaxFrameSize:
+			if s.value < defaultMaxFrameSize || s.value > maxFrameSizeLimit {
+				return connError(ErrCodeProtocol, "MAX_FRAME_SIZE of %d", s.value)
+			}
+			sc.maxFrameSize = int(s.value)
+		}
+		// We never push, so the other settings don't matter
+	}
+	return nil
+}
+
+func (sc *serverConn) processPing(f *frame) error {
+	if f.streamID != 0 {
+		return connError(ErrCodeProtocol, "PING on stream %d", f.streamID)
+	}
+	if len(f.payload) != 8 {
+		return connError(ErrCodeFrameSize, "PING of %d bytes", len(f.payload))
+	}
+	if f.has(flagAck) {
+		return nil
+	}
+	return sc.write(appendFrame(nil, framePing, flagAck, 0, f.payload))
+}
+
+func (sc *serverConn) processGoAway(f *frame) error {
+	if f.streamID != 0 {
+		return connError(ErrCodeProtocol, "GOAWAY on stream %d", f.streamID)
+	}
+	if len(f.payload) < 8 {
+		return connError(ErrCodeFrameSize, "GOAWAY of %d bytes", len(f.payload))
+	}
+	// The client opens no more streams; finish the ones it has
+	sc.goAway(ErrCodeNo)
+	return nil
+}
+
+func (sc *serverConn) processWindowUpdate(f *frame) error {
+	if len(f.payload) != 4 {
+		return connError(ErrCodeFrameSize, "WINDOW_UPDATE of %d bytes", len(f.payload))
+	}
+	inc := int64(binary.BigEndian.Uint32(f.payload) & maxWindowSize)
+
+	sc.mu.Lock()
+	defer sc.mu.Unlock()
+	defer sc.cond.Broadcast()
+	if f.streamID == 0 {
+		if inc == 0 {
+			return connError(ErrCodeProtocol, "WINDOW_UPDATE of 0")
+		}
+		sc.sendWindow += inc
+		if sc.sendWindow > maxWindowSize {
+			return connError(ErrCodeFlowControl, "connection window overflow")
+		}
+		return nil
+	}
+	if f.streamID > sc.maxStreamID {
+		return connError(ErrCodeProtocol, "WINDOW_UPDATE on idle stream %d", f.streamID)
+	}
+	st := sc.streams[f.streamID]
+	if st == nil {
+		return nil
+	}
+	if inc == 0 {
+		return streamError(f.streamID, ErrCodeProtocol, "WINDOW_UPDATE of 0")
+	}
+	st.sendWindow += inc
+	if st.sendWindow > maxWindowSize {
+		return streamError(f.streamID, ErrCodeFlowControl, "stream window overflow")
+	}
+	return nil
+}
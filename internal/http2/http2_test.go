@@ -0,0 +1,511 @@
+package http2
+
+import (
+	"bufio"
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/pem"
+	"io"
+	"math/big"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"http-scratch/internal/headers"
+	"http-scratch/internal/hpack"
+	"http-scratch/internal/request"
+	"http-scratch/internal/response"
+	"http-scratch/internal/server"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// testClient speaks raw frames to a server.
+type testClient struct {
+	t    *testing.T
+	conn net.Conn
+	br   *bufio.Reader
+	enc  *hpack.Encoder
+	dec  *hpack.Decoder
+}
+
+func newTestClient(t *testing.T, s *server.Server) *testClient {
+	conn, err := net.Dial("tcp", s.Addr().String())
+	require.NoError(t, err)
+	t.Cleanup(func() { conn.Close() })
+	return &testClient{t: t, conn: conn, br: bufio.NewReader(conn), enc: hpack.NewEncoder(defaultTableSize), dec: hpack.NewDecoder(defaultTableSize, 0)}
+}
+
+// start sends the preface and waits for the server's SETTINGS.
+func (c *testClient) start(settings ...setting) {
+	io.WriteString(c.conn, ClientPreface)
+	c.conn.Write(appendSettings(nil, settings...))
+	f := c.readFrame()
+	require.Equal(c.t, frameSettings, f.typ)
+	c.write(frameSettings, flagAck, 0, nil)
+}
+
+func (c *testClient) write(typ frameType, flags uint8, id uint32, payload []byte) {
+	_, err := c.conn.Write(appendFrame(nil, typ, flags, id, payload))
+	require.NoError(c.t, err)
+}
+
+func (c *testClient) headers(id uint32, end bool, kv ...string) {
+	var fields []hpack.HeaderField
+	for i := 0; i < len(kv); i += 2 {
+		fields = append(fields, hpack.HeaderField{Name: kv[i], Value: kv[i+1]})
+	}
+	c.conn.Write(appendHeaderBlock(nil, id, c.enc.Encode(fields), end, defaultMaxFrameSize))
+}
+
+func (c *testClient) get(id uint32, path string) {
+	c.headers(id, true, ":method", "GET", ":scheme", "http", ":path", path, ":authority", "localhost")
+}
+
+func (c *testClient) readFrame() *frame {
+	c.conn.SetReadDeadline(time.Now().Add(2 * time.Second))
+	f, err := readFrame(c.br, maxFrameSizeLimit)
+	require.NoError(c.t, err)
+	return f
+}
+
+// next reads frames up to the first one that isn't connection upkeep.
+func (c *testClient) next() *frame {
+	for {
+		f := c.readFrame()
+		switch {
+		case f.typ == frameSettings, f.typ == frameWindowUpdate, f.typ == framePing && f.has(flagAck):
+			continue
+		}
+		return f
+	}
+}
+
+type testResponse struct {
+	fields map[string]string
+	body   string
+}
+
+// response reads the response on stream id, ignoring other streams.
+func (c *testClient) response(id uint32) testResponse {
+	resp := testResponse{fields: map[string]string{}}
+	for {
+		f := c.next()
+		if f.streamID != id {
+			continue
+		}
+		switch f.typ {
+		case frameHeaders, frameContinuation:
+			block := f.payload
+			for !f.has(flagEndHeaders) {
+				f = c.readFrame()
+				require.Equal(c.t, frameContinuation, f.typ)
+				block = append(block, f.payload...)
+			}
+			fields, err := c.dec.Decode(block)
+			require.NoError(c.t, err)
+			for _, hf := range fields {
+				resp.fields[hf.Name] = hf.Value
+			}
+		case frameData:
+			resp.body += string(f.payload)
+		default:
+			c.t.Fatalf("unexpected %v frame", f.typ)
+		}
+		if f.has(flagEndStream) {
+			return resp
+		}
+	}
+}
+
+// goAway reads the GOAWAY, skipping frames of streams still answered.
+func (c *testClient) goAway() (uint32, ErrCode) {
+	f := c.next()
+	for f.streamID != 0 {
+		f = c.next()
+	}
+	require.Equal(c.t, frameGoAway, f.typ)
+	return binary.BigEndian.Uint32(f.payload), ErrCode(binary.BigEndian.Uint32(f.payload[4:]))
+}
+
+func (c *testClient) rst(id uint32) ErrCode {
+	f := c.next()
+	require.Equal(c.t, frameRSTStream, f.typ)
+	require.Equal(c.t, id, f.streamID)
+	return ErrCode(binary.BigEndian.Uint32(f.payload))
+}
+
+func echo(w *response.Writer, req *request.Request) {
+	if req.RequestLine.RequestTarget == "/silent" {
+		return
+	}
+	if link, ok := req.Headers.Get("x-early-hints"); ok {
+		hints := headers.NewHeaders()
+		hints.Set("Link", link)
+		w.WriteInformational(response.StatusEarlyHints, hints)
+	}
+	body := req.RequestLine.Method + " " + req.RequestLine.RequestTarget + " " + req.RequestLine.HTTPVersion + " " + req.Body
+	if n, ok := req.Headers.Get("x-repeat"); ok {
+		body = strings.Repeat("x", len(n)*1000)
+	}
+	h := response.GetDefaultHeaders(len(body))
+	host, _ := req.Headers.Get("host")
+	h.Replace("x-host", host)
+	w.WriteStatusLine(response.StatusOK)
+	w.WriteHeaders(h)
+	w.WriteBody([]byte(body))
+}
+
+func startH2C(t *testing.T, h2 *Server) *server.Server {
+	if h2.Handler == nil {
+		h2.Handler = echo
+	}
+	s, err := server.Serve(0, func(w *response.Writer, req *request.Request) {
+		w.WriteStatusLine(response.StatusOK)
+		w.WriteHeaders(response.GetDefaultHeaders(2))
+		w.WriteBody([]byte("h1"))
+	})
+	require.NoError(t, err)
+	h2.EnableH2C(s)
+	t.Cleanup(func() { s.Close() })
+	return s
+}
+
+func TestPriorKnowledge(t *testing.T) {
+	s := startH2C(t, &Server{})
+	c := newTestClient(t, s)
+	c.start()
+
+	// Test: GET on a stream
+	c.get(1, "/hello")
+	resp := c.response(1)
+	assert.Equal(t, "200", resp.fields[":status"])
+	assert.Equal(t, "localhost", resp.fields["x-host"])
+	assert.Equal(t, "GET /hello 2 ", resp.body)
+	assert.NotContains(t, resp.fields, "connection")
+
+	// Test: Body split across DATA frames
+	c.headers(3, false, ":method", "POST", ":scheme", "http", ":path", "/post", ":authority", "localhost", "content-length", "5")
+	c.write(frameData, 0, 3, []byte("he"))
+	c.write(frameData, flagEndStream, 3, []byte("llo"))
+	assert.Equal(t, "POST /post 2 hello", c.response(3).body)
+
+	// Test: PING is answered
+	c.write(framePing, 0, 0, []byte("12345678"))
+	f := c.readFrame()
+	for f.typ == frameWindowUpdate {
+		f = c.readFrame()
+	}
+	assert.Equal(t, framePing, f.typ)
+	assert.True(t, f.has(flagAck))
+	assert.Equal(t, "12345678", string(f.payload))
+
+	// Test: Content-length has to match the body
+	c.headers(5, false, ":method", "POST", ":scheme", "http", ":path", "/post", "content-length", "10")
+	c.write(frameData, flagEndStream, 5, []byte("short"))
+	assert.Equal(t, ErrCodeProtocol, c.rst(5))
+
+	// Test: Malformed requests reset their stream only
+	c.headers(7, true, ":method", "GET", ":path", "/")
+	assert.Equal(t, ErrCodeProtocol, c.rst(7))
+	c.headers(9, true, ":method", "GET", ":scheme", "http", ":path", "/", "connection", "close")
+	assert.Equal(t, ErrCodeProtocol, c.rst(9))
+
+	// Test: A handler that writes nothing resets its stream
+	c.get(11, "/silent")
+	assert.Equal(t, ErrCodeInternal, c.rst(11))
+
+	c.get(13, "/still-up")
+	assert.Equal(t, "GET /still-up 2 ", c.response(13).body)
+
+	// Test: A client holding its body back gets 100 Continue first
+	c.headers(15, false, ":method", "POST", ":scheme", "http", ":path", "/post", ":authority", "localhost",
+		"content-length", "2", "expect", "100-continue")
+	f = c.next()
+	require.Equal(t, frameHeaders, f.typ)
+	assert.False(t, f.has(flagEndStream))
+	fields, err := c.dec.Decode(f.payload)
+	require.NoError(t, err)
+	assert.Equal(t, []hpack.HeaderField{{Name: ":status", Value: "100"}}, fields)
+	c.write(frameData, flagEndStream, 15, []byte("hi"))
+	assert.Equal(t, "POST /post 2 hi", c.response(15).body)
+
+	// Test: Early hints go out ahead of the response
+	c.headers(17, true, ":method", "GET", ":scheme", "http", ":path", "/", ":authority", "localhost", "x-early-hints", "</app.css>; rel=preload")
+	f = c.next()
+	fields, err = c.dec.Decode(f.payload)
+	require.NoError(t, err)
+	assert.Equal(t, []hpack.HeaderField{{Name: ":status", Value: "103"}, {Name: "link", Value: "</app.css>; rel=preload"}}, fields)
+	assert.Equal(t, "200", c.response(17).fields[":status"])
+
+	// Test: HTTP/1.1 still works on the same listener
+	conn, err := net.Dial("tcp", s.Addr().String())
+	require.NoError(t, err)
+	defer conn.Close()
+	io.WriteString(conn, "GET / HTTP/1.1\r\nHost: localhost\r\n\r\n")
+	status, err := bufio.NewReader(conn).ReadString('\n')
+	require.NoError(t, err)
+	assert.Equal(t, "HTTP/1.1 200 OK\r\n", status)
+}
+
+func TestUpgradeH2C(t *testing.T) {
+	s := startH2C(t, &Server{})
+	settings := base64.RawURLEncoding.EncodeToString(appendSettings(nil, setting{settingInitialWindowSize, 1 << 20})[frameHeaderLen:])
+
+	// Test: The upgrading request is answered on stream 1
+	c := newTestClient(t, s)
+	io.WriteString(c.conn, "GET /up HTTP/1.1\r\nHost: localhost\r\nConnection: Upgrade, HTTP2-Settings\r\nUpgrade: h2c\r\nHTTP2-Settings: "+settings+"\r\n\r\n")
+	status, err := c.br.ReadString('\n')
+	require.NoError(t, err)
+	assert.Equal(t, "HTTP/1.1 101 Switching Protocols\r\n", status)
+	for line := ""; line != "\r\n"; {
+		line, err = c.br.ReadString('\n')
+		require.NoError(t, err)
+	}
+	c.start()
+	resp := c.response(1)
+	assert.Equal(t, "GET /up 1.1 ", resp.body)
+
+	c.get(3, "/next")
+	assert.Equal(t, "GET /next 2 ", c.response(3).body)
+
+	// Test: A missing HTTP2-Settings refuses the upgrade
+	c = newTestClient(t, s)
+	io.WriteString(c.conn, "GET /up HTTP/1.1\r\nHost: localhost\r\nConnection: Upgrade\r\nUpgrade: h2c\r\n\r\n")
+	status, err = c.br.ReadString('\n')
+	require.NoError(t, err)
+	assert.Equal(t, "HTTP/1.1 400 Bad Request\r\n", status)
+}
+
+func TestConnectionErrors(t *testing.T) {
+	s := startH2C(t, &Server{})
+	cases := []struct {
+		name string
+		send func(c *testClient)
+		code ErrCode
+	}{
+		{"DATA on stream 0", func(c *testClient) { c.write(frameData, 0, 0, []byte("x")) }, ErrCodeProtocol},
+		{"HEADERS on an even stream", func(c *testClient) { c.get(2, "/") }, ErrCodeProtocol},
+		{"PING of the wrong size", func(c *testClient) { c.write(framePing, 0, 0, []byte("1234")) }, ErrCodeFrameSize},
+		{"WINDOW_UPDATE overflowing the connection", func(c *testClient) {
+			c.write(frameWindowUpdate, 0, 0, binary.BigEndian.AppendUint32(nil, maxWindowSize))
+		}, ErrCodeFlowControl},
+		{"Broken HPACK", func(c *testClient) { c.write(frameHeaders, flagEndHeaders, 1, []byte{0xff, 0x7f}) }, ErrCodeCompression},
+		{"Frame between HEADERS and CONTINUATION", func(c *testClient) {
+			c.write(frameHeaders, 0, 1, []byte{0x82})
+			c.write(framePing, 0, 0, []byte("12345678"))
+		}, ErrCodeProtocol},
+		{"Oversized frame", func(c *testClient) { c.write(frameData, 0, 1, make([]byte, defaultMaxFrameSize+1)) }, ErrCodeFrameSize},
+	}
+	for _, tc := range cases {
+		// Test: Protocol violations end the connection with GOAWAY
+		c := newTestClient(t, s)
+		c.start()
+		tc.send(c)
+		_, code := c.goAway()
+		assert.Equal(t, tc.code, code, tc.name)
+	}
+
+	// Test: A bad preface after an upgrade gets a GOAWAY too
+	c := newTestClient(t, s)
+	io.WriteString(c.conn, "GET / HTTP/1.1\r\nHost: localhost\r\nConnection: Upgrade, HTTP2-Settings\r\nUpgrade: h2c\r\nHTTP2-Settings: \r\n\r\n")
+	for line := ""; line != "\r\n"; {
+		var err error
+		line, err = c.br.ReadString('\n')
+		require.NoError(t, err)
+	}
+	io.WriteString(c.conn, "GET / HTTP/1.1\r\nHost: localhost\r\n\r\n")
+	f := c.readFrame()
+	require.Equal(t, frameSettings, f.typ)
+	_, code := c.goAway()
+	assert.Equal(t, ErrCodeProtocol, code)
+}
+
+func TestStreamLimits(t *testing.T) {
+	release := make(chan struct{})
+	s := startH2C(t, &Server{
+		MaxConcurrentStreams: 1,
+		MaxBodySize:          4,
+		Handler: func(w *response.Writer, req *request.Request) {
+			if req.RequestLine.RequestTarget == "/wait" {
+				<-release
+			}
+			echo(w, req)
+		},
+	})
+	c := newTestClient(t, s)
+	c.start()
+
+	// Test: Streams past MaxConcurrentStreams are refused
+	c.get(1, "/wait")
+	c.get(3, "/")
+	assert.Equal(t, ErrCodeRefusedStream, c.rst(3))
+	close(release)
+	assert.Equal(t, "GET /wait 2 ", c.response(1).body)
+
+	// Test: Bodies over MaxBodySize get a 413 and the stream is stopped
+	c.headers(5, false, ":method", "POST", ":scheme", "http", ":path", "/", ":authority", "localhost")
+	c.write(frameData, 0, 5, []byte("too long"))
+	assert.Equal(t, "413", c.response(5).fields[":status"])
+	assert.Equal(t, ErrCodeNo, c.rst(5))
+
+	// Test: A held back body over MaxBodySize is refused before it is sent
+	c.headers(7, false, ":method", "POST", ":scheme", "http", ":path", "/", ":authority", "localhost",
+		"content-length", "8", "expect", "100-continue")
+	assert.Equal(t, "413", c.response(7).fields[":status"])
+	assert.Equal(t, ErrCodeNo, c.rst(7))
+
+	// Test: Client RST_STREAM frees the stream
+	c.headers(9, false, ":method", "POST", ":scheme", "http", ":path", "/", ":authority", "localhost")
+	c.write(frameRSTStream, 0, 9, binary.BigEndian.AppendUint32(nil, uint32(ErrCodeCancel)))
+	c.get(11, "/after")
+	assert.Equal(t, "GET /after 2 ", c.response(11).body)
+}
+
+func TestFlowControl(t *testing.T) {
+	s := startH2C(t, &Server{})
+	c := newTestClient(t, s)
+	c.start(setting{settingInitialWindowSize, 100})
+
+	// Test: DATA stops at the stream window until WINDOW_UPDATE
+	c.headers(1, true, ":method", "GET", ":scheme", "http", ":path", "/", "x-repeat", "x")
+	resp := c.next()
+	require.Equal(t, frameHeaders, resp.typ)
+	f := c.next()
+	require.Equal(t, frameData, f.typ)
+	assert.Len(t, f.payload, 100)
+
+	c.conn.SetReadDeadline(time.Now().Add(50 * time.Millisecond))
+	_, err := readFrame(c.br, maxFrameSizeLimit)
+	assert.Error(t, err)
+	c.br = bufio.NewReader(c.conn)
+
+	// Test: Raising INITIAL_WINDOW_SIZE applies to open streams
+	c.conn.Write(appendSettings(nil, setting{settingInitialWindowSize, 65535}))
+	got := 100
+	for got < 1000 {
+		f = c.next()
+		require.Equal(t, frameData, f.typ)
+		got += len(f.payload)
+	}
+	assert.Equal(t, 1000, got)
+	f = c.next()
+	assert.Empty(t, f.payload)
+	assert.True(t, f.has(flagEndStream))
+}
+
+func TestGracefulShutdown(t *testing.T) {
+	release := make(chan struct{})
+	s := startH2C(t, &Server{Handler: func(w *response.Writer, req *request.Request) {
+		<-release
+		echo(w, req)
+	}})
+	c := newTestClient(t, s)
+	c.start()
+	c.get(1, "/slow")
+	time.Sleep(20 * time.Millisecond)
+
+	// Test: Shutdown sends GOAWAY and waits for open streams
+	done := make(chan error)
+	go func() { done <- s.Shutdown(context.Background()) }()
+	last, code := c.goAway()
+	assert.Equal(t, uint32(1), last)
+	assert.Equal(t, ErrCodeNo, code)
+
+	// Test: Streams past the GOAWAY are ignored
+	c.get(3, "/late")
+	close(release)
+	assert.Equal(t, "GET /slow 2 ", c.response(1).body)
+	require.NoError(t, <-done)
+}
+
+// writeCert writes a self-signed certificate for localhost to dir.
+func writeCert(t *testing.T, dir string) (server.CertFile, *x509.Certificate) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	require.NoError(t, err)
+	tmpl := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: "localhost"},
+		DNSNames:     []string{"localhost"},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, &key.PublicKey, key)
+	require.NoError(t, err)
+	cert, err := x509.ParseCertificate(der)
+	require.NoError(t, err)
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	require.NoError(t, err)
+
+	f := server.CertFile{CertFile: filepath.Join(dir, "cert.pem"), KeyFile: filepath.Join(dir, "key.pem")}
+	require.NoError(t, os.WriteFile(f.CertFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0o600))
+	require.NoError(t, os.WriteFile(f.KeyFile, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER}), 0o600))
+	return f, cert
+}
+
+func TestServeTLS(t *testing.T) {
+	file, cert := writeCert(t, t.TempDir())
+	store, err := server.NewCertStore(file)
+	require.NoError(t, err)
+	h2 := &Server{Handler: func(w *response.Writer, req *request.Request) {
+		if req.TLS == nil {
+			w.WriteStatusLine(response.StatusInternalServerError)
+			w.WriteHeaders(response.GetDefaultHeaders(0))
+			return
+		}
+		echo(w, req)
+	}}
+	s, err := h2.ServeTLS(0, &server.TLSOptions{Certificates: store})
+	require.NoError(t, err)
+	defer s.Close()
+	roots := x509.NewCertPool()
+	roots.AddCert(cert)
+	url := "https://localhost:" + strconv.Itoa(s.Addr().(*net.TCPAddr).Port) + "/tls"
+
+	// Test: ALPN picks h2 for clients that offer it
+	client := &http.Client{Transport: &http.Transport{
+		TLSClientConfig:   &tls.Config{RootCAs: roots},
+		ForceAttemptHTTP2: true,
+	}}
+	defer client.CloseIdleConnections()
+	for range 2 {
+		resp, err := client.Post(url, "text/plain", strings.NewReader("body"))
+		require.NoError(t, err)
+		body, err := io.ReadAll(resp.Body)
+		resp.Body.Close()
+		require.NoError(t, err)
+		assert.Equal(t, 200, resp.StatusCode)
+		assert.Equal(t, "HTTP/2.0", resp.Proto)
+		assert.Equal(t, "POST /tls 2 body", string(body))
+	}
+
+	// Test: Clients without h2 get HTTP/1.1 from the same handler
+	client = &http.Client{Transport: &http.Transport{
+		TLSClientConfig:   &tls.Config{RootCAs: roots},
+		ForceAttemptHTTP2: false,
+		TLSNextProto:      map[string]func(string, *tls.Conn) http.RoundTripper{},
+	}}
+	defer client.CloseIdleConnections()
+	resp, err := client.Get(url)
+	require.NoError(t, err)
+	body, err := io.ReadAll(resp.Body)
+	resp.Body.Close()
+	require.NoError(t, err)
+	assert.Equal(t, "HTTP/1.1", resp.Proto)
+	assert.Equal(t, "GET /tls 1.1 ", string(body))
+}
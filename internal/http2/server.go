@@ -0,0 +1,148 @@
+package http2
+
+import (
+	"bufio"
+	"context"
+	"encoding/base64"
+	"errors"
+	"net"
+	"strings"
+
+	"http-scratch/internal/headers"
+	"http-scratch/internal/request"
+	"http-scratch/internal/response"
+	"http-scratch/internal/server"
+)
+
+var ErrBadSettingsHeader = errors.New("HTTP2-Settings must be one base64url SETTINGS payload")
+
+const (
+	defaultMaxConcurrentStreams = 100
+	defaultMaxHeaderListSize    = 1 << 20
+	defaultMaxBodySize          = 10 << 20
+)
+
+// Server serves HTTP/2 streams with the same Handler HTTP/1.1 requests go
+// to. Each stream becomes a request once its body is complete, so a client
+// expecting 100-continue is told to go on as soon as its headers arrive,
+// unless the declared length is past MaxBodySize. Unlike HTTP/1.1 servers
+// that hold bodies, handlers can't refuse a request before its body is
+// sent, and never see it held.
+type Server struct {
+	Handler server.Handler
+	// MaxConcurrentStreams caps the streams a client may have open at once;
+	// zero means 100. Streams past it are refused.
+	MaxConcurrentStreams uint32
+	// MaxHeaderListSize bounds the decoded header fields of a request; zero
+	// means 1MB. Larger requests get a 431.
+	MaxHeaderListSize uint32
+	// MaxBodySize bounds a request body; zero means 10MB. Larger bodies
+	// get a 413.
+	MaxBodySize int
+	// InitialWindowSize is how much body each stream may send before we
+	// acknowledge it; zero means the protocol's 65535.
+	InitialWindowSize uint32
+}
+
+func (s *Server) maxConcurrentStreams() uint32 {
+	if s.MaxConcurrentStreams == 0 {
+		return defaultMaxConcurrentStreams
+	}
+	return s.MaxConcurrentStreams
+}
+
+func (s *Server) maxHeaderListSize() uint32 {
+	if s.MaxHeaderListSize == 0 {
+		return defaultMaxHeaderListSize
+	}
+	return s.MaxHeaderListSize
+}
+
+func (s *Server) maxBodySize() int {
+	if s.MaxBodySize <= 0 {
+		return defaultMaxBodySize
+	}
+	return s.MaxBodySize
+}
+
+func (s *Server) initialWindowSize() uint32 {
+	if s.InitialWindowSize == 0 || s.InitialWindowSize > maxWindowSize {
+		return defaultWindowSize
+	}
+	return s.InitialWindowSize
+}
+
+// EnableH2C serves cleartext HTTP/2 on srv's listener, both to clients
+// starting with the connection preface and to those asking for
+// "Upgrade: h2c".
+func (s *Server) EnableH2C(srv *server.Server) {
+	srv.HandlePreface(ClientPreface, s.ServeConn)
+	srv.HandleUpgrade("h2c", h2cUpgrader{s})
+}
+
+// NextProtoTLS is HTTP/2's ALPN protocol name.
+const NextProtoTLS = "h2"
+
+// ServeTLS is server.ServeTLS offering HTTP/2 over ALPN, with s.Handler
+// serving both HTTP/2 and HTTP/1.1 clients.
+func (s *Server) ServeTLS(port int, opts *server.TLSOptions) (*server.Server, error) {
+	if opts == nil {
+		return nil, server.ErrNoCertificates
+	}
+	o := *opts
+	o.NextProtos = append([]server.NextProto{{Name: NextProtoTLS, Handler: s.ServeConn}}, opts.NextProtos...)
+	return server.ServeTLS(port, s.Handler, &o)
+}
+
+// ServeConn speaks HTTP/2 on conn, which must start with the client
+// preface, until the client leaves or ctx ends. Ending ctx sends GOAWAY
+// and lets the open streams finish first.
+func (s *Server) ServeConn(ctx context.Context, conn net.Conn, br *bufio.Reader) {
+	newServerConn(s, conn, br).serve(ctx, nil, nil)
+}
+
+type h2cUpgrader struct {
+	srv *Server
+}
+
+// Accept checks HTTP2-Settings, which carries the client's SETTINGS for
+// the upgraded connection (RFC 7540 section 3.2.1).
+func (u h2cUpgrader) Accept(req *request.Request) (headers.Headers, error) {
+	if req.TLS != nil {
+		return nil, &server.HandlerError{StatusCode: response.StatusBadRequest, Message: "h2c is for cleartext connections"}
+	}
+	if _, err := upgradeSettings(req); err != nil {
+		return nil, &server.HandlerError{StatusCode: response.StatusBadRequest, Message: err.Error()}
+	}
+	return nil, nil
+}
+
+// Serve answers the upgrading request as stream 1, then carries on with
+// whatever the client sends next.
+func (u h2cUpgrader) Serve(conn net.Conn, br *bufio.Reader, req *request.Request) {
+	defer conn.Close()
+	settings, err := upgradeSettings(req)
+	if err != nil {
+		return
+	}
+	for _, name := range []string{"connection", "upgrade", "http2-settings"} {
+		req.Headers.Delete(name)
+	}
+	newServerConn(u.srv, conn, br).serve(req.Context(), req, settings)
+}
+
+func upgradeSettings(req *request.Request) ([]setting, error) {
+	v, ok := req.Headers.Get("http2-settings")
+	if !ok || strings.Contains(v, ",") {
+		return nil, ErrBadSettingsHeader
+	}
+	payload, err := base64.RawURLEncoding.DecodeString(strings.TrimRight(strings.TrimSpace(v), "="))
+	if err != nil {
+		return nil, ErrBadSettingsHeader
+	}
+	settings, err := parseSettings(payload)
+	if err != nil {
+		return nil, ErrBadSettingsHeader
+	}
+	return settings, nil
+}
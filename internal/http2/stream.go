@@ -0,0 +1,333 @@
+package http2
+
+import (
+	"context"
+	"errors"
+	"strconv"
+	"strings"
+
+	"http-scratch/internal/headers"
+	"http-scratch/internal/hpack"
+	"http-scratch/internal/problem"
+	"http-scratch/internal/request"
+	"http-scratch/internal/response"
+	"http-scratch/internal/server"
+)
+
+var (
+	ErrStreamClosed  = errors.New("http2: stream closed")
+	ErrHeaderWritten = errors.New("http2: response header already written")
+)
+
+// stream is one request and its response.
+type stream struct {
+	sc     *serverConn
+	id     uint32
+	ctx    context.Context
+	cancel context.CancelFunc
+
+	// Owned by the read loop
+	req           *request.Request
+	body          []byte
+	contentLength int // -1 when the request has none
+	recvWindow    int64
+	dispatched    bool
+
+	// Guarded by sc.mu
+	endStream  bool // the client is done sending
+	closed     bool
+	sendWindow int64
+}
+
+func (sc *serverConn) newStream(id uint32) *stream {
+	st := &stream{
+		sc:            sc,
+		id:            id,
+		contentLength: -1,
+		recvWindow:    int64(sc.srv.initialWindowSize()),
+	}
+	st.ctx, st.cancel = context.WithCancel(sc.ctx)
+	return st
+}
+
+func (sc *serverConn) openStream(st *stream, end bool) {
+	sc.mu.Lock()
+	defer sc.mu.Unlock()
+	st.sendWindow = sc.initialWindow
+	st.endStream = end
+	sc.streams[st.id] = st
+}
+
+// openUpgraded makes the request that asked for h2c stream 1, complete
+// already (RFC 7540 section 3.2).
+func (sc *serverConn) openUpgraded(req *request.Request) {
+	st := sc.newStream(1)
+	st.req = req
+	sc.mu.Lock()
+	sc.maxStreamID = 1
+	sc.mu.Unlock()
+	sc.openStream(st, true)
+	sc.dispatch(st, sc.srv.Handler)
+}
+
+func (st *stream) remoteClosed() bool {
+	st.sc.mu.Lock()
+	defer st.sc.mu.Unlock()
+	return st.endStream
+}
+
+func (sc *serverConn) dispatch(st *stream, h server.Handler) {
+	st.dispatched = true
+	sc.handlers.Add(1)
+	go sc.runHandler(st, h)
+}
+
+func (sc *serverConn) runHandler(st *stream, h server.Handler) {
+	defer sc.handlers.Done()
+	rw := &responseWriter{st: st}
+	defer sc.finishStream(st, rw)
+	h(response.NewBackendWriter(rw), st.req.WithContext(st.ctx))
+}
+
+// finishStream ends the response once the handler returns. A handler
+// that wrote nothing gets the stream reset, and a client still sending a
+// body is told to stop.
+func (sc *serverConn) finishStream(st *stream, rw *responseWriter) {
+	sc.mu.Lock()
+	closed, remoteOpen := st.closed, !st.endStream
+	sc.mu.Unlock()
+	if !closed {
+		if !rw.wroteHeader {
+			sc.write(appendRSTStream(nil, st.id, ErrCodeInternal))
+		} else {
+			if !rw.ended {
+				rw.WriteTrailers(nil)
+			}
+			if remoteOpen {
+				sc.write(appendRSTStream(nil, st.id, ErrCodeNo))
+			}
+		}
+	}
+	sc.closeStream(st)
+}
+
+// reject answers a stream without the handler.
+func reject(status response.StatusCode, detail string) server.Handler {
+	return func(w *response.Writer, req *request.Request) {
+		problem.Write(w, req, problem.New(status, detail), nil)
+	}
+}
+
+func (sc *serverConn) bareRequest() *request.Request {
+	return &request.Request{Headers: headers.NewHeaders(), RemoteAddr: sc.remoteAddr, TLS: sc.tls}
+}
+
+// connectionSpecific fields have no meaning in HTTP/2 (RFC 9113 section
+// 8.2.2).
+var connectionSpecific = map[string]bool{
+	"connection":        true,
+	"keep-alive":        true,
+	"proxy-connection":  true,
+	"transfer-encoding": true,
+	"upgrade":           true,
+}
+
+func isPseudo(name string) bool {
+	return strings.HasPrefix(name, ":")
+}
+
+// buildRequest turns a request's header fields into st.req, rejecting
+// malformed ones (RFC 9113 section 8.3.1).
+func (sc *serverConn) buildRequest(st *stream, fields []hpack.HeaderField) error {
+	malformed := func(format string, args ...any) error {
+		return streamError(st.id, ErrCodeProtocol, "malformed request: "+format, args...)
+	}
+
+	req := sc.bareRequest()
+	pseudo := map[string]string{}
+	regular := false
+	for _, f := range fields {
+		if isPseudo(f.Name) {
+			switch f.Name {
+			case ":method", ":scheme", ":path", ":authority":
+			default:
+				return malformed("unknown pseudo-header %s", f.Name)
+			}
+			if regular {
+				return malformed("%s after regular fields", f.Name)
+			}
+			if _, ok := pseudo[f.Name]; ok {
+				return malformed("repeated %s", f.Name)
+			}
+			pseudo[f.Name] = f.Value
+			continue
+		}
+		regular = true
+		if f.Name == "" || strings.ToLower(f.Name) != f.Name {
+			return malformed("field name %q", f.Name)
+		}
+		if strings.ContainsAny(f.Value, "\r\n\x00") {
+			return malformed("value of %s", f.Name)
+		}
+		if connectionSpecific[f.Name] || (f.Name == "te" && f.Value != "trailers") {
+			return malformed("connection-specific field %s", f.Name)
+		}
+		req.Headers.Set(f.Name, f.Value)
+	}
+
+	method, authority := pseudo[":method"], pseudo[":authority"]
+	target := pseudo[":path"]
+	switch {
+	case method == "":
+		return malformed("no :method")
+	case method == "CONNECT":
+		_, hasScheme := pseudo[":scheme"]
+		_, hasPath := pseudo[":path"]
+		if hasScheme || hasPath || authority == "" {
+			return malformed("CONNECT needs :authority alone")
+		}
+		target = authority
+	case pseudo[":scheme"] == "" || target == "":
+		return malformed("no :scheme or :path")
+	}
+	if _, ok := req.Headers.Get("host"); !ok && authority != "" {
+		req.Headers.Replace("host", authority)
+	}
+	if v, ok := req.Headers.Get("content-length"); ok {
+		n, err := strconv.Atoi(v)
+		if err != nil || n < 0 {
+			return malformed("content-length %q", v)
+		}
+		st.contentLength = n
+	}
+
+	req.RequestLine = request.RequestLine{Method: method, RequestTarget: target, HTTPVersion: "2"}
+	st.req = req
+	return nil
+}
+
+// responseFields lists h for a header block, leaving out what HTTP/2
+// has no use for.
+func responseFields(fields []hpack.HeaderField, h headers.Headers) []hpack.HeaderField {
+	for _, f := range hpack.Fields(h) {
+		if !connectionSpecific[f.Name] {
+			fields = append(fields, f)
+		}
+	}
+	return fields
+}
+
+// responseWriter is the response.Backend of a stream.
+type responseWriter struct {
+	st          *stream
+	wroteHeader bool
+	ended       bool
+}
+
+func (rw *responseWriter) WriteInformational(statusCode response.StatusCode, h headers.Headers) error {
+	if rw.wroteHeader {
+		return ErrHeaderWritten
+	}
+	return rw.st.sc.writeInformational(rw.st, statusCode, h)
+}
+
+func (rw *responseWriter) WriteHeader(statusCode response.StatusCode, h headers.Headers) error {
+	if rw.wroteHeader {
+		return ErrHeaderWritten
+	}
+	rw.wroteHeader = true
+	status := []hpack.HeaderField{{Name: ":status", Value: strconv.Itoa(int(statusCode))}}
+	return rw.st.sc.writeHeaders(rw.st, responseFields(status, h), false)
+}
+
+func (rw *responseWriter) Write(p []byte) (int, error) {
+	if rw.ended {
+		return 0, ErrStreamClosed
+	}
+	if !rw.wroteHeader {
+		if err := rw.WriteHeader(response.StatusOK, headers.NewHeaders()); err != nil {
+			return 0, err
+		}
+	}
+	return rw.st.sc.writeData(rw.st, p, false)
+}
+
+func (rw *responseWriter) WriteTrailers(h headers.Headers) error {
+	if rw.ended {
+		return ErrStreamClosed
+	}
+	if !rw.wroteHeader {
+		if err := rw.WriteHeader(response.StatusOK, headers.NewHeaders()); err != nil {
+			return err
+		}
+	}
+	rw.ended = true
+	if len(h) == 0 {
+		_, err := rw.st.sc.writeData(rw.st, nil, true)
+		return err
+	}
+	return rw.st.sc.writeHeaders(rw.st, responseFields(nil, h), true)
+}
+
+// Flush does nothing: frames are written as soon as they're ready.
+func (rw *responseWriter) Flush() error {
+	return nil
+}
+
+// writeInformational sends a 1xx response as a HEADERS frame of its own
+// ahead of the final one.
+func (sc *serverConn) writeInformational(st *stream, statusCode response.StatusCode, h headers.Headers) error {
+	status := []hpack.HeaderField{{Name: ":status", Value: strconv.Itoa(int(statusCode))}}
+	return sc.writeHeaders(st, responseFields(status, h), false)
+}
+
+func (sc *serverConn) writeHeaders(st *stream, fields []hpack.HeaderField, end bool) error {
+	sc.mu.Lock()
+	closed := st.closed || sc.closed
+	maxFrameSize := sc.maxFrameSize
+	sc.mu.Unlock()
+	if closed {
+		return ErrStreamClosed
+	}
+	// Blocks have to go out in the order they're encoded, and nothing may
+	// come between HEADERS and its CONTINUATION frames
+	sc.wmu.Lock()
+	defer sc.wmu.Unlock()
+	block := sc.enc.Encode(fields)
+	_, err := sc.conn.Write(appendHeaderBlock(nil, st.id, block, end, maxFrameSize))
+	return err
+}
+
+// writeData sends p as DATA frames, waiting for the client to open the
+// connection and stream windows as needed.
+func (sc *serverConn) writeData(st *stream, p []byte, end bool) (int, error) {
+	written := 0
+	for {
+		sc.mu.Lock()
+		for len(p) > 0 && (sc.sendWindow <= 0 || st.sendWindow <= 0) && !st.closed && !sc.closed {
+			sc.cond.Wait()
+		}
+		if st.closed || sc.closed {
+			sc.mu.Unlock()
+			return written, ErrStreamClosed
+		}
+		n := min(int64(len(p)), sc.sendWindow, st.sendWindow, int64(sc.maxFrameSize))
+		sc.sendWindow -= n
+		st.sendWindow -= n
+		sc.mu.Unlock()
+
+		flags := uint8(0)
+		last := int(n) == len(p)
+		if last && end {
+			flags |= flagEndStream
+		}
+		if err := sc.write(appendFrame(nil, frameData, flags, st.id, p[:n])); err != nil {
+			return written, err
+		}
+		written += int(n)
+		p = p[n:]
+		if last {
+			return written, nil
+		}
+	}
+}
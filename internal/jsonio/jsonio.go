@@ -0,0 +1,166 @@
+package jsonio
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"strings"
+
+	"http-scratch/internal/problem"
+	"http-scratch/internal/request"
+	"http-scratch/internal/response"
+)
+
+var (
+	ErrUnsupportedMediaType = errors.New("content type must be application/json")
+	ErrEmptyBody            = errors.New("request body is empty")
+	ErrBodyTooLarge         = errors.New("request body too large")
+	ErrMalformedJSON        = errors.New("malformed JSON")
+	ErrUnknownField         = errors.New("unknown field")
+	ErrTrailingData         = errors.New("trailing data after JSON value")
+	ErrInvalidRule          = errors.New("invalid validation rule")
+)
+
+// DefaultMaxSize is used by Decode when maxSize is zero or less.
+const DefaultMaxSize = 1 << 20
+
+// Decode strictly decodes req's JSON body into v, then validates v. The
+// body must be labelled application/json (or a +json type), fit in
+// maxSize bytes, hold exactly one JSON value and only fields v knows
+// about. Every error wraps one of the errors above or is a
+// *ValidationError, which is what StatusFor relies on, save those loading
+// a held back body.
+func Decode(req *request.Request, v any, maxSize int64) error {
+	if !isJSON(req) {
+		return ErrUnsupportedMediaType
+	}
+	if maxSize <= 0 {
+		maxSize = DefaultMaxSize
+	}
+	// A body the client holds back is turned down before it is sent
+	if req.BodyHeld() && int64(req.ContentLength()) > maxSize {
+		return ErrBodyTooLarge
+	}
+	if err := req.LoadBody(); err != nil {
+		return err
+	}
+	if int64(len(req.Body)) > maxSize {
+		return ErrBodyTooLarge
+	}
+	if strings.TrimSpace(req.Body) == "" {
+		return ErrEmptyBody
+	}
+
+	dec := json.NewDecoder(strings.NewReader(req.Body))
+	dec.DisallowUnknownFields()
+	if err := dec.Decode(v); err != nil {
+		return decodeError(err)
+	}
+	if _, err := dec.Token(); !errors.Is(err, io.EOF) {
+		return ErrTrailingData
+	}
+	return Validate(v)
+}
+
+// decodeError turns encoding/json's errors into ones that name the
+// offending field or offset without leaking Go type names.
+func decodeError(err error) error {
+	var syntaxErr *json.SyntaxError
+	var typeErr *json.UnmarshalTypeError
+	switch {
+	case errors.As(err, &syntaxErr):
+		return fmt.Errorf("%w at offset %d", ErrMalformedJSON, syntaxErr.Offset)
+	case errors.As(err, &typeErr):
+		if typeErr.Field == "" {
+			return fmt.Errorf("%w: body must be %s", ErrMalformedJSON, jsonKind(typeErr.Type.Kind().String()))
+		}
+		return fmt.Errorf("%w: %s must be %s", ErrMalformedJSON, typeErr.Field, jsonKind(typeErr.Type.Kind().String()))
+	case errors.Is(err, io.ErrUnexpectedEOF):
+		return fmt.Errorf("%w: unexpected end of body", ErrMalformedJSON)
+	// DisallowUnknownFields has no error type of its own, only this
+	// message; TestDecode pins it
+	case strings.HasPrefix(err.Error(), "json: unknown field "):
+		return fmt.Errorf("%w %s", ErrUnknownField, strings.TrimPrefix(err.Error(), "json: unknown field "))
+	}
+	return fmt.Errorf("%w: %s", ErrMalformedJSON, strings.TrimPrefix(err.Error(), "json: "))
+}
+
+func jsonKind(kind string) string {
+	switch {
+	case strings.HasPrefix(kind, "int"), strings.HasPrefix(kind, "uint"), strings.HasPrefix(kind, "float"):
+		return "a number"
+	case kind == "string":
+		return "a string"
+	case kind == "bool":
+		return "a boolean"
+	case kind == "slice", kind == "array":
+		return "an array"
+	}
+	return "an object"
+}
+
+func isJSON(req *request.Request) bool {
+	mediaType, _, err := req.Headers.MediaType("content-type")
+	if err != nil {
+		return false
+	}
+	return mediaType == "application/json" || (strings.HasPrefix(mediaType, "application/") && strings.HasSuffix(mediaType, "+json"))
+}
+
+// Write marshals v and writes it as a complete response with the given
+// status.
+func Write(w *response.Writer, status response.StatusCode, v any) error {
+	body, err := json.Marshal(v)
+	if err != nil {
+		return err
+	}
+	body = append(body, '\n')
+
+	h := response.GetDefaultHeaders(len(body))
+	h.Replace("content-type", "application/json")
+	if err := w.WriteStatusLine(status); err != nil {
+		return err
+	}
+	if err := w.WriteHeaders(h); err != nil {
+		return err
+	}
+	_, err = w.WriteBody(body)
+	return err
+}
+
+// StatusFor maps an error from Decode to its response status: 415 for the
+// wrong media type, 413 for an oversized body, 422 for a body that decoded
+// but failed validation, 500 for a bad validation rule and 400 for
+// everything else.
+func StatusFor(err error) response.StatusCode {
+	var verr *ValidationError
+	switch {
+	case errors.Is(err, ErrUnsupportedMediaType):
+		return response.StatusUnsupportedMediaType
+	case errors.Is(err, ErrBodyTooLarge):
+		return response.StatusRequestEntityTooLarge
+	case errors.As(err, &verr):
+		return response.StatusUnprocessableEntity
+	case errors.Is(err, ErrInvalidRule):
+		return response.StatusInternalServerError
+	}
+	return response.StatusBadRequest
+}
+
+// WriteError responds to a failed Decode with problem details of status
+// StatusFor(err). Validation failures list the failed fields in an
+// "errors" member.
+func WriteError(w *response.Writer, req *request.Request, err error) error {
+	p := problem.New(StatusFor(err), err.Error())
+	var verr *ValidationError
+	switch {
+	case errors.As(err, &verr):
+		p.Detail = "the request body failed validation"
+		p.With("errors", verr.Fields)
+	case errors.Is(err, ErrInvalidRule):
+		// A bug of ours; the client doesn't need our struct tags
+		p.Detail = ""
+	}
+	return problem.Write(w, req, p, nil)
+}
@@ -0,0 +1,178 @@
+package jsonio
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"strconv"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"http-scratch/internal/request"
+	"http-scratch/internal/response"
+)
+
+type address struct {
+	City string `json:"city" validate:"required"`
+	Zip  string `json:"zip" validate:"min=5,max=5"`
+}
+
+type signup struct {
+	Name      string    `json:"name" validate:"required,max=10"`
+	Email     string    `json:"email" validate:"required,email"`
+	Age       int       `json:"age" validate:"min=18"`
+	Plan      string    `json:"plan" validate:"oneof=free pro"`
+	Nickname  *string   `json:"nickname,omitempty" validate:"min=2"`
+	Tags      []string  `json:"tags" validate:"max=2"`
+	Addresses []address `json:"addresses"`
+}
+
+func jsonRequest(t *testing.T, contentType, body string) *request.Request {
+	t.Helper()
+	raw := "POST /signup HTTP/1.1\r\nHost: localhost\r\nContent-Type: " + contentType +
+		"\r\nContent-Length: " + strconv.Itoa(len(body)) + "\r\n\r\n" + body
+	req, err := request.RequestFromReader(strings.NewReader(raw))
+	require.NoError(t, err)
+	return req
+}
+
+const validSignup = `{"name":"Ada","email":"ada@example.com","age":36,"plan":"pro","addresses":[{"city":"London","zip":"NW1AA"}]}`
+
+func TestDecode(t *testing.T) {
+	// Test: Valid body
+	var s signup
+	require.NoError(t, Decode(jsonRequest(t, "application/json; charset=utf-8", validSignup), &s, 0))
+	assert.Equal(t, "Ada", s.Name)
+	assert.Equal(t, "London", s.Addresses[0].City)
+
+	// Test: +json media types
+	require.NoError(t, Decode(jsonRequest(t, "application/merge-patch+json", validSignup), &s, 0))
+
+	// Test: Strict decoding
+	cases := []struct {
+		contentType string
+		body        string
+		want        error
+		status      response.StatusCode
+	}{
+		{"text/plain", validSignup, ErrUnsupportedMediaType, response.StatusUnsupportedMediaType},
+		{"application/json", validSignup, ErrBodyTooLarge, response.StatusRequestEntityTooLarge},
+		{"application/json", "  ", ErrEmptyBody, response.StatusBadRequest},
+		{"application/json", `{"name":`, ErrMalformedJSON, response.StatusBadRequest},
+		{"application/json", `{"name":"Ada",}`, ErrMalformedJSON, response.StatusBadRequest},
+		{"application/json", `{"age":"old"}`, ErrMalformedJSON, response.StatusBadRequest},
+		{"application/json", `{"admin":true}`, ErrUnknownField, response.StatusBadRequest},
+		{"application/json", validSignup + `{}`, ErrTrailingData, response.StatusBadRequest},
+	}
+	for _, c := range cases {
+		maxSize := int64(0)
+		if c.want == ErrBodyTooLarge {
+			maxSize = 10
+		}
+		err := Decode(jsonRequest(t, c.contentType, c.body), &signup{}, maxSize)
+		require.ErrorIs(t, err, c.want, c.body)
+		assert.Equal(t, c.status, StatusFor(err))
+	}
+
+	err := Decode(jsonRequest(t, "application/json", `{"age":"old"}`), &signup{}, 0)
+	assert.EqualError(t, err, "malformed JSON: age must be a number")
+
+	// Test: Unknown fields are named, nested ones included
+	err = Decode(jsonRequest(t, "application/json", `{"admin":true}`), &signup{}, 0)
+	assert.EqualError(t, err, `unknown field "admin"`)
+	err = Decode(jsonRequest(t, "application/json", `{"addresses":[{"city":"Oslo","street":"x"}]}`), &signup{}, 0)
+	assert.ErrorIs(t, err, ErrUnknownField)
+	assert.Contains(t, err.Error(), "street")
+}
+
+func TestValidate(t *testing.T) {
+	// Test: Every failed rule is reported with its JSON path
+	short := "x"
+	err := Validate(&signup{
+		Name:      "Bartholomew the Third",
+		Email:     "not an address",
+		Age:       12,
+		Plan:      "enterprise",
+		Nickname:  &short,
+		Tags:      []string{"a", "b", "c"},
+		Addresses: []address{{City: "Paris", Zip: "75001"}, {Zip: "123"}},
+	})
+	var verr *ValidationError
+	require.ErrorAs(t, err, &verr)
+
+	var got []string
+	for _, f := range verr.Fields {
+		got = append(got, f.Field+":"+f.Rule)
+	}
+	assert.Equal(t, []string{
+		"name:max", "email:email", "age:min", "plan:oneof", "nickname:min", "tags:max",
+		"addresses[1].city:required", "addresses[1].zip:min",
+	}, got)
+	assert.Equal(t, "age must be at least 18", verr.Fields[2].Message)
+	assert.Equal(t, "name must be at most 10 characters", verr.Fields[0].Message)
+
+	// Test: Required
+	err = Validate(signup{Age: 20, Plan: "free"})
+	require.ErrorAs(t, err, &verr)
+	assert.Equal(t, "name is required; email is required", err.Error())
+
+	// Test: Rules that can't be checked are errors, not panics
+	for _, v := range []any{
+		struct {
+			A string `validate:"shiny"`
+		}{},
+		struct {
+			A string `validate:"min=x"`
+		}{},
+		struct {
+			A bool `validate:"max=1"`
+		}{},
+	} {
+		err = Validate(v)
+		assert.ErrorIs(t, err, ErrInvalidRule)
+		assert.Equal(t, response.StatusInternalServerError, StatusFor(err))
+	}
+}
+
+func TestWrite(t *testing.T) {
+	parse := func(buf *bytes.Buffer) (*http.Response, map[string]any) {
+		resp, err := http.ReadResponse(bufio.NewReader(buf), nil)
+		require.NoError(t, err)
+		var body map[string]any
+		require.NoError(t, json.NewDecoder(resp.Body).Decode(&body))
+		return resp, body
+	}
+
+	// Test: Successful response
+	var buf bytes.Buffer
+	require.NoError(t, Write(response.NewWriter(&buf), response.StatusCreated, map[string]string{"id": "42"}))
+	resp, body := parse(&buf)
+	assert.Equal(t, 201, resp.StatusCode)
+	assert.Equal(t, "application/json", resp.Header.Get("Content-Type"))
+	assert.Equal(t, "42", body["id"])
+
+	// Test: Validation failures become 422 with field details
+	buf.Reset()
+	req := jsonRequest(t, "application/json", `{"name":"","email":"a@b.co","age":20,"plan":"free"}`)
+	err := Decode(req, &signup{}, 0)
+	require.NoError(t, WriteError(response.NewWriter(&buf), req, err))
+	resp, body = parse(&buf)
+	assert.Equal(t, 422, resp.StatusCode)
+	assert.Equal(t, "application/problem+json", resp.Header.Get("Content-Type"))
+	assert.Equal(t, float64(422), body["status"])
+	fields := body["errors"].([]any)
+	require.Len(t, fields, 1)
+	assert.Equal(t, map[string]any{"field": "name", "rule": "required", "message": "name is required"}, fields[0])
+
+	// Test: Other failures have no errors member
+	buf.Reset()
+	require.NoError(t, WriteError(response.NewWriter(&buf), req, ErrUnsupportedMediaType))
+	resp, body = parse(&buf)
+	assert.Equal(t, 415, resp.StatusCode)
+	assert.Equal(t, ErrUnsupportedMediaType.Error(), body["detail"])
+	assert.NotContains(t, body, "errors")
+}
@@ -0,0 +1,231 @@
+package jsonio
+
+import (
+	"fmt"
+	"net/mail"
+	"reflect"
+	"strconv"
+	"strings"
+	"unicode/utf8"
+)
+
+// FieldError is one failed rule. Field is the JSON path of the value, like
+// "items[2].name".
+type FieldError struct {
+	Field   string `json:"field"`
+	Rule    string `json:"rule"`
+	Message string `json:"message"`
+}
+
+// ValidationError lists every rule a decoded value broke.
+type ValidationError struct {
+	Fields []FieldError
+}
+
+func (e *ValidationError) Error() string {
+	msgs := make([]string, len(e.Fields))
+	for i, f := range e.Fields {
+		msgs[i] = f.Message
+	}
+	return strings.Join(msgs, "; ")
+}
+
+// Validate checks the rules in the `validate` struct tags of v, recursing
+// into nested structs, pointers, slices and maps. Rules are separated by
+// commas:
+//
+//	required     not the zero value; non-empty for strings, slices and maps
+//	min=N, max=N bounds on a number, or on the length of a string (in
+//	             characters), slice or map
+//	oneof=a b c  one of the space-separated values
+//	email        a bare e-mail address
+//
+// Rules other than required are skipped for nil pointers, so optional
+// fields are pointers. A rule that can't be checked, unknown or with a
+// bad argument, is a programming error reported as ErrInvalidRule.
+func Validate(v any) error {
+	var errs []FieldError
+	if err := validateValue(reflect.ValueOf(v), "", &errs); err != nil {
+		return err
+	}
+	if len(errs) > 0 {
+		return &ValidationError{Fields: errs}
+	}
+	return nil
+}
+
+func validateValue(v reflect.Value, path string, errs *[]FieldError) error {
+	for v.Kind() == reflect.Pointer || v.Kind() == reflect.Interface {
+		if v.IsNil() {
+			return nil
+		}
+		v = v.Elem()
+	}
+
+	switch v.Kind() {
+	case reflect.Struct:
+		t := v.Type()
+		for i := range t.NumField() {
+			f := t.Field(i)
+			if !f.IsExported() {
+				continue
+			}
+			name, ok := jsonName(f)
+			if !ok {
+				continue
+			}
+			fv := v.Field(i)
+			// Embedded structs are flattened by encoding/json, and so here
+			if f.Anonymous && name == "" {
+				if err := validateValue(fv, path, errs); err != nil {
+					return err
+				}
+				continue
+			}
+			if name == "" {
+				name = f.Name
+			}
+			fieldPath := name
+			if path != "" {
+				fieldPath = path + "." + name
+			}
+			if tag := f.Tag.Get("validate"); tag != "" {
+				descend, err := checkRules(fv, fieldPath, tag, errs)
+				if err != nil {
+					return err
+				}
+				if !descend {
+					continue
+				}
+			}
+			if err := validateValue(fv, fieldPath, errs); err != nil {
+				return err
+			}
+		}
+	case reflect.Slice, reflect.Array:
+		for i := range v.Len() {
+			if err := validateValue(v.Index(i), fmt.Sprintf("%s[%d]", path, i), errs); err != nil {
+				return err
+			}
+		}
+	case reflect.Map:
+		iter := v.MapRange()
+		for iter.Next() {
+			if err := validateValue(iter.Value(), fmt.Sprintf("%s[%v]", path, iter.Key()), errs); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// jsonName is the name encoding/json uses for f, "" for an untagged
+// field, and false for a field it skips.
+func jsonName(f reflect.StructField) (string, bool) {
+	tag := f.Tag.Get("json")
+	if tag == "-" {
+		return "", false
+	}
+	name, _, _ := strings.Cut(tag, ",")
+	return name, true
+}
+
+// checkRules adds an error for every broken rule and reports whether the
+// value is worth descending into.
+func checkRules(v reflect.Value, field, tag string, errs *[]FieldError) (bool, error) {
+	fail := func(rule, msg string) {
+		*errs = append(*errs, FieldError{Field: field, Rule: rule, Message: field + " " + msg})
+	}
+
+	rules := strings.Split(tag, ",")
+	for _, rule := range rules {
+		if rule == "required" && isEmpty(v) {
+			fail("required", "is required")
+			return false, nil
+		}
+	}
+
+	for v.Kind() == reflect.Pointer || v.Kind() == reflect.Interface {
+		if v.IsNil() {
+			return false, nil
+		}
+		v = v.Elem()
+	}
+
+	valid := true
+	for _, rule := range rules {
+		name, arg, _ := strings.Cut(rule, "=")
+		switch name {
+		case "required":
+		case "min", "max":
+			bound, err := strconv.ParseFloat(arg, 64)
+			if err != nil {
+				return false, fmt.Errorf("%w: bad argument to %s on %s", ErrInvalidRule, name, field)
+			}
+			n, unit, ok := measure(v)
+			if !ok {
+				return false, fmt.Errorf("%w: %s on %s, which has no size", ErrInvalidRule, name, field)
+			}
+			if name == "min" && n < bound {
+				fail(name, "must be at least "+arg+unit)
+				valid = false
+			}
+			if name == "max" && n > bound {
+				fail(name, "must be at most "+arg+unit)
+				valid = false
+			}
+		case "oneof":
+			options := strings.Fields(arg)
+			got := fmt.Sprint(v.Interface())
+			found := false
+			for _, o := range options {
+				if o == got {
+					found = true
+					break
+				}
+			}
+			if !found {
+				fail(name, "must be one of "+strings.Join(options, ", "))
+				valid = false
+			}
+		case "email":
+			s := fmt.Sprint(v.Interface())
+			addr, err := mail.ParseAddress(s)
+			if err != nil || addr.Address != s {
+				fail(name, "must be an e-mail address")
+				valid = false
+			}
+		default:
+			return false, fmt.Errorf("%w: %q on %s", ErrInvalidRule, name, field)
+		}
+	}
+	return valid, nil
+}
+
+func isEmpty(v reflect.Value) bool {
+	switch v.Kind() {
+	case reflect.String, reflect.Slice, reflect.Map, reflect.Array:
+		return v.Len() == 0
+	case reflect.Invalid:
+		return true
+	}
+	return v.IsZero()
+}
+
+// measure returns what min and max compare against, and the unit to
+// mention in messages.
+func measure(v reflect.Value) (float64, string, bool) {
+	switch v.Kind() {
+	case reflect.String:
+		return float64(utf8.RuneCountInString(v.String())), " characters", true
+	case reflect.Slice, reflect.Map, reflect.Array:
+		return float64(v.Len()), " items", true
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		return float64(v.Int()), "", true
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		return float64(v.Uint()), "", true
+	case reflect.Float32, reflect.Float64:
+		return v.Float(), "", true
+	}
+	return 0, "", false
+}
@@ -0,0 +1,189 @@
+package negotiate
+
+import (
+	"errors"
+	"sort"
+	"strconv"
+	"strings"
+
+	"http-scratch/internal/headers"
+	"http-scratch/internal/request"
+)
+
+// ErrNotAcceptable means the client accepts none of the offers. Handlers
+// answer it with 406 Not Acceptable, or knowingly ignore the preference
+// and send a default (RFC 9110 section 12.1).
+var ErrNotAcceptable = errors.New("no acceptable representation")
+
+// Preference is one element of an Accept* field.
+type Preference struct {
+	Value string
+	// Params are the media type parameters before the q parameter,
+	// names lowercased; nil outside Accept.
+	Params map[string]string
+	Q      float64
+}
+
+// Parse parses a weighted list like "text/html;level=1, text/*;q=0.3".
+// Elements with a malformed q-value are dropped; the result is sorted by
+// q-value, highest first, keeping the field order for equal ones.
+func Parse(value string) []Preference {
+	var prefs []Preference
+	for _, elem := range strings.Split(value, ",") {
+		parts := strings.Split(elem, ";")
+		v := strings.ToLower(strings.TrimSpace(parts[0]))
+		if v == "" {
+			continue
+		}
+
+		p := Preference{Value: v, Q: 1}
+		valid := true
+		for _, param := range parts[1:] {
+			name, pv, _ := strings.Cut(strings.TrimSpace(param), "=")
+			name = strings.ToLower(strings.TrimSpace(name))
+			pv = strings.Trim(strings.TrimSpace(pv), `"`)
+			if name == "q" {
+				q, err := strconv.ParseFloat(pv, 64)
+				if err != nil || q < 0 || q > 1 {
+					valid = false
+				}
+				p.Q = q
+				// Anything after q is an accept-ext, not a media type parameter
+				break
+			}
+			if p.Params == nil {
+				p.Params = map[string]string{}
+			}
+			p.Params[name] = pv
+		}
+		if valid {
+			prefs = append(prefs, p)
+		}
+	}
+	sort.SliceStable(prefs, func(i, j int) bool { return prefs[i].Q > prefs[j].Q })
+	return prefs
+}
+
+// ContentType picks the offer the Accept field likes best. Each offer gets
+// the q-value of the most specific media range matching it: one with
+// parameters beats the bare type, which beats type/*, which beats */*.
+// Equal q-values go to the earlier offer, and without an Accept field the
+// first offer wins. Vary: Accept is added to h, which may be nil.
+func ContentType(req *request.Request, h headers.Headers, offers ...string) (string, error) {
+	return negotiate(req, h, "Accept", offers, mediaRangeMatch)
+}
+
+// Language picks from offers, language tags like "en-GB", using
+// Accept-Language. A range matches a tag equal to it or starting with it
+// followed by '-' (RFC 4647 basic filtering); longer ranges are more
+// specific.
+func Language(req *request.Request, h headers.Headers, offers ...string) (string, error) {
+	return negotiate(req, h, "Accept-Language", offers, languageMatch)
+}
+
+// Charset picks from offers using Accept-Charset.
+func Charset(req *request.Request, h headers.Headers, offers ...string) (string, error) {
+	return negotiate(req, h, "Accept-Charset", offers, func(p Preference, offer string) int {
+		switch p.Value {
+		case strings.ToLower(offer):
+			return 1
+		case "*":
+			return 0
+		}
+		return -1
+	})
+}
+
+// A matcher reports how specifically p matches offer, -1 for no match.
+type matcher func(p Preference, offer string) int
+
+func negotiate(req *request.Request, h headers.Headers, field string, offers []string, match matcher) (string, error) {
+	if h != nil {
+		AddVary(h, field)
+	}
+	if len(offers) == 0 {
+		return "", ErrNotAcceptable
+	}
+
+	value, ok := req.Headers.Get(field)
+	if !ok || strings.TrimSpace(value) == "" {
+		return offers[0], nil
+	}
+	prefs := Parse(value)
+
+	best, bestQ := "", 0.0
+	for _, offer := range offers {
+		q, specificity := 0.0, -1
+		for _, p := range prefs {
+			if s := match(p, offer); s > specificity {
+				q, specificity = p.Q, s
+			}
+		}
+		if q > bestQ {
+			best, bestQ = offer, q
+		}
+	}
+	if bestQ == 0 {
+		return "", ErrNotAcceptable
+	}
+	return best, nil
+}
+
+func mediaRangeMatch(p Preference, offer string) int {
+	parts := strings.Split(offer, ";")
+	mediaType := strings.ToLower(strings.TrimSpace(parts[0]))
+	typ, subtype, _ := strings.Cut(mediaType, "/")
+	rangeType, rangeSubtype, _ := strings.Cut(p.Value, "/")
+
+	switch {
+	case p.Value == "*/*":
+		return 0
+	case rangeType != typ:
+		return -1
+	case rangeSubtype == "*":
+		return 1
+	case rangeSubtype != subtype:
+		return -1
+	case len(p.Params) == 0:
+		return 2
+	}
+
+	offerParams := map[string]string{}
+	for _, param := range parts[1:] {
+		name, v, _ := strings.Cut(strings.TrimSpace(param), "=")
+		offerParams[strings.ToLower(name)] = strings.Trim(v, `"`)
+	}
+	for name, v := range p.Params {
+		if !strings.EqualFold(offerParams[name], v) {
+			return -1
+		}
+	}
+	return 2 + len(p.Params)
+}
+
+func languageMatch(p Preference, offer string) int {
+	offer = strings.ToLower(offer)
+	switch {
+	case p.Value == "*":
+		return 0
+	case offer == p.Value, strings.HasPrefix(offer, p.Value+"-"):
+		return len(p.Value)
+	}
+	return -1
+}
+
+// AddVary adds field to the Vary field of h unless it's already listed.
+func AddVary(h headers.Headers, field string) {
+	value, ok := h.Get("vary")
+	if !ok || strings.TrimSpace(value) == "" {
+		h.Replace("vary", field)
+		return
+	}
+	for _, v := range strings.Split(value, ",") {
+		v = strings.TrimSpace(v)
+		if v == "*" || strings.EqualFold(v, field) {
+			return
+		}
+	}
+	h.Replace("vary", value+", "+field)
+}
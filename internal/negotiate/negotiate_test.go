@@ -0,0 +1,113 @@
+package negotiate
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"http-scratch/internal/headers"
+	"http-scratch/internal/request"
+)
+
+func requestWith(t *testing.T, fields ...string) *request.Request {
+	t.Helper()
+	raw := "GET / HTTP/1.1\r\nHost: localhost\r\n"
+	for _, f := range fields {
+		raw += f + "\r\n"
+	}
+	req, err := request.RequestFromReader(strings.NewReader(raw + "\r\n"))
+	require.NoError(t, err)
+	return req
+}
+
+func TestParse(t *testing.T) {
+	// Test: Sorted by q, field order kept for ties, parameters before q only
+	prefs := Parse(`text/*;q=0.3, text/html;q=0.7, text/html;level=1, text/html;level=2;q=0.4, */*;q=0.5;ext="x"`)
+	var got []string
+	for _, p := range prefs {
+		got = append(got, p.Value)
+	}
+	assert.Equal(t, []string{"text/html", "text/html", "*/*", "text/html", "text/*"}, got)
+	assert.Equal(t, map[string]string{"level": "1"}, prefs[0].Params)
+	assert.Nil(t, prefs[2].Params)
+	assert.Equal(t, 0.4, prefs[3].Q)
+
+	// Test: Malformed q-values drop the element
+	prefs = Parse("en;q=2, fr;q=abc, de;q=0.5, , es")
+	require.Len(t, prefs, 2)
+	assert.Equal(t, "es", prefs[0].Value)
+	assert.Equal(t, "de", prefs[1].Value)
+}
+
+func TestContentType(t *testing.T) {
+	offers := []string{"application/json", "text/html", "text/plain"}
+	cases := []struct {
+		accept string
+		want   string
+	}{
+		{"", "application/json"},
+		{"Accept: text/html", "text/html"},
+		{"Accept: text/*", "text/html"},
+		{"Accept: text/*, text/html;q=0.1", "text/plain"},
+		{"Accept: */*;q=0.1, text/plain", "text/plain"},
+		{"Accept: */*", "application/json"},
+		{"Accept: TEXT/PLAIN;Q=0.9, application/json;q=0.8", "text/plain"},
+	}
+	for _, c := range cases {
+		var fields []string
+		if c.accept != "" {
+			fields = append(fields, c.accept)
+		}
+		got, err := ContentType(requestWith(t, fields...), nil, offers...)
+		require.NoError(t, err, c.accept)
+		assert.Equal(t, c.want, got, c.accept)
+	}
+
+	// Test: Media type parameters make a range more specific
+	req := requestWith(t, "Accept: text/html;level=1;q=0.2, text/html;q=0.9")
+	got, err := ContentType(req, nil, "text/html;level=1", "text/html;level=2")
+	require.NoError(t, err)
+	assert.Equal(t, "text/html;level=2", got)
+
+	// Test: Nothing acceptable
+	h := headers.NewHeaders()
+	_, err = ContentType(requestWith(t, "Accept: image/*, text/html;q=0"), h, "text/html", "application/json")
+	require.ErrorIs(t, err, ErrNotAcceptable)
+	vary, _ := h.Get("vary")
+	assert.Equal(t, "Accept", vary)
+}
+
+func TestLanguageAndCharset(t *testing.T) {
+	// Test: Prefix matching, most specific range wins
+	req := requestWith(t, "Accept-Language: en;q=0.5, en-GB;q=0.1, fr-CH, fr;q=0.9")
+	got, err := Language(req, nil, "en-GB", "en-US", "fr")
+	require.NoError(t, err)
+	assert.Equal(t, "fr", got)
+
+	got, err = Language(req, nil, "en-GB", "en-US")
+	require.NoError(t, err)
+	assert.Equal(t, "en-US", got)
+
+	_, err = Language(requestWith(t, "Accept-Language: de"), nil, "en", "fr")
+	require.ErrorIs(t, err, ErrNotAcceptable)
+
+	got, err = Language(requestWith(t, "Accept-Language: de, *;q=0.1"), nil, "en", "fr")
+	require.NoError(t, err)
+	assert.Equal(t, "en", got)
+
+	// Test: Charsets
+	got, err = Charset(requestWith(t, "Accept-Charset: iso-8859-5, UTF-8;q=0.8"), nil, "utf-8", "ISO-8859-5")
+	require.NoError(t, err)
+	assert.Equal(t, "ISO-8859-5", got)
+
+	// Test: Vary lists every field consulted, once
+	h := headers.NewHeaders()
+	h.Set("Vary", "Origin")
+	Language(req, h, "en")
+	Charset(req, h, "utf-8")
+	Language(req, h, "en")
+	vary, _ := h.Get("vary")
+	assert.Equal(t, "Origin, Accept-Language, Accept-Charset", vary)
+}
@@ -0,0 +1,157 @@
+package problem
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"html/template"
+	"strconv"
+
+	"http-scratch/internal/headers"
+	"http-scratch/internal/negotiate"
+	"http-scratch/internal/request"
+	"http-scratch/internal/response"
+)
+
+const (
+	ContentType = "application/problem+json"
+	// blankType is the default type of RFC 9457 section 4.2.1: the problem
+	// is nothing more than its status code.
+	blankType = "about:blank"
+)
+
+// Details is an RFC 9457 problem details object. Extensions holds any
+// additional members; they are serialized next to the standard ones, which
+// they can't override.
+type Details struct {
+	Type       string
+	Title      string
+	Status     response.StatusCode
+	Detail     string
+	Instance   string
+	Extensions map[string]any
+}
+
+// New returns a problem of the default type, titled after status.
+func New(status response.StatusCode, detail string) *Details {
+	return &Details{
+		Type:   blankType,
+		Title:  response.StatusText(status),
+		Status: status,
+		Detail: detail,
+	}
+}
+
+// With sets an extension member and returns p for chaining.
+func (p *Details) With(key string, value any) *Details {
+	if p.Extensions == nil {
+		p.Extensions = map[string]any{}
+	}
+	p.Extensions[key] = value
+	return p
+}
+
+func (p *Details) Error() string {
+	if p.Detail == "" {
+		return p.Title
+	}
+	return p.Title + ": " + p.Detail
+}
+
+func (p *Details) MarshalJSON() ([]byte, error) {
+	members := make(map[string]any, len(p.Extensions)+5)
+	for k, v := range p.Extensions {
+		members[k] = v
+	}
+	typ := p.Type
+	if typ == "" {
+		typ = blankType
+	}
+	members["type"] = typ
+	if p.Title != "" {
+		members["title"] = p.Title
+	}
+	if p.Status != 0 {
+		members["status"] = p.Status
+	}
+	if p.Detail != "" {
+		members["detail"] = p.Detail
+	}
+	if p.Instance != "" {
+		members["instance"] = p.Instance
+	}
+	return json.Marshal(members)
+}
+
+var page = template.Must(template.New("problem").Parse(`<html>
+  <head>
+    <title>{{.Status}} {{.Title}}</title>
+  </head>
+  <body>
+    <h1>{{.Title}}</h1>
+    {{- if .Detail}}
+    <p>{{.Detail}}</p>
+    {{- end}}
+  </body>
+</html>
+`))
+
+// Write sends p as a complete response. The body is problem+json unless
+// req's Accept field prefers HTML or plain text; req may be nil when there
+// is no parsed request to go by. Fields in h, which may be nil, are added
+// to the response, for things like Allow or Retry-After.
+func Write(w *response.Writer, req *request.Request, p *Details, h headers.Headers) error {
+	fields := response.GetDefaultHeaders(0)
+	for n, v := range h {
+		fields.Replace(n, v)
+	}
+
+	var body []byte
+	var contentType string
+	switch preferred(req, fields) {
+	case "text/html":
+		var buf bytes.Buffer
+		if err := page.Execute(&buf, p); err != nil {
+			return err
+		}
+		body, contentType = buf.Bytes(), "text/html; charset=utf-8"
+	case "text/plain":
+		body = fmt.Appendf(nil, "%d %s\n", p.Status, p.Title)
+		if p.Detail != "" {
+			body = fmt.Appendf(body, "\n%s\n", p.Detail)
+		}
+		contentType = "text/plain; charset=utf-8"
+	default:
+		b, err := json.Marshal(p)
+		if err != nil {
+			return err
+		}
+		body, contentType = append(b, '\n'), ContentType
+	}
+
+	fields.Replace("content-type", contentType)
+	fields.Replace("content-length", strconv.Itoa(len(body)))
+
+	if err := w.WriteStatusLine(p.Status); err != nil {
+		return err
+	}
+	if err := w.WriteHeaders(fields); err != nil {
+		return err
+	}
+	_, err := w.WriteBody(body)
+	return err
+}
+
+// preferred picks the representation Accept likes best. Ties go to
+// problem+json, and so does a request that accepts none of them: an error
+// is better sent in the wrong format than not at all.
+func preferred(req *request.Request, h headers.Headers) string {
+	if req == nil {
+		return ContentType
+	}
+	offer, err := negotiate.ContentType(req, h, ContentType, "application/json", "text/plain", "text/html")
+	if err != nil || offer == "application/json" {
+		return ContentType
+	}
+	return offer
+}
@@ -0,0 +1,101 @@
+package problem
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"io"
+	"net/http"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"http-scratch/internal/headers"
+	"http-scratch/internal/request"
+	"http-scratch/internal/response"
+)
+
+func acceptRequest(t *testing.T, accept string) *request.Request {
+	t.Helper()
+	raw := "GET /orders/7 HTTP/1.1\r\nHost: localhost\r\n"
+	if accept != "" {
+		raw += "Accept: " + accept + "\r\n"
+	}
+	req, err := request.RequestFromReader(strings.NewReader(raw + "\r\n"))
+	require.NoError(t, err)
+	return req
+}
+
+func write(t *testing.T, req *request.Request, p *Details, h headers.Headers) (*http.Response, string) {
+	t.Helper()
+	var buf bytes.Buffer
+	require.NoError(t, Write(response.NewWriter(&buf), req, p, h))
+	resp, err := http.ReadResponse(bufio.NewReader(&buf), nil)
+	require.NoError(t, err)
+	body, err := io.ReadAll(resp.Body)
+	require.NoError(t, err)
+	return resp, string(body)
+}
+
+func TestMarshal(t *testing.T) {
+	// Test: Standard members and extensions side by side
+	p := New(response.StatusForbidden, "Your balance is 30, but that costs 50.")
+	p.Type = "https://example.com/probs/out-of-credit"
+	p.Instance = "/account/12345/msgs/abc"
+	p.With("balance", 30).With("status", "overridden?")
+
+	var got map[string]any
+	b, err := json.Marshal(p)
+	require.NoError(t, err)
+	require.NoError(t, json.Unmarshal(b, &got))
+	assert.Equal(t, map[string]any{
+		"type":     "https://example.com/probs/out-of-credit",
+		"title":    "Forbidden",
+		"status":   float64(403),
+		"detail":   "Your balance is 30, but that costs 50.",
+		"instance": "/account/12345/msgs/abc",
+		"balance":  float64(30),
+	}, got)
+
+	// Test: Empty members are left out, type defaults to about:blank
+	b, err = json.Marshal(&Details{Status: response.StatusNotFound})
+	require.NoError(t, err)
+	assert.JSONEq(t, `{"type":"about:blank","status":404}`, string(b))
+
+	assert.Equal(t, "Forbidden: Your balance is 30, but that costs 50.", p.Error())
+}
+
+func TestWrite(t *testing.T) {
+	p := New(response.StatusNotFound, "no order <7>")
+
+	// Test: problem+json by default
+	for _, accept := range []string{"", "*/*", "application/json", "application/*", "text/html;q=0.5, application/json"} {
+		resp, body := write(t, acceptRequest(t, accept), p, nil)
+		assert.Equal(t, 404, resp.StatusCode)
+		assert.Equal(t, ContentType, resp.Header.Get("Content-Type"), accept)
+		assert.JSONEq(t, `{"type":"about:blank","title":"Not Found","status":404,"detail":"no order <7>"}`, body)
+	}
+	resp, _ := write(t, nil, p, nil)
+	assert.Equal(t, ContentType, resp.Header.Get("Content-Type"))
+
+	// Test: HTML for browsers, escaped
+	resp, body := write(t, acceptRequest(t, "text/html,application/xhtml+xml,*/*;q=0.8"), p, nil)
+	assert.Equal(t, "text/html; charset=utf-8", resp.Header.Get("Content-Type"))
+	assert.Equal(t, "Accept", resp.Header.Get("Vary"))
+	assert.Contains(t, body, "<title>404 Not Found</title>")
+	assert.Contains(t, body, "no order &lt;7&gt;")
+
+	// Test: Plain text
+	resp, body = write(t, acceptRequest(t, "text/*"), p, nil)
+	assert.Equal(t, "text/plain; charset=utf-8", resp.Header.Get("Content-Type"))
+	assert.Equal(t, "404 Not Found\n\nno order <7>\n", body)
+
+	// Test: Extra fields
+	h := headers.NewHeaders()
+	h.Set("Allow", "GET, HEAD")
+	resp, _ = write(t, nil, New(response.StatusMethodNotAllowed, ""), h)
+	assert.Equal(t, 405, resp.StatusCode)
+	assert.Equal(t, "GET, HEAD", resp.Header.Get("Allow"))
+}
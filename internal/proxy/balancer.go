@@ -0,0 +1,173 @@
+package proxy
+
+import (
+	"errors"
+	"hash/fnv"
+	"net/url"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"http-scratch/internal/request"
+)
+
+var ErrNoHealthyBackend = errors.New("no healthy backend")
+
+const (
+	defaultMaxFailures = 3
+	defaultEjectFor    = 30 * time.Second
+)
+
+type Backend struct {
+	URL *url.URL
+
+	active   atomic.Int64
+	failures atomic.Int32
+
+	mu           sync.Mutex
+	healthy      bool
+	ejectedUntil time.Time
+}
+
+func (b *Backend) ActiveRequests() int64 {
+	return b.active.Load()
+}
+
+// Healthy reports whether the backend is taking traffic: it passed its last
+// active check and is not serving a passive ejection.
+func (b *Backend) Healthy() bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.healthy && time.Now().After(b.ejectedUntil)
+}
+
+// setHealthy records the result of an active check. A passive ejection
+// runs its course regardless.
+func (b *Backend) setHealthy(healthy bool) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.healthy = healthy
+}
+
+func (b *Backend) eject(d time.Duration) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.ejectedUntil = time.Now().Add(d)
+}
+
+// Strategy picks one of the candidate backends, all of which are healthy.
+// candidates is never empty.
+type Strategy interface {
+	Pick(candidates []*Backend, req *request.Request) *Backend
+}
+
+type RoundRobin struct {
+	next atomic.Uint64
+}
+
+func (rr *RoundRobin) Pick(candidates []*Backend, _ *request.Request) *Backend {
+	n := rr.next.Add(1) - 1
+	return candidates[n%uint64(len(candidates))]
+}
+
+type LeastConnections struct{}
+
+func (LeastConnections) Pick(candidates []*Backend, _ *request.Request) *Backend {
+	best := candidates[0]
+	for _, b := range candidates[1:] {
+		if b.ActiveRequests() < best.ActiveRequests() {
+			best = b
+		}
+	}
+	return best
+}
+
+// ConsistentHash sends requests with the same key to the same backend for
+// as long as it stays healthy. The key is the value of Header, or the
+// client IP when Header is empty or missing from the request.
+//
+// It uses rendezvous hashing, so losing a backend only moves the keys that
+// were mapped to it.
+type ConsistentHash struct {
+	Header string
+}
+
+func (ch ConsistentHash) Pick(candidates []*Backend, req *request.Request) *Backend {
+	key := ""
+	if ch.Header != "" {
+		key, _ = req.Headers.Get(ch.Header)
+	}
+	if key == "" {
+		key = clientIP(req.RemoteAddr)
+	}
+
+	var best *Backend
+	var bestScore uint64
+	for _, b := range candidates {
+		h := fnv.New64a()
+		h.Write([]byte(key))
+		h.Write([]byte{0})
+		h.Write([]byte(b.URL.String()))
+		if score := h.Sum64(); best == nil || score > bestScore {
+			best, bestScore = b, score
+		}
+	}
+	return best
+}
+
+type Pool struct {
+	Strategy Strategy
+	// MaxFailures consecutive failed attempts eject a backend for EjectFor.
+	MaxFailures int
+	EjectFor    time.Duration
+
+	backends []*Backend
+}
+
+func NewPool(strategy Strategy, upstreams ...string) (*Pool, error) {
+	if len(upstreams) == 0 {
+		return nil, ErrInvalidUpstream
+	}
+
+	pool := &Pool{
+		Strategy:    strategy,
+		MaxFailures: defaultMaxFailures,
+		EjectFor:    defaultEjectFor,
+	}
+	for _, upstream := range upstreams {
+		u, err := parseUpstream(upstream)
+		if err != nil {
+			return nil, err
+		}
+		pool.backends = append(pool.backends, &Backend{URL: u, healthy: true})
+	}
+	return pool, nil
+}
+
+func (p *Pool) Backends() []*Backend {
+	return p.backends
+}
+
+func (p *Pool) next(req *request.Request, tried map[*Backend]bool) (*Backend, error) {
+	var candidates []*Backend
+	for _, b := range p.backends {
+		if !tried[b] && b.Healthy() {
+			candidates = append(candidates, b)
+		}
+	}
+	if len(candidates) == 0 {
+		return nil, ErrNoHealthyBackend
+	}
+	return p.Strategy.Pick(candidates, req), nil
+}
+
+func (p *Pool) markSuccess(b *Backend) {
+	b.failures.Store(0)
+}
+
+func (p *Pool) markFailure(b *Backend) {
+	if int(b.failures.Add(1)) >= p.MaxFailures {
+		b.failures.Store(0)
+		b.eject(p.EjectFor)
+	}
+}
@@ -0,0 +1,175 @@
+package proxy
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+type testBackend struct {
+	*httptest.Server
+	hits    atomic.Int32
+	healthy atomic.Bool
+}
+
+func newTestBackend(t *testing.T) *testBackend {
+	t.Helper()
+	tb := &testBackend{}
+	tb.healthy.Store(true)
+	tb.Server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/healthz" {
+			if !tb.healthy.Load() {
+				w.WriteHeader(http.StatusServiceUnavailable)
+			}
+			return
+		}
+		tb.hits.Add(1)
+		fmt.Fprint(w, tb.URL)
+	}))
+	t.Cleanup(tb.Close)
+	return tb
+}
+
+func TestRoundRobin(t *testing.T) {
+	a, b, c := newTestBackend(t), newTestBackend(t), newTestBackend(t)
+	pool, err := NewPool(&RoundRobin{}, a.URL, b.URL, c.URL)
+	require.NoError(t, err)
+	p := NewBalanced(pool)
+
+	for range 9 {
+		res := proxyRequest(t, p, "GET / HTTP/1.1\r\nHost: example.com\r\n\r\n")
+		assert.Equal(t, http.StatusOK, res.StatusCode)
+	}
+	assert.EqualValues(t, 3, a.hits.Load())
+	assert.EqualValues(t, 3, b.hits.Load())
+	assert.EqualValues(t, 3, c.hits.Load())
+}
+
+func TestLeastConnections(t *testing.T) {
+	a, b := newTestBackend(t), newTestBackend(t)
+	pool, err := NewPool(LeastConnections{}, a.URL, b.URL)
+	require.NoError(t, err)
+	pool.Backends()[0].active.Store(5)
+
+	p := NewBalanced(pool)
+	for range 4 {
+		proxyRequest(t, p, "GET / HTTP/1.1\r\nHost: example.com\r\n\r\n")
+	}
+	assert.EqualValues(t, 0, a.hits.Load())
+	assert.EqualValues(t, 4, b.hits.Load())
+	assert.EqualValues(t, 0, pool.Backends()[1].ActiveRequests())
+}
+
+func TestConsistentHash(t *testing.T) {
+	a, b, c := newTestBackend(t), newTestBackend(t), newTestBackend(t)
+	pool, err := NewPool(ConsistentHash{Header: "X-User"}, a.URL, b.URL, c.URL)
+	require.NoError(t, err)
+	p := NewBalanced(pool)
+
+	// Test: same key, same backend
+	first := readAll(t, proxyRequest(t, p, "GET / HTTP/1.1\r\nHost: example.com\r\nX-User: alice\r\n\r\n"))
+	for range 5 {
+		got := readAll(t, proxyRequest(t, p, "GET / HTTP/1.1\r\nHost: example.com\r\nX-User: alice\r\n\r\n"))
+		assert.Equal(t, first, got)
+	}
+
+	// Test: falls back to the client IP without the header
+	first = readAll(t, proxyRequest(t, p, "GET / HTTP/1.1\r\nHost: example.com\r\n\r\n"))
+	got := readAll(t, proxyRequest(t, p, "GET / HTTP/1.1\r\nHost: example.com\r\n\r\n"))
+	assert.Equal(t, first, got)
+
+	// Test: keys spread over backends
+	seen := map[string]bool{}
+	for i := range 50 {
+		seen[readAll(t, proxyRequest(t, p, fmt.Sprintf("GET / HTTP/1.1\r\nHost: example.com\r\nX-User: user%d\r\n\r\n", i)))] = true
+	}
+	assert.Len(t, seen, 3)
+}
+
+func TestActiveHealthChecks(t *testing.T) {
+	a, b := newTestBackend(t), newTestBackend(t)
+	pool, err := NewPool(&RoundRobin{}, a.URL, b.URL)
+	require.NoError(t, err)
+
+	b.healthy.Store(false)
+	stop := pool.StartHealthChecks(HealthCheck{Path: "/healthz", Interval: 10 * time.Millisecond})
+	defer stop()
+
+	require.Eventually(t, func() bool { return !pool.Backends()[1].Healthy() }, time.Second, 5*time.Millisecond)
+	p := NewBalanced(pool)
+	for range 4 {
+		proxyRequest(t, p, "GET / HTTP/1.1\r\nHost: example.com\r\n\r\n")
+	}
+	assert.EqualValues(t, 4, a.hits.Load())
+	assert.EqualValues(t, 0, b.hits.Load())
+
+	b.healthy.Store(true)
+	require.Eventually(t, func() bool { return pool.Backends()[1].Healthy() }, time.Second, 5*time.Millisecond)
+
+	// Test: a zero Interval gets the default instead of panicking
+	stop2 := pool.StartHealthChecks(HealthCheck{Path: "/healthz"})
+	stop2()
+
+	// Test: redirects count as healthy without being followed
+	redirecting := httptest.NewServer(http.RedirectHandler("http://127.0.0.1:1/down", http.StatusFound))
+	defer redirecting.Close()
+	rpool, err := NewPool(&RoundRobin{}, redirecting.URL)
+	require.NoError(t, err)
+	rpool.Backends()[0].setHealthy(false)
+	stop3 := rpool.StartHealthChecks(HealthCheck{Path: "/healthz", Interval: time.Hour})
+	defer stop3()
+	require.Eventually(t, func() bool { return rpool.Backends()[0].Healthy() }, time.Second, 5*time.Millisecond)
+
+	// Test: passing checks don't cut a passive ejection short
+	pool.Backends()[0].eject(time.Minute)
+	time.Sleep(50 * time.Millisecond)
+	assert.False(t, pool.Backends()[0].Healthy())
+}
+
+func TestPassiveEjectionAndRetry(t *testing.T) {
+	a, b := newTestBackend(t), newTestBackend(t)
+	pool, err := NewPool(&RoundRobin{}, a.URL, b.URL)
+	require.NoError(t, err)
+	pool.MaxFailures = 2
+	p := NewBalanced(pool)
+	b.Close()
+
+	// Test: idempotent requests are retried on another backend
+	for range 4 {
+		res := proxyRequest(t, p, "GET / HTTP/1.1\r\nHost: example.com\r\n\r\n")
+		assert.Equal(t, http.StatusOK, res.StatusCode)
+	}
+	assert.EqualValues(t, 4, a.hits.Load())
+
+	// Test: consecutive failures eject the backend
+	assert.False(t, pool.Backends()[1].Healthy())
+	assert.True(t, pool.Backends()[0].Healthy())
+
+	// Test: non-idempotent requests are not retried
+	pool, err = NewPool(&RoundRobin{}, b.URL, a.URL)
+	require.NoError(t, err)
+	p = NewBalanced(pool)
+	res := proxyRequest(t, p, "POST / HTTP/1.1\r\nHost: example.com\r\nContent-Length: 2\r\n\r\nhi")
+	assert.Equal(t, http.StatusBadGateway, res.StatusCode)
+	assert.EqualValues(t, 4, a.hits.Load())
+
+	// Test: nothing healthy left
+	pool.Backends()[1].eject(time.Minute)
+	pool.Backends()[0].eject(time.Minute)
+	res = proxyRequest(t, p, "GET / HTTP/1.1\r\nHost: example.com\r\n\r\n")
+	assert.Equal(t, http.StatusBadGateway, res.StatusCode)
+}
+
+func readAll(t *testing.T, res *http.Response) string {
+	t.Helper()
+	b, err := io.ReadAll(res.Body)
+	require.NoError(t, err)
+	return string(b)
+}
@@ -0,0 +1,87 @@
+package proxy
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	"http-scratch/internal/client"
+	"http-scratch/internal/request"
+)
+
+const defaultHealthInterval = 10 * time.Second
+
+type HealthCheck struct {
+	// Path is requested with GET on every backend; any 2xx or 3xx answer
+	// counts as healthy. Redirects aren't followed.
+	Path string
+	// Interval defaults to 10s, Timeout to Interval.
+	Interval time.Duration
+	Timeout  time.Duration
+}
+
+// StartHealthChecks probes every backend once right away and then every
+// Interval until the returned stop function is called.
+func (p *Pool) StartHealthChecks(hc HealthCheck) (stop func()) {
+	if hc.Interval <= 0 {
+		hc.Interval = defaultHealthInterval
+	}
+	if hc.Timeout <= 0 {
+		hc.Timeout = hc.Interval
+	}
+	// One client for every probe, so they reuse connections
+	c := &client.Client{
+		Timeout: hc.Timeout,
+		CheckRedirect: func(*request.Request, []*request.Request) error {
+			return client.ErrUseLastResponse
+		},
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		ticker := time.NewTicker(hc.Interval)
+		defer ticker.Stop()
+		for {
+			p.checkAll(ctx, c, hc)
+			select {
+			case <-ctx.Done():
+				return
+			case <-ticker.C:
+			}
+		}
+	}()
+
+	return func() {
+		cancel()
+		<-done
+	}
+}
+
+func (p *Pool) checkAll(ctx context.Context, c *client.Client, hc HealthCheck) {
+	var wg sync.WaitGroup
+	for _, b := range p.backends {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			healthy := check(c, hc, b)
+			if ctx.Err() == nil {
+				b.setHealthy(healthy)
+			}
+		}()
+	}
+	wg.Wait()
+}
+
+func check(c *client.Client, hc HealthCheck, b *Backend) bool {
+	u := *b.URL
+	u.Path = singleJoiningSlash(b.URL.Path, hc.Path)
+
+	res, err := c.Get(u.String())
+	if err != nil {
+		return false
+	}
+	res.Body.Close()
+	return res.StatusLine.StatusCode >= 200 && res.StatusLine.StatusCode < 400
+}
@@ -0,0 +1,320 @@
+package proxy
+
+import (
+	"crypto/sha256"
+	"errors"
+	"fmt"
+	"net"
+	"net/url"
+	"strconv"
+	"strings"
+
+	"http-scratch/internal/client"
+	"http-scratch/internal/headers"
+	"http-scratch/internal/problem"
+	"http-scratch/internal/request"
+	"http-scratch/internal/response"
+)
+
+var ErrInvalidUpstream = errors.New("invalid upstream url")
+
+// Connection-specific fields from RFC 9110 section 7.6.1. They describe a
+// single hop and must not be forwarded.
+var hopByHopHeaders = []string{
+	"connection",
+	"keep-alive",
+	"proxy-authenticate",
+	"proxy-authorization",
+	"proxy-connection",
+	"te",
+	"trailer",
+	"transfer-encoding",
+	"upgrade",
+}
+
+const (
+	copyBufferSize = 32 * 1024
+	defaultRetries = 2
+)
+
+type ReverseProxy struct {
+	Backends *Pool
+	// Retries is how many other backends an idempotent request is sent to
+	// after the first one fails.
+	Retries int
+	// StripPrefix is removed from the request target before it is joined
+	// to the upstream path.
+	StripPrefix string
+	// ChecksumTrailers adds X-Content-SHA256 and X-Content-Length trailers
+	// computed over the relayed body.
+	ChecksumTrailers bool
+	Client           *client.Client
+}
+
+func New(upstream string) (*ReverseProxy, error) {
+	pool, err := NewPool(&RoundRobin{}, upstream)
+	if err != nil {
+		return nil, err
+	}
+	return NewBalanced(pool), nil
+}
+
+func NewBalanced(pool *Pool) *ReverseProxy {
+	return &ReverseProxy{
+		Backends: pool,
+		Retries:  defaultRetries,
+		Client: &client.Client{
+			// Redirects are the client's business, not ours.
+			CheckRedirect: func(*request.Request, []*request.Request) error {
+				return client.ErrUseLastResponse
+			},
+		},
+	}
+}
+
+func parseUpstream(upstream string) (*url.URL, error) {
+	u, err := url.Parse(upstream)
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		return nil, ErrInvalidUpstream
+	}
+	return u, nil
+}
+
+func (p *ReverseProxy) Handle(w *response.Writer, req *request.Request) {
+	if err := req.LoadBody(); err != nil {
+		problem.Write(w, req, problem.New(response.StatusBadRequest, err.Error()), nil)
+		return
+	}
+	tried := map[*Backend]bool{}
+	attempts := 1
+	if isIdempotent(req.RequestLine.Method) {
+		attempts += p.Retries
+	}
+
+	for range attempts {
+		backend, err := p.Backends.next(req, tried)
+		if err != nil {
+			break
+		}
+		tried[backend] = true
+
+		res, err := p.roundTrip(backend, req)
+		if err != nil {
+			p.Backends.markFailure(backend)
+			continue
+		}
+
+		if res.StatusLine.StatusCode >= 500 {
+			p.Backends.markFailure(backend)
+		} else {
+			p.Backends.markSuccess(backend)
+		}
+		p.relay(w, req, res)
+		res.Body.Close()
+		backend.active.Add(-1)
+		return
+	}
+
+	problem.Write(w, req, problem.New(response.StatusBadGateway, "no upstream server could handle the request"), nil)
+}
+
+// roundTrip leaves backend.active incremented on success; the caller owns
+// the response body and the decrement.
+func (p *ReverseProxy) roundTrip(backend *Backend, req *request.Request) (*client.Response, error) {
+	outReq, err := p.outboundRequest(backend, req)
+	if err != nil {
+		return nil, err
+	}
+
+	backend.active.Add(1)
+	res, err := p.Client.Do(outReq)
+	if err != nil {
+		backend.active.Add(-1)
+		return nil, err
+	}
+	return res, nil
+}
+
+func (p *ReverseProxy) outboundRequest(backend *Backend, req *request.Request) (*request.Request, error) {
+	target := req.RequestLine.RequestTarget
+	target = strings.TrimPrefix(target, p.StripPrefix)
+	path, rawQuery, _ := strings.Cut(target, "?")
+
+	// The target is already escaped; joining escaped paths keeps the
+	// client's escaping as it was
+	rawPath := singleJoiningSlash(backend.URL.EscapedPath(), path)
+	unescaped, err := url.PathUnescape(rawPath)
+	if err != nil {
+		return nil, err
+	}
+	u := *backend.URL
+	u.Path = unescaped
+	u.RawPath = rawPath
+	u.RawQuery = rawQuery
+
+	outReq, err := client.NewRequest(req.RequestLine.Method, u.String(), req.Body)
+	if err != nil {
+		return nil, err
+	}
+
+	req.Headers.ForEach(func(n, v string) {
+		switch n {
+		// The body is in already, there is nothing left to expect
+		case "host", "content-length", "expect":
+			return
+		}
+		outReq.Headers.Replace(n, v)
+	})
+	removeHopByHop(outReq.Headers)
+
+	host, _ := req.Headers.Get("host")
+	proto := "http"
+	if req.TLS != nil {
+		proto = "https"
+	}
+	addForwarded(outReq.Headers, clientIP(req.RemoteAddr), host, proto)
+	return outReq, nil
+}
+
+func (p *ReverseProxy) relay(w *response.Writer, req *request.Request, res *client.Response) {
+	declaredTrailers, _ := res.Headers.Get("trailer")
+	h := res.Headers
+	removeHopByHop(h)
+
+	if !hasBody(req.RequestLine.Method, res.StatusLine.StatusCode) {
+		w.WriteStatusLine(res.StatusLine.StatusCode)
+		w.WriteHeaders(h)
+		return
+	}
+
+	h.Delete("content-length")
+	h.Replace("transfer-encoding", "chunked")
+	if declaredTrailers != "" {
+		h.Set("trailer", declaredTrailers)
+	}
+	if p.ChecksumTrailers {
+		h.Set("trailer", "X-Content-SHA256")
+		h.Set("trailer", "X-Content-Length")
+	}
+
+	w.WriteStatusLine(res.StatusLine.StatusCode)
+	w.WriteHeaders(h)
+
+	sum := sha256.New()
+	total := 0
+	buf := make([]byte, copyBufferSize)
+	for {
+		n, err := res.Body.Read(buf)
+		if n > 0 {
+			sum.Write(buf[:n])
+			total += n
+			if _, werr := w.WriteChunkedBody(buf[:n]); werr != nil {
+				return
+			}
+		}
+		if err != nil {
+			// A broken upstream stream can't be reported once the status
+			// line is out; ending the chunked body is the best we can do.
+			break
+		}
+	}
+
+	trailers := res.Trailers
+	if trailers == nil {
+		trailers = headers.NewHeaders()
+	}
+	if p.ChecksumTrailers {
+		trailers.Set("X-Content-SHA256", fmt.Sprintf("%x", sum.Sum(nil)))
+		trailers.Set("X-Content-Length", strconv.Itoa(total))
+	}
+	w.WriteChunkedBodyDone(trailers)
+}
+
+func isIdempotent(method string) bool {
+	switch method {
+	case "GET", "HEAD", "OPTIONS", "TRACE", "PUT", "DELETE":
+		return true
+	}
+	return false
+}
+
+func hasBody(method string, status response.StatusCode) bool {
+	if method == "HEAD" {
+		return false
+	}
+	return status >= 200 && status != 204 && status != 304
+}
+
+func removeHopByHop(h headers.Headers) {
+	if c, ok := h.Get("connection"); ok {
+		for _, name := range strings.Split(c, ",") {
+			h.Delete(strings.TrimSpace(name))
+		}
+	}
+	for _, name := range hopByHopHeaders {
+		h.Delete(name)
+	}
+}
+
+func addForwarded(h headers.Headers, ip, host, proto string) {
+	if ip != "" {
+		if prior, ok := h.Get("X-Forwarded-For"); ok {
+			h.Replace("X-Forwarded-For", prior+", "+ip)
+		} else {
+			h.Replace("X-Forwarded-For", ip)
+		}
+	}
+	if host != "" {
+		h.Replace("X-Forwarded-Host", host)
+	}
+	h.Replace("X-Forwarded-Proto", proto)
+
+	var elems []string
+	if ip != "" {
+		elems = append(elems, "for="+forwardedNode(ip))
+	}
+	if host != "" {
+		elems = append(elems, "host="+quoteIfNeeded(host))
+	}
+	elems = append(elems, "proto="+proto)
+	elem := strings.Join(elems, ";")
+	if prior, ok := h.Get("Forwarded"); ok {
+		elem = prior + ", " + elem
+	}
+	h.Replace("Forwarded", elem)
+}
+
+// IPv6 addresses have to be bracketed and quoted in Forwarded (RFC 7239).
+func forwardedNode(ip string) string {
+	if strings.Contains(ip, ":") {
+		return `"[` + ip + `]"`
+	}
+	return ip
+}
+
+func quoteIfNeeded(s string) string {
+	if strings.ContainsAny(s, ":[]") {
+		return `"` + s + `"`
+	}
+	return s
+}
+
+func clientIP(remoteAddr string) string {
+	host, _, err := net.SplitHostPort(remoteAddr)
+	if err != nil {
+		return remoteAddr
+	}
+	return host
+}
+
+func singleJoiningSlash(a, b string) string {
+	aslash := strings.HasSuffix(a, "/")
+	bslash := strings.HasPrefix(b, "/")
+	switch {
+	case aslash && bslash:
+		return a + b[1:]
+	case !aslash && !bslash:
+		return a + "/" + b
+	}
+	return a + b
+}
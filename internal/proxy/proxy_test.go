@@ -0,0 +1,140 @@
+package proxy
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/tls"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"http-scratch/internal/request"
+	"http-scratch/internal/response"
+)
+
+func proxyRequest(t *testing.T, p *ReverseProxy, raw string) *http.Response {
+	t.Helper()
+	req, err := request.RequestFromReader(strings.NewReader(raw))
+	require.NoError(t, err)
+	req.RemoteAddr = "10.0.0.7:51234"
+
+	var out bytes.Buffer
+	p.Handle(response.NewWriter(&out), req)
+
+	res, err := http.ReadResponse(bufio.NewReader(&out), nil)
+	require.NoError(t, err)
+	return res
+}
+
+func TestReverseProxy(t *testing.T) {
+	var got *http.Request
+	var gotBody string
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		got = r
+		b, _ := io.ReadAll(r.Body)
+		gotBody = string(b)
+
+		w.Header().Set("Trailer", "X-Upstream-Done")
+		w.Header().Set("Keep-Alive", "timeout=5")
+		w.Header().Set("Proxy-Authenticate", "Basic")
+		w.Header().Set("X-Upstream", "yes")
+		w.WriteHeader(http.StatusCreated)
+		w.Write([]byte(strings.Repeat("z", 70000)))
+		w.Header().Set("X-Upstream-Done", "true")
+	}))
+	defer upstream.Close()
+
+	p, err := New(upstream.URL + "/base")
+	require.NoError(t, err)
+	p.StripPrefix = "/api"
+	p.ChecksumTrailers = true
+
+	// Test: method, body, headers and target are forwarded
+	res := proxyRequest(t, p, "PUT /api/things?x=1 HTTP/1.1\r\n"+
+		"Host: example.com\r\n"+
+		"Connection: keep-alive, X-Drop-Me\r\n"+
+		"X-Drop-Me: 1\r\n"+
+		"Proxy-Authorization: secret\r\n"+
+		"X-Custom: kept\r\n"+
+		"Content-Length: 5\r\n"+
+		"\r\nhello")
+	require.NotNil(t, got)
+	assert.Equal(t, "PUT", got.Method)
+	assert.Equal(t, "/base/things", got.URL.Path)
+	assert.Equal(t, "x=1", got.URL.RawQuery)
+	assert.Equal(t, "hello", gotBody)
+	assert.Equal(t, "kept", got.Header.Get("X-Custom"))
+	assert.Empty(t, got.Header.Get("X-Drop-Me"))
+	assert.Empty(t, got.Header.Get("Proxy-Authorization"))
+	assert.Equal(t, "10.0.0.7", got.Header.Get("X-Forwarded-For"))
+	assert.Equal(t, "example.com", got.Header.Get("X-Forwarded-Host"))
+	assert.Equal(t, "http", got.Header.Get("X-Forwarded-Proto"))
+	assert.Equal(t, "for=10.0.0.7;host=example.com;proto=http", got.Header.Get("Forwarded"))
+
+	// Test: upstream status, headers, body and trailers are relayed
+	assert.Equal(t, http.StatusCreated, res.StatusCode)
+	assert.Equal(t, "yes", res.Header.Get("X-Upstream"))
+	assert.Empty(t, res.Header.Get("Keep-Alive"))
+	assert.Empty(t, res.Header.Get("Proxy-Authenticate"))
+	assert.Equal(t, []string{"chunked"}, res.TransferEncoding)
+	body, err := io.ReadAll(res.Body)
+	require.NoError(t, err)
+	assert.Len(t, body, 70000)
+	assert.Equal(t, "true", res.Trailer.Get("X-Upstream-Done"))
+	assert.Equal(t, "70000", res.Trailer.Get("X-Content-Length"))
+	assert.Len(t, res.Trailer.Get("X-Content-SHA256"), 64)
+
+	// Test: requests that came over TLS are forwarded as https
+	tlsReq, err := request.RequestFromReader(strings.NewReader("GET /api/ HTTP/1.1\r\nHost: example.com\r\n\r\n"))
+	require.NoError(t, err)
+	tlsReq.RemoteAddr = "10.0.0.7:51234"
+	tlsReq.TLS = &tls.ConnectionState{}
+	p.Handle(response.NewWriter(io.Discard), tlsReq)
+	assert.Equal(t, "https", got.Header.Get("X-Forwarded-Proto"))
+	assert.Equal(t, "for=10.0.0.7;host=example.com;proto=https", got.Header.Get("Forwarded"))
+
+	// Test: percent-encoded paths keep their escaping
+	proxyRequest(t, p, "GET /api/a%20b/c%2Fd HTTP/1.1\r\nHost: example.com\r\n\r\n")
+	assert.Equal(t, "/base/a%20b/c%2Fd", got.URL.EscapedPath())
+	assert.Equal(t, "/base/a b/c/d", got.URL.Path)
+
+	// Test: existing X-Forwarded-For chain is extended
+	proxyRequest(t, p, "GET /api/ HTTP/1.1\r\nHost: example.com\r\nX-Forwarded-For: 1.2.3.4\r\n\r\n")
+	assert.Equal(t, "1.2.3.4, 10.0.0.7", got.Header.Get("X-Forwarded-For"))
+
+	// Test: response headers named in Connection are dropped
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	defer ln.Close()
+	go func() {
+		c, err := ln.Accept()
+		if err != nil {
+			return
+		}
+		defer c.Close()
+		http.ReadRequest(bufio.NewReader(c))
+		io.WriteString(c, "HTTP/1.1 200 OK\r\nConnection: X-Secret\r\nX-Secret: hop\r\nX-Upstream: yes\r\nContent-Length: 2\r\n\r\nok")
+	}()
+	raw, err := New("http://" + ln.Addr().String())
+	require.NoError(t, err)
+	res = proxyRequest(t, raw, "GET / HTTP/1.1\r\nHost: example.com\r\n\r\n")
+	assert.Equal(t, http.StatusOK, res.StatusCode)
+	assert.Equal(t, "yes", res.Header.Get("X-Upstream"))
+	assert.Empty(t, res.Header.Get("X-Secret"))
+	assert.Empty(t, res.Header.Get("Connection"))
+
+	// Test: unreachable upstream
+	upstream.Close()
+	res = proxyRequest(t, p, "GET /api/ HTTP/1.1\r\nHost: example.com\r\n\r\n")
+	assert.Equal(t, http.StatusBadGateway, res.StatusCode)
+
+	// Test: invalid upstream
+	_, err = New("not a url")
+	require.ErrorIs(t, err, ErrInvalidUpstream)
+}
@@ -0,0 +1,98 @@
+package request
+
+import (
+	"bytes"
+	"compress/flate"
+	"compress/gzip"
+	"compress/zlib"
+	"errors"
+	"io"
+	"strconv"
+	"strings"
+)
+
+var (
+	ErrUnsupportedEncoding = errors.New("unsupported content encoding")
+	ErrMalformedEncoding   = errors.New("malformed encoded body")
+	ErrBodyTooLarge        = errors.New("decoded body too large")
+)
+
+// SupportedEncodings lists the content codings DecodeBody understands,
+// suitable for an Accept-Encoding response header.
+const SupportedEncodings = "gzip, deflate"
+
+// DecodeBody undoes every coding listed in Content-Encoding, last applied
+// first, and replaces Body with the result. Decoding stops with
+// ErrBodyTooLarge once the output would exceed maxSize bytes. A held back
+// body is loaded first, unless its encoded size is past maxSize already.
+func (r *Request) DecodeBody(maxSize int64) error {
+	value, ok := r.Headers.Get("content-encoding")
+	if !ok {
+		return nil
+	}
+	if r.BodyHeld() && int64(r.ContentLength()) > maxSize {
+		return ErrBodyTooLarge
+	}
+	if err := r.LoadBody(); err != nil {
+		return err
+	}
+
+	codings := strings.Split(value, ",")
+	body := []byte(r.Body)
+	for i := len(codings) - 1; i >= 0; i-- {
+		coding := strings.ToLower(strings.TrimSpace(codings[i]))
+
+		var err error
+		switch coding {
+		case "", "identity":
+			continue
+		case "gzip", "x-gzip":
+			body, err = decodeGzip(body, maxSize)
+		case "deflate":
+			body, err = decodeDeflate(body, maxSize)
+		default:
+			return ErrUnsupportedEncoding
+		}
+		if err != nil {
+			return err
+		}
+	}
+
+	r.Body = string(body)
+	r.Headers.Delete("content-encoding")
+	r.Headers.Replace("content-length", strconv.Itoa(len(body)))
+	return nil
+}
+
+func decodeGzip(body []byte, maxSize int64) ([]byte, error) {
+	zr, err := gzip.NewReader(bytes.NewReader(body))
+	if err != nil {
+		return nil, ErrMalformedEncoding
+	}
+	defer zr.Close()
+	return readLimited(zr, maxSize)
+}
+
+// "deflate" is meant to be zlib-wrapped, but enough clients send raw
+// DEFLATE data that it is worth falling back to it.
+func decodeDeflate(body []byte, maxSize int64) ([]byte, error) {
+	zr, err := zlib.NewReader(bytes.NewReader(body))
+	if err != nil {
+		fr := flate.NewReader(bytes.NewReader(body))
+		defer fr.Close()
+		return readLimited(fr, maxSize)
+	}
+	defer zr.Close()
+	return readLimited(zr, maxSize)
+}
+
+func readLimited(r io.Reader, maxSize int64) ([]byte, error) {
+	out, err := io.ReadAll(io.LimitReader(r, maxSize+1))
+	if err != nil {
+		return nil, ErrMalformedEncoding
+	}
+	if int64(len(out)) > maxSize {
+		return nil, ErrBodyTooLarge
+	}
+	return out, nil
+}
@@ -0,0 +1,90 @@
+package request
+
+import (
+	"bytes"
+	"compress/flate"
+	"compress/gzip"
+	"compress/zlib"
+	"strconv"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func encodedRequest(t *testing.T, encoding string, body []byte) *Request {
+	t.Helper()
+	raw := "POST /upload HTTP/1.1\r\n" +
+		"Host: localhost:42069\r\n" +
+		"Content-Encoding: " + encoding + "\r\n" +
+		"Content-Length: " + strconv.Itoa(len(body)) + "\r\n" +
+		"\r\n" + string(body)
+	r, err := RequestFromReader(&chunkReader{data: raw, numBytesPerRead: 7})
+	require.NoError(t, err)
+	return r
+}
+
+func TestDecodeBody(t *testing.T) {
+	payload := []byte(`{"hello":"world","padding":"` + strings.Repeat("a", 2048) + `"}`)
+
+	// Test: gzip
+	var buf bytes.Buffer
+	gw := gzip.NewWriter(&buf)
+	gw.Write(payload)
+	gw.Close()
+	r := encodedRequest(t, "gzip", buf.Bytes())
+	require.NoError(t, r.DecodeBody(1<<20))
+	assert.Equal(t, string(payload), r.Body)
+	_, ok := r.Headers.Get("content-encoding")
+	assert.False(t, ok)
+	cl, _ := r.Headers.Get("content-length")
+	assert.Equal(t, strconv.Itoa(len(payload)), cl)
+
+	// Test: zlib-wrapped deflate
+	buf.Reset()
+	zw := zlib.NewWriter(&buf)
+	zw.Write(payload)
+	zw.Close()
+	r = encodedRequest(t, "deflate", buf.Bytes())
+	require.NoError(t, r.DecodeBody(1<<20))
+	assert.Equal(t, string(payload), r.Body)
+
+	// Test: raw deflate
+	buf.Reset()
+	fw, _ := flate.NewWriter(&buf, flate.DefaultCompression)
+	fw.Write(payload)
+	fw.Close()
+	r = encodedRequest(t, "deflate", buf.Bytes())
+	require.NoError(t, r.DecodeBody(1<<20))
+	assert.Equal(t, string(payload), r.Body)
+
+	// Test: stacked codings are undone in reverse
+	var inner bytes.Buffer
+	zw = zlib.NewWriter(&inner)
+	zw.Write(payload)
+	zw.Close()
+	buf.Reset()
+	gw = gzip.NewWriter(&buf)
+	gw.Write(inner.Bytes())
+	gw.Close()
+	r = encodedRequest(t, "deflate, gzip", buf.Bytes())
+	require.NoError(t, r.DecodeBody(1<<20))
+	assert.Equal(t, string(payload), r.Body)
+
+	// Test: decompressed size limit
+	buf.Reset()
+	gw = gzip.NewWriter(&buf)
+	gw.Write(bytes.Repeat([]byte{0}, 1<<20))
+	gw.Close()
+	r = encodedRequest(t, "gzip", buf.Bytes())
+	require.ErrorIs(t, r.DecodeBody(1024), ErrBodyTooLarge)
+
+	// Test: unsupported coding
+	r = encodedRequest(t, "br", []byte("whatever"))
+	require.ErrorIs(t, r.DecodeBody(1024), ErrUnsupportedEncoding)
+
+	// Test: corrupt gzip data
+	r = encodedRequest(t, "gzip", []byte("definitely not gzip"))
+	require.ErrorIs(t, r.DecodeBody(1024), ErrMalformedEncoding)
+}
@@ -2,23 +2,33 @@ package request
 
 import (
 	"bytes"
+	"context"
+	"crypto/tls"
+	"crypto/x509"
 	"errors"
 	"io"
 	"strconv"
 	"strings"
 
+	"http-scratch/internal/cookie"
 	"http-scratch/internal/headers"
 )
 
 var (
-	ErrMalformedReqLine       = errors.New("malformed request line")
-	ErrUnsupportedHTTPVersion = errors.New("unsupported HTTP version")
-	ErrReqInErrorState        = errors.New("request in error state")
-	Separator                 = []byte("\r\n")
+	ErrMalformedReqLine            = errors.New("malformed request line")
+	ErrUnsupportedHTTPVersion      = errors.New("unsupported HTTP version")
+	ErrReqInErrorState             = errors.New("request in error state")
+	ErrHeaderTooLarge              = errors.New("request header too large")
+	ErrInvalidContentLength        = errors.New("invalid Content-Length")
+	ErrUnsupportedTransferEncoding = errors.New("transfer codings are not supported")
+	Separator                      = []byte("\r\n")
 )
 
 type parserState string
 
+// DefaultMaxHeaderBytes is the Reader.MaxHeaderBytes used when it is zero.
+const DefaultMaxHeaderBytes = 1 << 20
+
 const (
 	StateInit    parserState = "init"
 	StateHeaders parserState = "headers"
@@ -36,8 +46,115 @@ type RequestLine struct {
 type Request struct {
 	RequestLine RequestLine
 	Headers     headers.Headers
-	Body        string
-	state       parserState
+	// Body is empty while the client holds it back, until LoadBody; see
+	// ExpectsContinue and BodyHeld. Only readers with Continue set leave
+	// bodies held.
+	Body       string
+	RemoteAddr string
+	// TLS is the state of the connection the request came over, nil for
+	// plaintext.
+	TLS   *tls.ConnectionState
+	state parserState
+	// headerLen counts the bytes of the request line and header section
+	// parsed so far.
+	headerLen int
+	ctx       context.Context
+	held      *heldBody
+}
+
+// heldBody is a body still on the connection, shared by the copies of a
+// request.
+type heldBody struct {
+	load   func() error
+	loaded bool
+	body   string
+	err    error
+}
+
+// Context is the request's context, context.Background when none was set.
+func (r *Request) Context() context.Context {
+	if r.ctx == nil {
+		return context.Background()
+	}
+	return r.ctx
+}
+
+// WithContext returns a shallow copy of r carrying ctx.
+func (r *Request) WithContext(ctx context.Context) *Request {
+	r2 := *r
+	r2.ctx = ctx
+	return &r2
+}
+
+// ClientChain is the client's verified certificate chain, leaf first, or
+// nil when the client sent no certificate or the request came over
+// plaintext.
+func (r *Request) ClientChain() []*x509.Certificate {
+	if r.TLS == nil || len(r.TLS.VerifiedChains) == 0 {
+		return nil
+	}
+	return r.TLS.VerifiedChains[0]
+}
+
+// ClientCertificate is the leaf of ClientChain, or nil.
+func (r *Request) ClientCertificate() *x509.Certificate {
+	if chain := r.ClientChain(); len(chain) > 0 {
+		return chain[0]
+	}
+	return nil
+}
+
+func (r *Request) Cookies() []*cookie.Cookie {
+	value, ok := r.Headers.Get("cookie")
+	if !ok {
+		return nil
+	}
+	return cookie.ParseCookies(value)
+}
+
+// Cookie returns the first cookie with the given name; names are case
+// sensitive.
+func (r *Request) Cookie(name string) (*cookie.Cookie, bool) {
+	for _, c := range r.Cookies() {
+		if c.Name == name {
+			return c, true
+		}
+	}
+	return nil, false
+}
+
+// ExpectsContinue reports whether the client waits for 100 Continue
+// before sending the body (RFC 9110 section 10.1.1).
+func (r *Request) ExpectsContinue() bool {
+	v, ok := r.Headers.Get("expect")
+	return ok && strings.EqualFold(strings.TrimSpace(v), "100-continue")
+}
+
+// ContentLength is the declared length of the body, 0 when there is none.
+func (r *Request) ContentLength() int {
+	n, _ := contentLength(r.Headers)
+	return n
+}
+
+// BodyHeld reports whether the body is still with the client, waiting
+// for LoadBody. Handlers can turn such requests down, say with 413 or
+// 417, without the body ever being sent.
+func (r *Request) BodyHeld() bool {
+	return r.held != nil && !r.held.loaded
+}
+
+// LoadBody reads a body the client held back into Body, telling it to go
+// on first. It does nothing for bodies read along with the request.
+func (r *Request) LoadBody() error {
+	if r.held == nil {
+		return nil
+	}
+	if !r.held.loaded {
+		r.held.loaded = true
+		r.held.err = r.held.load()
+	}
+	r.Body = r.held.body
+	return r.held.err
 }
 
 func (r *Request) done() bool {
@@ -45,8 +162,18 @@ func (r *Request) done() bool {
 }
 
 func (r *Request) hasBody() bool {
-	cl := getInt(r.Headers, "content-length", 0)
-	return cl > 0
+	return r.ContentLength() > 0
+}
+
+// checkFraming rejects header sections that could tell the end of the
+// body apart from how another hop tells it, the root of request
+// smuggling (RFC 9112 section 6.3).
+func (r *Request) checkFraming() error {
+	if _, ok := r.Headers.Get("transfer-encoding"); ok {
+		return ErrUnsupportedTransferEncoding
+	}
+	_, err := contentLength(r.Headers)
+	return err
 }
 
 func (r *Request) parse(data []byte) (int, error) {
@@ -73,6 +200,7 @@ outer:
 
 			r.RequestLine = rl
 			read += n
+			r.headerLen += n
 			r.state = StateHeaders
 
 		case StateHeaders:
@@ -87,8 +215,13 @@ outer:
 			}
 
 			read += n
+			r.headerLen += n
 
 			if done {
+				if err := r.checkFraming(); err != nil {
+					r.state = StateError
+					return 0, err
+				}
 				if r.hasBody() {
 					r.state = StateBody
 				} else {
@@ -97,10 +230,16 @@ outer:
 			}
 
 		case StateBody:
-			cl := getInt(r.Headers, "content-length", 0)
+			cl := r.ContentLength()
 
+			// Nothing to read; hasBody keeps us from getting here
 			if cl == 0 {
-				panic("yes")
+				r.state = StateDone
+				break outer
+			}
+
+			if len(currentData) == 0 {
+				break outer
 			}
 
 			remaining := min(cl-len(r.Body), len(currentData))
@@ -115,7 +254,8 @@ outer:
 			break outer
 
 		default:
-			panic("yo")
+			r.state = StateError
+			return 0, ErrReqInErrorState
 		}
 	}
 	return read, nil
@@ -126,31 +266,127 @@ func newRequest() *Request {
 }
 
 func RequestFromReader(reader io.Reader) (*Request, error) {
+	return NewReader(reader).ReadRequest()
+}
+
+// Reader reads requests one after another from a connection. Bytes read
+// past the end of a request are kept for the next one.
+type Reader struct {
+	// Continue, when set, leaves bodies the client holds back for 100
+	// Continue on the connection until Request.LoadBody. It is called
+	// then to send 100 Continue and must call read to get the body.
+	Continue func(req *Request, read func() error) error
+	// MaxHeaderBytes bounds the request line and header section of a
+	// request; zero means DefaultMaxHeaderBytes. Past it ReadRequest fails
+	// with ErrHeaderTooLarge.
+	MaxHeaderBytes int
+
+	reader io.Reader
+	// buf grows as a header section needs it, up to MaxHeaderBytes
+	buf    []byte
+	bufLen int
+}
+
+func NewReader(reader io.Reader) *Reader {
+	return &Reader{reader: reader, buf: make([]byte, 1024)}
+}
+
+func (r *Reader) ReadRequest() (*Request, error) {
 	request := newRequest()
+	if err := r.read(request, r.Continue != nil); err != nil {
+		return nil, err
+	}
+	return request, nil
+}
 
-	// Could overrun
-	buf := make([]byte, 1024)
-	bufLen := 0
-	for !request.done() {
-		// Read from buffer
-		n, err := reader.Read(buf[bufLen:])
+// read parses request from the buffer and the connection until it is
+// done or, with hold set, until all that is left is a body the client
+// holds back.
+func (r *Reader) read(request *Request, hold bool) error {
+	for {
+		// Parse what is buffered first, it may already hold a request
+		readN, err := request.parse(r.buf[:r.bufLen])
 		if err != nil {
-			return nil, err
+			return err
 		}
 
-		// Parse read buffer
-		bufLen += n
-		readN, err := request.parse(buf[:bufLen])
-		if err != nil {
-			return nil, err
+		// Move to beginning
+		copy(r.buf, r.buf[readN:r.bufLen])
+		r.bufLen -= readN
+		if request.done() {
+			return nil
+		}
+		if hold && request.state == StateBody && request.Body == "" && request.ExpectsContinue() {
+			r.holdBody(request)
+			return nil
+		}
+		if request.state != StateBody && request.headerLen+r.bufLen > r.maxHeaderBytes() {
+			return ErrHeaderTooLarge
 		}
 
-		// Move to beginning
-		copy(buf, buf[readN:bufLen])
-		bufLen -= readN
+		if err := r.fill(); err != nil {
+			return err
+		}
 	}
+}
 
-	return request, nil
+func (r *Reader) maxHeaderBytes() int {
+	if r.MaxHeaderBytes <= 0 {
+		return DefaultMaxHeaderBytes
+	}
+	return r.MaxHeaderBytes
+}
+
+// fill reads from the connection into the buffer, doubling it first when
+// it is full.
+func (r *Reader) fill() error {
+	if r.bufLen == len(r.buf) {
+		if r.bufLen >= r.maxHeaderBytes() {
+			return ErrHeaderTooLarge
+		}
+		buf := make([]byte, min(2*len(r.buf), r.maxHeaderBytes()))
+		copy(buf, r.buf[:r.bufLen])
+		r.buf = buf
+	}
+	n, err := r.reader.Read(r.buf[r.bufLen:])
+	r.bufLen += n
+	return err
+}
+
+func (r *Reader) holdBody(request *Request) {
+	held := &heldBody{}
+	held.load = func() error {
+		err := r.Continue(request, func() error {
+			return r.read(request, false)
+		})
+		held.body = request.Body
+		return err
+	}
+	request.held = held
+}
+
+// HasPrefix reports whether the next bytes on the connection are prefix,
+// reading only as far as it takes to tell. Nothing is consumed.
+func (r *Reader) HasPrefix(prefix []byte) (bool, error) {
+	for {
+		n := min(r.bufLen, len(prefix))
+		if !bytes.Equal(r.buf[:n], prefix[:n]) {
+			return false, nil
+		}
+		if n == len(prefix) {
+			return true, nil
+		}
+
+		if err := r.fill(); err != nil {
+			return false, err
+		}
+	}
+}
+
+// Buffered returns the bytes read past the last request, valid until the
+// next call to ReadRequest.
+func (r *Reader) Buffered() []byte {
+	return r.buf[:r.bufLen]
 }
 
 func parseRequestLine(b []byte) (RequestLine, int, error) {
@@ -190,14 +426,24 @@ func parseRequestLine(b []byte) (RequestLine, int, error) {
 	return rl, read, nil
 }
 
-func getInt(h headers.Headers, name string, defaultVal int) int {
-	valStr, ok := h.Get(name)
+// contentLength is the declared length of the body, 0 without one.
+// Repeated Content-Length fields must agree (RFC 9110 section 8.6).
+func contentLength(h headers.Headers) (int, error) {
+	v, ok := h.Get("content-length")
 	if !ok {
-		return defaultVal
+		return 0, nil
 	}
-	val, err := strconv.Atoi(valStr)
-	if err != nil {
-		return defaultVal
+	n := -1
+	for _, s := range strings.Split(v, ",") {
+		s = strings.TrimSpace(s)
+		if s == "" || strings.Trim(s, "0123456789") != "" {
+			return 0, ErrInvalidContentLength
+		}
+		cl, err := strconv.Atoi(s)
+		if err != nil || (n != -1 && cl != n) {
+			return 0, ErrInvalidContentLength
+		}
+		n = cl
 	}
-	return val
+	return n, nil
 }
@@ -1,6 +1,7 @@
 package request
 
 import (
+	"context"
 	"io"
 	"strings"
 	"testing"
@@ -132,7 +133,6 @@ func TestParseHeaders(t *testing.T) {
 	require.Error(t, err)
 }
 
-/*
 func TestParseBody(t *testing.T) {
 	// Test: Standard Body
 	reader := &chunkReader{
@@ -159,5 +159,134 @@ func TestParseBody(t *testing.T) {
 	}
 	r, err = RequestFromReader(reader)
 	require.Error(t, err)
+
+	// Test: Repeated Content-Length fields that agree
+	r, err = RequestFromReader(strings.NewReader("POST / HTTP/1.1\r\nHost: x\r\nContent-Length: 2\r\nContent-Length: 2\r\n\r\nhi"))
+	require.NoError(t, err)
+	assert.Equal(t, "hi", r.Body)
+
+	// Test: Framing another hop could read differently is rejected
+	for _, field := range []string{"Content-Length: 5x", "Content-Length: -1", "Content-Length: +5", "Content-Length: 2\r\nContent-Length: 3"} {
+		_, err = RequestFromReader(strings.NewReader("POST / HTTP/1.1\r\nHost: x\r\n" + field + "\r\n\r\nhi"))
+		assert.ErrorIs(t, err, ErrInvalidContentLength, field)
+	}
+	_, err = RequestFromReader(strings.NewReader("POST / HTTP/1.1\r\nHost: x\r\nTransfer-Encoding: chunked\r\n\r\n0\r\n\r\n"))
+	assert.ErrorIs(t, err, ErrUnsupportedTransferEncoding)
+}
+
+func TestReader(t *testing.T) {
+	// Test: Back to back requests in one read, then leftover bytes
+	rr := NewReader(strings.NewReader(
+		"POST /a HTTP/1.1\r\nHost: localhost:42069\r\nContent-Length: 5\r\n\r\nhello" +
+			"GET /b HTTP/1.1\r\nHost: localhost:42069\r\n\r\n" +
+			"\x81\x05frame"))
+	r, err := rr.ReadRequest()
+	require.NoError(t, err)
+	assert.Equal(t, "/a", r.RequestLine.RequestTarget)
+	assert.Equal(t, "hello", r.Body)
+
+	r, err = rr.ReadRequest()
+	require.NoError(t, err)
+	assert.Equal(t, "/b", r.RequestLine.RequestTarget)
+	assert.Equal(t, "\x81\x05frame", string(rr.Buffered()))
+
+	// Test: Requests split across reads
+	rr = NewReader(&chunkReader{
+		data:            "GET /1 HTTP/1.1\r\nHost: x\r\n\r\nGET /2 HTTP/1.1\r\nHost: x\r\n\r\n",
+		numBytesPerRead: 7,
+	})
+	for _, target := range []string{"/1", "/2"} {
+		r, err = rr.ReadRequest()
+		require.NoError(t, err)
+		assert.Equal(t, target, r.RequestLine.RequestTarget)
+	}
+	_, err = rr.ReadRequest()
+	assert.ErrorIs(t, err, io.EOF)
+
+	// Test: HasPrefix peeks without consuming
+	rr = NewReader(&chunkReader{data: "PRI * HTTP/2.0\r\n", numBytesPerRead: 2})
+	ok, err := rr.HasPrefix([]byte("PRI * HTTP/2.0"))
+	require.NoError(t, err)
+	assert.True(t, ok)
+	assert.Equal(t, "PRI * HTTP/2.0", string(rr.Buffered()))
+
+	rr = NewReader(&chunkReader{data: "POST /a HTTP/1.1\r\nHost: x\r\n\r\n", numBytesPerRead: 3})
+	ok, err = rr.HasPrefix([]byte("PRI * HTTP/2.0"))
+	require.NoError(t, err)
+	assert.False(t, ok)
+	r, err = rr.ReadRequest()
+	require.NoError(t, err)
+	assert.Equal(t, "POST", r.RequestLine.Method)
+
+	// Test: The buffer grows for a header section longer than it
+	long := strings.Repeat("a", 4000)
+	rr = NewReader(&chunkReader{data: "GET / HTTP/1.1\r\nHost: x\r\nCookie: " + long + "\r\n\r\n", numBytesPerRead: 500})
+	r, err = rr.ReadRequest()
+	require.NoError(t, err)
+	cookie, _ := r.Headers.Get("cookie")
+	assert.Equal(t, long, cookie)
+
+	// Test: Past MaxHeaderBytes, whether one line or many
+	rr = NewReader(strings.NewReader("GET / HTTP/1.1\r\nHost: x\r\nCookie: " + long + "\r\n\r\n"))
+	rr.MaxHeaderBytes = 2048
+	_, err = rr.ReadRequest()
+	assert.ErrorIs(t, err, ErrHeaderTooLarge)
+
+	rr = NewReader(strings.NewReader("GET / HTTP/1.1\r\n" + strings.Repeat("X-A: b\r\n", 400) + "\r\n"))
+	rr.MaxHeaderBytes = 2048
+	_, err = rr.ReadRequest()
+	assert.ErrorIs(t, err, ErrHeaderTooLarge)
+
+	// Test: With Continue set, a body the client holds back waits for
+	// LoadBody
+	const expect = "POST /up HTTP/1.1\r\nHost: x\r\nExpect: 100-continue\r\nContent-Length: 5\r\n\r\n"
+	continued := 0
+	pr, pw := io.Pipe()
+	rr = NewReader(pr)
+	rr.Continue = func(req *Request, read func() error) error {
+		continued++
+		go io.WriteString(pw, "hello")
+		return read()
+	}
+	go io.WriteString(pw, expect)
+	r, err = rr.ReadRequest()
+	require.NoError(t, err)
+	assert.True(t, r.ExpectsContinue())
+	assert.True(t, r.BodyHeld())
+	assert.Equal(t, "", r.Body)
+
+	copied := r.WithContext(context.Background())
+	require.NoError(t, copied.LoadBody())
+	assert.Equal(t, "hello", copied.Body)
+	assert.False(t, r.BodyHeld())
+	require.NoError(t, r.LoadBody())
+	assert.Equal(t, "hello", r.Body)
+	assert.Equal(t, 1, continued)
+
+	// Test: Without Continue the body is read along with the request
+	r, err = RequestFromReader(strings.NewReader(expect + "hello"))
+	require.NoError(t, err)
+	assert.False(t, r.BodyHeld())
+	assert.Equal(t, "hello", r.Body)
+}
+
+func TestCookies(t *testing.T) {
+	// Test: Cookies across repeated Cookie fields
+	r, err := RequestFromReader(strings.NewReader("GET / HTTP/1.1\r\nHost: localhost:42069\r\nCookie: session=abc; theme=dark\r\nCookie: lang=en\r\n\r\n"))
+	require.NoError(t, err)
+	cookies := r.Cookies()
+	require.Len(t, cookies, 3)
+	assert.Equal(t, "lang", cookies[2].Name)
+
+	c, ok := r.Cookie("theme")
+	assert.True(t, ok)
+	assert.Equal(t, "dark", c.Value)
+
+	_, ok = r.Cookie("Theme")
+	assert.False(t, ok)
+
+	// Test: No Cookie field
+	r, err = RequestFromReader(strings.NewReader("GET / HTTP/1.1\r\nHost: localhost:42069\r\n\r\n"))
+	require.NoError(t, err)
+	assert.Empty(t, r.Cookies())
 }
-*/
@@ -0,0 +1,27 @@
+package response
+
+import (
+	"bufio"
+	"errors"
+	"net"
+)
+
+var (
+	ErrHijacked      = errors.New("connection has been hijacked")
+	ErrNotHijackable = errors.New("connection can't be hijacked")
+)
+
+// Hijack takes the underlying connection over, for protocols like
+// WebSocket that leave HTTP behind after the handshake. The reader returns
+// any bytes the server already read past the request before reading from
+// the connection itself. Once hijacked, the Writer can't be used any more
+// and the caller is responsible for closing the connection.
+func (w *Writer) Hijack() (net.Conn, *bufio.Reader, error) {
+	h, ok := w.writer.(interface {
+		Hijack() (net.Conn, *bufio.Reader, error)
+	})
+	if !ok {
+		return nil, nil, ErrNotHijackable
+	}
+	return h.Hijack()
+}
@@ -6,44 +6,145 @@ import (
 	"io"
 	"strconv"
 
+	"http-scratch/internal/cookie"
 	"http-scratch/internal/headers"
 )
 
-var ErrUnrecognizedStatusCode = errors.New("unrecognized status code")
+var (
+	ErrUnrecognizedStatusCode = errors.New("unrecognized status code")
+	ErrNotInformational       = errors.New("status code is not informational")
+	ErrResponseStarted        = errors.New("response already started")
+	Separator                 = []byte("\r\n")
+)
 
 type StatusCode int
 
 const (
-	StatusOK                  StatusCode = 200
-	StatusBadRequest          StatusCode = 400
+	StatusContinue           StatusCode = 100
+	StatusSwitchingProtocols StatusCode = 101
+	StatusEarlyHints         StatusCode = 103
+
+	StatusOK        StatusCode = 200
+	StatusCreated   StatusCode = 201
+	StatusAccepted  StatusCode = 202
+	StatusNoContent StatusCode = 204
+
+	StatusMovedPermanently  StatusCode = 301
+	StatusFound             StatusCode = 302
+	StatusSeeOther          StatusCode = 303
+	StatusNotModified       StatusCode = 304
+	StatusTemporaryRedirect StatusCode = 307
+	StatusPermanentRedirect StatusCode = 308
+
+	StatusBadRequest                  StatusCode = 400
+	StatusUnauthorized                StatusCode = 401
+	StatusForbidden                   StatusCode = 403
+	StatusNotFound                    StatusCode = 404
+	StatusMethodNotAllowed            StatusCode = 405
+	StatusNotAcceptable               StatusCode = 406
+	StatusRequestTimeout              StatusCode = 408
+	StatusConflict                    StatusCode = 409
+	StatusGone                        StatusCode = 410
+	StatusLengthRequired              StatusCode = 411
+	StatusRequestEntityTooLarge       StatusCode = 413
+	StatusUnsupportedMediaType        StatusCode = 415
+	StatusExpectationFailed           StatusCode = 417
+	StatusUnprocessableEntity         StatusCode = 422
+	StatusUpgradeRequired             StatusCode = 426
+	StatusTooManyRequests             StatusCode = 429
+	StatusRequestHeaderFieldsTooLarge StatusCode = 431
+
 	StatusInternalServerError StatusCode = 500
+	StatusNotImplemented      StatusCode = 501
+	StatusBadGateway          StatusCode = 502
+	StatusServiceUnavailable  StatusCode = 503
+	StatusGatewayTimeout      StatusCode = 504
 )
 
+var statusText = map[StatusCode]string{
+	StatusContinue:           "Continue",
+	StatusSwitchingProtocols: "Switching Protocols",
+	StatusEarlyHints:         "Early Hints",
+
+	StatusOK:        "OK",
+	StatusCreated:   "Created",
+	StatusAccepted:  "Accepted",
+	StatusNoContent: "No Content",
+
+	StatusMovedPermanently:  "Moved Permanently",
+	StatusFound:             "Found",
+	StatusSeeOther:          "See Other",
+	StatusNotModified:       "Not Modified",
+	StatusTemporaryRedirect: "Temporary Redirect",
+	StatusPermanentRedirect: "Permanent Redirect",
+
+	StatusBadRequest:                  "Bad Request",
+	StatusUnauthorized:                "Unauthorized",
+	StatusForbidden:                   "Forbidden",
+	StatusNotFound:                    "Not Found",
+	StatusMethodNotAllowed:            "Method Not Allowed",
+	StatusNotAcceptable:               "Not Acceptable",
+	StatusRequestTimeout:              "Request Timeout",
+	StatusConflict:                    "Conflict",
+	StatusGone:                        "Gone",
+	StatusLengthRequired:              "Length Required",
+	StatusRequestEntityTooLarge:       "Content Too Large",
+	StatusUnsupportedMediaType:        "Unsupported Media Type",
+	StatusExpectationFailed:           "Expectation Failed",
+	StatusUnprocessableEntity:         "Unprocessable Content",
+	StatusUpgradeRequired:             "Upgrade Required",
+	StatusTooManyRequests:             "Too Many Requests",
+	StatusRequestHeaderFieldsTooLarge: "Request Header Fields Too Large",
+
+	StatusInternalServerError: "Internal Server Error",
+	StatusNotImplemented:      "Not Implemented",
+	StatusBadGateway:          "Bad Gateway",
+	StatusServiceUnavailable:  "Service Unavailable",
+	StatusGatewayTimeout:      "Gateway Timeout",
+}
+
+func StatusText(statusCode StatusCode) string {
+	return statusText[statusCode]
+}
+
+// Codes missing from the table are still valid on the wire (a proxy has
+// to relay whatever the upstream sent), they just go out with an empty
+// reason phrase.
+func statusLine(statusCode StatusCode) ([]byte, error) {
+	if statusCode < 100 || statusCode > 999 {
+		return nil, ErrUnrecognizedStatusCode
+	}
+	return fmt.Appendf(nil, "HTTP/1.1 %d %s\r\n", statusCode, statusText[statusCode]), nil
+}
+
 func WriteStatusLine(w io.Writer, statusCode StatusCode) error {
-	// statusLine := []byte{}
-	var statusLine []byte
-	switch statusCode {
-	case StatusOK:
-		statusLine = []byte("HTTP/1.1 200 OK\r\n")
-	case StatusBadRequest:
-		statusLine = []byte("HTTP/1.1 400 Bad Request\r\n")
-	case StatusInternalServerError:
-		statusLine = []byte("HTTP/1.1 500 Internal Server Error\r\n")
-	default:
-		return ErrUnrecognizedStatusCode
-	}
-	_, err := w.Write(statusLine)
+	statusLine, err := statusLine(statusCode)
+	if err != nil {
+		return err
+	}
+	_, err = w.Write(statusLine)
 	return err
 }
 
+// GetDefaultHeaders frames a plain text body of contentLen bytes. Whether
+// the connection stays open is the server's call.
 func GetDefaultHeaders(contentLen int) headers.Headers {
 	headers := headers.NewHeaders()
 	headers.Set("Content-Length", strconv.Itoa(contentLen))
-	headers.Set("Connection", "close")
 	headers.Set("Content-Type", "text/plain")
 	return headers
 }
 
+// SetCookie adds a Set-Cookie field for c to h. Every cookie ends up on a
+// line of its own when h is written.
+func SetCookie(h headers.Headers, c *cookie.Cookie) error {
+	if err := c.Valid(); err != nil {
+		return err
+	}
+	h.Set("Set-Cookie", c.String())
+	return nil
+}
+
 func WriteHeaders(w io.Writer, headers headers.Headers) error {
 	b := []byte{}
 	headers.ForEach(func(n string, v string) {
@@ -54,41 +155,125 @@ func WriteHeaders(w io.Writer, headers headers.Headers) error {
 	return err
 }
 
+// Backend carries responses for protocols that don't write them as
+// HTTP/1.1 text, like HTTP/2. A Writer on a Backend hands it the status
+// once the header fields are written, and chunked bodies go out as plain
+// data.
+type Backend interface {
+	// WriteInformational sends a 1xx response ahead of the final one.
+	WriteInformational(statusCode StatusCode, h headers.Headers) error
+	WriteHeader(statusCode StatusCode, h headers.Headers) error
+	Write(p []byte) (int, error)
+	// WriteTrailers ends the body, with trailer fields unless h is empty.
+	WriteTrailers(h headers.Headers) error
+	Flush() error
+}
+
 type Writer struct {
-	writer io.Writer
+	writer  io.Writer
+	backend Backend
+	status  StatusCode
 }
 
 func NewWriter(writer io.Writer) *Writer {
 	return &Writer{writer: writer}
 }
 
+func NewBackendWriter(backend Backend) *Writer {
+	return &Writer{backend: backend}
+}
+
 func (w *Writer) WriteStatusLine(statusCode StatusCode) error {
-	var statusLine []byte
-	switch statusCode {
-	case StatusOK:
-		statusLine = []byte("HTTP/1.1 200 OK\r\n")
-	case StatusBadRequest:
-		statusLine = []byte("HTTP/1.1 400 Bad Request\r\n")
-	case StatusInternalServerError:
-		statusLine = []byte("HTTP/1.1 500 Internal Server Error\r\n")
-	default:
-		return ErrUnrecognizedStatusCode
-	}
-	_, err := w.writer.Write(statusLine)
-	return err
+	if _, err := statusLine(statusCode); err != nil {
+		return err
+	}
+	w.status = statusCode
+	if w.backend != nil {
+		return nil
+	}
+	return WriteStatusLine(w.writer, statusCode)
+}
+
+// WriteInformational sends a 1xx response, like 103 Early Hints, before
+// the final one; h may be nil. 101 is left to Hijack.
+func (w *Writer) WriteInformational(statusCode StatusCode, h headers.Headers) error {
+	if statusCode < 100 || statusCode > 199 || statusCode == StatusSwitchingProtocols {
+		return ErrNotInformational
+	}
+	if w.status != 0 {
+		return ErrResponseStarted
+	}
+	if h == nil {
+		h = headers.NewHeaders()
+	}
+	if w.backend != nil {
+		return w.backend.WriteInformational(statusCode, h)
+	}
+	if err := WriteStatusLine(w.writer, statusCode); err != nil {
+		return err
+	}
+	return WriteHeaders(w.writer, h)
 }
 
 func (w *Writer) WriteHeaders(headers headers.Headers) error {
-	b := []byte{}
-	headers.ForEach(func(n string, v string) {
-		b = fmt.Appendf(b, "%s: %s\r\n", n, v)
-	})
-	b = fmt.Append(b, "\r\n")
-	_, err := w.writer.Write(b)
-	return err
+	if w.backend != nil {
+		if w.status == 0 {
+			w.status = StatusOK
+		}
+		return w.backend.WriteHeader(w.status, headers)
+	}
+	return WriteHeaders(w.writer, headers)
 }
 
 func (w *Writer) WriteBody(p []byte) (int, error) {
+	if w.backend != nil {
+		return w.backend.Write(p)
+	}
 	n, err := w.writer.Write(p)
 	return n, err
 }
+
+// Flush pushes anything the underlying writer buffers out to the client,
+// for responses like event streams that are written bit by bit. It does
+// nothing when the underlying writer doesn't buffer.
+func (w *Writer) Flush() error {
+	if w.backend != nil {
+		return w.backend.Flush()
+	}
+	if f, ok := w.writer.(interface{ Flush() error }); ok {
+		return f.Flush()
+	}
+	return nil
+}
+
+func (w *Writer) WriteChunkedBody(p []byte) (int, error) {
+	if len(p) == 0 {
+		return 0, nil
+	}
+	if w.backend != nil {
+		return w.backend.Write(p)
+	}
+
+	chunk := fmt.Appendf(nil, "%x\r\n", len(p))
+	chunk = append(chunk, p...)
+	chunk = append(chunk, Separator...)
+	if _, err := w.writer.Write(chunk); err != nil {
+		return 0, err
+	}
+	return len(p), nil
+}
+
+// WriteChunkedBodyDone writes the last chunk followed by the trailer
+// section. trailers may be nil.
+func (w *Writer) WriteChunkedBodyDone(trailers headers.Headers) error {
+	if w.backend != nil {
+		return w.backend.WriteTrailers(trailers)
+	}
+	if _, err := w.writer.Write([]byte("0\r\n")); err != nil {
+		return err
+	}
+	if trailers == nil {
+		trailers = headers.NewHeaders()
+	}
+	return w.WriteHeaders(trailers)
+}
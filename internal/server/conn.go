@@ -0,0 +1,176 @@
+package server
+
+import (
+	"errors"
+	"net"
+	"os"
+	"sync"
+	"time"
+
+	"http-scratch/internal/request"
+	"http-scratch/internal/response"
+)
+
+// conn is a connection carrying HTTP/1.1 requests. It watches for the
+// client going away while a handler runs, and lets the handler take the
+// connection over.
+type conn struct {
+	net.Conn
+	reader *request.Reader
+
+	mu       sync.Mutex
+	hijacked bool
+	// waiting is set while the server waits for a request that hasn't
+	// started to arrive; with nothing in flight the connection is idle.
+	waiting  bool
+	inFlight int
+	// closing stops the connection after the response being written.
+	closing bool
+	// pending holds bytes of the next request the watcher read.
+	pending []byte
+	// current is the serial exchange being handled.
+	current *exchange
+
+	// The background read started by watch; see stopWatch.
+	watching bool
+	stopping bool
+	done     chan struct{}
+	buf      [1]byte
+	n        int
+}
+
+// Read returns the bytes the watcher kept before reading from the
+// connection.
+func (c *conn) Read(p []byte) (int, error) {
+	var n int
+	var err error
+	if len(c.pending) > 0 {
+		n = copy(p, c.pending)
+		c.pending = c.pending[n:]
+	} else {
+		n, err = c.Conn.Read(p)
+	}
+	if n > 0 {
+		c.setActive()
+	}
+	return n, err
+}
+
+func (c *conn) Write(p []byte) (int, error) {
+	c.mu.Lock()
+	hijacked := c.hijacked
+	c.mu.Unlock()
+	if hijacked {
+		return 0, response.ErrHijacked
+	}
+	return c.Conn.Write(p)
+}
+
+// watch calls onClose once the client hangs up. Data arriving instead is
+// the next pipelined request: the watch ends and stopWatch hands it back.
+func (c *conn) watch(onClose func()) {
+	c.watching = true
+	c.done = make(chan struct{})
+	c.mu.Lock()
+	c.stopping = false
+	c.n = 0
+	c.mu.Unlock()
+	go func() {
+		defer close(c.done)
+		n, err := c.Conn.Read(c.buf[:])
+
+		c.mu.Lock()
+		c.n = n
+		stopping := c.stopping
+		c.mu.Unlock()
+		if n > 0 || stopping && errors.Is(err, os.ErrDeadlineExceeded) {
+			return
+		}
+		onClose()
+	}()
+}
+
+// stopWatch interrupts the background read and returns what it read, if
+// anything.
+func (c *conn) stopWatch() []byte {
+	if !c.watching {
+		return nil
+	}
+	c.watching = false
+
+	c.mu.Lock()
+	c.stopping = true
+	c.mu.Unlock()
+	c.Conn.SetReadDeadline(time.Unix(1, 0))
+	<-c.done
+	c.Conn.SetReadDeadline(time.Time{})
+	return c.buf[:c.n]
+}
+
+// resumeReading makes the watcher's byte, if any, the start of the next
+// request.
+func (c *conn) resumeReading() {
+	c.pending = append(c.pending, c.stopWatch()...)
+}
+
+// continueBody tells the client of the current request to send the body
+// it holds back, then reads it. The watcher steps aside meanwhile.
+func (c *conn) continueBody(req *request.Request, read func() error) error {
+	ex := c.current
+	if ex.started() {
+		return response.ErrResponseStarted
+	}
+	c.resumeReading()
+	defer c.watch(ex.cancel)
+	if err := response.NewWriter(ex).WriteInformational(response.StatusContinue, nil); err != nil {
+		return err
+	}
+	return read()
+}
+
+// isIdle reports whether the connection sits between requests.
+func (c *conn) isIdle() bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.waiting && c.inFlight == 0 && !c.hijacked
+}
+
+// waitForRequest marks the connection idle until the next request starts
+// arriving, unless part of it is buffered already.
+func (c *conn) waitForRequest() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.waiting = len(c.reader.Buffered()) == 0 && len(c.pending) == 0
+}
+
+// setActive marks the connection busy with a request, or a protocol that
+// isn't HTTP/1.1.
+func (c *conn) setActive() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.waiting = false
+}
+
+func (c *conn) startRequest() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.inFlight++
+}
+
+func (c *conn) finishRequest() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.inFlight--
+}
+
+func (c *conn) setClosing() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.closing = true
+}
+
+func (c *conn) isClosing() bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.closing
+}
@@ -0,0 +1,41 @@
+package server
+
+import (
+	"bufio"
+	"bytes"
+	"io"
+	"net"
+	"time"
+
+	"http-scratch/internal/response"
+)
+
+// Hijack hands the connection over to the caller, with a reader that
+// first returns anything already read from it. The server neither writes
+// to, times out nor closes a hijacked connection, and Shutdown doesn't
+// wait for it.
+func (c *conn) Hijack() (net.Conn, *bufio.Reader, error) {
+	c.mu.Lock()
+	if c.hijacked {
+		c.mu.Unlock()
+		return nil, nil, response.ErrHijacked
+	}
+	c.hijacked = true
+	c.mu.Unlock()
+
+	// Bytes the parser read past the request come first, then the one the
+	// watcher may have read
+	buffered := bytes.Clone(c.reader.Buffered())
+	buffered = append(buffered, c.pending...)
+	buffered = append(buffered, c.stopWatch()...)
+	c.Conn.SetDeadline(time.Time{})
+
+	r := io.MultiReader(bytes.NewReader(buffered), c.Conn)
+	return c.Conn, bufio.NewReader(r), nil
+}
+
+func (c *conn) isHijacked() bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.hijacked
+}
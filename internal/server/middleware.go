@@ -0,0 +1,30 @@
+package server
+
+import (
+	"errors"
+
+	"http-scratch/internal/headers"
+	"http-scratch/internal/request"
+	"http-scratch/internal/response"
+)
+
+// DecodeBody wraps handler so that request bodies sent with a
+// Content-Encoding reach it already decompressed. Bodies that decode to
+// more than maxSize bytes are rejected with 413, unknown codings with 415.
+func DecodeBody(maxSize int64, handler Handler) Handler {
+	return func(w *response.Writer, req *request.Request) {
+		err := req.DecodeBody(maxSize)
+		switch {
+		case err == nil:
+			handler(w, req)
+		case errors.Is(err, request.ErrUnsupportedEncoding):
+			h := headers.NewHeaders()
+			h.Set("Accept-Encoding", request.SupportedEncodings)
+			writeError(w, req, h, &HandlerError{StatusCode: response.StatusUnsupportedMediaType, Message: err.Error()})
+		case errors.Is(err, request.ErrBodyTooLarge):
+			writeError(w, req, nil, &HandlerError{StatusCode: response.StatusRequestEntityTooLarge, Message: err.Error()})
+		default:
+			writeError(w, req, nil, &HandlerError{StatusCode: response.StatusBadRequest, Message: err.Error()})
+		}
+	}
+}
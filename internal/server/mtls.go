@@ -0,0 +1,121 @@
+package server
+
+import (
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"os"
+	"path"
+	"slices"
+	"strings"
+
+	"http-scratch/internal/request"
+	"http-scratch/internal/response"
+)
+
+var ErrNoClientCAs = errors.New("client authentication needs client CAs")
+
+// ClientAuth is whether a TLS server asks clients for certificates.
+type ClientAuth int
+
+const (
+	NoClientCert ClientAuth = iota
+	// ClientCertOptional verifies certificates clients send, but lets
+	// clients without one connect; RequireClientCert can then guard the
+	// routes that need one.
+	ClientCertOptional
+	// ClientCertRequired refuses the handshake without a valid certificate.
+	ClientCertRequired
+)
+
+// LoadCertPool reads PEM certificates from files into a pool, for
+// TLSOptions.ClientCAs.
+func LoadCertPool(files ...string) (*x509.CertPool, error) {
+	pool := x509.NewCertPool()
+	for _, name := range files {
+		data, err := os.ReadFile(name)
+		if err != nil {
+			return nil, err
+		}
+		if !pool.AppendCertsFromPEM(data) {
+			return nil, fmt.Errorf("no certificates in %s", name)
+		}
+	}
+	return pool, nil
+}
+
+// CertPolicy says which client certificates may reach a route. A
+// certificate is allowed when any of its names matches any rule; a policy
+// without rules allows every verified certificate.
+type CertPolicy struct {
+	// CommonNames match the subject common name exactly.
+	CommonNames []string
+	// DNSNames match DNS SANs; "*.example.com" matches a single label.
+	DNSNames []string
+	// URIs match URI SANs, "*" standing for one path segment, as in
+	// "spiffe://prod/ns/*/sa/billing".
+	URIs []string
+	// EmailAddresses match email SANs exactly, ignoring case.
+	EmailAddresses []string
+}
+
+func (p *CertPolicy) empty() bool {
+	return len(p.CommonNames) == 0 && len(p.DNSNames) == 0 && len(p.URIs) == 0 && len(p.EmailAddresses) == 0
+}
+
+// Allows reports whether cert satisfies the policy.
+func (p *CertPolicy) Allows(cert *x509.Certificate) bool {
+	if p.empty() {
+		return true
+	}
+	if slices.Contains(p.CommonNames, cert.Subject.CommonName) {
+		return true
+	}
+	for _, pattern := range p.DNSNames {
+		for _, name := range cert.DNSNames {
+			if matchDNSName(pattern, name) {
+				return true
+			}
+		}
+	}
+	for _, pattern := range p.URIs {
+		for _, uri := range cert.URIs {
+			if ok, _ := path.Match(pattern, uri.String()); ok {
+				return true
+			}
+		}
+	}
+	for _, want := range p.EmailAddresses {
+		for _, email := range cert.EmailAddresses {
+			if strings.EqualFold(want, email) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+func matchDNSName(pattern, name string) bool {
+	pattern, name = strings.ToLower(pattern), strings.ToLower(strings.TrimSuffix(name, "."))
+	if suffix, ok := strings.CutPrefix(pattern, "*."); ok {
+		label, rest, found := strings.Cut(name, ".")
+		return found && label != "" && rest == suffix
+	}
+	return pattern == name
+}
+
+// RequireClientCert wraps handler so that only requests over TLS with a
+// verified client certificate allowed by policy reach it; others get 403.
+func RequireClientCert(policy *CertPolicy, handler Handler) Handler {
+	return func(w *response.Writer, req *request.Request) {
+		cert := req.ClientCertificate()
+		switch {
+		case cert == nil:
+			writeError(w, req, nil, &HandlerError{StatusCode: response.StatusForbidden, Message: "client certificate required"})
+		case !policy.Allows(cert):
+			writeError(w, req, nil, &HandlerError{StatusCode: response.StatusForbidden, Message: "client certificate not allowed"})
+		default:
+			handler(w, req)
+		}
+	}
+}
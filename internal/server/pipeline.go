@@ -0,0 +1,369 @@
+package server
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"http-scratch/internal/headers"
+	"http-scratch/internal/request"
+	"http-scratch/internal/response"
+)
+
+// safeMethods may be handled alongside other pipelined requests (RFC 9112
+// section 9.3.2).
+var safeMethods = map[string]bool{
+	"GET":     true,
+	"HEAD":    true,
+	"OPTIONS": true,
+	"TRACE":   true,
+}
+
+// exchange is a request and what the response.Writer of its handler
+// writes. Once every earlier response on the connection is out, writes go
+// straight to the connection; until then they are buffered, so pipelined
+// requests can be handled at the same time and still answered in order.
+type exchange struct {
+	s   *Server
+	c   *conn
+	req *request.Request
+	// serial exchanges have the connection to themselves: nothing is read
+	// while they run, and they may hijack it.
+	serial bool
+	prev   <-chan struct{}
+	ready  chan struct{} // closed once earlier responses are out
+	done   chan struct{} // closed once this response is out
+	cancel context.CancelFunc
+
+	mu      sync.Mutex
+	head    bool // writes go to the connection
+	discard bool // an earlier response ended the connection
+	buf     bytes.Buffer
+	err     error
+	framing framing
+}
+
+func newExchange(s *Server, c *conn, req *request.Request, prev *exchange, serial bool) *exchange {
+	ex := &exchange{
+		s:      s,
+		c:      c,
+		req:    req,
+		serial: serial,
+		ready:  make(chan struct{}),
+		done:   make(chan struct{}),
+	}
+	ex.framing.method = req.RequestLine.Method
+	ex.framing.closeAfter = hasToken(req.Headers.List("connection"), "close")
+	// Responses written while shutting down are the connection's last, as
+	// are those leaving a body unread on it
+	ex.framing.closing = func() bool {
+		return !s.isRunning.Load() || req.BodyHeld()
+	}
+	if prev != nil {
+		ex.prev = prev.done
+	}
+	c.startRequest()
+	go ex.waitTurn()
+	return ex
+}
+
+// waitTurn sends what was buffered once the previous response is out.
+func (ex *exchange) waitTurn() {
+	if ex.prev != nil {
+		<-ex.prev
+	}
+	ex.mu.Lock()
+	defer ex.mu.Unlock()
+	ex.head = true
+	if ex.c.isClosing() {
+		ex.discard = true
+	} else if ex.buf.Len() > 0 {
+		_, ex.err = ex.c.Write(ex.buf.Bytes())
+	}
+	ex.buf.Reset()
+	close(ex.ready)
+}
+
+func (ex *exchange) Write(p []byte) (int, error) {
+	if ex.c.isHijacked() {
+		return 0, response.ErrHijacked
+	}
+	ex.mu.Lock()
+	defer ex.mu.Unlock()
+	if ex.err != nil {
+		return 0, ex.err
+	}
+	if err := ex.emit(ex.framing.write(p)); err != nil {
+		return 0, err
+	}
+	return len(p), nil
+}
+
+func (ex *exchange) emit(b []byte) error {
+	switch {
+	case ex.discard || len(b) == 0:
+	case ex.head:
+		_, ex.err = ex.c.Write(b)
+	default:
+		ex.buf.Write(b)
+	}
+	return ex.err
+}
+
+// started reports whether the final response is under way.
+func (ex *exchange) started() bool {
+	ex.mu.Lock()
+	defer ex.mu.Unlock()
+	return ex.framing.state != framingHead || len(ex.framing.head) > 0
+}
+
+// Flush does nothing: writes are either on the connection already or
+// waiting for earlier responses.
+func (ex *exchange) Flush() error {
+	return nil
+}
+
+// Hijack is only for serial exchanges; the connection may already hold
+// requests past a concurrent one.
+func (ex *exchange) Hijack() (net.Conn, *bufio.Reader, error) {
+	if !ex.serial {
+		return nil, nil, response.ErrNotHijackable
+	}
+	return ex.c.Hijack()
+}
+
+// finish waits for the response to be out and reports whether the
+// connection can carry another. When it can't, a read for the next
+// request is interrupted.
+func (ex *exchange) finish() bool {
+	<-ex.ready
+	ex.mu.Lock()
+	defer ex.mu.Unlock()
+	// A header section never finished goes out as it is
+	ex.emit(ex.framing.flush())
+	keep := !ex.discard && ex.err == nil && ex.framing.complete()
+	if !keep {
+		ex.c.setClosing()
+		ex.c.SetReadDeadline(time.Unix(1, 0))
+	}
+	ex.c.finishRequest()
+	close(ex.done)
+	return keep
+}
+
+type framingState int
+
+const (
+	framingHead framingState = iota
+	framingLength
+	framingChunked
+	framingNoBody
+	framingUntilClose
+	framingOverrun
+)
+
+// framing follows a response as it is written to tell where it ends, the
+// only way the connection can carry another after it.
+type framing struct {
+	method string
+	// closeAfter ends the connection after the response, which is told so
+	// with Connection: close. closing is asked too once the response is
+	// final.
+	closeAfter bool
+	closing    func() bool
+	state      framingState
+	head       []byte // the header section so far
+	left       int64  // Content-Length still to come
+	chunks     chunkScanner
+}
+
+// write returns what of p goes to the client. The header section is held
+// back until complete, and a body the response can't have is dropped.
+func (f *framing) write(p []byte) []byte {
+	var out []byte
+	for len(p) > 0 {
+		switch f.state {
+		case framingHead:
+			f.head = append(f.head, p...)
+			end := bytes.Index(f.head, []byte("\r\n\r\n"))
+			if end == -1 {
+				return out
+			}
+			section, rest := f.head[:end+4], f.head[end+4:]
+			f.head = nil
+			out = append(out, f.header(section)...)
+			p = rest
+		case framingLength:
+			if int64(len(p)) > f.left {
+				f.state = framingOverrun
+				continue
+			}
+			f.left -= int64(len(p))
+			out = append(out, p...)
+			p = nil
+		case framingChunked:
+			if n := f.chunks.scan(p); n < len(p) {
+				f.state = framingOverrun
+			}
+			out = append(out, p...)
+			p = nil
+		case framingNoBody:
+			p = nil
+		default:
+			out = append(out, p...)
+			p = nil
+		}
+	}
+	return out
+}
+
+// header sets the framing from a header section and returns the section
+// to send, marked Connection: close when the connection ends after it.
+func (f *framing) header(section []byte) []byte {
+	lineEnd := bytes.Index(section, []byte("\r\n"))
+	statusLine := section[:lineEnd+2]
+	h := headers.NewHeaders()
+	parts := strings.Fields(string(statusLine))
+	if _, _, err := h.Parse(section[lineEnd+2:]); err != nil || len(parts) < 2 {
+		f.state = framingUntilClose
+		return section
+	}
+	status, _ := strconv.Atoi(parts[1])
+
+	switch {
+	case status == int(response.StatusSwitchingProtocols):
+		f.state = framingUntilClose
+		return section
+	case status < 200:
+		// The final response is still to come
+		return section
+	case f.method == "HEAD" || status == int(response.StatusNoContent) || status == int(response.StatusNotModified):
+		f.state = framingNoBody
+	case hasToken(h.List("transfer-encoding"), "chunked"):
+		f.state = framingChunked
+	default:
+		f.state = framingUntilClose
+		if v, ok := h.Get("content-length"); ok {
+			if n, err := strconv.ParseInt(strings.TrimSpace(v), 10, 64); err == nil && n >= 0 {
+				f.state = framingLength
+				f.left = n
+			}
+		}
+	}
+
+	if hasToken(h.List("connection"), "close") {
+		f.closeAfter = true
+		return section
+	}
+	if !f.closeAfter && !f.closing() && f.state != framingUntilClose {
+		return section
+	}
+	f.closeAfter = true
+	h.Replace("Connection", "close")
+	var b bytes.Buffer
+	b.Write(statusLine)
+	response.WriteHeaders(&b, h)
+	return b.Bytes()
+}
+
+// flush returns a header section the handler never finished.
+func (f *framing) flush() []byte {
+	head := f.head
+	f.head = nil
+	return head
+}
+
+// complete reports whether the response was written in full and leaves
+// the connection ready for another.
+func (f *framing) complete() bool {
+	if f.closeAfter {
+		return false
+	}
+	switch f.state {
+	case framingNoBody:
+		return true
+	case framingLength:
+		return f.left == 0
+	case framingChunked:
+		return f.chunks.done
+	}
+	return false
+}
+
+type chunkState int
+
+const (
+	chunkSize chunkState = iota
+	chunkExt
+	chunkData
+	chunkDataEnd
+	chunkTrailer
+)
+
+// chunkScanner follows a chunked body (RFC 9112 section 7.1) far enough
+// to find its end.
+type chunkScanner struct {
+	state chunkState
+	size  int64
+	line  int // length of the current trailer line
+	done  bool
+}
+
+// scan reads p up to the end of the body and returns how much it read.
+func (c *chunkScanner) scan(p []byte) int {
+	for i := 0; i < len(p); i++ {
+		if c.done {
+			return i
+		}
+		b := p[i]
+		switch c.state {
+		case chunkSize:
+			switch b {
+			case '\n':
+				c.endSizeLine()
+			case ';', '\r', ' ', '\t':
+				c.state = chunkExt
+			default:
+				c.size = c.size<<4 | int64(max(strings.IndexByte("0123456789abcdef", b|0x20), 0))
+			}
+		case chunkExt:
+			if b == '\n' {
+				c.endSizeLine()
+			}
+		case chunkData:
+			n := min(c.size, int64(len(p)-i))
+			c.size -= n
+			i += int(n) - 1
+			if c.size == 0 {
+				c.state = chunkDataEnd
+			}
+		case chunkDataEnd:
+			if b == '\n' {
+				c.state = chunkSize
+			}
+		case chunkTrailer:
+			switch b {
+			case '\n':
+				c.done = c.line == 0
+				c.line = 0
+			case '\r':
+			default:
+				c.line++
+			}
+		}
+	}
+	return len(p)
+}
+
+func (c *chunkScanner) endSizeLine() {
+	if c.size == 0 {
+		c.state = chunkTrailer
+		return
+	}
+	c.state = chunkData
+}
@@ -1,12 +1,21 @@
 package server
 
 import (
+	"bufio"
+	"bytes"
+	"context"
+	"crypto/tls"
 	"errors"
 	"fmt"
+	"io"
 	"log"
 	"net"
+	"sync"
 	"sync/atomic"
+	"time"
 
+	"http-scratch/internal/headers"
+	"http-scratch/internal/problem"
 	"http-scratch/internal/request"
 	"http-scratch/internal/response"
 )
@@ -21,22 +30,168 @@ type HandlerError struct {
 	Message    string
 }
 
+func (e *HandlerError) Error() string {
+	return e.Message
+}
+
+// Problem is the problem details response for e.
+func (e *HandlerError) Problem() *problem.Details {
+	return problem.New(e.StatusCode, e.Message)
+}
+
+// writeError responds with herr as problem details; h holds extra fields
+// and may be nil.
+func writeError(w *response.Writer, req *request.Request, h headers.Headers, herr *HandlerError) {
+	problem.Write(w, req, herr.Problem(), h)
+}
+
 type Handler func(w *response.Writer, req *request.Request)
 
 type Server struct {
-	listener  net.Listener
-	handler   Handler
-	isRunning atomic.Bool
+	listener net.Listener
+	handler  Handler
+	// nextProtos maps ALPN protocols to their handlers; fixed before the
+	// server starts.
+	nextProtos map[string]ConnHandler
+	isRunning  atomic.Bool
+	// pipelineDepth is set with SetMaxPipelineDepth.
+	pipelineDepth atomic.Int32
+	// maxHeaderBytes is set with SetMaxHeaderBytes.
+	maxHeaderBytes atomic.Int64
+	// holdBodies is set with SetHoldBodies.
+	holdBodies atomic.Bool
+	// ctx is the parent of every request context; Close cancels it.
+	ctx    context.Context
+	cancel context.CancelFunc
+	// drain ends when shutdown starts, telling ConnHandlers to wrap up.
+	drain      context.Context
+	startDrain context.CancelFunc
+
+	mu        sync.Mutex
+	conns     map[*conn]struct{}
+	upgraders map[string]Upgrader
+	prefaces  map[string]ConnHandler
 }
 
+// Close stops the server at once, closing every connection it still
+// manages.
 func (s *Server) Close() error {
 	if !s.isRunning.CompareAndSwap(true, false) {
 		return ErrCloseServer
 	}
 	s.listener.Close()
+	s.cancel()
+	s.closeConns()
 	return nil
 }
 
+// shutdownPollInterval is how often Shutdown checks for idle connections.
+const shutdownPollInterval = 10 * time.Millisecond
+
+// Shutdown stops accepting connections, closes those between requests and
+// waits for the requests in flight to finish. When ctx ends first, the
+// remaining connections are closed and ctx's error returned. Hijacked
+// connections aren't waited for.
+func (s *Server) Shutdown(ctx context.Context) error {
+	if !s.isRunning.CompareAndSwap(true, false) {
+		return ErrCloseServer
+	}
+	s.listener.Close()
+	s.startDrain()
+	defer s.cancel()
+
+	ticker := time.NewTicker(shutdownPollInterval)
+	defer ticker.Stop()
+	for {
+		s.closeIdleConns()
+		if s.activeConns() == 0 {
+			return nil
+		}
+		select {
+		case <-ctx.Done():
+			s.closeConns()
+			return ctx.Err()
+		case <-ticker.C:
+		}
+	}
+}
+
+// SetMaxPipelineDepth lets up to n pipelined requests with safe methods
+// be handled at once on a connection. Other requests, and every request
+// when n is 1, the default, are handled one at a time. Either way
+// responses go out in the order the requests came in.
+func (s *Server) SetMaxPipelineDepth(n int) {
+	s.pipelineDepth.Store(int32(max(n, 1)))
+}
+
+// SetMaxHeaderBytes bounds the request line and header section of an
+// HTTP/1.1 request; zero means request.DefaultMaxHeaderBytes. Larger
+// requests get a 431 and the connection is closed.
+func (s *Server) SetMaxHeaderBytes(n int) {
+	s.maxHeaderBytes.Store(int64(max(n, 0)))
+}
+
+// SetHoldBodies, when hold is set, leaves the body of a request sent with
+// Expect: 100-continue with the client until the handler calls
+// req.LoadBody, so it can refuse the request without the body being sent.
+// Handlers must then load the body before reading req.Body; the form,
+// jsonio and DecodeBody helpers do. By default the body is loaded, and 100
+// Continue sent, before the handler runs.
+func (s *Server) SetHoldBodies(hold bool) {
+	s.holdBodies.Store(hold)
+}
+
+func (s *Server) trackConn(c *conn, add bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if add {
+		s.conns[c] = struct{}{}
+	} else {
+		delete(s.conns, c)
+	}
+}
+
+// activeConns counts the connections the server still manages that are
+// busy with a request.
+func (s *Server) activeConns() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	n := 0
+	for c := range s.conns {
+		if !c.isHijacked() && !c.isIdle() {
+			n++
+		}
+	}
+	return n
+}
+
+// closeIdleConns closes the connections waiting for another request.
+func (s *Server) closeIdleConns() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for c := range s.conns {
+		if c.isIdle() {
+			c.Close()
+		}
+	}
+}
+
+func (s *Server) closeConns() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for c := range s.conns {
+		if !c.isHijacked() {
+			c.Close()
+		}
+	}
+}
+
+// Addr is the address the server listens on, useful after serving on
+// port 0.
+func (s *Server) Addr() net.Addr {
+	return s.listener.Addr()
+}
+
 func (s *Server) listen() {
 	for {
 		conn, err := s.listener.Accept()
@@ -52,21 +207,147 @@ func (s *Server) listen() {
 	}
 }
 
-func (s *Server) handle(conn net.Conn) {
+func (s *Server) handle(netConn net.Conn) {
+	c := &conn{Conn: netConn, waiting: true}
+	c.reader = request.NewReader(c)
+	c.reader.Continue = c.continueBody
+	c.reader.MaxHeaderBytes = int(s.maxHeaderBytes.Load())
+	s.trackConn(c, true)
+	defer func() {
+		s.trackConn(c, false)
+		if !c.isHijacked() {
+			netConn.Close()
+		}
+	}()
 	if !s.isRunning.Load() {
-		conn.Close()
 		return
 	}
 
-	responseWriter := response.NewWriter(conn)
-	request, err := request.RequestFromReader(conn)
+	if tlsConn, ok := netConn.(*tls.Conn); ok {
+		// ALPN is settled by the handshake, before any request
+		if err := tlsConn.HandshakeContext(s.ctx); err != nil {
+			return
+		}
+		if h := s.nextProtos[tlsConn.ConnectionState().NegotiatedProtocol]; h != nil {
+			c.setActive()
+			h(s.drain, netConn, bufio.NewReader(netConn))
+			return
+		}
+	}
+
+	h, err := s.prefaceHandler(c)
 	if err != nil {
-		responseWriter.WriteStatusLine(response.StatusBadRequest)
-		responseWriter.WriteHeaders(response.GetDefaultHeaders(0))
+		return
+	}
+	if h != nil {
+		buffered := bytes.Clone(c.reader.Buffered())
+		h(s.drain, netConn, bufio.NewReader(io.MultiReader(bytes.NewReader(buffered), netConn)))
 		return
 	}
 
-	s.handler(responseWriter, request)
+	s.serveHTTP(c)
+}
+
+// serveHTTP reads requests off c until the client, a response or the
+// server ends the connection.
+func (s *Server) serveHTTP(c *conn) {
+	// Requests in flight end with the connection
+	ctx, cancel := context.WithCancel(s.ctx)
+	defer cancel()
+	depth := max(int(s.pipelineDepth.Load()), 1)
+	slots := make(chan struct{}, depth)
+	var wg sync.WaitGroup
+	defer wg.Wait()
+
+	var prev *exchange
+	for s.isRunning.Load() && !c.isClosing() {
+		c.waitForRequest()
+		req, err := c.reader.ReadRequest()
+		if err != nil {
+			var netErr net.Error
+			if errors.Is(err, io.EOF) || errors.As(err, &netErr) {
+				cancel()
+				return
+			}
+			wg.Wait()
+			if !c.isClosing() {
+				status := response.StatusBadRequest
+				switch {
+				case errors.Is(err, request.ErrHeaderTooLarge):
+					status = response.StatusRequestHeaderFieldsTooLarge
+				case errors.Is(err, request.ErrUnsupportedTransferEncoding):
+					status = response.StatusNotImplemented
+				}
+				// Whatever follows can't be told apart from this request
+				h := headers.NewHeaders()
+				h.Set("Connection", "close")
+				writeError(response.NewWriter(c), nil, h, &HandlerError{StatusCode: status, Message: err.Error()})
+			}
+			return
+		}
+		req.RemoteAddr = c.RemoteAddr().String()
+		if tlsConn, ok := c.Conn.(*tls.Conn); ok {
+			state := tlsConn.ConnectionState()
+			req.TLS = &state
+		}
+
+		serial := depth == 1 || !safeMethods[req.RequestLine.Method] || req.BodyHeld() ||
+			hasToken(req.Headers.List("connection"), "upgrade")
+		ex := newExchange(s, c, req, prev, serial)
+		prev = ex
+		if serial {
+			<-ex.ready
+			s.serveExchange(ctx, ex)
+			if c.isHijacked() {
+				return
+			}
+			continue
+		}
+		slots <- struct{}{}
+		wg.Add(1)
+		go func() {
+			defer func() {
+				<-slots
+				wg.Done()
+			}()
+			s.serveExchange(ctx, ex)
+		}()
+	}
+}
+
+// serveExchange runs the handler of ex, or the upgrade it asks for.
+func (s *Server) serveExchange(ctx context.Context, ex *exchange) {
+	// The request context ends when the handler returns, the server closes
+	// or the client goes away. Only serial requests watch for the latter;
+	// otherwise the connection is still being read.
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	ex.cancel = cancel
+	if ex.serial {
+		ex.c.current = ex
+		ex.c.watch(cancel)
+	}
+
+	w := response.NewWriter(ex)
+	req := ex.req.WithContext(ctx)
+	if v, ok := req.Headers.Get("expect"); ok && !req.ExpectsContinue() {
+		writeError(w, req, nil, &HandlerError{StatusCode: response.StatusExpectationFailed, Message: fmt.Sprintf("unsupported expectation %q", v)})
+	} else if !s.holdBodies.Load() && req.LoadBody() != nil {
+		// The body never came; without a response the connection ends
+	} else if u, protocol, ok := s.upgraderFor(req); !ok {
+		s.refuseUpgrade(w, req)
+	} else if u != nil {
+		s.upgrade(w, req, protocol, u)
+	} else {
+		s.handler(w, req)
+	}
+	if ex.c.isHijacked() {
+		return
+	}
+	if ex.serial {
+		ex.c.resumeReading()
+	}
+	ex.finish()
 }
 
 func Serve(port int, handler Handler) (*Server, error) {
@@ -76,12 +357,24 @@ func Serve(port int, handler Handler) (*Server, error) {
 		return nil, ErrListenServer
 	}
 
+	server := newServer(listener, handler)
+	go server.listen()
+	return server, nil
+}
+
+func newServer(listener net.Listener, handler Handler) *Server {
+	ctx, cancel := context.WithCancel(context.Background())
+	drain, startDrain := context.WithCancel(ctx)
 	server := &Server{
-		listener: listener,
-		handler:  handler,
+		listener:   listener,
+		handler:    handler,
+		ctx:        ctx,
+		cancel:     cancel,
+		drain:      drain,
+		startDrain: startDrain,
+		conns:      map[*conn]struct{}{},
+		nextProtos: map[string]ConnHandler{},
 	}
 	server.isRunning.Store(true)
-
-	go server.listen()
-	return server, nil
+	return server
 }
@@ -0,0 +1,497 @@
+package server
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"io"
+	"net"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"http-scratch/internal/headers"
+	"http-scratch/internal/request"
+	"http-scratch/internal/response"
+)
+
+func dial(t *testing.T, s *Server) net.Conn {
+	t.Helper()
+	c, err := net.Dial("tcp", fmt.Sprintf("127.0.0.1:%d", s.Addr().(*net.TCPAddr).Port))
+	require.NoError(t, err)
+	t.Cleanup(func() { c.Close() })
+	return c
+}
+
+func TestHijack(t *testing.T) {
+	errs := make(chan error, 2)
+	s, err := Serve(0, func(w *response.Writer, req *request.Request) {
+		netConn, br, err := w.Hijack()
+		if err != nil {
+			errs <- err
+			return
+		}
+		defer netConn.Close()
+
+		_, _, err = w.Hijack()
+		errs <- err
+		errs <- w.WriteStatusLine(response.StatusOK)
+
+		line, _ := br.ReadString('\n')
+		fmt.Fprintf(netConn, "echo %s", line)
+	})
+	require.NoError(t, err)
+	defer s.Close()
+
+	// Test: Bytes sent along with the request reach the new owner
+	c := dial(t, s)
+	_, err = io.WriteString(c, "GET / HTTP/1.1\r\nHost: localhost\r\nUpgrade: x\r\n\r\nhello\n")
+	require.NoError(t, err)
+	line, err := bufio.NewReader(c).ReadString('\n')
+	require.NoError(t, err)
+	assert.Equal(t, "echo hello\n", line)
+
+	// Test: The Writer is done with the connection
+	assert.ErrorIs(t, <-errs, response.ErrHijacked)
+	assert.ErrorIs(t, <-errs, response.ErrHijacked)
+}
+
+func TestShutdown(t *testing.T) {
+	release := make(chan struct{})
+	hijacked := make(chan struct{})
+	s, err := Serve(0, func(w *response.Writer, req *request.Request) {
+		if req.RequestLine.RequestTarget == "/hijack" {
+			netConn, _, _ := w.Hijack()
+			close(hijacked)
+			<-release
+			netConn.Close()
+			return
+		}
+		<-release
+		w.WriteStatusLine(response.StatusNoContent)
+		w.WriteHeaders(response.GetDefaultHeaders(0))
+	})
+	require.NoError(t, err)
+
+	hc := dial(t, s)
+	io.WriteString(hc, "GET /hijack HTTP/1.1\r\nHost: localhost\r\n\r\n")
+	<-hijacked
+	c := dial(t, s)
+	io.WriteString(c, "GET /slow HTTP/1.1\r\nHost: localhost\r\n\r\n")
+	time.Sleep(20 * time.Millisecond)
+
+	// Test: In-flight requests are waited for
+	done := make(chan error)
+	go func() { done <- s.Shutdown(context.Background()) }()
+	select {
+	case <-done:
+		t.Fatal("shutdown didn't wait for the request")
+	case <-time.After(50 * time.Millisecond):
+	}
+	close(release)
+	require.NoError(t, <-done)
+	status, err := bufio.NewReader(c).ReadString('\n')
+	require.NoError(t, err)
+	assert.Equal(t, "HTTP/1.1 204 No Content\r\n", status)
+
+	// Test: No new connections once shut down
+	_, err = net.Dial("tcp", s.Addr().String())
+	assert.Error(t, err)
+	assert.ErrorIs(t, s.Shutdown(context.Background()), ErrCloseServer)
+}
+
+func TestShutdownTimeout(t *testing.T) {
+	s, err := Serve(0, func(w *response.Writer, req *request.Request) {
+		<-req.Context().Done()
+	})
+	require.NoError(t, err)
+
+	c := dial(t, s)
+	io.WriteString(c, "GET / HTTP/1.1\r\nHost: localhost\r\n\r\n")
+	time.Sleep(20 * time.Millisecond)
+
+	// Test: Connections still busy at the deadline are closed
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Millisecond)
+	defer cancel()
+	assert.ErrorIs(t, s.Shutdown(ctx), context.DeadlineExceeded)
+	_, err = c.Read(make([]byte, 1))
+	assert.ErrorIs(t, err, io.EOF)
+}
+
+type refusingUpgrader struct{}
+
+func (refusingUpgrader) Accept(req *request.Request) (headers.Headers, error) {
+	return nil, &HandlerError{StatusCode: response.StatusForbidden, Message: "not for you"}
+}
+
+func (refusingUpgrader) Serve(conn net.Conn, br *bufio.Reader, req *request.Request) {
+	panic("refused upgrades are never served")
+}
+
+func TestUpgrade(t *testing.T) {
+	s, err := Serve(0, func(w *response.Writer, req *request.Request) {
+		w.WriteStatusLine(response.StatusOK)
+		w.WriteHeaders(response.GetDefaultHeaders(0))
+	})
+	require.NoError(t, err)
+	defer s.Close()
+
+	s.HandleUpgrade("Echo/1", UpgradeFunc(func(conn net.Conn, br *bufio.Reader, req *request.Request) {
+		defer conn.Close()
+		line, _ := br.ReadString('\n')
+		fmt.Fprintf(conn, "%s %s", req.RequestLine.RequestTarget, line)
+	}))
+	s.HandleUpgrade("private", refusingUpgrader{})
+
+	roundTrip := func(raw string) *bufio.Reader {
+		c := dial(t, s)
+		_, err := io.WriteString(c, raw)
+		require.NoError(t, err)
+		return bufio.NewReader(c)
+	}
+	head := func(br *bufio.Reader) []string {
+		var lines []string
+		for {
+			line, err := br.ReadString('\n')
+			require.NoError(t, err)
+			if line == "\r\n" {
+				return lines
+			}
+			lines = append(lines, strings.TrimRight(line, "\r\n"))
+		}
+	}
+
+	// Test: The first registered protocol the client offers is chosen
+	br := roundTrip("GET /room HTTP/1.1\r\nHost: localhost\r\nConnection: keep-alive, Upgrade\r\nUpgrade: foo/3, echo/1\r\n\r\nhi\n")
+	lines := head(br)
+	assert.Equal(t, "HTTP/1.1 101 Switching Protocols", lines[0])
+	assert.Contains(t, lines, "upgrade: echo/1")
+	assert.Contains(t, lines, "connection: Upgrade")
+	line, err := br.ReadString('\n')
+	require.NoError(t, err)
+	assert.Equal(t, "/room hi\n", line)
+
+	// Test: Refused upgrades get an ordinary error response
+	lines = head(roundTrip("GET / HTTP/1.1\r\nHost: localhost\r\nConnection: upgrade\r\nUpgrade: private\r\n\r\n"))
+	assert.Equal(t, "HTTP/1.1 403 Forbidden", lines[0])
+
+	// Test: Unknown protocols are refused, listing the supported ones
+	lines = head(roundTrip("GET / HTTP/1.1\r\nHost: localhost\r\nConnection: upgrade\r\nUpgrade: foo/3\r\n\r\n"))
+	assert.Equal(t, "HTTP/1.1 400 Bad Request", lines[0])
+	assert.Contains(t, lines, "upgrade: echo/1, private")
+
+	// Test: Passed protocols and Upgrade without Connection reach the handler
+	s.PassUpgrade("foo/3")
+	for _, raw := range []string{
+		"GET / HTTP/1.1\r\nHost: localhost\r\nConnection: upgrade\r\nUpgrade: foo/3\r\n\r\n",
+		"GET / HTTP/1.1\r\nHost: localhost\r\nUpgrade: bar/1\r\n\r\n",
+	} {
+		lines = head(roundTrip(raw))
+		assert.Equal(t, "HTTP/1.1 200 OK", lines[0])
+	}
+}
+
+// readHead reads the status line and header fields of a response.
+func readHead(t *testing.T, br *bufio.Reader) (string, headers.Headers) {
+	t.Helper()
+	status, err := br.ReadString('\n')
+	require.NoError(t, err)
+	h := headers.NewHeaders()
+	for {
+		line, err := br.ReadString('\n')
+		require.NoError(t, err)
+		if line == "\r\n" {
+			return strings.TrimRight(status, "\r\n"), h
+		}
+		_, _, err = h.Parse([]byte(line))
+		require.NoError(t, err)
+	}
+}
+
+// readResponse reads one response off br, its body framed by
+// Content-Length or chunked coding.
+func readResponse(t *testing.T, br *bufio.Reader) (string, headers.Headers, string) {
+	t.Helper()
+	status, h := readHead(t, br)
+	var body strings.Builder
+	if hasToken(h.List("transfer-encoding"), "chunked") {
+		for {
+			var size int
+			line, err := br.ReadString('\n')
+			require.NoError(t, err)
+			fmt.Sscanf(line, "%x", &size)
+			if size == 0 {
+				_, err = br.ReadString('\n')
+				require.NoError(t, err)
+				break
+			}
+			chunk := make([]byte, size+2)
+			_, err = io.ReadFull(br, chunk)
+			require.NoError(t, err)
+			body.Write(chunk[:size])
+		}
+	} else if v, ok := h.Get("content-length"); ok {
+		var n int
+		fmt.Sscan(v, &n)
+		b := make([]byte, n)
+		_, err := io.ReadFull(br, b)
+		require.NoError(t, err)
+		body.Write(b)
+	}
+	return status, h, body.String()
+}
+
+// echoTarget answers with the request target, framed the way the target
+// asks for.
+func echoTarget(w *response.Writer, req *request.Request) {
+	body := []byte(req.RequestLine.RequestTarget)
+	h := response.GetDefaultHeaders(len(body))
+	switch req.RequestLine.RequestTarget {
+	case "/chunked":
+		h.Delete("content-length")
+		h.Set("Transfer-Encoding", "chunked")
+		w.WriteStatusLine(response.StatusOK)
+		w.WriteHeaders(h)
+		w.WriteChunkedBody(body)
+		w.WriteChunkedBodyDone(nil)
+		return
+	case "/stream":
+		h.Delete("content-length")
+	}
+	w.WriteStatusLine(response.StatusOK)
+	w.WriteHeaders(h)
+	w.WriteBody(body)
+}
+
+func TestKeepAlive(t *testing.T) {
+	s, err := Serve(0, echoTarget)
+	require.NoError(t, err)
+	defer s.Close()
+
+	// Test: Delimited responses leave the connection open
+	c := dial(t, s)
+	br := bufio.NewReader(c)
+	for _, target := range []string{"/a", "/chunked", "/b"} {
+		io.WriteString(c, "GET "+target+" HTTP/1.1\r\nHost: localhost\r\n\r\n")
+		status, h, body := readResponse(t, br)
+		assert.Equal(t, "HTTP/1.1 200 OK", status)
+		assert.Equal(t, target, body)
+		_, ok := h.Get("connection")
+		assert.False(t, ok)
+	}
+
+	// Test: HEAD responses are sent without the body
+	io.WriteString(c, "HEAD /head HTTP/1.1\r\nHost: localhost\r\n\r\nGET /after HTTP/1.1\r\nHost: localhost\r\n\r\n")
+	_, h := readHead(t, br)
+	cl, _ := h.Get("content-length")
+	assert.Equal(t, "5", cl)
+	_, _, body := readResponse(t, br)
+	assert.Equal(t, "/after", body)
+
+	// Test: A response running until close ends the connection
+	io.WriteString(c, "GET /stream HTTP/1.1\r\nHost: localhost\r\n\r\n")
+	_, h = readHead(t, br)
+	assert.Equal(t, []string{"close"}, h.List("connection"))
+	rest, err := io.ReadAll(br)
+	require.NoError(t, err)
+	assert.Equal(t, "/stream", string(rest))
+
+	// Test: Connection: close from the client is the last request
+	c = dial(t, s)
+	io.WriteString(c, "GET /a HTTP/1.1\r\nHost: localhost\r\nConnection: close\r\n\r\n")
+	br = bufio.NewReader(c)
+	_, h, _ = readResponse(t, br)
+	assert.Equal(t, []string{"close"}, h.List("connection"))
+	_, err = br.ReadByte()
+	assert.ErrorIs(t, err, io.EOF)
+
+	// Test: Bodies that could be framed another way end the connection
+	// rather than smuggle the request inside them
+	smuggled := "GET /yourproblem HTTP/1.1\r\nHost: localhost\r\n\r\n"
+	for _, attempt := range []struct{ fields, body, status string }{
+		{"Transfer-Encoding: chunked", fmt.Sprintf("%x\r\n%s\r\n0\r\n\r\n", len(smuggled), smuggled), "HTTP/1.1 501 Not Implemented"},
+		{"Content-Length: 5x", smuggled, "HTTP/1.1 400 Bad Request"},
+		{"Content-Length: -1", smuggled, "HTTP/1.1 400 Bad Request"},
+		{"Content-Length: 0\r\nContent-Length: 5", smuggled, "HTTP/1.1 400 Bad Request"},
+	} {
+		c = dial(t, s)
+		io.WriteString(c, "POST /a HTTP/1.1\r\nHost: localhost\r\n"+attempt.fields+"\r\n\r\n"+attempt.body)
+		br = bufio.NewReader(c)
+		status, h, _ := readResponse(t, br)
+		assert.Equal(t, attempt.status, status, attempt.fields)
+		assert.Equal(t, []string{"close"}, h.List("connection"), attempt.fields)
+		_, err = br.ReadByte()
+		assert.ErrorIs(t, err, io.EOF, attempt.fields)
+	}
+
+	// Test: A header section past the limit gets a 431
+	s.SetMaxHeaderBytes(1024)
+	c = dial(t, s)
+	io.WriteString(c, "GET /a HTTP/1.1\r\n"+strings.Repeat("X-A: b\r\n", 150))
+	br = bufio.NewReader(c)
+	status, _ := readHead(t, br)
+	assert.Equal(t, "HTTP/1.1 431 Request Header Fields Too Large", status)
+	s.SetMaxHeaderBytes(0)
+
+	// Test: Idle connections are closed by Shutdown
+	c = dial(t, s)
+	io.WriteString(c, "GET /a HTTP/1.1\r\nHost: localhost\r\n\r\n")
+	br = bufio.NewReader(c)
+	readResponse(t, br)
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	require.NoError(t, s.Shutdown(ctx))
+	_, err = br.ReadByte()
+	assert.ErrorIs(t, err, io.EOF)
+}
+
+func TestPipelining(t *testing.T) {
+	release := make(chan struct{})
+	var started atomic.Int32
+	s, err := Serve(0, func(w *response.Writer, req *request.Request) {
+		started.Add(1)
+		if req.RequestLine.RequestTarget == "/slow" {
+			<-release
+		}
+		echoTarget(w, req)
+	})
+	require.NoError(t, err)
+	defer s.Close()
+
+	pipeline := "GET /slow HTTP/1.1\r\nHost: localhost\r\n\r\n" +
+		"GET /chunked HTTP/1.1\r\nHost: localhost\r\n\r\n" +
+		"GET /fast HTTP/1.1\r\nHost: localhost\r\n\r\n"
+
+	// Test: Requests sent ahead are answered in order, one at a time by
+	// default
+	c := dial(t, s)
+	slow := strings.Index(pipeline, "GET /chunked")
+	io.WriteString(c, pipeline[:slow])
+	time.Sleep(20 * time.Millisecond)
+	io.WriteString(c, pipeline[slow:])
+	time.Sleep(20 * time.Millisecond)
+	assert.Equal(t, int32(1), started.Load())
+	close(release)
+	br := bufio.NewReader(c)
+	for _, target := range []string{"/slow", "/chunked", "/fast"} {
+		_, _, body := readResponse(t, br)
+		assert.Equal(t, target, body)
+	}
+
+	// Test: With a depth, safe requests run at once and still answer in order
+	s.SetMaxPipelineDepth(3)
+	release = make(chan struct{})
+	started.Store(0)
+	c = dial(t, s)
+	io.WriteString(c, pipeline)
+	require.Eventually(t, func() bool { return started.Load() == 3 }, time.Second, 5*time.Millisecond)
+	close(release)
+	br = bufio.NewReader(c)
+	for _, target := range []string{"/slow", "/chunked", "/fast"} {
+		_, _, body := readResponse(t, br)
+		assert.Equal(t, target, body)
+	}
+
+	// Test: Unsafe requests wait for those before them
+	release = make(chan struct{})
+	started.Store(0)
+	c = dial(t, s)
+	io.WriteString(c, "GET /slow HTTP/1.1\r\nHost: localhost\r\n\r\n"+
+		"POST /post HTTP/1.1\r\nHost: localhost\r\nContent-Length: 2\r\n\r\nhi")
+	time.Sleep(20 * time.Millisecond)
+	assert.Equal(t, int32(1), started.Load())
+	close(release)
+	br = bufio.NewReader(c)
+	for _, target := range []string{"/slow", "/post"} {
+		_, _, body := readResponse(t, br)
+		assert.Equal(t, target, body)
+	}
+}
+
+func TestExpectContinue(t *testing.T) {
+	s, err := Serve(0, func(w *response.Writer, req *request.Request) {
+		if req.RequestLine.RequestTarget == "/hints" {
+			h := headers.NewHeaders()
+			h.Set("Link", "</app.css>; rel=preload")
+			w.WriteInformational(response.StatusEarlyHints, h)
+		}
+		if req.ContentLength() > 10 {
+			writeError(w, req, nil, &HandlerError{StatusCode: response.StatusRequestEntityTooLarge, Message: "too large"})
+			return
+		}
+		if err := req.LoadBody(); err != nil {
+			return
+		}
+		w.WriteStatusLine(response.StatusOK)
+		w.WriteHeaders(response.GetDefaultHeaders(len(req.Body)))
+		w.WriteBody([]byte(req.Body))
+	})
+	require.NoError(t, err)
+	defer s.Close()
+	s.SetHoldBodies(true)
+
+	upload := func(n int) string {
+		return fmt.Sprintf("POST /upload HTTP/1.1\r\nHost: localhost\r\nExpect: 100-continue\r\nContent-Length: %d\r\n\r\n", n)
+	}
+
+	// Test: 100 Continue is sent once the handler reads the body
+	c := dial(t, s)
+	br := bufio.NewReader(c)
+	io.WriteString(c, upload(5))
+	status, _ := readHead(t, br)
+	assert.Equal(t, "HTTP/1.1 100 Continue", status)
+	io.WriteString(c, "hello")
+	status, _, body := readResponse(t, br)
+	assert.Equal(t, "HTTP/1.1 200 OK", status)
+	assert.Equal(t, "hello", body)
+
+	// Test: Informational responses come ahead of the final one
+	io.WriteString(c, "GET /hints HTTP/1.1\r\nHost: localhost\r\n\r\n")
+	status, h := readHead(t, br)
+	assert.Equal(t, "HTTP/1.1 103 Early Hints", status)
+	assert.Equal(t, []string{"</app.css>; rel=preload"}, h.List("link"))
+	status, _, _ = readResponse(t, br)
+	assert.Equal(t, "HTTP/1.1 200 OK", status)
+
+	// Test: Clients that don't wait get no 100 Continue
+	io.WriteString(c, upload(2)+"hi")
+	status, _, body = readResponse(t, br)
+	assert.Equal(t, "HTTP/1.1 200 OK", status)
+	assert.Equal(t, "hi", body)
+
+	// Test: Refusing before reading closes the connection
+	io.WriteString(c, upload(100))
+	status, h, _ = readResponse(t, br)
+	assert.Equal(t, "HTTP/1.1 413 Content Too Large", status)
+	assert.Equal(t, []string{"close"}, h.List("connection"))
+	_, err = br.ReadByte()
+	assert.ErrorIs(t, err, io.EOF)
+
+	// Test: Unknown expectations fail
+	c = dial(t, s)
+	io.WriteString(c, "GET / HTTP/1.1\r\nHost: localhost\r\nExpect: teapot\r\n\r\n")
+	status, _, _ = readResponse(t, bufio.NewReader(c))
+	assert.Equal(t, "HTTP/1.1 417 Expectation Failed", status)
+
+	// Test: Without SetHoldBodies handlers get the body in req.Body
+	s2, err := Serve(0, func(w *response.Writer, req *request.Request) {
+		w.WriteStatusLine(response.StatusOK)
+		w.WriteHeaders(response.GetDefaultHeaders(len(req.Body)))
+		w.WriteBody([]byte(req.Body))
+	})
+	require.NoError(t, err)
+	defer s2.Close()
+	c = dial(t, s2)
+	br = bufio.NewReader(c)
+	io.WriteString(c, upload(5))
+	status, _ = readHead(t, br)
+	assert.Equal(t, "HTTP/1.1 100 Continue", status)
+	io.WriteString(c, "hello")
+	status, _, body = readResponse(t, br)
+	assert.Equal(t, "HTTP/1.1 200 OK", status)
+	assert.Equal(t, "hello", body)
+}
@@ -0,0 +1,228 @@
+package server
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"os"
+	"os/signal"
+	"sync"
+	"syscall"
+	"time"
+)
+
+var ErrNoCertificates = errors.New("no certificates configured")
+
+// CertFile names a PEM certificate chain and its private key.
+type CertFile struct {
+	CertFile string
+	KeyFile  string
+}
+
+// CertStore holds the certificates a TLS server presents and picks one per
+// handshake from the client's SNI. Reloading swaps them for new handshakes
+// only; established connections are left alone.
+type CertStore struct {
+	files []CertFile
+
+	mu       sync.RWMutex
+	certs    []*tls.Certificate
+	modTimes []time.Time
+}
+
+// NewCertStore loads the given pairs. The first is the default, presented
+// to clients that send no server name or one no certificate covers.
+func NewCertStore(files ...CertFile) (*CertStore, error) {
+	if len(files) == 0 {
+		return nil, ErrNoCertificates
+	}
+	s := &CertStore{files: files}
+	if err := s.Reload(); err != nil {
+		return nil, err
+	}
+	return s, nil
+}
+
+// Reload reads every pair from disk again. When any of them fails to load,
+// the current certificates stay in place.
+func (s *CertStore) Reload() error {
+	modTimes := s.currentModTimes()
+	certs, err := s.load()
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	// Remember the attempt either way, so a broken file is only reported
+	// once per change
+	s.modTimes = modTimes
+	if err != nil {
+		return err
+	}
+	s.certs = certs
+	return nil
+}
+
+func (s *CertStore) load() ([]*tls.Certificate, error) {
+	certs := make([]*tls.Certificate, 0, len(s.files))
+	for _, f := range s.files {
+		cert, err := tls.LoadX509KeyPair(f.CertFile, f.KeyFile)
+		if err != nil {
+			return nil, fmt.Errorf("loading %s: %w", f.CertFile, err)
+		}
+		if cert.Leaf == nil {
+			if cert.Leaf, err = x509.ParseCertificate(cert.Certificate[0]); err != nil {
+				return nil, fmt.Errorf("parsing %s: %w", f.CertFile, err)
+			}
+		}
+		certs = append(certs, &cert)
+	}
+	return certs, nil
+}
+
+func (s *CertStore) currentModTimes() []time.Time {
+	times := make([]time.Time, 0, 2*len(s.files))
+	for _, f := range s.files {
+		for _, name := range []string{f.CertFile, f.KeyFile} {
+			var t time.Time
+			if fi, err := os.Stat(name); err == nil {
+				t = fi.ModTime()
+			}
+			times = append(times, t)
+		}
+	}
+	return times
+}
+
+// changed reports whether any file was modified since it was last loaded.
+func (s *CertStore) changed() bool {
+	current := s.currentModTimes()
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	for i, t := range current {
+		if !t.Equal(s.modTimes[i]) {
+			return true
+		}
+	}
+	return false
+}
+
+// GetCertificate is the tls.Config hook choosing a certificate by SNI.
+func (s *CertStore) GetCertificate(hello *tls.ClientHelloInfo) (*tls.Certificate, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	if hello.ServerName != "" {
+		for _, cert := range s.certs {
+			if cert.Leaf.VerifyHostname(hello.ServerName) == nil {
+				return cert, nil
+			}
+		}
+	}
+	return s.certs[0], nil
+}
+
+// watch reloads the certificates when their files change, checking every
+// interval, and on SIGHUP, until ctx ends.
+func (s *CertStore) watch(ctx context.Context, interval time.Duration) {
+	hup := make(chan os.Signal, 1)
+	signal.Notify(hup, syscall.SIGHUP)
+	defer signal.Stop(hup)
+
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-hup:
+		case <-ticker.C:
+			if !s.changed() {
+				continue
+			}
+		}
+		if err := s.Reload(); err != nil {
+			log.Printf("Error reloading certificates: %v", err)
+		}
+	}
+}
+
+// defaultReloadInterval is how often certificate files are checked for
+// changes.
+const defaultReloadInterval = 5 * time.Second
+
+// NextProto is a protocol offered over ALPN, with the handler for the
+// connections that negotiate it.
+type NextProto struct {
+	Name    string
+	Handler ConnHandler
+}
+
+// TLSOptions configures ServeTLS.
+type TLSOptions struct {
+	Certificates *CertStore
+	// ReloadInterval is how often the certificate files are checked for
+	// changes; zero means 5s.
+	ReloadInterval time.Duration
+	// MinVersion is the oldest TLS version accepted; zero means TLS 1.2.
+	MinVersion uint16
+	// ClientAuth asks clients for certificates, which are verified
+	// against ClientCAs.
+	ClientAuth ClientAuth
+	ClientCAs  *x509.CertPool
+	// NextProtos are offered over ALPN ahead of http/1.1, most preferred
+	// first. Connections negotiating one go to its handler instead of
+	// the server's.
+	NextProtos []NextProto
+}
+
+func (o *TLSOptions) config() *tls.Config {
+	cfg := &tls.Config{
+		GetCertificate: o.Certificates.GetCertificate,
+		MinVersion:     o.MinVersion,
+		ClientCAs:      o.ClientCAs,
+	}
+	for _, p := range o.NextProtos {
+		cfg.NextProtos = append(cfg.NextProtos, p.Name)
+	}
+	cfg.NextProtos = append(cfg.NextProtos, "http/1.1")
+	if cfg.MinVersion == 0 {
+		cfg.MinVersion = tls.VersionTLS12
+	}
+	switch o.ClientAuth {
+	case ClientCertOptional:
+		cfg.ClientAuth = tls.VerifyClientCertIfGiven
+	case ClientCertRequired:
+		cfg.ClientAuth = tls.RequireAndVerifyClientCert
+	}
+	return cfg
+}
+
+// ServeTLS is Serve over TLS. Requests carry the connection state in TLS.
+// Clients that negotiate none of opts.NextProtos speak HTTP/1.1.
+func ServeTLS(port int, handler Handler, opts *TLSOptions) (*Server, error) {
+	if opts == nil || opts.Certificates == nil {
+		return nil, ErrNoCertificates
+	}
+	if opts.ClientAuth != NoClientCert && opts.ClientCAs == nil {
+		return nil, ErrNoClientCAs
+	}
+	listener, err := net.Listen("tcp", fmt.Sprintf(":%d", port))
+	if err != nil {
+		return nil, ErrListenServer
+	}
+
+	server := newServer(tls.NewListener(listener, opts.config()), handler)
+	for _, p := range opts.NextProtos {
+		server.nextProtos[p.Name] = p.Handler
+	}
+	interval := opts.ReloadInterval
+	if interval <= 0 {
+		interval = defaultReloadInterval
+	}
+	go opts.Certificates.watch(server.ctx, interval)
+
+	go server.listen()
+	return server, nil
+}
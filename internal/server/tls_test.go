@@ -0,0 +1,310 @@
+package server
+
+import (
+	"bufio"
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"fmt"
+	"io"
+	"math/big"
+	"net"
+	"net/url"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"http-scratch/internal/request"
+	"http-scratch/internal/response"
+)
+
+// selfSigned completes tmpl and signs it with a fresh key.
+func selfSigned(t *testing.T, tmpl *x509.Certificate) (tls.Certificate, *x509.Certificate) {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	require.NoError(t, err)
+	tmpl.NotBefore = time.Now().Add(-time.Hour)
+	tmpl.NotAfter = time.Now().Add(time.Hour)
+	tmpl.KeyUsage = x509.KeyUsageDigitalSignature | x509.KeyUsageCertSign
+	tmpl.ExtKeyUsage = []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth, x509.ExtKeyUsageClientAuth}
+	tmpl.BasicConstraintsValid = true
+	tmpl.IsCA = true
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, &key.PublicKey, key)
+	require.NoError(t, err)
+	cert, err := x509.ParseCertificate(der)
+	require.NoError(t, err)
+	return tls.Certificate{Certificate: [][]byte{der}, PrivateKey: key, Leaf: cert}, cert
+}
+
+// writeCert writes a self-signed certificate for the given names to dir
+// and returns its files and the parsed certificate.
+func writeCert(t *testing.T, dir, name string, serial int64, dnsNames ...string) (CertFile, *x509.Certificate) {
+	t.Helper()
+	pair, cert := selfSigned(t, &x509.Certificate{
+		SerialNumber: big.NewInt(serial),
+		Subject:      pkix.Name{CommonName: dnsNames[0]},
+		DNSNames:     dnsNames,
+	})
+	keyDER, err := x509.MarshalECPrivateKey(pair.PrivateKey.(*ecdsa.PrivateKey))
+	require.NoError(t, err)
+
+	f := CertFile{CertFile: filepath.Join(dir, name+".crt"), KeyFile: filepath.Join(dir, name+".key")}
+	require.NoError(t, os.WriteFile(f.CertFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: cert.Raw}), 0o600))
+	require.NoError(t, os.WriteFile(f.KeyFile, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER}), 0o600))
+	return f, cert
+}
+
+func tlsDial(t *testing.T, s *Server, serverName string, roots *x509.CertPool) *tls.Conn {
+	t.Helper()
+	c, err := tls.Dial("tcp", fmt.Sprintf("127.0.0.1:%d", s.Addr().(*net.TCPAddr).Port), &tls.Config{
+		ServerName: serverName,
+		RootCAs:    roots,
+	})
+	require.NoError(t, err)
+	t.Cleanup(func() { c.Close() })
+	return c
+}
+
+func TestServeTLS(t *testing.T) {
+	dir := t.TempDir()
+	apiFile, apiCert := writeCert(t, dir, "api", 1, "api.test")
+	wwwFile, wwwCert := writeCert(t, dir, "www", 2, "www.test", "*.static.test")
+	roots := x509.NewCertPool()
+	roots.AddCert(apiCert)
+	roots.AddCert(wwwCert)
+
+	store, err := NewCertStore(apiFile, wwwFile)
+	require.NoError(t, err)
+	s, err := ServeTLS(0, func(w *response.Writer, req *request.Request) {
+		body := []byte(req.TLS.ServerName)
+		w.WriteStatusLine(response.StatusOK)
+		w.WriteHeaders(response.GetDefaultHeaders(len(body)))
+		w.WriteBody(body)
+	}, &TLSOptions{Certificates: store, ReloadInterval: 10 * time.Millisecond})
+	require.NoError(t, err)
+	defer s.Close()
+
+	// Test: SNI picks the certificate, the first one is the default
+	for name, serial := range map[string]int64{"api.test": 1, "www.test": 2, "img.static.test": 2, "": 1} {
+		c, err := tls.Dial("tcp", s.Addr().String(), &tls.Config{ServerName: name, InsecureSkipVerify: true})
+		require.NoError(t, err, name)
+		assert.Equal(t, serial, c.ConnectionState().PeerCertificates[0].SerialNumber.Int64(), name)
+		c.Close()
+	}
+
+	// Test: Handlers see the connection state
+	c := tlsDial(t, s, "www.test", roots)
+	io.WriteString(c, "GET / HTTP/1.1\r\nHost: www.test\r\nConnection: close\r\n\r\n")
+	body, err := io.ReadAll(c)
+	require.NoError(t, err)
+	assert.Contains(t, string(body), "\r\n\r\nwww.test")
+
+	// Test: Changed files are picked up for new handshakes only
+	held := tlsDial(t, s, "api.test", roots)
+	_, newCert := writeCert(t, dir, "api", 3, "api.test")
+	future := time.Now().Add(time.Minute)
+	require.NoError(t, os.Chtimes(apiFile.CertFile, future, future))
+	require.NoError(t, os.Chtimes(apiFile.KeyFile, future, future))
+	roots.AddCert(newCert)
+	require.Eventually(t, func() bool {
+		c, err := tls.Dial("tcp", s.Addr().String(), &tls.Config{ServerName: "api.test", InsecureSkipVerify: true})
+		if err != nil {
+			return false
+		}
+		defer c.Close()
+		return c.ConnectionState().PeerCertificates[0].SerialNumber.Int64() == 3
+	}, time.Second, 10*time.Millisecond)
+
+	io.WriteString(held, "GET / HTTP/1.1\r\nHost: api.test\r\n\r\n")
+	status, err := bufio.NewReader(held).ReadString('\n')
+	require.NoError(t, err)
+	assert.Equal(t, "HTTP/1.1 200 OK\r\n", status)
+	assert.Equal(t, int64(1), held.ConnectionState().PeerCertificates[0].SerialNumber.Int64())
+
+	// Test: A broken file keeps the current certificates
+	require.NoError(t, os.WriteFile(apiFile.KeyFile, []byte("garbage"), 0o600))
+	assert.Error(t, store.Reload())
+	cert, err := store.GetCertificate(&tls.ClientHelloInfo{ServerName: "api.test"})
+	require.NoError(t, err)
+	assert.Equal(t, int64(3), cert.Leaf.SerialNumber.Int64())
+}
+
+func TestNextProtos(t *testing.T) {
+	dir := t.TempDir()
+	file, cert := writeCert(t, dir, "api", 1, "api.test")
+	roots := x509.NewCertPool()
+	roots.AddCert(cert)
+	store, err := NewCertStore(file)
+	require.NoError(t, err)
+
+	s, err := ServeTLS(0, func(w *response.Writer, req *request.Request) {
+		w.WriteStatusLine(response.StatusNoContent)
+		w.WriteHeaders(response.GetDefaultHeaders(0))
+	}, &TLSOptions{Certificates: store, NextProtos: []NextProto{{
+		Name: "echo/1",
+		Handler: func(ctx context.Context, conn net.Conn, br *bufio.Reader) {
+			line, _ := br.ReadString('\n')
+			io.WriteString(conn, "echo "+line)
+		},
+	}}})
+	require.NoError(t, err)
+	defer s.Close()
+
+	dial := func(protos ...string) *tls.Conn {
+		c, err := tls.Dial("tcp", s.Addr().String(), &tls.Config{ServerName: "api.test", RootCAs: roots, NextProtos: protos})
+		require.NoError(t, err)
+		t.Cleanup(func() { c.Close() })
+		return c
+	}
+
+	// Test: A negotiated protocol gets its handler
+	c := dial("echo/1", "http/1.1")
+	assert.Equal(t, "echo/1", c.ConnectionState().NegotiatedProtocol)
+	io.WriteString(c, "hi\n")
+	line, err := bufio.NewReader(c).ReadString('\n')
+	require.NoError(t, err)
+	assert.Equal(t, "echo hi\n", line)
+
+	// Test: http/1.1 and clients without ALPN get the server's handler
+	for _, protos := range [][]string{{"http/1.1"}, nil} {
+		c = dial(protos...)
+		io.WriteString(c, "GET / HTTP/1.1\r\nHost: api.test\r\n\r\n")
+		status, err := bufio.NewReader(c).ReadString('\n')
+		require.NoError(t, err)
+		assert.Equal(t, "HTTP/1.1 204 No Content\r\n", status)
+	}
+}
+
+func TestClientCertificates(t *testing.T) {
+	dir := t.TempDir()
+	serverFile, serverCert := writeCert(t, dir, "server", 1, "api.test")
+	roots := x509.NewCertPool()
+	roots.AddCert(serverCert)
+	store, err := NewCertStore(serverFile)
+	require.NoError(t, err)
+
+	billing, billingCert := selfSigned(t, &x509.Certificate{
+		SerialNumber: big.NewInt(10),
+		Subject:      pkix.Name{CommonName: "billing"},
+		URIs:         []*url.URL{{Scheme: "spiffe", Host: "prod", Path: "/ns/payments/sa/billing"}},
+	})
+	search, searchCert := selfSigned(t, &x509.Certificate{
+		SerialNumber: big.NewInt(11),
+		Subject:      pkix.Name{CommonName: "search"},
+		DNSNames:     []string{"search.svc.internal"},
+	})
+	stranger, _ := selfSigned(t, &x509.Certificate{SerialNumber: big.NewInt(12), Subject: pkix.Name{CommonName: "billing"}})
+
+	caFile := filepath.Join(dir, "clients.pem")
+	pemData := append(pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: billingCert.Raw}),
+		pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: searchCert.Raw})...)
+	require.NoError(t, os.WriteFile(caFile, pemData, 0o600))
+	clientCAs, err := LoadCertPool(caFile)
+	require.NoError(t, err)
+
+	handler := func(w *response.Writer, req *request.Request) {
+		body := []byte("anonymous")
+		if cert := req.ClientCertificate(); cert != nil {
+			body = []byte(fmt.Sprintf("%s chain=%d", cert.Subject.CommonName, len(req.ClientChain())))
+		}
+		w.WriteStatusLine(response.StatusOK)
+		w.WriteHeaders(response.GetDefaultHeaders(len(body)))
+		w.WriteBody(body)
+	}
+	policy := &CertPolicy{URIs: []string{"spiffe://prod/ns/*/sa/billing"}}
+	mux := func(w *response.Writer, req *request.Request) {
+		if req.RequestLine.RequestTarget == "/charges" {
+			RequireClientCert(policy, handler)(w, req)
+			return
+		}
+		handler(w, req)
+	}
+
+	get := func(s *Server, target string, certs ...tls.Certificate) (string, error) {
+		c, err := tls.Dial("tcp", s.Addr().String(), &tls.Config{ServerName: "api.test", RootCAs: roots, Certificates: certs})
+		if err != nil {
+			return "", err
+		}
+		defer c.Close()
+		if _, err := io.WriteString(c, "GET "+target+" HTTP/1.1\r\nHost: api.test\r\nConnection: close\r\n\r\n"); err != nil {
+			return "", err
+		}
+		res, err := io.ReadAll(c)
+		return string(res), err
+	}
+
+	_, err = ServeTLS(0, mux, &TLSOptions{Certificates: store, ClientAuth: ClientCertRequired})
+	assert.ErrorIs(t, err, ErrNoClientCAs)
+
+	// Test: Optional mode lets anonymous clients in, policies guard routes
+	s, err := ServeTLS(0, mux, &TLSOptions{Certificates: store, ClientAuth: ClientCertOptional, ClientCAs: clientCAs})
+	require.NoError(t, err)
+	defer s.Close()
+
+	res, err := get(s, "/")
+	require.NoError(t, err)
+	assert.Contains(t, res, "\r\n\r\nanonymous")
+	res, err = get(s, "/", search)
+	require.NoError(t, err)
+	assert.Contains(t, res, "\r\n\r\nsearch chain=1")
+
+	res, err = get(s, "/charges")
+	require.NoError(t, err)
+	assert.Contains(t, res, "403 Forbidden")
+	assert.Contains(t, res, "client certificate required")
+	res, err = get(s, "/charges", search)
+	require.NoError(t, err)
+	assert.Contains(t, res, "client certificate not allowed")
+	res, err = get(s, "/charges", billing)
+	require.NoError(t, err)
+	assert.Contains(t, res, "\r\n\r\nbilling chain=1")
+
+	// Test: Unknown issuers fail the handshake
+	_, err = get(s, "/", stranger)
+	assert.Error(t, err)
+
+	// Test: Required mode turns anonymous clients away
+	s2, err := ServeTLS(0, mux, &TLSOptions{Certificates: store, ClientAuth: ClientCertRequired, ClientCAs: clientCAs})
+	require.NoError(t, err)
+	defer s2.Close()
+	_, err = get(s2, "/")
+	assert.Error(t, err)
+	res, err = get(s2, "/", billing)
+	require.NoError(t, err)
+	assert.Contains(t, res, "\r\n\r\nbilling chain=1")
+}
+
+func TestCertPolicy(t *testing.T) {
+	cert := &x509.Certificate{
+		Subject:        pkix.Name{CommonName: "worker"},
+		DNSNames:       []string{"worker.jobs.internal"},
+		URIs:           []*url.URL{{Scheme: "spiffe", Host: "prod", Path: "/ns/jobs/sa/worker"}},
+		EmailAddresses: []string{"Ops@example.com"},
+	}
+	cases := []struct {
+		policy CertPolicy
+		allow  bool
+	}{
+		{CertPolicy{}, true},
+		{CertPolicy{CommonNames: []string{"worker"}}, true},
+		{CertPolicy{CommonNames: []string{"Worker"}}, false},
+		{CertPolicy{DNSNames: []string{"*.jobs.internal"}}, true},
+		{CertPolicy{DNSNames: []string{"*.internal"}}, false},
+		{CertPolicy{URIs: []string{"spiffe://prod/ns/*/sa/worker"}}, true},
+		{CertPolicy{URIs: []string{"spiffe://prod/*"}}, false},
+		{CertPolicy{EmailAddresses: []string{"ops@example.com"}}, true},
+		{CertPolicy{CommonNames: []string{"api"}, EmailAddresses: []string{"dev@example.com"}}, false},
+	}
+	for _, c := range cases {
+		assert.Equal(t, c.allow, c.policy.Allows(cert), "%+v", c.policy)
+	}
+}
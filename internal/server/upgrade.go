@@ -0,0 +1,171 @@
+package server
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"fmt"
+	"maps"
+	"net"
+	"slices"
+	"strings"
+
+	"http-scratch/internal/headers"
+	"http-scratch/internal/request"
+	"http-scratch/internal/response"
+)
+
+// Upgrader switches a connection to the protocol it is registered for
+// with HandleUpgrade.
+type Upgrader interface {
+	// Accept vets the request before the switch and returns fields to add
+	// to the 101 response. An error refuses the upgrade with its status if
+	// it is a *HandlerError, 400 otherwise, and the connection stays HTTP.
+	Accept(req *request.Request) (headers.Headers, error)
+	// Serve speaks the new protocol. br first returns whatever the client
+	// sent after the request. Serve owns conn and must close it; req's
+	// context ends when the server closes.
+	Serve(conn net.Conn, br *bufio.Reader, req *request.Request)
+}
+
+// UpgradeFunc is an Upgrader accepting every request.
+type UpgradeFunc func(conn net.Conn, br *bufio.Reader, req *request.Request)
+
+func (f UpgradeFunc) Accept(req *request.Request) (headers.Headers, error) {
+	return nil, nil
+}
+
+func (f UpgradeFunc) Serve(conn net.Conn, br *bufio.Reader, req *request.Request) {
+	f(conn, br, req)
+}
+
+// HandleUpgrade registers u for requests asking to upgrade to protocol, an
+// Upgrade token like "h2c" or "chat/2". Tokens match case-insensitively.
+// Requests offering no token registered here or with PassUpgrade are
+// refused with 400, listing the supported ones in Upgrade.
+func (s *Server) HandleUpgrade(protocol string, u Upgrader) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.upgraders == nil {
+		s.upgraders = map[string]Upgrader{}
+	}
+	s.upgraders[strings.ToLower(protocol)] = u
+}
+
+// PassUpgrade leaves requests asking to upgrade to protocol to the
+// Handler, for protocols it switches to itself by hijacking the
+// connection, like WebSocket with websocket.Upgrader.
+func (s *Server) PassUpgrade(protocol string) {
+	s.HandleUpgrade(protocol, nil)
+}
+
+// upgraderFor picks the first protocol the client asks for that is
+// registered. Upgrade only counts when Connection lists it (RFC 9110
+// section 7.8). ok is false when the client asks for nothing we know;
+// a nil Upgrader with ok set leaves the request to the handler.
+func (s *Server) upgraderFor(req *request.Request) (u Upgrader, protocol string, ok bool) {
+	if !hasToken(req.Headers.List("connection"), "upgrade") {
+		return nil, "", true
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for _, protocol := range req.Headers.List("upgrade") {
+		protocol = strings.TrimSpace(protocol)
+		if u, ok := s.upgraders[strings.ToLower(protocol)]; ok {
+			return u, protocol, true
+		}
+	}
+	return nil, "", false
+}
+
+// refuseUpgrade answers a request for protocols nobody registered.
+func (s *Server) refuseUpgrade(w *response.Writer, req *request.Request) {
+	s.mu.Lock()
+	supported := slices.Sorted(maps.Keys(s.upgraders))
+	s.mu.Unlock()
+
+	h := headers.NewHeaders()
+	if len(supported) > 0 {
+		h.Set("Upgrade", strings.Join(supported, ", "))
+	}
+	offered, _ := req.Headers.Get("upgrade")
+	writeError(w, req, h, &HandlerError{StatusCode: response.StatusBadRequest, Message: fmt.Sprintf("can't upgrade to %q", offered)})
+}
+
+// ConnHandler serves a connection that opened with a registered preface
+// rather than an HTTP/1.1 request; br first returns the preface itself.
+// ctx ends when the server starts shutting down, the cue to finish what
+// is in flight and return. The server closes conn afterwards.
+type ConnHandler func(ctx context.Context, conn net.Conn, br *bufio.Reader)
+
+// HandlePreface hands connections whose first bytes are preface to h, for
+// protocols like HTTP/2 with prior knowledge.
+func (s *Server) HandlePreface(preface string, h ConnHandler) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.prefaces == nil {
+		s.prefaces = map[string]ConnHandler{}
+	}
+	s.prefaces[preface] = h
+}
+
+// prefaceHandler peeks at the start of the connection for a registered
+// preface. It reads no further than needed to rule them out, so an
+// HTTP/1.1 request is left for the parser.
+func (s *Server) prefaceHandler(c *conn) (ConnHandler, error) {
+	s.mu.Lock()
+	prefaces := maps.Clone(s.prefaces)
+	s.mu.Unlock()
+	for preface, h := range prefaces {
+		ok, err := c.reader.HasPrefix([]byte(preface))
+		if err != nil {
+			return nil, err
+		}
+		if ok {
+			return h, nil
+		}
+	}
+	return nil, nil
+}
+
+func (s *Server) upgrade(w *response.Writer, req *request.Request, protocol string, u Upgrader) {
+	h, err := u.Accept(req)
+	if err != nil {
+		var herr *HandlerError
+		if !errors.As(err, &herr) {
+			herr = &HandlerError{StatusCode: response.StatusBadRequest, Message: err.Error()}
+		}
+		writeError(w, req, nil, herr)
+		return
+	}
+
+	netConn, br, err := w.Hijack()
+	if err != nil {
+		return
+	}
+	if h == nil {
+		h = headers.NewHeaders()
+	}
+	h.Replace("Connection", "Upgrade")
+	h.Replace("Upgrade", protocol)
+
+	rw := response.NewWriter(netConn)
+	if err := rw.WriteStatusLine(response.StatusSwitchingProtocols); err != nil {
+		netConn.Close()
+		return
+	}
+	if err := rw.WriteHeaders(h); err != nil {
+		netConn.Close()
+		return
+	}
+	u.Serve(netConn, br, req)
+}
+
+func hasToken(list []string, token string) bool {
+	for _, v := range list {
+		if strings.EqualFold(strings.TrimSpace(v), token) {
+			return true
+		}
+	}
+	return false
+}
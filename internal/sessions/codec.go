@@ -0,0 +1,145 @@
+package sessions
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"errors"
+	"strings"
+)
+
+var (
+	ErrNoKeys         = errors.New("at least one key is required")
+	ErrInvalidKey     = errors.New("hash key must be at least 32 bytes, block key 16, 24 or 32")
+	ErrInvalidCookie  = errors.New("invalid session cookie")
+	ErrCookieTooLarge = errors.New("session cookie too large")
+)
+
+// Browsers stop at around 4096 bytes per cookie, name and attributes
+// included.
+const maxCookieValue = 3800
+
+// Key signs, and with a BlockKey also encrypts, cookie values. BlockKey
+// selects AES-128, AES-192 or AES-256 by length; leave it nil for signed
+// but readable cookies.
+type Key struct {
+	HashKey  []byte
+	BlockKey []byte
+}
+
+type codec struct {
+	hashKey []byte
+	aead    cipher.AEAD
+}
+
+// codecs are tried in order: the first one encodes, any of them decodes,
+// so a new key goes first and old ones stay behind it until every cookie
+// signed with them has expired.
+func newCodecs(keys []Key) ([]codec, error) {
+	if len(keys) == 0 {
+		return nil, ErrNoKeys
+	}
+
+	codecs := make([]codec, 0, len(keys))
+	for _, k := range keys {
+		if len(k.HashKey) < 32 {
+			return nil, ErrInvalidKey
+		}
+		c := codec{hashKey: k.HashKey}
+		if k.BlockKey != nil {
+			block, err := aes.NewCipher(k.BlockKey)
+			if err != nil {
+				return nil, ErrInvalidKey
+			}
+			c.aead, err = cipher.NewGCM(block)
+			if err != nil {
+				return nil, ErrInvalidKey
+			}
+		}
+		codecs = append(codecs, c)
+	}
+	return codecs, nil
+}
+
+// encode produces base64(payload).base64(mac). The cookie name is part of
+// both the MAC and the GCM additional data so a value can't be replayed
+// under another cookie.
+func (c codec) encode(name string, plain []byte) (string, error) {
+	payload := plain
+	if c.aead != nil {
+		nonce := make([]byte, c.aead.NonceSize())
+		if _, err := rand.Read(nonce); err != nil {
+			return "", err
+		}
+		payload = c.aead.Seal(nonce, nonce, plain, []byte(name))
+	}
+
+	data := base64.RawURLEncoding.EncodeToString(payload)
+	mac := base64.RawURLEncoding.EncodeToString(c.mac(name, data))
+	value := data + "." + mac
+	if len(value) > maxCookieValue {
+		return "", ErrCookieTooLarge
+	}
+	return value, nil
+}
+
+func (c codec) decode(name, value string) ([]byte, error) {
+	data, macStr, ok := strings.Cut(value, ".")
+	if !ok {
+		return nil, ErrInvalidCookie
+	}
+	mac, err := base64.RawURLEncoding.DecodeString(macStr)
+	if err != nil || !hmac.Equal(mac, c.mac(name, data)) {
+		return nil, ErrInvalidCookie
+	}
+
+	payload, err := base64.RawURLEncoding.DecodeString(data)
+	if err != nil {
+		return nil, ErrInvalidCookie
+	}
+	if c.aead == nil {
+		return payload, nil
+	}
+
+	n := c.aead.NonceSize()
+	if len(payload) < n {
+		return nil, ErrInvalidCookie
+	}
+	plain, err := c.aead.Open(nil, payload[:n], payload[n:], []byte(name))
+	if err != nil {
+		return nil, ErrInvalidCookie
+	}
+	return plain, nil
+}
+
+func (c codec) mac(name, data string) []byte {
+	h := hmac.New(sha256.New, c.hashKey)
+	h.Write([]byte(name))
+	h.Write([]byte{'|'})
+	h.Write([]byte(data))
+	return h.Sum(nil)
+}
+
+func encode(codecs []codec, name string, plain []byte) (string, error) {
+	return codecs[0].encode(name, plain)
+}
+
+func decode(codecs []codec, name, value string) ([]byte, error) {
+	for _, c := range codecs {
+		if plain, err := c.decode(name, value); err == nil {
+			return plain, nil
+		}
+	}
+	return nil, ErrInvalidCookie
+}
+
+func newID() (string, error) {
+	b := make([]byte, 32)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return base64.RawURLEncoding.EncodeToString(b), nil
+}
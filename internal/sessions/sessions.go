@@ -0,0 +1,286 @@
+package sessions
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"time"
+
+	"http-scratch/internal/cookie"
+	"http-scratch/internal/headers"
+	"http-scratch/internal/request"
+	"http-scratch/internal/response"
+	"http-scratch/internal/server"
+)
+
+var ErrNoSession = errors.New("no session in request context")
+
+const defaultCookieName = "session"
+
+type Options struct {
+	CookieName string
+	Path       string
+	Domain     string
+	Secure     bool
+	SameSite   cookie.SameSite
+	// IdleTimeout ends a session that has not been saved for that long,
+	// AbsoluteTimeout one that was created that long ago, however active.
+	// Zero disables either.
+	IdleTimeout     time.Duration
+	AbsoluteTimeout time.Duration
+}
+
+// Manager loads sessions from requests and writes them back as cookies.
+// With a nil Store the whole session lives in the cookie, signed and, when
+// the key has a BlockKey, encrypted. With a Store the cookie only holds a
+// signed session ID.
+type Manager struct {
+	opts   Options
+	store  Store
+	codecs []codec
+	// now is overridden in tests
+	now func() time.Time
+}
+
+func NewManager(store Store, opts Options, keys ...Key) (*Manager, error) {
+	codecs, err := newCodecs(keys)
+	if err != nil {
+		return nil, err
+	}
+	if opts.CookieName == "" {
+		opts.CookieName = defaultCookieName
+	}
+	if opts.Path == "" {
+		opts.Path = "/"
+	}
+	return &Manager{opts: opts, store: store, codecs: codecs, now: time.Now}, nil
+}
+
+type Session struct {
+	Values map[string]string
+
+	manager *Manager
+	id      string
+	created time.Time
+	isNew   bool
+	oldID   string
+	deleted bool
+}
+
+func (s *Session) Get(key string) (string, bool) {
+	v, ok := s.Values[key]
+	return v, ok
+}
+
+func (s *Session) Set(key, value string) {
+	s.Values[key] = value
+}
+
+func (s *Session) Delete(key string) {
+	delete(s.Values, key)
+}
+
+// IsNew reports whether the request carried no usable session.
+func (s *Session) IsNew() bool {
+	return s.isNew
+}
+
+// Regenerate gives the session a fresh ID, keeping its values. Call it
+// whenever the privilege level changes, login above all, so an ID planted
+// before authentication is worthless afterwards.
+func (s *Session) Regenerate() error {
+	id, err := newID()
+	if err != nil {
+		return err
+	}
+	if s.oldID == "" && !s.isNew {
+		s.oldID = s.id
+	}
+	s.id = id
+	s.created = s.manager.now()
+	return nil
+}
+
+// Destroy empties the session; Save then expires the cookie.
+func (s *Session) Destroy() {
+	s.Values = map[string]string{}
+	s.deleted = true
+}
+
+func (s *Session) Save(h headers.Headers) error {
+	return s.manager.Save(h, s)
+}
+
+type cookiePayload struct {
+	ID string `json:"id"`
+	Record
+}
+
+// Load never fails: a missing, forged, expired or unknown session all
+// give a new empty one. In particular an ID the store doesn't know is
+// never adopted, which is what defeats session fixation.
+func (m *Manager) Load(req *request.Request) *Session {
+	if s, err := m.load(req); err == nil {
+		return s
+	}
+	return m.newSession()
+}
+
+func (m *Manager) load(req *request.Request) (*Session, error) {
+	c, ok := req.Cookie(m.opts.CookieName)
+	if !ok {
+		return nil, ErrNotFound
+	}
+	plain, err := decode(m.codecs, m.opts.CookieName, c.Value)
+	if err != nil {
+		return nil, err
+	}
+
+	var id string
+	var rec Record
+	if m.store == nil {
+		var p cookiePayload
+		if err := json.Unmarshal(plain, &p); err != nil {
+			return nil, ErrInvalidCookie
+		}
+		id, rec = p.ID, p.Record
+	} else {
+		id = string(plain)
+		rec, err = m.store.Load(id)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	if m.expired(rec) {
+		if m.store != nil {
+			m.store.Delete(id)
+		}
+		return nil, ErrNotFound
+	}
+	if rec.Values == nil {
+		rec.Values = map[string]string{}
+	}
+	return &Session{Values: rec.Values, manager: m, id: id, created: rec.Created}, nil
+}
+
+func (m *Manager) newSession() *Session {
+	// An ID is only needed once the session gets saved
+	id, _ := newID()
+	return &Session{
+		Values:  map[string]string{},
+		manager: m,
+		id:      id,
+		created: m.now(),
+		isNew:   true,
+	}
+}
+
+func (m *Manager) expired(rec Record) bool {
+	now := m.now()
+	if m.opts.IdleTimeout > 0 && now.Sub(rec.LastSeen) > m.opts.IdleTimeout {
+		return true
+	}
+	if m.opts.AbsoluteTimeout > 0 && now.Sub(rec.Created) > m.opts.AbsoluteTimeout {
+		return true
+	}
+	return false
+}
+
+// Save adds the Set-Cookie field for s to h; call it before the headers
+// are written. Saving also refreshes the idle timeout.
+func (m *Manager) Save(h headers.Headers, s *Session) error {
+	if s.oldID != "" && m.store != nil {
+		if err := m.store.Delete(s.oldID); err != nil {
+			return err
+		}
+		s.oldID = ""
+	}
+
+	if s.deleted {
+		if m.store != nil && !s.isNew {
+			if err := m.store.Delete(s.id); err != nil {
+				return err
+			}
+		}
+		c := m.cookie("")
+		c.MaxAge = -1
+		return response.SetCookie(h, c)
+	}
+
+	now := m.now()
+	rec := Record{Values: s.Values, Created: s.created, LastSeen: now}
+	expires := m.expiry(rec)
+
+	var plain []byte
+	if m.store == nil {
+		b, err := json.Marshal(cookiePayload{ID: s.id, Record: rec})
+		if err != nil {
+			return err
+		}
+		plain = b
+	} else {
+		if err := m.store.Save(s.id, rec, expires); err != nil {
+			return err
+		}
+		plain = []byte(s.id)
+	}
+
+	value, err := encode(m.codecs, m.opts.CookieName, plain)
+	if err != nil {
+		return err
+	}
+	c := m.cookie(value)
+	if !expires.IsZero() {
+		c.MaxAge = max(int(expires.Sub(now)/time.Second), 1)
+	}
+	s.isNew = false
+	return response.SetCookie(h, c)
+}
+
+// expiry is the earlier of the idle and absolute deadlines, zero if there
+// is neither.
+func (m *Manager) expiry(rec Record) time.Time {
+	var t time.Time
+	if m.opts.IdleTimeout > 0 {
+		t = rec.LastSeen.Add(m.opts.IdleTimeout)
+	}
+	if m.opts.AbsoluteTimeout > 0 {
+		abs := rec.Created.Add(m.opts.AbsoluteTimeout)
+		if t.IsZero() || abs.Before(t) {
+			t = abs
+		}
+	}
+	return t
+}
+
+func (m *Manager) cookie(value string) *cookie.Cookie {
+	return &cookie.Cookie{
+		Name:     m.opts.CookieName,
+		Value:    value,
+		Path:     m.opts.Path,
+		Domain:   m.opts.Domain,
+		Secure:   m.opts.Secure,
+		HttpOnly: true,
+		SameSite: m.opts.SameSite,
+	}
+}
+
+type contextKey struct{}
+
+// Middleware loads the session before handler runs; handlers get it with
+// FromRequest and still call Save themselves before writing headers.
+func (m *Manager) Middleware(handler server.Handler) server.Handler {
+	return func(w *response.Writer, req *request.Request) {
+		s := m.Load(req)
+		handler(w, req.WithContext(context.WithValue(req.Context(), contextKey{}, s)))
+	}
+}
+
+func FromRequest(req *request.Request) (*Session, error) {
+	s, ok := req.Context().Value(contextKey{}).(*Session)
+	if !ok {
+		return nil, ErrNoSession
+	}
+	return s, nil
+}
@@ -0,0 +1,217 @@
+package sessions
+
+import (
+	"bytes"
+	"encoding/base64"
+	"fmt"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"http-scratch/internal/cookie"
+	"http-scratch/internal/headers"
+	"http-scratch/internal/request"
+	"http-scratch/internal/response"
+)
+
+var (
+	hashKey  = bytes.Repeat([]byte("h"), 32)
+	hashKey2 = bytes.Repeat([]byte("k"), 32)
+	blockKey = bytes.Repeat([]byte("b"), 32)
+)
+
+// roundTrip saves s and builds the request a browser would send next.
+func roundTrip(t *testing.T, s *Session) (*request.Request, *cookie.Cookie) {
+	t.Helper()
+	h := headers.NewHeaders()
+	require.NoError(t, s.Save(h))
+	return requestWith(t, h)
+}
+
+func requestWith(t *testing.T, h headers.Headers) (*request.Request, *cookie.Cookie) {
+	t.Helper()
+	sc, ok := h.Get("set-cookie")
+	require.True(t, ok)
+	c, err := cookie.ParseSetCookie(sc)
+	require.NoError(t, err)
+
+	req, err := request.RequestFromReader(strings.NewReader("GET / HTTP/1.1\r\nHost: localhost\r\nCookie: " + c.Name + "=" + c.Value + "\r\n\r\n"))
+	require.NoError(t, err)
+	return req, c
+}
+
+func emptyRequest(t *testing.T) *request.Request {
+	t.Helper()
+	req, err := request.RequestFromReader(strings.NewReader("GET / HTTP/1.1\r\nHost: localhost\r\n\r\n"))
+	require.NoError(t, err)
+	return req
+}
+
+func TestCookieSessions(t *testing.T) {
+	m, err := NewManager(nil, Options{}, Key{HashKey: hashKey})
+	require.NoError(t, err)
+
+	// Test: New session round trips through a signed cookie
+	s := m.Load(emptyRequest(t))
+	assert.True(t, s.IsNew())
+	s.Set("user", "alice")
+	req, c := roundTrip(t, s)
+	assert.True(t, c.HttpOnly)
+	assert.Equal(t, "/", c.Path)
+
+	s = m.Load(req)
+	assert.False(t, s.IsNew())
+	user, ok := s.Get("user")
+	assert.True(t, ok)
+	assert.Equal(t, "alice", user)
+
+	// Test: Signed-only cookies are readable but tamper-proof
+	data, _, _ := strings.Cut(c.Value, ".")
+	plain, err := base64.RawURLEncoding.DecodeString(data)
+	require.NoError(t, err)
+	assert.Contains(t, string(plain), "alice")
+
+	forged := base64.RawURLEncoding.EncodeToString(bytes.Replace(plain, []byte("alice"), []byte("admin"), 1))
+	h := headers.NewHeaders()
+	response.SetCookie(h, &cookie.Cookie{Name: "session", Value: forged + c.Value[len(data):]})
+	req, _ = requestWith(t, h)
+	assert.True(t, m.Load(req).IsNew())
+
+	// Test: Encrypted cookies hide their content
+	m, err = NewManager(nil, Options{}, Key{HashKey: hashKey, BlockKey: blockKey})
+	require.NoError(t, err)
+	s = m.Load(emptyRequest(t))
+	s.Set("user", "alice")
+	req, c = roundTrip(t, s)
+	assert.NotContains(t, c.Value, base64.RawURLEncoding.EncodeToString([]byte("alice")))
+	user, _ = m.Load(req).Get("user")
+	assert.Equal(t, "alice", user)
+
+	// Test: Key rotation keeps old cookies valid
+	rotated, err := NewManager(nil, Options{}, Key{HashKey: hashKey2, BlockKey: blockKey}, Key{HashKey: hashKey, BlockKey: blockKey})
+	require.NoError(t, err)
+	s = rotated.Load(req)
+	assert.False(t, s.IsNew())
+	req, _ = roundTrip(t, s)
+	assert.True(t, m.Load(req).IsNew(), "re-signed with the new key only")
+
+	// Test: Bad keys
+	_, err = NewManager(nil, Options{})
+	require.ErrorIs(t, err, ErrNoKeys)
+	_, err = NewManager(nil, Options{}, Key{HashKey: []byte("short")})
+	require.ErrorIs(t, err, ErrInvalidKey)
+	_, err = NewManager(nil, Options{}, Key{HashKey: hashKey, BlockKey: []byte("nope")})
+	require.ErrorIs(t, err, ErrInvalidKey)
+}
+
+func TestExpiry(t *testing.T) {
+	now := time.Date(2026, 1, 1, 0, 0, 0, 0, time.UTC)
+	m, err := NewManager(nil, Options{IdleTimeout: 10 * time.Minute, AbsoluteTimeout: time.Hour}, Key{HashKey: hashKey})
+	require.NoError(t, err)
+	m.now = func() time.Time { return now }
+
+	s := m.Load(emptyRequest(t))
+	req, c := roundTrip(t, s)
+	assert.Equal(t, 600, c.MaxAge)
+
+	// Test: Idle timeout
+	now = now.Add(11 * time.Minute)
+	assert.True(t, m.Load(req).IsNew())
+
+	// Test: Activity extends the idle timeout, but not past the absolute one
+	now = time.Date(2026, 1, 1, 0, 0, 0, 0, time.UTC)
+	s = m.Load(emptyRequest(t))
+	req, _ = roundTrip(t, s)
+	for range 6 {
+		now = now.Add(9 * time.Minute)
+		s = m.Load(req)
+		assert.False(t, s.IsNew())
+		req, c = roundTrip(t, s)
+	}
+	assert.Equal(t, 360, c.MaxAge)
+	now = now.Add(7 * time.Minute)
+	assert.True(t, m.Load(req).IsNew())
+}
+
+func TestServerSideSessions(t *testing.T) {
+	fileStore, err := NewFileStore(t.TempDir())
+	require.NoError(t, err)
+
+	for name, store := range map[string]Store{"memory": NewMemoryStore(), "file": fileStore} {
+		t.Run(name, func(t *testing.T) {
+			m, err := NewManager(store, Options{}, Key{HashKey: hashKey})
+			require.NoError(t, err)
+
+			// Test: The cookie only carries the ID
+			s := m.Load(emptyRequest(t))
+			s.Set("cart", "3 items")
+			req, c := roundTrip(t, s)
+			assert.NotContains(t, c.Value, base64.RawURLEncoding.EncodeToString([]byte("3 items")))
+			cart, _ := m.Load(req).Get("cart")
+			assert.Equal(t, "3 items", cart)
+
+			// Test: Unknown IDs are never adopted
+			planted, err := encode(m.codecs, "session", []byte("attacker-chosen-id"))
+			require.NoError(t, err)
+			h := headers.NewHeaders()
+			response.SetCookie(h, &cookie.Cookie{Name: "session", Value: planted})
+			plantedReq, _ := requestWith(t, h)
+			s = m.Load(plantedReq)
+			assert.True(t, s.IsNew())
+			assert.NotEqual(t, "attacker-chosen-id", s.id)
+
+			// Test: Regenerate moves the data and kills the old ID
+			s = m.Load(req)
+			oldID := s.id
+			require.NoError(t, s.Regenerate())
+			newReq, _ := roundTrip(t, s)
+			assert.NotEqual(t, oldID, s.id)
+			_, err = store.Load(oldID)
+			require.ErrorIs(t, err, ErrNotFound)
+			assert.True(t, m.Load(req).IsNew())
+			cart, _ = m.Load(newReq).Get("cart")
+			assert.Equal(t, "3 items", cart)
+
+			// Test: Destroy deletes the record and expires the cookie
+			s = m.Load(newReq)
+			s.Destroy()
+			h = headers.NewHeaders()
+			require.NoError(t, s.Save(h))
+			sc, _ := h.Get("set-cookie")
+			assert.Contains(t, sc, "Max-Age=0")
+			assert.True(t, m.Load(newReq).IsNew())
+		})
+	}
+}
+
+func TestMemoryStoreSweep(t *testing.T) {
+	// Test: Expired records nobody loads are swept out by Save
+	store := NewMemoryStore()
+	past := time.Now().Add(-time.Minute)
+	for i := range minSweep - 1 {
+		require.NoError(t, store.Save(fmt.Sprint("old", i), Record{}, past))
+	}
+	require.NoError(t, store.Save("live", Record{}, time.Now().Add(time.Hour)))
+	assert.Len(t, store.entries, 1)
+	_, err := store.Load("live")
+	assert.NoError(t, err)
+}
+
+func TestMiddleware(t *testing.T) {
+	m, err := NewManager(NewMemoryStore(), Options{}, Key{HashKey: hashKey})
+	require.NoError(t, err)
+
+	var got *Session
+	handler := m.Middleware(func(w *response.Writer, req *request.Request) {
+		got, err = FromRequest(req)
+	})
+	handler(response.NewWriter(&bytes.Buffer{}), emptyRequest(t))
+	require.NoError(t, err)
+	assert.True(t, got.IsNew())
+
+	_, err = FromRequest(emptyRequest(t))
+	require.ErrorIs(t, err, ErrNoSession)
+}
@@ -0,0 +1,185 @@
+package sessions
+
+import (
+	"encoding/json"
+	"errors"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+)
+
+var ErrNotFound = errors.New("session not found")
+
+// Record is what a Store keeps per session ID.
+type Record struct {
+	Values   map[string]string `json:"values"`
+	Created  time.Time         `json:"created"`
+	LastSeen time.Time         `json:"last_seen"`
+}
+
+// Store keeps sessions on the server side; the cookie then only carries
+// the signed session ID. Load returns ErrNotFound for unknown or expired
+// IDs. expires is when the store may forget the record on its own.
+type Store interface {
+	Load(id string) (Record, error)
+	Save(id string, rec Record, expires time.Time) error
+	Delete(id string) error
+}
+
+type memoryEntry struct {
+	rec     Record
+	expires time.Time
+}
+
+// minSweep is how many entries a MemoryStore holds before Save first
+// looks for expired ones.
+const minSweep = 64
+
+// MemoryStore forgets expired records when they are loaded, and in
+// sweeps from Save each time it has doubled in size since the last one,
+// so abandoned sessions don't pile up.
+type MemoryStore struct {
+	mu      sync.Mutex
+	entries map[string]memoryEntry
+	sweepAt int
+}
+
+func NewMemoryStore() *MemoryStore {
+	return &MemoryStore{entries: map[string]memoryEntry{}, sweepAt: minSweep}
+}
+
+func (s *MemoryStore) Load(id string) (Record, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	e, ok := s.entries[id]
+	if !ok {
+		return Record{}, ErrNotFound
+	}
+	if !e.expires.IsZero() && time.Now().After(e.expires) {
+		delete(s.entries, id)
+		return Record{}, ErrNotFound
+	}
+	return cloneRecord(e.rec), nil
+}
+
+func (s *MemoryStore) Save(id string, rec Record, expires time.Time) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.entries[id] = memoryEntry{rec: cloneRecord(rec), expires: expires}
+	if len(s.entries) >= s.sweepAt {
+		s.sweep()
+	}
+	return nil
+}
+
+func (s *MemoryStore) sweep() {
+	now := time.Now()
+	for id, e := range s.entries {
+		if !e.expires.IsZero() && now.After(e.expires) {
+			delete(s.entries, id)
+		}
+	}
+	s.sweepAt = max(2*len(s.entries), minSweep)
+}
+
+func (s *MemoryStore) Delete(id string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	delete(s.entries, id)
+	return nil
+}
+
+// FileStore keeps one JSON file per session in a directory. IDs are
+// generated by the manager and only ever contain base64url characters, so
+// they are safe to use as file names.
+type FileStore struct {
+	dir string
+	mu  sync.Mutex
+}
+
+type fileEntry struct {
+	Record
+	Expires time.Time `json:"expires"`
+}
+
+func NewFileStore(dir string) (*FileStore, error) {
+	if err := os.MkdirAll(dir, 0o700); err != nil {
+		return nil, err
+	}
+	return &FileStore{dir: dir}, nil
+}
+
+func (s *FileStore) Load(id string) (Record, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	b, err := os.ReadFile(s.path(id))
+	if errors.Is(err, os.ErrNotExist) {
+		return Record{}, ErrNotFound
+	}
+	if err != nil {
+		return Record{}, err
+	}
+
+	var e fileEntry
+	if err := json.Unmarshal(b, &e); err != nil {
+		return Record{}, err
+	}
+	if !e.Expires.IsZero() && time.Now().After(e.Expires) {
+		os.Remove(s.path(id))
+		return Record{}, ErrNotFound
+	}
+	return e.Record, nil
+}
+
+// Save writes to a temporary file first so a crash never leaves half a
+// session behind.
+func (s *FileStore) Save(id string, rec Record, expires time.Time) error {
+	b, err := json.Marshal(fileEntry{Record: rec, Expires: expires})
+	if err != nil {
+		return err
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	tmp, err := os.CreateTemp(s.dir, ".tmp-*")
+	if err != nil {
+		return err
+	}
+	if _, err := tmp.Write(b); err != nil {
+		tmp.Close()
+		os.Remove(tmp.Name())
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		os.Remove(tmp.Name())
+		return err
+	}
+	return os.Rename(tmp.Name(), s.path(id))
+}
+
+func (s *FileStore) Delete(id string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	err := os.Remove(s.path(id))
+	if errors.Is(err, os.ErrNotExist) {
+		return nil
+	}
+	return err
+}
+
+func (s *FileStore) path(id string) string {
+	return filepath.Join(s.dir, "sess_"+filepath.Base(id))
+}
+
+func cloneRecord(rec Record) Record {
+	values := make(map[string]string, len(rec.Values))
+	for k, v := range rec.Values {
+		values[k] = v
+	}
+	rec.Values = values
+	return rec
+}
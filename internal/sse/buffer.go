@@ -0,0 +1,50 @@
+package sse
+
+import (
+	"strconv"
+	"sync"
+)
+
+// Buffer keeps the most recent events of a stream so a browser that
+// reconnects with a Last-Event-ID can catch up on what it missed.
+type Buffer struct {
+	mu     sync.Mutex
+	size   int
+	events []Event
+	next   uint64
+}
+
+func NewBuffer(size int) *Buffer {
+	return &Buffer{size: size, next: 1}
+}
+
+// Add numbers e, overwriting its ID, stores it and returns it ready to
+// send. Once the buffer is full the oldest event is dropped.
+func (b *Buffer) Add(e Event) Event {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	e.ID = strconv.FormatUint(b.next, 10)
+	b.next++
+	b.events = append(b.events, e)
+	if len(b.events) > b.size {
+		b.events = b.events[len(b.events)-b.size:]
+	}
+	return e
+}
+
+// Since returns the buffered events after lastEventID. An empty or unknown
+// ID, or one already dropped, gives everything buffered.
+func (b *Buffer) Since(lastEventID string) []Event {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	start := 0
+	if last, err := strconv.ParseUint(lastEventID, 10, 64); err == nil && len(b.events) > 0 {
+		first, _ := strconv.ParseUint(b.events[0].ID, 10, 64)
+		if last >= first && last < b.next {
+			start = int(last - first + 1)
+		}
+	}
+	return append([]Event(nil), b.events[start:]...)
+}
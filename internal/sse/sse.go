@@ -0,0 +1,187 @@
+package sse
+
+import (
+	"context"
+	"errors"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"http-scratch/internal/request"
+	"http-scratch/internal/response"
+)
+
+var (
+	ErrStreamClosed = errors.New("event stream closed")
+	ErrInvalidField = errors.New("event id and type can't contain line breaks")
+)
+
+const defaultHeartbeat = 15 * time.Second
+
+// Event is one message of an event stream. Only Data is required; a
+// multi-line Data is sent as several data fields and reassembled by the
+// browser.
+type Event struct {
+	ID    string
+	Event string
+	Data  string
+	// Retry tells the browser how long to wait before reconnecting.
+	Retry time.Duration
+}
+
+type Options struct {
+	// Heartbeat is how often a comment is sent to keep proxies from timing
+	// out an idle stream; zero means 15s, negative disables heartbeats.
+	Heartbeat time.Duration
+	// Retry, when set, is sent before any event.
+	Retry time.Duration
+}
+
+// Stream is a text/event-stream response. Its methods are safe to call
+// from several goroutines.
+type Stream struct {
+	w           *response.Writer
+	lastEventID string
+	ctx         context.Context
+	cancel      context.CancelFunc
+
+	mu  sync.Mutex
+	err error
+}
+
+// NewStream writes the response head and starts the heartbeat. The stream
+// ends, and Done is closed, when the request context is cancelled, a
+// write fails or Close is called.
+func NewStream(w *response.Writer, req *request.Request, opts Options) (*Stream, error) {
+	h := response.GetDefaultHeaders(0)
+	// The body runs until the connection closes
+	h.Delete("content-length")
+	h.Replace("content-type", "text/event-stream; charset=utf-8")
+	h.Replace("cache-control", "no-cache")
+	// Stops nginx and friends from buffering the stream
+	h.Replace("x-accel-buffering", "no")
+	if err := w.WriteStatusLine(response.StatusOK); err != nil {
+		return nil, err
+	}
+	if err := w.WriteHeaders(h); err != nil {
+		return nil, err
+	}
+
+	ctx, cancel := context.WithCancel(req.Context())
+	s := &Stream{w: w, ctx: ctx, cancel: cancel}
+	if id, ok := req.Headers.Get("last-event-id"); ok {
+		s.lastEventID = strings.TrimSpace(id)
+	}
+
+	if opts.Retry > 0 {
+		if err := s.write("retry: " + strconv.FormatInt(opts.Retry.Milliseconds(), 10) + "\n\n"); err != nil {
+			return nil, err
+		}
+	}
+
+	heartbeat := opts.Heartbeat
+	if heartbeat == 0 {
+		heartbeat = defaultHeartbeat
+	}
+	if heartbeat > 0 {
+		go s.heartbeat(heartbeat)
+	}
+	return s, nil
+}
+
+// LastEventID is the ID of the last event the browser saw before it
+// reconnected, "" on a first connection. Handlers resume the stream after
+// it.
+func (s *Stream) LastEventID() string {
+	return s.lastEventID
+}
+
+// Done is closed once the stream has ended.
+func (s *Stream) Done() <-chan struct{} {
+	return s.ctx.Done()
+}
+
+// Close ends the stream. The handler still has to return for the
+// connection to close.
+func (s *Stream) Close() {
+	s.cancel()
+}
+
+func (s *Stream) Send(e Event) error {
+	if strings.ContainsAny(e.ID, "\r\n\x00") || strings.ContainsAny(e.Event, "\r\n") {
+		return ErrInvalidField
+	}
+
+	var b strings.Builder
+	if e.ID != "" {
+		b.WriteString("id: " + e.ID + "\n")
+	}
+	if e.Event != "" {
+		b.WriteString("event: " + e.Event + "\n")
+	}
+	if e.Retry > 0 {
+		b.WriteString("retry: " + strconv.FormatInt(e.Retry.Milliseconds(), 10) + "\n")
+	}
+	data := strings.ReplaceAll(e.Data, "\r\n", "\n")
+	data = strings.ReplaceAll(data, "\r", "\n")
+	for _, line := range strings.Split(data, "\n") {
+		b.WriteString("data: " + line + "\n")
+	}
+	b.WriteString("\n")
+	return s.write(b.String())
+}
+
+// Comment sends a comment line, which browsers ignore.
+func (s *Stream) Comment(text string) error {
+	var b strings.Builder
+	for _, line := range strings.Split(strings.ReplaceAll(text, "\r", ""), "\n") {
+		b.WriteString(": " + line + "\n")
+	}
+	b.WriteString("\n")
+	return s.write(b.String())
+}
+
+func (s *Stream) write(p string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.err != nil {
+		return s.err
+	}
+	if s.ctx.Err() != nil {
+		s.err = ErrStreamClosed
+		return s.err
+	}
+	if _, err := s.w.WriteBody([]byte(p)); err != nil {
+		s.fail(err)
+		return err
+	}
+	if err := s.w.Flush(); err != nil {
+		s.fail(err)
+		return err
+	}
+	return nil
+}
+
+// fail ends the stream after a write error; the client is most likely
+// gone.
+func (s *Stream) fail(err error) {
+	s.err = err
+	s.cancel()
+}
+
+func (s *Stream) heartbeat(interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-s.ctx.Done():
+			return
+		case <-ticker.C:
+			if s.Comment("heartbeat") != nil {
+				return
+			}
+		}
+	}
+}
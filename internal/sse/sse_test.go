@@ -0,0 +1,126 @@
+package sse
+
+import (
+	"bufio"
+	"context"
+	"io"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"http-scratch/internal/request"
+	"http-scratch/internal/response"
+)
+
+func streamRequest(t *testing.T, fields string) *request.Request {
+	t.Helper()
+	req, err := request.RequestFromReader(strings.NewReader("GET /builds/7/log HTTP/1.1\r\nHost: localhost\r\nAccept: text/event-stream\r\n" + fields + "\r\n"))
+	require.NoError(t, err)
+	return req
+}
+
+// readUntil reads lines up to and including the first one equal to stop.
+func readUntil(t *testing.T, br *bufio.Reader, stop string) []string {
+	t.Helper()
+	var lines []string
+	for {
+		line, err := br.ReadString('\n')
+		require.NoError(t, err)
+		line = strings.TrimRight(line, "\r\n")
+		lines = append(lines, line)
+		if line == stop {
+			return lines
+		}
+	}
+}
+
+func TestStream(t *testing.T) {
+	pr, pw := io.Pipe()
+	br := bufio.NewReader(pr)
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	req := streamRequest(t, "Last-Event-ID: 41\r\n").WithContext(ctx)
+
+	var s *Stream
+	started := make(chan error)
+	go func() {
+		var err error
+		s, err = NewStream(response.NewWriter(pw), req, Options{Heartbeat: 20 * time.Millisecond, Retry: 3 * time.Second})
+		started <- err
+	}()
+
+	// Test: Response head
+	head := readUntil(t, br, "")
+	assert.Equal(t, []string{"retry: 3000", ""}, readUntil(t, br, ""))
+	require.NoError(t, <-started)
+	assert.Equal(t, "HTTP/1.1 200 OK", head[0])
+	assert.Contains(t, head, "content-type: text/event-stream; charset=utf-8")
+	assert.Contains(t, head, "cache-control: no-cache")
+	for _, line := range head {
+		assert.False(t, strings.HasPrefix(line, "content-length"))
+	}
+	assert.Equal(t, "41", s.LastEventID())
+
+	// Test: Event fields and multi-line data
+	go s.Send(Event{ID: "42", Event: "log", Data: "compiling\r\nlinking\ndone"})
+	block := readUntil(t, br, "")
+	for block[0] == ": heartbeat" {
+		block = readUntil(t, br, "")
+	}
+	assert.Equal(t, []string{"id: 42", "event: log", "data: compiling", "data: linking", "data: done", ""}, block)
+
+	assert.ErrorIs(t, s.Send(Event{ID: "4\n2"}), ErrInvalidField)
+
+	// Test: Heartbeats while idle
+	assert.Equal(t, []string{": heartbeat", ""}, readUntil(t, br, ""))
+
+	// Test: Cancelling the request ends the stream
+	cancel()
+	select {
+	case <-s.Done():
+	case <-time.After(time.Second):
+		t.Fatal("stream still running")
+	}
+	assert.ErrorIs(t, s.Send(Event{Data: "late"}), ErrStreamClosed)
+}
+
+func TestStreamWriteFailure(t *testing.T) {
+	pr, pw := io.Pipe()
+	go io.Copy(io.Discard, pr)
+	s, err := NewStream(response.NewWriter(pw), streamRequest(t, ""), Options{Heartbeat: -1})
+	require.NoError(t, err)
+	assert.Equal(t, "", s.LastEventID())
+
+	// Test: A failed write ends the stream
+	pr.Close()
+	require.Error(t, s.Send(Event{Data: "x"}))
+	<-s.Done()
+}
+
+func TestBuffer(t *testing.T) {
+	b := NewBuffer(3)
+	for _, line := range []string{"a", "b", "c", "d"} {
+		b.Add(Event{Data: line})
+	}
+
+	data := func(events []Event) []string {
+		var out []string
+		for _, e := range events {
+			out = append(out, e.ID+"="+e.Data)
+		}
+		return out
+	}
+
+	// Test: Resume after a known ID
+	assert.Equal(t, []string{"4=d"}, data(b.Since("3")))
+	assert.Empty(t, b.Since("4"))
+
+	// Test: First connection, dropped or foreign IDs replay the buffer
+	assert.Equal(t, []string{"2=b", "3=c", "4=d"}, data(b.Since("")))
+	assert.Equal(t, []string{"2=b", "3=c", "4=d"}, data(b.Since("1")))
+	assert.Equal(t, []string{"2=b", "3=c", "4=d"}, data(b.Since("abc")))
+	assert.Equal(t, []string{"2=b", "3=c", "4=d"}, data(b.Since("99")))
+}
@@ -0,0 +1,374 @@
+package websocket
+
+import (
+	"bytes"
+	"compress/flate"
+	"errors"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+	"sync"
+
+	"http-scratch/internal/headers"
+)
+
+var ErrBadCompression = errors.New("websocket compressed data is corrupt")
+
+const (
+	deflateExtension = "permessage-deflate"
+	// rsv1 marks the first frame of a compressed message.
+	rsv1 = 0x40
+
+	defaultThreshold = 128
+	maxWindowBits    = 15
+	minWindowBits    = 8
+)
+
+// deflateTail is the empty stored block ending a sync flush. Senders strip
+// it from every message and receivers put it back (RFC 7692 section 7.2).
+var deflateTail = []byte{0x00, 0x00, 0xff, 0xff}
+
+// finalBlock is an empty final stored block, appended after deflateTail so
+// the flate reader sees a clean end of stream.
+var finalBlock = []byte{0x01, 0x00, 0x00, 0xff, 0xff}
+
+// Compression configures the permessage-deflate extension of RFC 7692.
+//
+// With context takeover, each side reuses what it saw in earlier messages,
+// which compresses chat-like traffic far better but holds state for the
+// whole connection: up to 2^MaxWindowBits bytes of history for inflating,
+// and a flate compressor, a few hundred KB depending on Level, for
+// deflating. Without it that state lives only while a message is processed
+// and is pooled between connections.
+type Compression struct {
+	// Level is the flate level of outgoing messages; zero means
+	// flate.BestSpeed.
+	Level int
+	// Threshold is the size under which messages are sent uncompressed;
+	// zero means 128 bytes.
+	Threshold int
+	// ServerNoContextTakeover and ClientNoContextTakeover turn off context
+	// takeover for the server's and the client's messages.
+	ServerNoContextTakeover bool
+	ClientNoContextTakeover bool
+	// MaxWindowBits, between 8 and 15, limits the window the peer
+	// compresses with, and so the history kept to inflate its messages.
+	// Zero means 15.
+	MaxWindowBits int
+}
+
+// deflate is the negotiated extension as seen from one end.
+type deflate struct {
+	level     int
+	threshold int
+	// compressWrites is false when the peer's window limit is smaller than
+	// compress/flate can honour. Messages are then sent uncompressed,
+	// which the extension always allows.
+	compressWrites bool
+	writeTakeover  bool
+	readTakeover   bool
+	readWindow     int
+
+	// Only used with context takeover.
+	fw      *flate.Writer
+	out     bytes.Buffer
+	history []byte
+}
+
+func (c *Compression) newDeflate() *deflate {
+	d := &deflate{
+		level:          c.Level,
+		threshold:      c.Threshold,
+		compressWrites: true,
+		writeTakeover:  true,
+		readTakeover:   true,
+		readWindow:     1 << maxWindowBits,
+	}
+	if d.level == 0 {
+		d.level = flate.BestSpeed
+	}
+	if d.threshold == 0 {
+		d.threshold = defaultThreshold
+	}
+	return d
+}
+
+// windowBits is the configured limit, if any.
+func (c *Compression) windowBits() int {
+	if c.MaxWindowBits >= minWindowBits && c.MaxWindowBits < maxWindowBits {
+		return c.MaxWindowBits
+	}
+	return maxWindowBits
+}
+
+type extParam struct {
+	name     string
+	value    string
+	hasValue bool
+}
+
+type extension struct {
+	name   string
+	params []extParam
+}
+
+// parseExtensions splits a Sec-WebSocket-Extensions field into its
+// extensions and their parameters.
+func parseExtensions(h headers.Headers) []extension {
+	var exts []extension
+	for _, elem := range h.List("sec-websocket-extensions") {
+		parts := strings.Split(elem, ";")
+		ext := extension{name: strings.ToLower(strings.TrimSpace(parts[0]))}
+		for _, p := range parts[1:] {
+			name, value, hasValue := strings.Cut(p, "=")
+			ext.params = append(ext.params, extParam{
+				name:     strings.ToLower(strings.TrimSpace(name)),
+				value:    strings.Trim(strings.TrimSpace(value), `"`),
+				hasValue: hasValue,
+			})
+		}
+		exts = append(exts, ext)
+	}
+	return exts
+}
+
+func parseWindowBits(p extParam) (int, bool) {
+	n, err := strconv.Atoi(p.value)
+	if err != nil || n < minWindowBits || n > maxWindowBits {
+		return 0, false
+	}
+	return n, true
+}
+
+// accept picks the first offer the server can take and returns the
+// response field for it, or "" when there is none.
+func (c *Compression) accept(offers []extension) (string, *deflate) {
+	for _, offer := range offers {
+		if offer.name != deflateExtension {
+			continue
+		}
+		if resp, d, ok := c.acceptOffer(offer.params); ok {
+			return resp, d
+		}
+	}
+	return "", nil
+}
+
+func (c *Compression) acceptOffer(params []extParam) (string, *deflate, bool) {
+	d := c.newDeflate()
+	d.writeTakeover = !c.ServerNoContextTakeover
+	d.readTakeover = !c.ClientNoContextTakeover
+	serverBits, clientBits := 0, 0
+
+	seen := map[string]bool{}
+	for _, p := range params {
+		if seen[p.name] {
+			return "", nil, false
+		}
+		seen[p.name] = true
+
+		switch p.name {
+		case "server_no_context_takeover":
+			if p.hasValue {
+				return "", nil, false
+			}
+			d.writeTakeover = false
+		case "client_no_context_takeover":
+			if p.hasValue {
+				return "", nil, false
+			}
+			d.readTakeover = false
+		case "server_max_window_bits":
+			bits, ok := parseWindowBits(p)
+			if !ok {
+				return "", nil, false
+			}
+			serverBits = bits
+			d.compressWrites = bits == maxWindowBits
+		case "client_max_window_bits":
+			bits := maxWindowBits
+			if p.hasValue {
+				var ok bool
+				if bits, ok = parseWindowBits(p); !ok {
+					return "", nil, false
+				}
+			}
+			// The client only limits its window when told to
+			clientBits = min(bits, c.windowBits())
+		default:
+			return "", nil, false
+		}
+	}
+
+	resp := []string{deflateExtension}
+	if !d.writeTakeover {
+		resp = append(resp, "server_no_context_takeover")
+	}
+	if !d.readTakeover {
+		resp = append(resp, "client_no_context_takeover")
+	}
+	if serverBits != 0 {
+		resp = append(resp, "server_max_window_bits="+strconv.Itoa(serverBits))
+	}
+	if clientBits != 0 && clientBits < maxWindowBits {
+		resp = append(resp, "client_max_window_bits="+strconv.Itoa(clientBits))
+		d.readWindow = 1 << clientBits
+	}
+	return strings.Join(resp, "; "), d, true
+}
+
+// offer is the client's Sec-WebSocket-Extensions field.
+func (c *Compression) offer() string {
+	offer := []string{deflateExtension, "client_max_window_bits"}
+	if c.ServerNoContextTakeover {
+		offer = append(offer, "server_no_context_takeover")
+	}
+	if c.ClientNoContextTakeover {
+		offer = append(offer, "client_no_context_takeover")
+	}
+	if bits := c.windowBits(); bits < maxWindowBits {
+		offer = append(offer, "server_max_window_bits="+strconv.Itoa(bits))
+	}
+	return strings.Join(offer, "; ")
+}
+
+// confirm checks the server's response to offer. The server may decline,
+// in which case the connection is uncompressed.
+func (c *Compression) confirm(resp []extension) (*deflate, error) {
+	if len(resp) == 0 {
+		return nil, nil
+	}
+	if len(resp) > 1 || resp[0].name != deflateExtension {
+		return nil, fmt.Errorf("%w: server chose an unoffered extension", ErrBadHandshake)
+	}
+
+	d := c.newDeflate()
+	seen := map[string]bool{}
+	for _, p := range resp[0].params {
+		if seen[p.name] {
+			return nil, fmt.Errorf("%w: duplicate extension parameter %s", ErrBadHandshake, p.name)
+		}
+		seen[p.name] = true
+
+		switch p.name {
+		case "server_no_context_takeover":
+			d.readTakeover = false
+		case "client_no_context_takeover":
+			d.writeTakeover = false
+		case "server_max_window_bits":
+			bits, ok := parseWindowBits(p)
+			if !ok || bits > c.windowBits() {
+				return nil, fmt.Errorf("%w: invalid server_max_window_bits", ErrBadHandshake)
+			}
+			d.readWindow = 1 << bits
+		case "client_max_window_bits":
+			bits, ok := parseWindowBits(p)
+			if !ok {
+				return nil, fmt.Errorf("%w: invalid client_max_window_bits", ErrBadHandshake)
+			}
+			d.compressWrites = bits == maxWindowBits
+		default:
+			return nil, fmt.Errorf("%w: unknown extension parameter %s", ErrBadHandshake, p.name)
+		}
+	}
+	return d, nil
+}
+
+func (d *deflate) shouldCompress(n int) bool {
+	return d.compressWrites && n >= d.threshold
+}
+
+// compress deflates one message. The result is only valid until the next
+// call.
+func (d *deflate) compress(p []byte) ([]byte, error) {
+	var out *bytes.Buffer
+	var fw *flate.Writer
+	if d.writeTakeover {
+		if d.fw == nil {
+			var err error
+			if d.fw, err = flate.NewWriter(&d.out, d.level); err != nil {
+				return nil, err
+			}
+		}
+		d.out.Reset()
+		out, fw = &d.out, d.fw
+	} else {
+		out = new(bytes.Buffer)
+		var err error
+		if fw, err = getWriter(d.level, out); err != nil {
+			return nil, err
+		}
+		defer putWriter(d.level, fw)
+	}
+
+	if _, err := fw.Write(p); err != nil {
+		return nil, err
+	}
+	if err := fw.Flush(); err != nil {
+		return nil, err
+	}
+	return bytes.TrimSuffix(out.Bytes(), deflateTail), nil
+}
+
+// decompress inflates one message, refusing to produce more than limit
+// bytes.
+func (d *deflate) decompress(p []byte, limit int64) ([]byte, error) {
+	fr := readerPool.Get().(io.ReadCloser)
+	defer readerPool.Put(fr)
+
+	var dict []byte
+	if d.readTakeover {
+		dict = d.history
+	}
+	src := io.MultiReader(bytes.NewReader(p), bytes.NewReader(deflateTail), bytes.NewReader(finalBlock))
+	if err := fr.(flate.Resetter).Reset(src, dict); err != nil {
+		return nil, err
+	}
+
+	msg, err := io.ReadAll(io.LimitReader(fr, limit+1))
+	if err != nil {
+		return nil, fmt.Errorf("%w: %v", ErrBadCompression, err)
+	}
+	if int64(len(msg)) > limit {
+		return nil, ErrMessageTooBig
+	}
+	if d.readTakeover {
+		d.remember(msg)
+	}
+	return msg, nil
+}
+
+// remember keeps the last readWindow bytes inflated, the most the peer's
+// next message can refer back to.
+func (d *deflate) remember(msg []byte) {
+	if len(msg) > d.readWindow {
+		msg = msg[len(msg)-d.readWindow:]
+	}
+	d.history = append(d.history, msg...)
+	if over := len(d.history) - d.readWindow; over > 0 {
+		n := copy(d.history, d.history[over:])
+		d.history = d.history[:n]
+	}
+}
+
+var (
+	readerPool  = sync.Pool{New: func() any { return flate.NewReader(nil) }}
+	writerPools [flate.BestCompression - flate.HuffmanOnly + 1]sync.Pool
+)
+
+func getWriter(level int, w io.Writer) (*flate.Writer, error) {
+	if level < flate.HuffmanOnly || level > flate.BestCompression {
+		return nil, fmt.Errorf("websocket: invalid compression level %d", level)
+	}
+	if fw, ok := writerPools[level-flate.HuffmanOnly].Get().(*flate.Writer); ok {
+		fw.Reset(w)
+		return fw, nil
+	}
+	return flate.NewWriter(w, level)
+}
+
+func putWriter(level int, fw *flate.Writer) {
+	fw.Reset(nil)
+	writerPools[level-flate.HuffmanOnly].Put(fw)
+}
@@ -0,0 +1,479 @@
+package websocket
+
+import (
+	"bufio"
+	"crypto/rand"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"sync"
+	"time"
+	"unicode/utf8"
+)
+
+var (
+	ErrProtocol       = errors.New("websocket protocol violation")
+	ErrMessageTooBig  = errors.New("websocket message too big")
+	ErrInvalidUTF8    = errors.New("websocket text is not valid UTF-8")
+	ErrClosed         = errors.New("websocket connection closed")
+	ErrControlTooLong = errors.New("websocket control payload longer than 125 bytes")
+)
+
+type MessageType int
+
+const (
+	TextMessage   MessageType = 1
+	BinaryMessage MessageType = 2
+)
+
+// Frame opcodes, RFC 6455 section 5.2.
+const (
+	opContinuation = 0x0
+	opText         = 0x1
+	opBinary       = 0x2
+	opClose        = 0x8
+	opPing         = 0x9
+	opPong         = 0xa
+)
+
+// Close codes, RFC 6455 section 7.4.1.
+const (
+	CloseNormal             = 1000
+	CloseGoingAway          = 1001
+	CloseProtocolError      = 1002
+	CloseUnsupportedData    = 1003
+	CloseNoStatus           = 1005
+	CloseAbnormal           = 1006
+	CloseInvalidPayload     = 1007
+	ClosePolicyViolation    = 1008
+	CloseMessageTooBig      = 1009
+	CloseMandatoryExtension = 1010
+	CloseInternalError      = 1011
+)
+
+const (
+	defaultMaxMessageSize = 16 << 20
+	defaultCloseTimeout   = 5 * time.Second
+	maxControlPayload     = 125
+)
+
+// CloseError is what ReadMessage returns once the peer has closed the
+// connection. Code is CloseNoStatus when the close frame had no code.
+type CloseError struct {
+	Code   int
+	Reason string
+}
+
+func (e *CloseError) Error() string {
+	if e.Reason == "" {
+		return fmt.Sprintf("websocket closed: %d", e.Code)
+	}
+	return fmt.Sprintf("websocket closed: %d %s", e.Code, e.Reason)
+}
+
+// Conn is a WebSocket connection. One goroutine may read while others
+// write; writes are serialized.
+type Conn struct {
+	conn        net.Conn
+	br          *bufio.Reader
+	server      bool
+	subprotocol string
+
+	maxMessageSize int64
+	fragmentSize   int
+	closeTimeout   time.Duration
+
+	readMu  sync.Mutex
+	readErr error
+
+	writeMu   sync.Mutex
+	closeSent bool
+
+	closeOnce  sync.Once
+	peerClosed chan struct{}
+
+	// deflate is nil unless permessage-deflate was negotiated.
+	deflate *deflate
+}
+
+type connConfig struct {
+	maxMessageSize int64
+	fragmentSize   int
+	closeTimeout   time.Duration
+	deflate        *deflate
+}
+
+func newConn(conn net.Conn, br *bufio.Reader, server bool, subprotocol string, cfg connConfig) *Conn {
+	if cfg.maxMessageSize <= 0 {
+		cfg.maxMessageSize = defaultMaxMessageSize
+	}
+	if cfg.closeTimeout <= 0 {
+		cfg.closeTimeout = defaultCloseTimeout
+	}
+	return &Conn{
+		conn:           conn,
+		br:             br,
+		server:         server,
+		subprotocol:    subprotocol,
+		maxMessageSize: cfg.maxMessageSize,
+		fragmentSize:   cfg.fragmentSize,
+		closeTimeout:   cfg.closeTimeout,
+		peerClosed:     make(chan struct{}),
+		deflate:        cfg.deflate,
+	}
+}
+
+// Subprotocol is the subprotocol agreed on during the handshake, "" for
+// none.
+func (c *Conn) Subprotocol() string {
+	return c.subprotocol
+}
+
+func (c *Conn) RemoteAddr() net.Addr {
+	return c.conn.RemoteAddr()
+}
+
+// Compressed reports whether permessage-deflate was negotiated.
+func (c *Conn) Compressed() bool {
+	return c.deflate != nil
+}
+
+type frame struct {
+	fin     bool
+	rsv     byte
+	opcode  byte
+	payload []byte
+}
+
+// readFrame reads one frame, refusing payloads longer than limit.
+func (c *Conn) readFrame(limit int64) (frame, error) {
+	var hdr [8]byte
+	if _, err := io.ReadFull(c.br, hdr[:2]); err != nil {
+		return frame{}, err
+	}
+
+	f := frame{
+		fin:    hdr[0]&0x80 != 0,
+		rsv:    hdr[0] & 0x70,
+		opcode: hdr[0] & 0x0f,
+	}
+	masked := hdr[1]&0x80 != 0
+	length := int64(hdr[1] & 0x7f)
+
+	switch f.opcode {
+	case opContinuation, opText, opBinary:
+	case opClose, opPing, opPong:
+		if !f.fin || length > maxControlPayload {
+			return frame{}, ErrProtocol
+		}
+		// Control frames have their own limit, whatever the message so far
+		limit = maxControlPayload
+	default:
+		return frame{}, ErrProtocol
+	}
+	// RSV1 is only defined by permessage-deflate, and only on the first
+	// frame of a message
+	if f.rsv != 0 && (f.rsv != rsv1 || c.deflate == nil || (f.opcode != opText && f.opcode != opBinary)) {
+		return frame{}, ErrProtocol
+	}
+	// Clients always mask, servers never do
+	if masked != c.server {
+		return frame{}, ErrProtocol
+	}
+
+	switch length {
+	case 126:
+		if _, err := io.ReadFull(c.br, hdr[:2]); err != nil {
+			return frame{}, err
+		}
+		length = int64(binary.BigEndian.Uint16(hdr[:2]))
+	case 127:
+		if _, err := io.ReadFull(c.br, hdr[:8]); err != nil {
+			return frame{}, err
+		}
+		if hdr[0]&0x80 != 0 {
+			return frame{}, ErrProtocol
+		}
+		length = int64(binary.BigEndian.Uint64(hdr[:8]))
+	}
+	if length > limit {
+		return frame{}, ErrMessageTooBig
+	}
+
+	var key [4]byte
+	if masked {
+		if _, err := io.ReadFull(c.br, key[:]); err != nil {
+			return frame{}, err
+		}
+	}
+	f.payload = make([]byte, length)
+	if _, err := io.ReadFull(c.br, f.payload); err != nil {
+		return frame{}, err
+	}
+	if masked {
+		mask(key, f.payload)
+	}
+	return f, nil
+}
+
+func mask(key [4]byte, b []byte) {
+	for i := range b {
+		b[i] ^= key[i%4]
+	}
+}
+
+// ReadMessage returns the next data message, answering pings and
+// reassembling fragments along the way. After the peer closes it returns
+// a *CloseError; after a protocol violation it closes the connection with
+// the matching code and returns the violation. Every later call returns
+// the same error.
+func (c *Conn) ReadMessage() (MessageType, []byte, error) {
+	c.readMu.Lock()
+	defer c.readMu.Unlock()
+
+	if c.readErr != nil {
+		return 0, nil, c.readErr
+	}
+
+	var typ MessageType
+	msg := []byte{}
+	started, compressed := false, false
+	for {
+		f, err := c.readFrame(c.maxMessageSize - int64(len(msg)))
+		if err != nil {
+			return 0, nil, c.fail(err)
+		}
+
+		switch f.opcode {
+		case opPing:
+			if err := c.writeFrame(opPong, true, f.payload); err != nil && !errors.Is(err, ErrClosed) {
+				return 0, nil, c.fail(err)
+			}
+			continue
+		case opPong:
+			continue
+		case opClose:
+			return 0, nil, c.handleClose(f.payload)
+		case opContinuation:
+			if !started {
+				return 0, nil, c.fail(ErrProtocol)
+			}
+		default:
+			if started {
+				return 0, nil, c.fail(ErrProtocol)
+			}
+			started = true
+			compressed = f.rsv&rsv1 != 0
+			typ = MessageType(f.opcode)
+		}
+
+		msg = append(msg, f.payload...)
+		if f.fin {
+			if compressed {
+				if msg, err = c.deflate.decompress(msg, c.maxMessageSize); err != nil {
+					return 0, nil, c.fail(err)
+				}
+			}
+			if typ == TextMessage && !utf8.Valid(msg) {
+				return 0, nil, c.fail(ErrInvalidUTF8)
+			}
+			return typ, msg, nil
+		}
+	}
+}
+
+// handleClose answers the peer's close frame, if we haven't sent ours yet,
+// and closes the connection.
+func (c *Conn) handleClose(payload []byte) error {
+	code, reason := CloseNoStatus, ""
+	switch {
+	case len(payload) == 1:
+		return c.fail(ErrProtocol)
+	case len(payload) >= 2:
+		code = int(binary.BigEndian.Uint16(payload))
+		reason = string(payload[2:])
+		if !validCloseCode(code) {
+			return c.fail(ErrProtocol)
+		}
+		if !utf8.ValidString(reason) {
+			return c.fail(ErrInvalidUTF8)
+		}
+	}
+
+	reply := []byte{}
+	if code != CloseNoStatus {
+		reply = binary.BigEndian.AppendUint16(nil, uint16(code))
+	}
+	c.writeFrame(opClose, true, reply)
+	c.closeOnce.Do(func() { close(c.peerClosed) })
+	c.conn.Close()
+
+	c.readErr = &CloseError{Code: code, Reason: reason}
+	return c.readErr
+}
+
+// fail ends the connection after a read error, telling the peer why when
+// it is the peer's fault.
+func (c *Conn) fail(err error) error {
+	code := 0
+	switch {
+	case errors.Is(err, ErrProtocol):
+		code = CloseProtocolError
+	case errors.Is(err, ErrMessageTooBig):
+		code = CloseMessageTooBig
+	case errors.Is(err, ErrInvalidUTF8), errors.Is(err, ErrBadCompression):
+		code = CloseInvalidPayload
+	}
+	if code != 0 {
+		c.writeFrame(opClose, true, closePayload(code, ""))
+	}
+	c.conn.Close()
+	c.readErr = err
+	return err
+}
+
+func validCloseCode(code int) bool {
+	switch {
+	case code >= 1000 && code <= 1003, code >= 1007 && code <= 1014:
+		return true
+	case code >= 3000 && code <= 4999:
+		return true
+	}
+	return false
+}
+
+func closePayload(code int, reason string) []byte {
+	return append(binary.BigEndian.AppendUint16(nil, uint16(code)), reason...)
+}
+
+// WriteMessage sends data as one message, split into frames of at most
+// the configured fragment size. With permessage-deflate the message is
+// compressed first, unless it is below the compression threshold.
+func (c *Conn) WriteMessage(typ MessageType, data []byte) error {
+	if typ != TextMessage && typ != BinaryMessage {
+		return fmt.Errorf("websocket: unknown message type %d", typ)
+	}
+	if typ == TextMessage && !utf8.Valid(data) {
+		return ErrInvalidUTF8
+	}
+
+	c.writeMu.Lock()
+	defer c.writeMu.Unlock()
+
+	opcode := byte(typ)
+	if c.deflate != nil && c.deflate.shouldCompress(len(data)) {
+		compressed, err := c.deflate.compress(data)
+		if err != nil {
+			return err
+		}
+		data = compressed
+		opcode |= rsv1
+	}
+	for {
+		chunk := data
+		if c.fragmentSize > 0 && len(chunk) > c.fragmentSize {
+			chunk = chunk[:c.fragmentSize]
+		}
+		data = data[len(chunk):]
+		if err := c.writeFrameLocked(opcode, len(data) == 0, chunk); err != nil {
+			return err
+		}
+		if len(data) == 0 {
+			return nil
+		}
+		opcode = opContinuation
+	}
+}
+
+func (c *Conn) Ping(data []byte) error {
+	if len(data) > maxControlPayload {
+		return ErrControlTooLong
+	}
+	return c.writeFrame(opPing, true, data)
+}
+
+func (c *Conn) writeFrame(opcode byte, fin bool, payload []byte) error {
+	c.writeMu.Lock()
+	defer c.writeMu.Unlock()
+	return c.writeFrameLocked(opcode, fin, payload)
+}
+
+// writeFrameLocked writes one frame; opcode may carry rsv1.
+func (c *Conn) writeFrameLocked(opcode byte, fin bool, payload []byte) error {
+	if c.closeSent {
+		return ErrClosed
+	}
+	if opcode == opClose {
+		c.closeSent = true
+	}
+
+	b0 := opcode
+	if fin {
+		b0 |= 0x80
+	}
+	buf := []byte{b0, 0}
+	switch n := len(payload); {
+	case n <= 125:
+		buf[1] = byte(n)
+	case n <= 0xffff:
+		buf[1] = 126
+		buf = binary.BigEndian.AppendUint16(buf, uint16(n))
+	default:
+		buf[1] = 127
+		buf = binary.BigEndian.AppendUint64(buf, uint64(n))
+	}
+
+	if c.server {
+		buf = append(buf, payload...)
+	} else {
+		var key [4]byte
+		if _, err := rand.Read(key[:]); err != nil {
+			return err
+		}
+		buf[1] |= 0x80
+		buf = append(buf, key[:]...)
+		start := len(buf)
+		buf = append(buf, payload...)
+		mask(key, buf[start:])
+	}
+
+	_, err := c.conn.Write(buf)
+	return err
+}
+
+// Close runs the closing handshake: it sends a close frame with code and
+// reason, waits a while for the peer's, then closes the connection.
+func (c *Conn) Close(code int, reason string) error {
+	if len(reason) > maxControlPayload-2 {
+		return ErrControlTooLong
+	}
+	err := c.writeFrame(opClose, true, closePayload(code, reason))
+	if errors.Is(err, ErrClosed) {
+		return c.conn.Close()
+	}
+
+	if c.readMu.TryLock() {
+		// Nobody is reading, so wait for the peer's close frame ourselves
+		c.conn.SetReadDeadline(time.Now().Add(c.closeTimeout))
+		for c.readErr == nil {
+			f, err := c.readFrame(c.maxMessageSize)
+			if err != nil {
+				c.readErr = ErrClosed
+				break
+			}
+			if f.opcode == opClose {
+				c.closeOnce.Do(func() { close(c.peerClosed) })
+				c.readErr = ErrClosed
+			}
+		}
+		c.readMu.Unlock()
+	} else {
+		select {
+		case <-c.peerClosed:
+		case <-time.After(c.closeTimeout):
+		}
+	}
+	return c.conn.Close()
+}
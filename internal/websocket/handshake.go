@@ -0,0 +1,317 @@
+package websocket
+
+import (
+	"bufio"
+	"crypto/rand"
+	"crypto/sha1"
+	"crypto/tls"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"net"
+	"net/url"
+	"strings"
+	"time"
+
+	"http-scratch/internal/client"
+	"http-scratch/internal/headers"
+	"http-scratch/internal/problem"
+	"http-scratch/internal/request"
+	"http-scratch/internal/response"
+)
+
+var (
+	ErrBadHandshake = errors.New("bad websocket handshake")
+	ErrBadOrigin    = errors.New("websocket origin not allowed")
+)
+
+// acceptGUID is the fixed GUID of RFC 6455 section 1.3.
+const acceptGUID = "258EAFA5-E914-47DA-95CA-C5AB0DC85B11"
+
+func acceptKey(key string) string {
+	h := sha1.Sum([]byte(key + acceptGUID))
+	return base64.StdEncoding.EncodeToString(h[:])
+}
+
+// Upgrader turns requests into WebSocket connections on the server side.
+type Upgrader struct {
+	// Subprotocols the server speaks, most preferred first. The first one
+	// the client also offers is selected.
+	Subprotocols []string
+	// CheckOrigin decides whether a browser on another origin may connect.
+	// When nil, an Origin field must match the Host field.
+	CheckOrigin func(req *request.Request) bool
+	// MaxMessageSize bounds incoming messages; zero means 16MB.
+	MaxMessageSize int64
+	// FragmentSize splits outgoing messages into frames of at most that
+	// many bytes; zero sends every message in a single frame.
+	FragmentSize int
+	// CloseTimeout bounds the wait for the peer's close frame; zero means
+	// 5s.
+	CloseTimeout time.Duration
+	// Compression enables permessage-deflate when the client offers it;
+	// nil leaves connections uncompressed.
+	Compression *Compression
+}
+
+// Upgrade validates the opening handshake, takes the connection over and
+// answers 101 Switching Protocols. When the handshake is invalid it
+// responds with an error itself, so the handler only has to return. The
+// server must let the handler have such requests, see
+// server.Server.PassUpgrade.
+func (u *Upgrader) Upgrade(w *response.Writer, req *request.Request) (*Conn, error) {
+	key, status, err := u.check(req)
+	if err != nil {
+		h := headers.NewHeaders()
+		if status == response.StatusUpgradeRequired {
+			h.Set("Sec-WebSocket-Version", "13")
+			h.Set("Upgrade", "websocket")
+		}
+		problem.Write(w, req, problem.New(status, err.Error()), h)
+		return nil, err
+	}
+
+	subprotocol := u.selectSubprotocol(req)
+	var extensions string
+	var d *deflate
+	if u.Compression != nil {
+		extensions, d = u.Compression.accept(parseExtensions(req.Headers))
+	}
+
+	// Take the connection over before answering, so whatever the client
+	// sends right after the 101 is never seen by the server.
+	netConn, br, err := w.Hijack()
+	if err != nil {
+		return nil, err
+	}
+
+	h := headers.NewHeaders()
+	h.Set("Upgrade", "websocket")
+	h.Set("Connection", "Upgrade")
+	h.Set("Sec-WebSocket-Accept", acceptKey(key))
+	if subprotocol != "" {
+		h.Set("Sec-WebSocket-Protocol", subprotocol)
+	}
+	if extensions != "" {
+		h.Set("Sec-WebSocket-Extensions", extensions)
+	}
+	rw := response.NewWriter(netConn)
+	if err := rw.WriteStatusLine(response.StatusSwitchingProtocols); err != nil {
+		netConn.Close()
+		return nil, err
+	}
+	if err := rw.WriteHeaders(h); err != nil {
+		netConn.Close()
+		return nil, err
+	}
+
+	return newConn(netConn, br, true, subprotocol, connConfig{
+		maxMessageSize: u.MaxMessageSize,
+		fragmentSize:   u.FragmentSize,
+		closeTimeout:   u.CloseTimeout,
+		deflate:        d,
+	}), nil
+}
+
+// check validates the handshake fields of RFC 6455 section 4.2.1 and
+// returns the client's key, or the status to refuse it with.
+func (u *Upgrader) check(req *request.Request) (string, response.StatusCode, error) {
+	if req.RequestLine.Method != "GET" {
+		return "", response.StatusMethodNotAllowed, fmt.Errorf("%w: method must be GET", ErrBadHandshake)
+	}
+	if !hasToken(req.Headers.List("connection"), "upgrade") || !hasToken(req.Headers.List("upgrade"), "websocket") {
+		return "", response.StatusBadRequest, fmt.Errorf("%w: not a websocket upgrade", ErrBadHandshake)
+	}
+	if v, _ := req.Headers.Get("sec-websocket-version"); strings.TrimSpace(v) != "13" {
+		return "", response.StatusUpgradeRequired, fmt.Errorf("%w: unsupported version", ErrBadHandshake)
+	}
+
+	key, _ := req.Headers.Get("sec-websocket-key")
+	key = strings.TrimSpace(key)
+	if decoded, err := base64.StdEncoding.DecodeString(key); err != nil || len(decoded) != 16 {
+		return "", response.StatusBadRequest, fmt.Errorf("%w: invalid Sec-WebSocket-Key", ErrBadHandshake)
+	}
+
+	checkOrigin := u.CheckOrigin
+	if checkOrigin == nil {
+		checkOrigin = sameOrigin
+	}
+	if !checkOrigin(req) {
+		return "", response.StatusForbidden, fmt.Errorf("%w: %w", ErrBadHandshake, ErrBadOrigin)
+	}
+	return key, 0, nil
+}
+
+func (u *Upgrader) selectSubprotocol(req *request.Request) string {
+	offered := req.Headers.List("sec-websocket-protocol")
+	for _, p := range u.Subprotocols {
+		for _, o := range offered {
+			if o == p {
+				return p
+			}
+		}
+	}
+	return ""
+}
+
+// sameOrigin accepts requests without an Origin field, which don't come
+// from browsers, and those whose Origin host is the Host they connect to.
+func sameOrigin(req *request.Request) bool {
+	origin, ok := req.Headers.Get("origin")
+	if !ok {
+		return true
+	}
+	u, err := url.Parse(origin)
+	if err != nil {
+		return false
+	}
+	host, _ := req.Headers.Get("host")
+	return strings.EqualFold(u.Host, host)
+}
+
+func hasToken(list []string, token string) bool {
+	for _, v := range list {
+		if strings.EqualFold(strings.TrimSpace(v), token) {
+			return true
+		}
+	}
+	return false
+}
+
+// Dialer opens WebSocket connections as a client.
+type Dialer struct {
+	// Subprotocols offered to the server, most preferred first.
+	Subprotocols []string
+	// Header holds extra handshake fields, like Origin or Authorization.
+	Header    headers.Headers
+	TLSConfig *tls.Config
+	// Timeout bounds connecting and the handshake; zero means no limit.
+	Timeout        time.Duration
+	MaxMessageSize int64
+	FragmentSize   int
+	CloseTimeout   time.Duration
+	// Compression offers permessage-deflate to the server.
+	Compression *Compression
+}
+
+// Dial connects to a ws:// or wss:// URL and runs the opening handshake.
+func (d *Dialer) Dial(rawURL string) (*Conn, error) {
+	u, err := url.Parse(rawURL)
+	if err != nil || u.Host == "" {
+		return nil, fmt.Errorf("%w: invalid URL %q", ErrBadHandshake, rawURL)
+	}
+
+	addr := u.Host
+	if u.Port() == "" {
+		port := "80"
+		if u.Scheme == "wss" {
+			port = "443"
+		}
+		addr = net.JoinHostPort(u.Hostname(), port)
+	}
+
+	dialer := &net.Dialer{Timeout: d.Timeout}
+	var netConn net.Conn
+	switch u.Scheme {
+	case "ws":
+		netConn, err = dialer.Dial("tcp", addr)
+	case "wss":
+		cfg := d.TLSConfig.Clone()
+		if cfg == nil {
+			cfg = &tls.Config{}
+		}
+		if cfg.ServerName == "" {
+			cfg.ServerName = u.Hostname()
+		}
+		netConn, err = tls.DialWithDialer(dialer, "tcp", addr, cfg)
+	default:
+		return nil, fmt.Errorf("%w: unsupported scheme %q", ErrBadHandshake, u.Scheme)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	if d.Timeout > 0 {
+		netConn.SetDeadline(time.Now().Add(d.Timeout))
+	}
+	c, err := d.handshake(netConn, u)
+	if err != nil {
+		netConn.Close()
+		return nil, err
+	}
+	netConn.SetDeadline(time.Time{})
+	return c, nil
+}
+
+func (d *Dialer) handshake(netConn net.Conn, u *url.URL) (*Conn, error) {
+	raw := make([]byte, 16)
+	if _, err := rand.Read(raw); err != nil {
+		return nil, err
+	}
+	key := base64.StdEncoding.EncodeToString(raw)
+
+	var b strings.Builder
+	b.WriteString("GET " + u.RequestURI() + " HTTP/1.1\r\n")
+	b.WriteString("Host: " + u.Host + "\r\n")
+	b.WriteString("Upgrade: websocket\r\nConnection: Upgrade\r\n")
+	b.WriteString("Sec-WebSocket-Key: " + key + "\r\nSec-WebSocket-Version: 13\r\n")
+	if len(d.Subprotocols) > 0 {
+		b.WriteString("Sec-WebSocket-Protocol: " + strings.Join(d.Subprotocols, ", ") + "\r\n")
+	}
+	if d.Compression != nil {
+		b.WriteString("Sec-WebSocket-Extensions: " + d.Compression.offer() + "\r\n")
+	}
+	d.Header.ForEach(func(n, v string) {
+		b.WriteString(n + ": " + v + "\r\n")
+	})
+	b.WriteString("\r\n")
+	if _, err := netConn.Write([]byte(b.String())); err != nil {
+		return nil, err
+	}
+
+	br := bufio.NewReader(netConn)
+	status, h, err := readResponseHead(br)
+	if err != nil {
+		return nil, err
+	}
+	if status != response.StatusSwitchingProtocols {
+		return nil, fmt.Errorf("%w: server answered %d", ErrBadHandshake, status)
+	}
+	if !hasToken(h.List("upgrade"), "websocket") || !hasToken(h.List("connection"), "upgrade") {
+		return nil, fmt.Errorf("%w: missing upgrade fields", ErrBadHandshake)
+	}
+	if accept, _ := h.Get("sec-websocket-accept"); accept != acceptKey(key) {
+		return nil, fmt.Errorf("%w: wrong Sec-WebSocket-Accept", ErrBadHandshake)
+	}
+
+	subprotocol, _ := h.Get("sec-websocket-protocol")
+	if subprotocol != "" && !hasToken(d.Subprotocols, subprotocol) {
+		return nil, fmt.Errorf("%w: server chose an unoffered subprotocol", ErrBadHandshake)
+	}
+
+	exts := parseExtensions(h)
+	var dfl *deflate
+	if d.Compression != nil {
+		var err error
+		if dfl, err = d.Compression.confirm(exts); err != nil {
+			return nil, err
+		}
+	} else if len(exts) > 0 {
+		return nil, fmt.Errorf("%w: server chose an unoffered extension", ErrBadHandshake)
+	}
+
+	return newConn(netConn, br, false, subprotocol, connConfig{
+		maxMessageSize: d.MaxMessageSize,
+		fragmentSize:   d.FragmentSize,
+		closeTimeout:   d.CloseTimeout,
+		deflate:        dfl,
+	}), nil
+}
+
+func readResponseHead(br *bufio.Reader) (response.StatusCode, headers.Headers, error) {
+	sl, h, err := client.ReadHead(br)
+	if err != nil {
+		return 0, nil, fmt.Errorf("%w: %v", ErrBadHandshake, err)
+	}
+	return sl.StatusCode, h, nil
+}
@@ -0,0 +1,398 @@
+package websocket
+
+import (
+	"bufio"
+	"bytes"
+	"compress/flate"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"http-scratch/internal/headers"
+	"http-scratch/internal/request"
+	"http-scratch/internal/response"
+	"http-scratch/internal/server"
+)
+
+// echoServer upgrades every request and echoes messages back until the
+// client closes. The close error it saw is sent on closed.
+func echoServer(t *testing.T, u *Upgrader) (string, chan error) {
+	t.Helper()
+	closed := make(chan error, 1)
+	s, err := server.Serve(0, func(w *response.Writer, req *request.Request) {
+		c, err := u.Upgrade(w, req)
+		if err != nil {
+			return
+		}
+		for {
+			typ, msg, err := c.ReadMessage()
+			if err != nil {
+				closed <- err
+				return
+			}
+			if err := c.WriteMessage(typ, msg); err != nil {
+				closed <- err
+				return
+			}
+		}
+	})
+	require.NoError(t, err)
+	s.PassUpgrade("websocket")
+	t.Cleanup(func() { s.Close() })
+	return fmt.Sprintf("ws://127.0.0.1:%d/chat", s.Addr().(*net.TCPAddr).Port), closed
+}
+
+func TestEcho(t *testing.T) {
+	url, closed := echoServer(t, &Upgrader{Subprotocols: []string{"chat.v2", "chat.v1"}})
+
+	d := &Dialer{Subprotocols: []string{"chat.v1", "chat.v2"}, FragmentSize: 7, Timeout: time.Second}
+	c, err := d.Dial(url)
+	require.NoError(t, err)
+
+	// Test: The server's preference wins
+	assert.Equal(t, "chat.v2", c.Subprotocol())
+
+	// Test: Text, binary, fragmented and long messages
+	big := bytes.Repeat([]byte("0123456789"), 10_000)
+	d.FragmentSize = 0
+	for _, m := range []struct {
+		typ  MessageType
+		data []byte
+	}{
+		{TextMessage, []byte("héllo, wörld — split over several frames")},
+		{BinaryMessage, []byte{0, 1, 2, 0xff}},
+		{TextMessage, []byte{}},
+		{BinaryMessage, big},
+	} {
+		require.NoError(t, c.WriteMessage(m.typ, m.data))
+		typ, data, err := c.ReadMessage()
+		require.NoError(t, err)
+		assert.Equal(t, m.typ, typ)
+		assert.Equal(t, m.data, data)
+	}
+
+	// Test: Pings are answered without surfacing as messages
+	require.NoError(t, c.Ping([]byte("are you there")))
+	require.NoError(t, c.WriteMessage(TextMessage, []byte("after ping")))
+	_, data, err := c.ReadMessage()
+	require.NoError(t, err)
+	assert.Equal(t, "after ping", string(data))
+
+	// Test: Invalid text is refused on the way out
+	assert.ErrorIs(t, c.WriteMessage(TextMessage, []byte{0xff}), ErrInvalidUTF8)
+
+	// Test: Closing handshake
+	require.NoError(t, c.Close(CloseGoingAway, "bye"))
+	select {
+	case err := <-closed:
+		var cerr *CloseError
+		require.ErrorAs(t, err, &cerr)
+		assert.Equal(t, CloseGoingAway, cerr.Code)
+		assert.Equal(t, "bye", cerr.Reason)
+	case <-time.After(time.Second):
+		t.Fatal("server never saw the close")
+	}
+	assert.ErrorIs(t, c.WriteMessage(TextMessage, []byte("late")), ErrClosed)
+}
+
+func TestHandshakeRejected(t *testing.T) {
+	const valid = "GET /chat HTTP/1.1\r\nHost: example.com\r\nUpgrade: websocket\r\nConnection: keep-alive, Upgrade\r\n" +
+		"Sec-WebSocket-Key: dGhlIHNhbXBsZSBub25jZQ==\r\n"
+
+	cases := []struct {
+		name   string
+		raw    string
+		status int
+	}{
+		{"wrong version", valid + "Sec-WebSocket-Version: 8\r\n", http.StatusUpgradeRequired},
+		{"bad key", strings.Replace(valid, "dGhlIHNhbXBsZSBub25jZQ==", "short", 1) + "Sec-WebSocket-Version: 13\r\n", http.StatusBadRequest},
+		{"no upgrade", strings.Replace(valid, "Upgrade: websocket\r\n", "", 1) + "Sec-WebSocket-Version: 13\r\n", http.StatusBadRequest},
+		{"other origin", valid + "Sec-WebSocket-Version: 13\r\nOrigin: https://evil.example\r\n", http.StatusForbidden},
+	}
+	for _, c := range cases {
+		req, err := request.RequestFromReader(strings.NewReader(c.raw + "\r\n"))
+		require.NoError(t, err, c.name)
+
+		var buf bytes.Buffer
+		_, err = (&Upgrader{}).Upgrade(response.NewWriter(&buf), req)
+		require.ErrorIs(t, err, ErrBadHandshake, c.name)
+
+		res, err := http.ReadResponse(bufio.NewReader(&buf), nil)
+		require.NoError(t, err, c.name)
+		assert.Equal(t, c.status, res.StatusCode, c.name)
+		if c.status == http.StatusUpgradeRequired {
+			assert.Equal(t, "13", res.Header.Get("Sec-WebSocket-Version"))
+		}
+	}
+
+	// Test: The dialer reads response heads with the client's parser
+	status, h, err := readResponseHead(bufio.NewReader(strings.NewReader("HTTP/1.1 101 Switching Protocols\r\nUpgrade: websocket\r\n\r\n")))
+	require.NoError(t, err)
+	assert.Equal(t, response.StatusSwitchingProtocols, status)
+	assert.Equal(t, []string{"websocket"}, h.List("upgrade"))
+	for _, bad := range []string{"HTTP/1.1 1010 Odd\r\n\r\n", "HTTP/1.1 101x\r\n\r\n", "ICY 101 OK\r\n\r\n"} {
+		_, _, err = readResponseHead(bufio.NewReader(strings.NewReader(bad)))
+		assert.ErrorIs(t, err, ErrBadHandshake, bad)
+	}
+
+	// Test: Accept key from RFC 6455 section 1.3
+	assert.Equal(t, "s3pPLMBiTxaQ9kYGzzhZRbK+xOo=", acceptKey("dGhlIHNhbXBsZSBub25jZQ=="))
+}
+
+// clientFrame builds a masked frame as a client would send it.
+func clientFrame(b0 byte, payload []byte) []byte {
+	key := [4]byte{1, 2, 3, 4}
+	buf := []byte{b0, 0x80 | byte(len(payload))}
+	buf = append(buf, key[:]...)
+	masked := bytes.Clone(payload)
+	mask(key, masked)
+	return append(buf, masked...)
+}
+
+// serverPipe returns a server-side Conn and the client end of the pipe.
+func serverPipe(maxMessageSize int64) (*Conn, net.Conn) {
+	srv, cli := net.Pipe()
+	return newConn(srv, bufio.NewReader(srv), true, "", connConfig{maxMessageSize: maxMessageSize}), cli
+}
+
+// readServerFrame reads one unmasked frame from the server.
+func readServerFrame(t *testing.T, r io.Reader) (byte, []byte) {
+	t.Helper()
+	hdr := make([]byte, 2)
+	_, err := io.ReadFull(r, hdr)
+	require.NoError(t, err)
+	require.Zero(t, hdr[1]&0x80, "server frames are never masked")
+	payload := make([]byte, hdr[1]&0x7f)
+	_, err = io.ReadFull(r, payload)
+	require.NoError(t, err)
+	return hdr[0] & 0x0f, payload
+}
+
+func TestFraming(t *testing.T) {
+	// Test: Control frames interleaved with fragments
+	c, cli := serverPipe(0)
+	go cli.Write(bytes.Join([][]byte{
+		clientFrame(opText, []byte("Hel")),
+		clientFrame(0x80|opPing, []byte("p")),
+		clientFrame(0x80|opContinuation, []byte("lo")),
+	}, nil))
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		typ, data, err := c.ReadMessage()
+		assert.NoError(t, err)
+		assert.Equal(t, TextMessage, typ)
+		assert.Equal(t, "Hello", string(data))
+	}()
+	op, payload := readServerFrame(t, cli)
+	assert.Equal(t, byte(opPong), op)
+	assert.Equal(t, "p", string(payload))
+	<-done
+
+	// Test: A ping doesn't count toward the message it interrupts
+	c, cli = serverPipe(10)
+	go cli.Write(bytes.Join([][]byte{
+		clientFrame(opBinary, make([]byte, 10)),
+		clientFrame(0x80|opPing, []byte("ping")),
+		clientFrame(0x80|opContinuation, nil),
+	}, nil))
+	done = make(chan struct{})
+	go func() {
+		defer close(done)
+		_, data, err := c.ReadMessage()
+		assert.NoError(t, err)
+		assert.Len(t, data, 10)
+	}()
+	op, payload = readServerFrame(t, cli)
+	assert.Equal(t, byte(opPong), op)
+	assert.Equal(t, "ping", string(payload))
+	<-done
+
+	// Test: Violations close the connection with the matching code
+	violations := []struct {
+		name  string
+		input []byte
+		code  int
+		err   error
+	}{
+		{"unmasked", []byte{0x80 | opText, 1, 'x'}, CloseProtocolError, ErrProtocol},
+		{"reserved bits", clientFrame(0xa0|opText, []byte("x")), CloseProtocolError, ErrProtocol},
+		{"compressed without deflate", clientFrame(0xc0|opText, []byte("x")), CloseProtocolError, ErrProtocol},
+		{"unknown opcode", clientFrame(0x80|0x3, nil), CloseProtocolError, ErrProtocol},
+		{"fragmented control", clientFrame(opPing, nil), CloseProtocolError, ErrProtocol},
+		{"orphan continuation", clientFrame(0x80|opContinuation, []byte("x")), CloseProtocolError, ErrProtocol},
+		{"new message mid-fragment", append(clientFrame(opText, []byte("a")), clientFrame(0x80|opText, []byte("b"))...), CloseProtocolError, ErrProtocol},
+		{"bad utf-8", clientFrame(0x80|opText, []byte{0xc3, 0x28}), CloseInvalidPayload, ErrInvalidUTF8},
+		{"too big", clientFrame(0x80|opBinary, make([]byte, 11)), CloseMessageTooBig, ErrMessageTooBig},
+		{"bad close code", clientFrame(0x80|opClose, binary.BigEndian.AppendUint16(nil, 1005)), CloseProtocolError, ErrProtocol},
+	}
+	for _, v := range violations {
+		c, cli := serverPipe(10)
+		go cli.Write(v.input)
+		errc := make(chan error, 1)
+		go func() {
+			_, _, err := c.ReadMessage()
+			errc <- err
+		}()
+		op, payload := readServerFrame(t, cli)
+		assert.Equal(t, byte(opClose), op, v.name)
+		require.Len(t, payload, 2, v.name)
+		assert.Equal(t, v.code, int(binary.BigEndian.Uint16(payload)), v.name)
+		assert.ErrorIs(t, <-errc, v.err, v.name)
+	}
+
+	// Test: The peer's close is echoed
+	c, cli = serverPipe(0)
+	go cli.Write(clientFrame(0x80|opClose, closePayload(CloseNormal, "done")))
+	errc := make(chan error, 1)
+	go func() {
+		_, _, err := c.ReadMessage()
+		errc <- err
+	}()
+	op, payload = readServerFrame(t, cli)
+	assert.Equal(t, byte(opClose), op)
+	assert.Equal(t, CloseNormal, int(binary.BigEndian.Uint16(payload)))
+	var cerr *CloseError
+	require.ErrorAs(t, <-errc, &cerr)
+	assert.Equal(t, "done", cerr.Reason)
+}
+
+func TestCompressionNegotiation(t *testing.T) {
+	offers := func(field string) []extension {
+		h := headers.NewHeaders()
+		h.Set("Sec-WebSocket-Extensions", field)
+		return parseExtensions(h)
+	}
+
+	cases := []struct {
+		name     string
+		c        Compression
+		offer    string
+		response string
+		compress bool
+		window   int
+	}{
+		{"plain", Compression{}, "permessage-deflate", "permessage-deflate", true, 1 << 15},
+		{"client window hint", Compression{}, "permessage-deflate; client_max_window_bits", "permessage-deflate", true, 1 << 15},
+		{"limit client window", Compression{MaxWindowBits: 10}, "permessage-deflate; client_max_window_bits=12", "permessage-deflate; client_max_window_bits=10", true, 1 << 10},
+		{"client picks smaller window", Compression{MaxWindowBits: 12}, "permessage-deflate; client_max_window_bits=9", "permessage-deflate; client_max_window_bits=9", true, 1 << 9},
+		{"small server window", Compression{}, "permessage-deflate; server_max_window_bits=10", "permessage-deflate; server_max_window_bits=10", false, 1 << 15},
+		{"no takeover", Compression{ClientNoContextTakeover: true}, `permessage-deflate; server_no_context_takeover`, "permessage-deflate; server_no_context_takeover; client_no_context_takeover", true, 1 << 15},
+		{"fallback offer", Compression{}, "x-webkit-deflate-frame, permessage-deflate; server_max_window_bits=7, permessage-deflate; server_max_window_bits=\"15\"", "permessage-deflate; server_max_window_bits=15", true, 1 << 15},
+		{"unknown parameter", Compression{}, "permessage-deflate; foo=1", "", false, 0},
+		{"duplicate parameter", Compression{}, "permessage-deflate; server_no_context_takeover; server_no_context_takeover", "", false, 0},
+		{"other extension", Compression{}, "x-webkit-deflate-frame", "", false, 0},
+	}
+	for _, c := range cases {
+		resp, d := c.c.accept(offers(c.offer))
+		assert.Equal(t, c.response, resp, c.name)
+		if c.response == "" {
+			assert.Nil(t, d, c.name)
+			continue
+		}
+		assert.Equal(t, c.compress, d.compressWrites, c.name)
+		assert.Equal(t, c.window, d.readWindow, c.name)
+	}
+
+	// Test: The client side of the same exchange
+	client := &Compression{MaxWindowBits: 10, ClientNoContextTakeover: true}
+	assert.Equal(t, "permessage-deflate; client_max_window_bits; client_no_context_takeover; server_max_window_bits=10", client.offer())
+	d, err := client.confirm(offers("permessage-deflate; client_no_context_takeover; server_max_window_bits=10; client_max_window_bits=9"))
+	require.NoError(t, err)
+	assert.False(t, d.writeTakeover)
+	assert.False(t, d.compressWrites)
+	assert.Equal(t, 1<<10, d.readWindow)
+
+	d, err = client.confirm(nil)
+	assert.NoError(t, err)
+	assert.Nil(t, d)
+	for _, bad := range []string{"permessage-deflate; server_max_window_bits=12", "permessage-deflate; bogus", "x-other"} {
+		_, err := client.confirm(offers(bad))
+		assert.ErrorIs(t, err, ErrBadHandshake, bad)
+	}
+}
+
+func TestCompression(t *testing.T) {
+	line := []byte(`{"room":"general","user":"ada","text":"the build is green again, merging now"}`)
+	line = bytes.Repeat(line, 3)
+
+	// Test: Context takeover makes repeated messages cheaper
+	d := (&Compression{}).newDeflate()
+	first, err := d.compress(line)
+	require.NoError(t, err)
+	firstLen := len(first)
+	second, err := d.compress(line)
+	require.NoError(t, err)
+	assert.Less(t, len(second), firstLen)
+
+	// Test: Without takeover every message stands alone
+	d = (&Compression{ServerNoContextTakeover: true}).newDeflate()
+	d.writeTakeover = false
+	first, err = d.compress(line)
+	require.NoError(t, err)
+	firstLen = len(first)
+	second, err = d.compress(line)
+	require.NoError(t, err)
+	assert.Equal(t, firstLen, len(second))
+
+	// Test: Inflating is bounded by the message limit
+	bomb, err := (&Compression{}).newDeflate().compress(make([]byte, 1<<20))
+	require.NoError(t, err)
+	assert.Less(t, len(bomb), 2048)
+	_, err = (&Compression{}).newDeflate().decompress(bomb, 1<<16)
+	assert.ErrorIs(t, err, ErrMessageTooBig)
+
+	_, err = (&Compression{}).newDeflate().decompress([]byte{0xff, 0xff, 0xff}, 1<<16)
+	assert.ErrorIs(t, err, ErrBadCompression)
+
+	// Test: History is capped at the window
+	d = (&Compression{}).newDeflate()
+	d.readWindow = 1 << 8
+	d.remember(make([]byte, 200))
+	d.remember(make([]byte, 1000))
+	assert.Len(t, d.history, 1<<8)
+	assert.LessOrEqual(t, cap(d.history), 2<<8)
+
+	// Test: End to end, with and without context takeover
+	for _, cfg := range []struct {
+		server, client Compression
+	}{
+		{Compression{}, Compression{}},
+		{Compression{ServerNoContextTakeover: true, MaxWindowBits: 9}, Compression{ClientNoContextTakeover: true, MaxWindowBits: 10, Level: flate.BestCompression}},
+	} {
+		url, closed := echoServer(t, &Upgrader{Compression: &cfg.server, FragmentSize: 50})
+		c, err := (&Dialer{Compression: &cfg.client}).Dial(url)
+		require.NoError(t, err)
+		assert.True(t, c.Compressed())
+
+		for i := range 5 {
+			msg := append(bytes.Clone(line), byte('0'+i))
+			require.NoError(t, c.WriteMessage(TextMessage, msg))
+			_, got, err := c.ReadMessage()
+			require.NoError(t, err)
+			assert.Equal(t, msg, got)
+		}
+		require.NoError(t, c.WriteMessage(BinaryMessage, []byte("short")))
+		_, got, err := c.ReadMessage()
+		require.NoError(t, err)
+		assert.Equal(t, "short", string(got))
+
+		require.NoError(t, c.Close(CloseNormal, ""))
+		var cerr *CloseError
+		require.ErrorAs(t, <-closed, &cerr)
+	}
+
+	// Test: Servers without compression decline the offer
+	url, _ := echoServer(t, &Upgrader{})
+	c, err := (&Dialer{Compression: &Compression{}}).Dial(url)
+	require.NoError(t, err)
+	assert.False(t, c.Compressed())
+}